@@ -1,28 +1,63 @@
 package activities
 
 import (
+	"net/http"
+	"net/netip"
+	"time"
+
+	"github.com/joberly/demo-temporal/internal/signedurl"
+	"github.com/joberly/demo-temporal/internal/storage"
+
 	"go.uber.org/zap"
 )
 
 type Config struct {
-	UploadDir    string
-	WorkingDir   string
-	ProcessedDir string
+	// MaxImageBytes is the largest image file that will be decoded.
+	MaxImageBytes int64
+	// MaxImagePixels is the largest image, in pixels, that will be decoded.
+	MaxImagePixels int64
+	// StreamingPixels is the image size, in pixels, above which images are
+	// converted while being encoded instead of into a full size copy, and
+	// encoded straight into storage. Non-interlaced PNGs above it are
+	// decoded a band of rows at a time for grayscale conversion, other
+	// images are decoded in full.
+	StreamingPixels int64
+	// PublicURL is the base URL clients use to reach the API, used for
+	// download links in webhooks.
+	PublicURL string
+	// WebhookSecrets maps client ids to the secrets their webhooks are
+	// signed with. The empty client id holds the default secret.
+	WebhookSecrets map[string]string `json:"-"`
+	// WebhookTimeout bounds each webhook request.
+	WebhookTimeout time.Duration
+	// WebhookAllowedNetworks lists the networks webhooks may be sent to
+	// even though they are private, loopback or otherwise not public.
+	WebhookAllowedNetworks []netip.Prefix
+	// DownloadURLs signs the download links in webhooks. Links are left
+	// unsigned when it has no keys.
+	DownloadURLs signedurl.Config
 }
 
 type ActivitiesParams struct {
 	Logger *zap.Logger
 	Config *Config
+	Stores *storage.Stores
 }
 
 type Activities struct {
-	logger *zap.Logger
-	config *Config
+	logger     *zap.Logger
+	config     *Config
+	stores     *storage.Stores
+	httpClient *http.Client
+	signer     *signedurl.Signer
 }
 
 func New(p *ActivitiesParams) *Activities {
 	return &Activities{
-		logger: p.Logger,
-		config: p.Config,
+		logger:     p.Logger,
+		config:     p.Config,
+		stores:     p.Stores,
+		httpClient: newWebhookClient(p.Config),
+		signer:     signedurl.New(&p.Config.DownloadURLs),
 	}
 }
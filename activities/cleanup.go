@@ -0,0 +1,46 @@
+package activities
+
+import (
+	"context"
+	"errors"
+
+	"github.com/joberly/demo-temporal/internal/storage"
+
+	"go.uber.org/zap"
+)
+
+// CleanupInput lists the keys CleanupActivity deletes from each store.
+type CleanupInput struct {
+	ImageID   string
+	Upload    []string
+	Working   []string
+	Processed []string
+}
+
+// CleanupActivity is a Temporal activity that deletes the files of an
+// image from the stores. Keys that are already gone are skipped so it can
+// be retried safely.
+func (a *Activities) CleanupActivity(ctx context.Context, input CleanupInput) error {
+	a.logger.Info("cleaning up image", zap.String("imageID", input.ImageID))
+
+	// keep going after a failure so one bad key doesn't strand the rest
+	var errs []error
+	deleteKeys := func(store storage.Blob, keys []string) {
+		for _, key := range keys {
+			if err := store.Delete(ctx, key); err != nil {
+				a.logger.Error("failed to delete object", zap.String("key", key), zap.Error(err))
+				errs = append(errs, err)
+			}
+			heartbeat(ctx, key)
+		}
+	}
+	deleteKeys(a.stores.Upload, input.Upload)
+	deleteKeys(a.stores.Working, input.Working)
+	deleteKeys(a.stores.Processed, input.Processed)
+	if err := errors.Join(errs...); err != nil {
+		return err
+	}
+
+	a.logger.Info("image cleaned up", zap.String("imageID", input.ImageID))
+	return nil
+}
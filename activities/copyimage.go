@@ -2,7 +2,6 @@ package activities
 
 import (
 	"context"
-	"path/filepath"
 
 	"go.uber.org/zap"
 )
@@ -12,9 +11,8 @@ import (
 func (a *Activities) CopyImageActivity(ctx context.Context, imageID string) error {
 	a.logger.Info("copying image", zap.String("imageID", imageID))
 
-	// copy file from upload to working dir
-	err := a.copyFile(filepath.Join(a.config.UploadDir, imageID),
-		filepath.Join(a.config.WorkingDir, imageID))
+	// copy image from upload store to working store
+	err := a.copyObject(ctx, a.stores.Upload, a.stores.Working, imageID)
 	if err != nil {
 		return err
 	}
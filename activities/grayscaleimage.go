@@ -2,82 +2,66 @@ package activities
 
 import (
 	"context"
-	"fmt"
 	"image"
 	"image/color"
-	"image/jpeg"
-	"image/png"
-	"os"
-	"path/filepath"
+	"runtime"
+	"sync"
+	"sync/atomic"
 
-	"golang.org/x/image/webp"
+	"github.com/joberly/demo-temporal/internal/pipeline"
 
 	"go.uber.org/zap"
 )
 
+// minBandRows is the smallest number of rows handed to a worker at once.
+const minBandRows = 16
+
 // GrayscaleImageActivity is a Temporal activity that converts a working image
 // to black and white.
 func (a *Activities) GrayscaleImageActivity(ctx context.Context, imageID string) error {
 	a.logger.Info("converting image to grayscale", zap.String("imageID", imageID))
 
-	// open image file
-	a.logger.Info("opening working image", zap.String("imageID", imageID))
-	file, err := os.Open(filepath.Join(a.config.WorkingDir, imageID))
+	file, err := a.openImage(ctx, a.stores.Working, imageID)
 	if err != nil {
 		return err
 	}
+	defer file.Close()
+	out := pipeline.Output{Format: pipeline.FormatJPEG, Quality: pipeline.DefaultQuality}
 
-	// decode for image format
-	a.logger.Info("decoding working image type", zap.String("imageID", imageID))
-	_, format, err := image.DecodeConfig(file)
-	if err != nil {
-		file.Close()
-		return err
-	}
-
-	// rewind file to beginning
-	a.logger.Info("rewinding working image", zap.String("imageID", imageID))
-	_, err = file.Seek(0, 0)
-	if err != nil {
-		file.Close()
-		return err
+	// large PNGs are decoded a band of rows at a time as the grayscale image
+	// is encoded, so they are never held in full
+	bounds := image.Rect(0, 0, file.config.Width, file.config.Height)
+	if file.format == "png" && a.streaming(bounds) && pngStreamable(file.header) {
+		a.logger.Info("streaming grayscale image", zap.String("imageID", imageID))
+		bands, err := newPNGBands(file.reader())
+		if err != nil {
+			return err
+		}
+		gray := newStreamedGray(bands, background(out))
+		if _, err := a.streamImage(ctx, a.stores.Processed, imageID, gray, out); err != nil {
+			return err
+		}
+		a.logger.Info("conversion to grayscale complete", zap.String("imageID", imageID))
+		return nil
 	}
 
 	// decode image
-	a.logger.Info("decoding working image data", zap.String("imageID", imageID))
-	var img image.Image
-	switch format {
-	case "jpeg":
-		img, err = jpeg.Decode(file)
-	case "png":
-		img, err = png.Decode(file)
-	case "webp":
-		img, err = webp.Decode(file)
-	default:
-		err = fmt.Errorf("unsupported image format: %s", format)
-	}
-	// done with the source image file at this point
-	file.Close()
+	a.logger.Info("decoding working image", zap.String("imageID", imageID))
+	img, err := file.decode()
 	if err != nil {
 		return err
 	}
 
 	// convert the image to grayscale
 	a.logger.Info("converting image to grayscale", zap.String("imageID", imageID))
-	gray := a.convertToGrayscale(ctx, img)
-
-	// save the grayscale image as a jpeg in the processed dir
-	a.logger.Info("creating processed image file", zap.String("imageID", imageID))
-	processedFile, err := os.Create(filepath.Join(a.config.ProcessedDir, imageID))
+	gray, err := a.convertToGrayscale(ctx, img)
 	if err != nil {
 		return err
 	}
-	defer processedFile.Close()
 
-	// encode the grayscale image as jpeg
+	// save the grayscale image as a jpeg in the processed store
 	a.logger.Info("writing grayscale image file", zap.String("imageID", imageID))
-	err = jpeg.Encode(processedFile, gray, &jpeg.Options{Quality: 90})
-	if err != nil {
+	if _, err := a.saveImage(ctx, a.stores.Processed, imageID, gray, out); err != nil {
 		return err
 	}
 
@@ -85,15 +69,179 @@ func (a *Activities) GrayscaleImageActivity(ctx context.Context, imageID string)
 	return nil
 }
 
-func (a *Activities) convertToGrayscale(ctx context.Context, img image.Image) *image.Gray {
+// GrayscaleProgress is recorded as heartbeat details while an image is
+// converted to grayscale.
+type GrayscaleProgress struct {
+	Rows     int
+	RowsDone int
+}
+
+// convertToGrayscale returns a grayscale copy of img. Transparent images
+// keep their alpha channel. The image is split into bands of rows that are
+// converted in parallel, heartbeating progress and stopping early once ctx
+// is done. Very large images get a view that is converted as it is encoded
+// so no second full size image is allocated.
+func (a *Activities) convertToGrayscale(ctx context.Context, img image.Image) (image.Image, error) {
 	bounds := img.Bounds()
-	grayImg := image.NewGray(bounds)
-	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
-		for x := bounds.Min.X; x < bounds.Max.X; x++ {
-			originalColor := img.At(x, y)
-			grayColor := color.GrayModel.Convert(originalColor)
-			grayImg.Set(x, y, grayColor)
+	if a.streaming(bounds) {
+		return grayscaleView(img), nil
+	}
+
+	var dst image.Image
+	var convert func(y0, y1 int)
+	if isOpaque(img) {
+		gray := image.NewGray(bounds)
+		dst = gray
+		convert = func(y0, y1 int) { grayRows(gray, img, y0, y1) }
+	} else {
+		nrgba := image.NewNRGBA(bounds)
+		dst = nrgba
+		convert = func(y0, y1 int) { grayAlphaRows(nrgba, img, y0, y1) }
+	}
+
+	if err := processBands(ctx, bounds, convert); err != nil {
+		return nil, err
+	}
+	return dst, nil
+}
+
+// processBands calls convert for bands of rows within bounds across
+// GOMAXPROCS goroutines.
+func processBands(ctx context.Context, bounds image.Rectangle, convert func(y0, y1 int)) error {
+	workers := runtime.GOMAXPROCS(0)
+	rows := bounds.Dy()
+	bandRows := max(minBandRows, rows/(workers*4))
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var rowsDone atomic.Int64
+	bands := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for y0 := range bands {
+				y1 := min(y0+bandRows, bounds.Max.Y)
+				convert(y0, y1)
+				rowsDone.Add(int64(y1 - y0))
+			}
+		}()
+	}
+
+	// hand out bands, reporting progress as they are picked up
+feed:
+	for y0 := bounds.Min.Y; y0 < bounds.Max.Y; y0 += bandRows {
+		select {
+		case bands <- y0:
+		case <-ctx.Done():
+			break feed
 		}
+		heartbeat(ctx, GrayscaleProgress{Rows: rows, RowsDone: int(rowsDone.Load())})
 	}
-	return grayImg
+	close(bands)
+	wg.Wait()
+
+	return ctx.Err()
+}
+
+// grayRows converts rows [y0, y1) of an opaque src into dst, using direct
+// pixel access for the common decoded image types.
+func grayRows(dst *image.Gray, src image.Image, y0, y1 int) {
+	b := dst.Rect
+	switch src := src.(type) {
+	case *image.Gray:
+		for y := y0; y < y1; y++ {
+			di := dst.PixOffset(b.Min.X, y)
+			si := src.PixOffset(b.Min.X, y)
+			copy(dst.Pix[di:di+b.Dx()], src.Pix[si:si+b.Dx()])
+		}
+
+	case *image.YCbCr:
+		// the Y plane is not quite the luma of the decoded colors, convert
+		// through RGB as color.GrayModel does
+		for y := y0; y < y1; y++ {
+			di := dst.PixOffset(b.Min.X, y)
+			yi := src.YOffset(b.Min.X, y)
+			for x := b.Min.X; x < b.Max.X; x++ {
+				ci := src.COffset(x, y)
+				r, g, bl, _ := color.YCbCr{Y: src.Y[yi], Cb: src.Cb[ci], Cr: src.Cr[ci]}.RGBA()
+				dst.Pix[di] = luma16(r, g, bl)
+				di++
+				yi++
+			}
+		}
+
+	case *image.RGBA:
+		// opaque so premultiplied and straight values are the same
+		for y := y0; y < y1; y++ {
+			di := dst.PixOffset(b.Min.X, y)
+			si := src.PixOffset(b.Min.X, y)
+			for x := b.Min.X; x < b.Max.X; x++ {
+				dst.Pix[di] = luma(src.Pix[si], src.Pix[si+1], src.Pix[si+2])
+				di++
+				si += 4
+			}
+		}
+
+	case *image.NRGBA:
+		for y := y0; y < y1; y++ {
+			di := dst.PixOffset(b.Min.X, y)
+			si := src.PixOffset(b.Min.X, y)
+			for x := b.Min.X; x < b.Max.X; x++ {
+				dst.Pix[di] = luma(src.Pix[si], src.Pix[si+1], src.Pix[si+2])
+				di++
+				si += 4
+			}
+		}
+
+	default:
+		for y := y0; y < y1; y++ {
+			for x := b.Min.X; x < b.Max.X; x++ {
+				originalColor := src.At(x, y)
+				grayColor := color.GrayModel.Convert(originalColor)
+				dst.Set(x, y, grayColor)
+			}
+		}
+	}
+}
+
+// grayAlphaRows converts rows [y0, y1) of src to gray in dst while
+// preserving transparency.
+func grayAlphaRows(dst *image.NRGBA, src image.Image, y0, y1 int) {
+	b := dst.Rect
+	switch src := src.(type) {
+	case *image.NRGBA:
+		for y := y0; y < y1; y++ {
+			i := dst.PixOffset(b.Min.X, y)
+			si := src.PixOffset(b.Min.X, y)
+			for x := b.Min.X; x < b.Max.X; x++ {
+				v := luma(src.Pix[si], src.Pix[si+1], src.Pix[si+2])
+				dst.Pix[i], dst.Pix[i+1], dst.Pix[i+2], dst.Pix[i+3] = v, v, v, src.Pix[si+3]
+				i += 4
+				si += 4
+			}
+		}
+
+	default:
+		for y := y0; y < y1; y++ {
+			for x := b.Min.X; x < b.Max.X; x++ {
+				c := color.NRGBAModel.Convert(src.At(x, y)).(color.NRGBA)
+				v := luma(c.R, c.G, c.B)
+				dst.SetNRGBA(x, y, color.NRGBA{R: v, G: v, B: v, A: c.A})
+			}
+		}
+	}
+}
+
+// luma returns the gray value of an 8-bit color as color.GrayModel does.
+func luma(r, g, b uint8) uint8 {
+	return luma16(uint32(r)*0x101, uint32(g)*0x101, uint32(b)*0x101)
+}
+
+// luma16 returns the gray value of a 16-bit color as color.GrayModel does,
+// rounding at 16 bits before dropping to 8.
+func luma16(r, g, b uint32) uint8 {
+	return uint8((19595*r + 38470*g + 7471*b + 1<<15) >> 24)
 }
@@ -0,0 +1,186 @@
+package activities
+
+import (
+	"context"
+	"errors"
+	"image"
+	"image/color"
+	"math/rand"
+	"sync/atomic"
+	"testing"
+)
+
+// testImages returns images of each type with a typed fast path, filled
+// with random pixels. Their bounds don't start at the origin to catch
+// offset mistakes.
+func testImages(w, h int) map[string]image.Image {
+	rng := rand.New(rand.NewSource(1))
+	r := image.Rect(3, 5, 3+w, 5+h)
+
+	gray := image.NewGray(r)
+	rng.Read(gray.Pix)
+
+	ycbcr := image.NewYCbCr(r, image.YCbCrSubsampleRatio420)
+	rng.Read(ycbcr.Y)
+	rng.Read(ycbcr.Cb)
+	rng.Read(ycbcr.Cr)
+
+	rgba := image.NewRGBA(r)
+	rng.Read(rgba.Pix)
+	for i := 3; i < len(rgba.Pix); i += 4 {
+		rgba.Pix[i] = 0xff
+	}
+
+	nrgba := image.NewNRGBA(r)
+	rng.Read(nrgba.Pix)
+	opaque := image.NewNRGBA(r)
+	copy(opaque.Pix, nrgba.Pix)
+	for i := 3; i < len(opaque.Pix); i += 4 {
+		opaque.Pix[i] = 0xff
+	}
+
+	return map[string]image.Image{
+		"gray":          gray,
+		"ycbcr":         ycbcr,
+		"rgba":          rgba,
+		"nrgba":         nrgba,
+		"nrgba opaque":  opaque,
+		"paletted":      palettedImage(r, rng),
+		"rgba64 opaque": image.NewRGBA64(r),
+	}
+}
+
+func palettedImage(r image.Rectangle, rng *rand.Rand) *image.Paletted {
+	palette := make(color.Palette, 256)
+	for i := range palette {
+		palette[i] = color.RGBA{uint8(rng.Intn(256)), uint8(rng.Intn(256)), uint8(rng.Intn(256)), 0xff}
+	}
+	img := image.NewPaletted(r, palette)
+	rng.Read(img.Pix)
+	return img
+}
+
+// legacyGrayscale is the conversion used before images were converted in
+// bands, kept as a reference for the fast paths and the benchmarks.
+func legacyGrayscale(img image.Image) *image.Gray {
+	bounds := img.Bounds()
+	gray := image.NewGray(bounds)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			gray.Set(x, y, color.GrayModel.Convert(img.At(x, y)))
+		}
+	}
+	return gray
+}
+
+func TestConvertToGrayscaleMatchesGrayModel(t *testing.T) {
+	// the streaming views must match the converted copies
+	for _, a := range []*Activities{{}, {config: &Config{StreamingPixels: 1}}} {
+		for name, img := range testImages(67, 41) {
+			testConvertToGrayscale(t, a, name, img)
+		}
+	}
+}
+
+func testConvertToGrayscale(t *testing.T, a *Activities, name string, img image.Image) {
+	if a.streaming(img.Bounds()) {
+		name += " view"
+	}
+	t.Run(name, func(t *testing.T) {
+		got, err := a.convertToGrayscale(context.Background(), img)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Bounds() != img.Bounds() {
+			t.Fatalf("bounds = %v, want %v", got.Bounds(), img.Bounds())
+		}
+
+		b := img.Bounds()
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			for x := b.Min.X; x < b.Max.X; x++ {
+				want := color.GrayModel.Convert(img.At(x, y)).(color.Gray)
+				var gotY, gotA uint8
+				switch c := got.At(x, y).(type) {
+				case color.Gray:
+					gotY, gotA = c.Y, 0xff
+				case color.NRGBA:
+					if c.R != c.G || c.G != c.B {
+						t.Fatalf("pixel (%d, %d) = %v is not gray", x, y, c)
+					}
+					gotY, gotA = c.R, c.A
+					// gray model works on premultiplied values, compare
+					// with the straight gray of the source pixel
+					n := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+					want.Y = color.GrayModel.Convert(color.NRGBA{n.R, n.G, n.B, 0xff}).(color.Gray).Y
+					if gotA != n.A {
+						t.Fatalf("alpha (%d, %d) = %d, want %d", x, y, gotA, n.A)
+					}
+				default:
+					t.Fatalf("unexpected color %T", c)
+				}
+				if gotY != want.Y {
+					t.Fatalf("pixel (%d, %d) = %d, want %d", x, y, gotY, want.Y)
+				}
+			}
+		}
+	})
+}
+
+func TestProcessBandsStopsWhenCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	bounds := image.Rect(0, 0, 16, 64*minBandRows)
+	var bands atomic.Int32
+	err := processBands(ctx, bounds, func(y0, y1 int) { bands.Add(1) })
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("err = %v, want context.Canceled", err)
+	}
+	if n := bands.Load(); n >= 64 {
+		t.Errorf("converted %d bands after cancellation", n)
+	}
+}
+
+func TestConvertToGrayscaleCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	a := &Activities{}
+	img, err := a.convertToGrayscale(ctx, image.NewRGBA(image.Rect(0, 0, 256, 4096)))
+	if !errors.Is(err, context.Canceled) || img != nil {
+		t.Errorf("convertToGrayscale = %v, %v, want context.Canceled", img, err)
+	}
+}
+
+// benchmarkImages are large enough for banding to pay off.
+func benchmarkImages() map[string]image.Image {
+	images := testImages(4000, 3000)
+	return map[string]image.Image{
+		"ycbcr": images["ycbcr"],
+		"rgba":  images["rgba"],
+		"nrgba": images["nrgba"],
+	}
+}
+
+func BenchmarkGrayscaleLegacy(b *testing.B) {
+	for name, img := range benchmarkImages() {
+		b.Run(name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				legacyGrayscale(img)
+			}
+		})
+	}
+}
+
+func BenchmarkGrayscaleBands(b *testing.B) {
+	a := &Activities{}
+	for name, img := range benchmarkImages() {
+		b.Run(name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := a.convertToGrayscale(context.Background(), img); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
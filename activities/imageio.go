@@ -0,0 +1,324 @@
+package activities
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+
+	"github.com/joberly/demo-temporal/internal/pipeline"
+	"github.com/joberly/demo-temporal/internal/storage"
+
+	"go.temporal.io/sdk/temporal"
+	"go.uber.org/zap"
+	"golang.org/x/image/draw"
+	"golang.org/x/image/webp"
+)
+
+// contentTypes maps output formats to their MIME types.
+var contentTypes = map[string]string{
+	pipeline.FormatJPEG: "image/jpeg",
+	pipeline.FormatPNG:  "image/png",
+	pipeline.FormatGIF:  "image/gif",
+	pipeline.FormatWebP: "image/webp",
+}
+
+// compressionLevels maps PNG compression names to encoder levels.
+var compressionLevels = map[string]png.CompressionLevel{
+	"":                          png.DefaultCompression,
+	pipeline.CompressionDefault: png.DefaultCompression,
+	pipeline.CompressionNone:    png.NoCompression,
+	pipeline.CompressionSpeed:   png.BestSpeed,
+	pipeline.CompressionBest:    png.BestCompression,
+}
+
+// loadImage decodes the image stored under key, returning the image and
+// the name of its format. Images over the configured byte or pixel limits
+// are rejected before they are decoded.
+func (a *Activities) loadImage(ctx context.Context, store storage.Blob, key string) (image.Image, string, error) {
+	file, err := a.openImage(ctx, store, key)
+	if err != nil {
+		return nil, "", err
+	}
+	defer file.Close()
+
+	img, err := file.decode()
+	if err != nil {
+		return nil, "", err
+	}
+	return img, file.format, nil
+}
+
+// imageFile is a stored image whose header has been read and checked
+// against the limits, ready to be decoded.
+type imageFile struct {
+	file   io.Closer
+	config image.Config
+	format string
+	// header holds the bytes read to decode the header, r the rest of the
+	// file.
+	header []byte
+	r      io.Reader
+}
+
+// openImage opens the image stored under key and checks its size and
+// header, rejecting images over the configured limits and files that
+// aren't supported images.
+func (a *Activities) openImage(ctx context.Context, store storage.Blob, key string) (*imageFile, error) {
+	file, info, err := store.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := a.checkImageBytes(info.Size); err != nil {
+		file.Close()
+		return nil, err
+	}
+	r := &limitedReader{a: a, r: &heartbeatReader{ctx: ctx, r: file}}
+
+	// decode for image format, keeping the header bytes for the full decode
+	var header bytes.Buffer
+	config, format, err := image.DecodeConfig(io.TeeReader(r, &header))
+	if errors.Is(err, image.ErrFormat) {
+		err = temporal.NewNonRetryableApplicationError(
+			"file is not a supported image", ErrTypeUnsupportedFormat, err)
+	}
+	if err == nil {
+		err = a.checkImagePixels(config)
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &imageFile{file: file, config: config, format: format, header: header.Bytes(), r: r}, nil
+}
+
+// reader returns the whole file, header included.
+func (f *imageFile) reader() io.Reader {
+	return io.MultiReader(bytes.NewReader(f.header), f.r)
+}
+
+func (f *imageFile) Close() error {
+	return f.file.Close()
+}
+
+// decode decodes the whole image into memory.
+func (f *imageFile) decode() (image.Image, error) {
+	src := f.reader()
+	switch f.format {
+	case "jpeg":
+		return jpeg.Decode(src)
+	case "png":
+		return png.Decode(src)
+	case "gif":
+		return gif.Decode(src)
+	case "webp":
+		return webp.Decode(src)
+	}
+	return nil, temporal.NewNonRetryableApplicationError(
+		fmt.Sprintf("unsupported image format: %s", f.format), ErrTypeUnsupportedFormat, nil)
+}
+
+// saveImage encodes img as described by out and stores it under key,
+// returning the format that was used.
+func (a *Activities) saveImage(ctx context.Context, store storage.Blob, key string, img image.Image, out pipeline.Output) (string, error) {
+	if a.streaming(img.Bounds()) {
+		return a.streamImage(ctx, store, key, img, out)
+	}
+
+	var buf bytes.Buffer
+	format, err := encodeImage(&buf, img, out)
+	if err != nil {
+		return "", err
+	}
+
+	a.logger.Info("storing image",
+		zap.String("key", key),
+		zap.String("format", format),
+		zap.Int("size", buf.Len()),
+	)
+	err = store.Put(ctx, key, &heartbeatReader{ctx: ctx, r: &buf}, &storage.PutOptions{
+		ContentType: contentTypes[format],
+		Size:        int64(buf.Len()),
+	})
+	if err != nil {
+		return "", err
+	}
+	return format, nil
+}
+
+// streamImage encodes img straight into the store as it is written rather
+// than holding the whole encoded image in memory first. img is read once,
+// in order, so it can be decoded as it is encoded. Stores that need the
+// length up front spool the encoded image to disk.
+func (a *Activities) streamImage(ctx context.Context, store storage.Blob, key string, img image.Image, out pipeline.Output) (string, error) {
+	format := outputFormat(img, out)
+	a.logger.Info("streaming image",
+		zap.String("key", key),
+		zap.String("format", format),
+	)
+
+	pr, pw := io.Pipe()
+	go func() {
+		_, err := encodeImage(pw, img, out)
+		// images decoded as they are encoded report decode errors once
+		// the encoder is done, failing the put instead of storing a
+		// broken image
+		if s, ok := img.(interface{ Err() error }); ok && err == nil {
+			err = s.Err()
+		}
+		pw.CloseWithError(err)
+	}()
+
+	err := store.Put(ctx, key, &heartbeatReader{ctx: ctx, r: pr}, &storage.PutOptions{
+		ContentType: contentTypes[format],
+		Size:        -1,
+	})
+	// unblock the encoder if the store gave up early
+	pr.CloseWithError(err)
+	if err != nil {
+		return "", err
+	}
+	return format, nil
+}
+
+// outputFormat returns the format img is encoded in for out.
+func outputFormat(img image.Image, out pipeline.Output) string {
+	if out.Format != "" {
+		return out.Format
+	}
+	if !isOpaque(img) {
+		return pipeline.FormatPNG
+	}
+	return pipeline.FormatJPEG
+}
+
+// encodeImage writes img to w as described by out, returning the format
+// that was used. Images with transparency are kept as PNG unless another
+// format is asked for.
+func encodeImage(w io.Writer, img image.Image, out pipeline.Output) (string, error) {
+	format := outputFormat(img, out)
+
+	var err error
+	switch format {
+	case pipeline.FormatJPEG:
+		quality := out.Quality
+		if quality == 0 {
+			quality = pipeline.DefaultQuality
+		}
+		err = jpeg.Encode(w, flatten(img, background(out)), &jpeg.Options{Quality: quality})
+	case pipeline.FormatPNG:
+		enc := png.Encoder{CompressionLevel: compressionLevels[out.Compression]}
+		err = enc.Encode(w, img)
+	case pipeline.FormatGIF:
+		err = gif.Encode(w, toPaletted(img, out), nil)
+	default:
+		err = fmt.Errorf("unsupported output format: %s", format)
+	}
+	if err != nil {
+		return "", err
+	}
+	return format, nil
+}
+
+// isOpaque reports whether img has no transparent pixels.
+func isOpaque(img image.Image) bool {
+	if o, ok := img.(interface{ Opaque() bool }); ok {
+		return o.Opaque()
+	}
+	b := img.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			if _, _, _, a := img.At(x, y).RGBA(); a != 0xffff {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// background returns the color transparent areas are flattened onto.
+func background(out pipeline.Output) color.Color {
+	if c, err := pipeline.ParseColor(out.Background); err == nil {
+		return c
+	}
+	return color.White
+}
+
+// flatten composites img over a solid background for formats without an
+// alpha channel, which would otherwise turn transparent areas black.
+func flatten(img image.Image, bg color.Color) image.Image {
+	if isOpaque(img) {
+		return img
+	}
+	b := img.Bounds()
+	dst := image.NewRGBA(b)
+	draw.Draw(dst, b, image.NewUniform(bg), image.Point{}, draw.Src)
+	draw.Draw(dst, b, img, b.Min, draw.Over)
+	return dst
+}
+
+// toPaletted reduces img to the palette size and dithering in out. Gray
+// images get an evenly spaced gray palette, others an adaptive palette
+// chosen from their colors. Transparent images keep one entry of the
+// palette for transparency.
+func toPaletted(img image.Image, out pipeline.Output) *image.Paletted {
+	colors := out.Colors
+	if colors == 0 {
+		colors = 256
+	}
+	opaque := isOpaque(img)
+	if !opaque {
+		colors--
+	}
+
+	var pal color.Palette
+	if _, ok := img.(*image.Gray); ok {
+		pal = make(color.Palette, colors)
+		for i := range pal {
+			v := uint8(i * 255 / max(1, colors-1))
+			pal[i] = color.Gray{Y: v}
+		}
+	} else {
+		pal = adaptivePalette(img, colors)
+	}
+	if !opaque {
+		pal = append(pal, color.Transparent)
+	}
+
+	b := img.Bounds()
+	dst := image.NewPaletted(b, pal)
+	var drawer draw.Drawer = draw.FloydSteinberg
+	if out.Dither == pipeline.DitherNone {
+		drawer = draw.Src
+	}
+	drawer.Draw(dst, b, img, b.Min)
+	return dst
+}
+
+// saveWorkingImage stores an intermediate image losslessly.
+func (a *Activities) saveWorkingImage(ctx context.Context, key string, img image.Image) error {
+	if a.streaming(img.Bounds()) {
+		_, err := a.streamImage(ctx, a.stores.Working, key, img, pipeline.Output{
+			Format:      pipeline.FormatPNG,
+			Compression: pipeline.CompressionSpeed,
+		})
+		return err
+	}
+
+	var buf bytes.Buffer
+	enc := png.Encoder{CompressionLevel: png.BestSpeed}
+	if err := enc.Encode(&buf, img); err != nil {
+		return err
+	}
+	return a.stores.Working.Put(ctx, key, &heartbeatReader{ctx: ctx, r: &buf}, &storage.PutOptions{
+		ContentType: "image/png",
+		Size:        int64(buf.Len()),
+	})
+}
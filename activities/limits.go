@@ -0,0 +1,109 @@
+package activities
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+
+	"go.temporal.io/sdk/temporal"
+)
+
+// ErrTypeImageTooLarge is the application error type returned when an image
+// exceeds the configured byte or pixel limits.
+const ErrTypeImageTooLarge = "ImageTooLarge"
+
+// checkImageBytes rejects image files larger than the configured limit.
+func (a *Activities) checkImageBytes(size int64) error {
+	if a.config == nil || a.config.MaxImageBytes <= 0 || size <= a.config.MaxImageBytes {
+		return nil
+	}
+	return temporal.NewNonRetryableApplicationError(
+		fmt.Sprintf("image is %d bytes, the limit is %d", size, a.config.MaxImageBytes),
+		ErrTypeImageTooLarge, nil)
+}
+
+// checkImagePixels rejects images whose header claims more pixels than the
+// configured limit. This runs before any pixels are decoded so a small file
+// declaring huge dimensions is refused before memory is allocated for it.
+func (a *Activities) checkImagePixels(cfg image.Config) error {
+	pixels := int64(cfg.Width) * int64(cfg.Height)
+	if a.config == nil || a.config.MaxImagePixels <= 0 || pixels <= a.config.MaxImagePixels {
+		return nil
+	}
+	return temporal.NewNonRetryableApplicationError(
+		fmt.Sprintf("image is %dx%d (%d pixels), the limit is %d pixels",
+			cfg.Width, cfg.Height, pixels, a.config.MaxImagePixels),
+		ErrTypeImageTooLarge, nil)
+}
+
+// streaming reports whether an image with the given bounds is large enough
+// that it should be converted while it is encoded rather than copied first,
+// and encoded straight into the store. This saves the second full size
+// buffer. Non-interlaced PNGs are also decoded as they are converted, other
+// images are decoded in full first.
+func (a *Activities) streaming(b image.Rectangle) bool {
+	if a.config == nil || a.config.StreamingPixels <= 0 {
+		return false
+	}
+	return int64(b.Dx())*int64(b.Dy()) > a.config.StreamingPixels
+}
+
+// limitedReader reads from r, failing once more than n bytes have been read.
+// It guards against stores reporting a smaller size than they return.
+type limitedReader struct {
+	a *Activities
+	r io.Reader
+	n int64
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	l.n += int64(n)
+	if cerr := l.a.checkImageBytes(l.n); cerr != nil {
+		return n, cerr
+	}
+	return n, err
+}
+
+// grayView is an opaque image that converts its source to gray as each
+// pixel is read, so a large image can be encoded in gray without
+// allocating a gray copy of it.
+type grayView struct {
+	src image.Image
+}
+
+func (v grayView) ColorModel() color.Model { return color.GrayModel }
+func (v grayView) Bounds() image.Rectangle { return v.src.Bounds() }
+func (v grayView) Opaque() bool            { return true }
+
+func (v grayView) At(x, y int) color.Color {
+	return color.GrayModel.Convert(v.src.At(x, y))
+}
+
+// grayAlphaView is the grayView of an image with transparency.
+type grayAlphaView struct {
+	src image.Image
+}
+
+func (v grayAlphaView) ColorModel() color.Model { return color.NRGBAModel }
+func (v grayAlphaView) Bounds() image.Rectangle { return v.src.Bounds() }
+func (v grayAlphaView) Opaque() bool            { return false }
+
+func (v grayAlphaView) At(x, y int) color.Color {
+	c := color.NRGBAModel.Convert(v.src.At(x, y)).(color.NRGBA)
+	g := luma(c.R, c.G, c.B)
+	return color.NRGBA{R: g, G: g, B: g, A: c.A}
+}
+
+// grayscaleView returns a gray view of img that shares or converts its
+// pixels on demand instead of copying them.
+func grayscaleView(img image.Image) image.Image {
+	if gray, ok := img.(*image.Gray); ok {
+		return gray
+	}
+	if isOpaque(img) {
+		return grayView{src: img}
+	}
+	return grayAlphaView{src: img}
+}
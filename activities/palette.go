@@ -0,0 +1,97 @@
+package activities
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"sort"
+)
+
+// maxPaletteSamples bounds the pixels sampled to choose a palette, so large
+// images cost no more than small ones.
+const maxPaletteSamples = 1 << 16
+
+// paletteBox is a set of sampled colors that becomes one palette entry.
+type paletteBox [][3]uint8
+
+// widest returns the channel the colors of the box spread over most and
+// how far they spread.
+func (b paletteBox) widest() (channel, spread int) {
+	for c := 0; c < 3; c++ {
+		lo, hi := uint8(math.MaxUint8), uint8(0)
+		for _, s := range b {
+			lo, hi = min(lo, s[c]), max(hi, s[c])
+		}
+		if int(hi)-int(lo) > spread {
+			channel, spread = c, int(hi)-int(lo)
+		}
+	}
+	return channel, spread
+}
+
+// mean returns the average color of the box.
+func (b paletteBox) mean() color.Color {
+	var sum [3]int
+	for _, s := range b {
+		for c := range sum {
+			sum[c] += int(s[c])
+		}
+	}
+	n := len(b)
+	return color.RGBA{
+		R: uint8((sum[0] + n/2) / n),
+		G: uint8((sum[1] + n/2) / n),
+		B: uint8((sum[2] + n/2) / n),
+		A: 0xff,
+	}
+}
+
+// adaptivePalette returns a palette of at most n colors chosen for img by
+// median cut: the sampled colors are split in two at the median of their
+// widest channel, box by box, until there are n boxes, and each box gives
+// its average color. Transparent pixels are left out.
+func adaptivePalette(img image.Image, n int) color.Palette {
+	b := img.Bounds()
+	step := 1
+	if pixels := b.Dx() * b.Dy(); pixels > maxPaletteSamples {
+		step = int(math.Ceil(math.Sqrt(float64(pixels) / maxPaletteSamples)))
+	}
+	var samples paletteBox
+	for y := b.Min.Y; y < b.Max.Y; y += step {
+		for x := b.Min.X; x < b.Max.X; x += step {
+			c := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+			if c.A != 0 {
+				samples = append(samples, [3]uint8{c.R, c.G, c.B})
+			}
+		}
+	}
+	if len(samples) == 0 {
+		return color.Palette{color.Black}
+	}
+
+	boxes := []paletteBox{samples}
+	for len(boxes) < n {
+		// split the box spreading widest
+		split, channel, spread := -1, 0, 0
+		for i, box := range boxes {
+			if c, s := box.widest(); s > spread {
+				split, channel, spread = i, c, s
+			}
+		}
+		if split < 0 {
+			// every box holds a single color
+			break
+		}
+		box := boxes[split]
+		sort.Slice(box, func(i, j int) bool { return box[i][channel] < box[j][channel] })
+		mid := len(box) / 2
+		boxes[split] = box[:mid]
+		boxes = append(boxes, box[mid:])
+	}
+
+	pal := make(color.Palette, len(boxes))
+	for i, box := range boxes {
+		pal[i] = box.mean()
+	}
+	return pal
+}
@@ -0,0 +1,98 @@
+package activities
+
+import (
+	"image"
+	"image/color"
+	"testing"
+
+	"github.com/joberly/demo-temporal/internal/pipeline"
+)
+
+// stripes returns an image of vertical stripes, one of each color.
+func stripes(colors ...color.Color) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, 8*len(colors), 8))
+	for x := 0; x < img.Bounds().Dx(); x++ {
+		for y := 0; y < 8; y++ {
+			img.Set(x, y, colors[x/8])
+		}
+	}
+	return img
+}
+
+// sqDistance is the squared distance between two colors.
+func sqDistance(a, b color.Color) int {
+	ar, ag, ab, _ := a.RGBA()
+	br, bg, bb, _ := b.RGBA()
+	d := func(x, y uint32) int { v := int(x>>8) - int(y>>8); return v * v }
+	return d(ar, br) + d(ag, bg) + d(ab, bb)
+}
+
+func TestToPalettedKeepsColors(t *testing.T) {
+	red := color.NRGBA{0xe0, 0x10, 0x10, 0xff}
+	orange := color.NRGBA{0xff, 0x80, 0x00, 0xff}
+	white := color.NRGBA{0xff, 0xff, 0xff, 0xff}
+	img := stripes(red, orange, white, color.NRGBA{0x20, 0x40, 0xc0, 0xff})
+
+	for _, colors := range []int{4, 16, 0} {
+		out := toPaletted(img, pipeline.Output{Colors: colors, Dither: pipeline.DitherNone})
+		if want := max(colors, 4); colors != 0 && len(out.Palette) > want {
+			t.Errorf("colors %d: palette has %d entries", colors, len(out.Palette))
+		}
+		for x := 0; x < img.Bounds().Dx(); x += 8 {
+			if d := sqDistance(out.At(x, 0), img.At(x, 0)); d != 0 {
+				t.Errorf("colors %d: pixel %d = %v, want %v", colors, x, out.At(x, 0), img.At(x, 0))
+			}
+		}
+	}
+}
+
+func TestToPalettedGradient(t *testing.T) {
+	// a red to blue gradient, which the first entries of a fixed palette
+	// can't show
+	img := image.NewNRGBA(image.Rect(0, 0, 256, 4))
+	for x := 0; x < 256; x++ {
+		for y := 0; y < 4; y++ {
+			img.Set(x, y, color.NRGBA{uint8(255 - x), 0x20, uint8(x), 0xff})
+		}
+	}
+	out := toPaletted(img, pipeline.Output{Colors: 16, Dither: pipeline.DitherNone})
+	if len(out.Palette) != 16 {
+		t.Fatalf("palette has %d entries, want 16", len(out.Palette))
+	}
+	for x := 0; x < 256; x++ {
+		// 16 entries over 256 steps leave each pixel within 8 steps
+		if d := sqDistance(out.At(x, 0), img.At(x, 0)); d > 2*9*9 {
+			t.Errorf("pixel %d = %v, want about %v", x, out.At(x, 0), img.At(x, 0))
+		}
+	}
+}
+
+func TestToPalettedTransparency(t *testing.T) {
+	white := color.NRGBA{0xff, 0xff, 0xff, 0xff}
+	black := color.NRGBA{0, 0, 0, 0xff}
+	img := stripes(white, black, color.NRGBA{})
+
+	out := toPaletted(img, pipeline.Output{Colors: 3, Dither: pipeline.DitherNone})
+	if len(out.Palette) != 3 {
+		t.Fatalf("palette = %v, want 2 colors and transparency", out.Palette)
+	}
+	if out.Palette[2] != color.Transparent {
+		t.Errorf("last entry = %v, want transparent", out.Palette[2])
+	}
+	for i, want := range []color.Color{white, black, color.Transparent} {
+		if got := out.At(i*8, 0); sqDistance(got, want) != 0 {
+			t.Errorf("stripe %d = %v, want %v", i, got, want)
+		}
+		if _, _, _, a := out.At(i*8, 0).RGBA(); (a == 0) != (i == 2) {
+			t.Errorf("stripe %d alpha = %d", i, a)
+		}
+	}
+}
+
+func TestToPalettedGray(t *testing.T) {
+	img := image.NewGray(image.Rect(0, 0, 4, 1))
+	out := toPaletted(img, pipeline.Output{Colors: 2})
+	if len(out.Palette) != 2 || out.Palette[0] != (color.Gray{0}) || out.Palette[1] != (color.Gray{0xff}) {
+		t.Errorf("palette = %v, want black and white", out.Palette)
+	}
+}
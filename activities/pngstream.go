@@ -0,0 +1,447 @@
+package activities
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"hash"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+)
+
+// pngSignature starts every PNG file.
+const pngSignature = "\x89PNG\r\n\x1a\n"
+
+// streamBandRows is how many rows of a streamed image are decoded at a
+// time, a multiple of the 16 rows the JPEG encoder reads together.
+const streamBandRows = 64
+
+// errStreamOrder is reported when a streamed image is read out of order,
+// after the rows asked for have been dropped.
+var errStreamOrder = errors.New("streamed image read out of order")
+
+// pngStreamable reports whether a PNG, given the header read to check it,
+// can be decoded a band of rows at a time. Interlaced PNGs can't, each of
+// their passes covers the whole image.
+func pngStreamable(header []byte) bool {
+	return len(header) > 28 && string(header[12:16]) == "IHDR" && header[28] == 0
+}
+
+// pngChunks reads the chunks of a PNG file, checking their CRCs.
+type pngChunks struct {
+	r    io.Reader
+	crc  hash.Hash32
+	typ  string
+	left uint32
+}
+
+// next skips what is left of the current chunk and reads the header of the
+// next one.
+func (c *pngChunks) next() error {
+	if c.typ != "" {
+		if _, err := io.Copy(io.Discard, c); err != nil {
+			return err
+		}
+		var sum [4]byte
+		if _, err := io.ReadFull(c.r, sum[:]); err != nil {
+			return unexpectedEOF(err)
+		}
+		if binary.BigEndian.Uint32(sum[:]) != c.crc.Sum32() {
+			return png.FormatError("invalid checksum")
+		}
+	}
+	var h [8]byte
+	if _, err := io.ReadFull(c.r, h[:]); err != nil {
+		return unexpectedEOF(err)
+	}
+	c.left = binary.BigEndian.Uint32(h[:4])
+	c.typ = string(h[4:])
+	c.crc = crc32.NewIEEE()
+	c.crc.Write(h[4:])
+	return nil
+}
+
+// Read reads the data of the current chunk.
+func (c *pngChunks) Read(p []byte) (int, error) {
+	if c.left == 0 {
+		return 0, io.EOF
+	}
+	if uint32(len(p)) > c.left {
+		p = p[:c.left]
+	}
+	n, err := c.r.Read(p)
+	c.crc.Write(p[:n])
+	c.left -= uint32(n)
+	if err == io.EOF {
+		err = nil
+		if c.left > 0 {
+			err = io.ErrUnexpectedEOF
+		}
+	}
+	return n, err
+}
+
+// data reads the data of the current chunk, which must be no longer than
+// max bytes.
+func (c *pngChunks) data(max int) ([]byte, error) {
+	if c.left > uint32(max) {
+		return nil, png.FormatError("bad " + c.typ + " length")
+	}
+	return io.ReadAll(c)
+}
+
+// pngIDAT reads the compressed image data, which may be split over several
+// IDAT chunks.
+type pngIDAT struct {
+	c    *pngChunks
+	done bool
+}
+
+func (r *pngIDAT) Read(p []byte) (int, error) {
+	for !r.done && r.c.left == 0 {
+		if err := r.c.next(); err != nil {
+			return 0, err
+		}
+		r.done = r.c.typ != "IDAT"
+	}
+	if r.done {
+		return 0, io.EOF
+	}
+	return r.c.Read(p)
+}
+
+// pngBands decodes a non-interlaced PNG a band of rows at a time, holding
+// no more than a band of pixels and two rows of image data.
+//
+// Rows are inflated and unfiltered here. Each band is then handed to the
+// standard decoder as a PNG of its own, with the rows stored uncompressed
+// and unfiltered, so bands decode to the same image types and colors as the
+// whole image does.
+type pngBands struct {
+	width, height int
+	// ihdr, plte and trns hold the data of the chunks copied into each
+	// band.
+	ihdr, plte, trns []byte
+	z                io.ReadCloser
+	// bpp is the number of bytes a filter looks back, a whole pixel or
+	// at least a byte.
+	bpp       int
+	cur, prev []byte
+	y         int
+}
+
+// newPNGBands reads the chunks of a PNG up to its image data.
+func newPNGBands(r io.Reader) (*pngBands, error) {
+	var sig [len(pngSignature)]byte
+	if _, err := io.ReadFull(r, sig[:]); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	if string(sig[:]) != pngSignature {
+		return nil, png.FormatError("not a PNG file")
+	}
+
+	d := &pngBands{}
+	c := &pngChunks{r: r}
+	for c.typ != "IDAT" {
+		if err := c.next(); err != nil {
+			return nil, err
+		}
+		var err error
+		switch c.typ {
+		case "IHDR":
+			d.ihdr, err = c.data(13)
+		case "PLTE":
+			d.plte, err = c.data(3 * 256)
+		case "tRNS":
+			d.trns, err = c.data(3 * 256)
+		case "IEND":
+			err = png.FormatError("no image data")
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(d.ihdr) != 13 {
+		return nil, png.FormatError("missing IHDR")
+	}
+	if d.ihdr[12] != 0 {
+		return nil, png.UnsupportedError("streaming interlaced images")
+	}
+
+	d.width = int(binary.BigEndian.Uint32(d.ihdr[0:4]))
+	d.height = int(binary.BigEndian.Uint32(d.ihdr[4:8]))
+	bits := pngBitsPerPixel(d.ihdr[9], d.ihdr[8])
+	if bits == 0 || d.width <= 0 || d.height <= 0 {
+		return nil, png.FormatError("bad IHDR")
+	}
+	d.bpp = max(1, bits/8)
+	rowBytes := 1 + (d.width*bits+7)/8
+	d.cur = make([]byte, rowBytes)
+	d.prev = make([]byte, rowBytes)
+
+	z, err := zlib.NewReader(&pngIDAT{c: c})
+	if err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	d.z = z
+	return d, nil
+}
+
+// pngBitsPerPixel returns the bits a pixel takes for a PNG color type and
+// bit depth, 0 for combinations PNG doesn't allow.
+func pngBitsPerPixel(colorType, depth byte) int {
+	var channels int
+	var depths string
+	switch colorType {
+	case 0:
+		channels, depths = 1, "\x01\x02\x04\x08\x10"
+	case 2:
+		channels, depths = 3, "\x08\x10"
+	case 3:
+		channels, depths = 1, "\x01\x02\x04\x08"
+	case 4:
+		channels, depths = 2, "\x08\x10"
+	case 6:
+		channels, depths = 4, "\x08\x10"
+	}
+	if bytes.IndexByte([]byte(depths), depth) < 0 {
+		return 0
+	}
+	return channels * int(depth)
+}
+
+// Bounds returns the bounds of the whole image.
+func (d *pngBands) Bounds() image.Rectangle {
+	return image.Rect(0, 0, d.width, d.height)
+}
+
+// Opaque reports whether the image has no alpha channel or transparent
+// color.
+func (d *pngBands) Opaque() bool {
+	colorType := d.ihdr[9]
+	return (colorType == 0 || colorType == 2 || colorType == 3) && d.trns == nil
+}
+
+// next decodes the next band of at most n rows. The band's bounds start at
+// the origin, whatever rows of the image it holds. It returns io.EOF once
+// every row has been decoded.
+func (d *pngBands) next(n int) (image.Image, error) {
+	n = min(n, d.height-d.y)
+	if n <= 0 {
+		return nil, io.EOF
+	}
+
+	var idat bytes.Buffer
+	zw, err := zlib.NewWriterLevel(&idat, zlib.NoCompression)
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < n; i++ {
+		if err := d.readRow(); err != nil {
+			return nil, err
+		}
+		// the row is unfiltered, so it is stored with filter type none
+		d.cur[0] = 0
+		zw.Write(d.cur)
+	}
+	zw.Close()
+	if d.y == d.height {
+		if err := d.end(); err != nil {
+			return nil, err
+		}
+	}
+
+	var band bytes.Buffer
+	band.WriteString(pngSignature)
+	ihdr := append([]byte(nil), d.ihdr...)
+	binary.BigEndian.PutUint32(ihdr[4:8], uint32(n))
+	writePNGChunk(&band, "IHDR", ihdr)
+	if d.plte != nil {
+		writePNGChunk(&band, "PLTE", d.plte)
+	}
+	if d.trns != nil {
+		writePNGChunk(&band, "tRNS", d.trns)
+	}
+	writePNGChunk(&band, "IDAT", idat.Bytes())
+	writePNGChunk(&band, "IEND", nil)
+	return png.Decode(&band)
+}
+
+// readRow reads and unfilters the next row into cur.
+func (d *pngBands) readRow() error {
+	d.cur, d.prev = d.prev, d.cur
+	if _, err := io.ReadFull(d.z, d.cur); err != nil {
+		return unexpectedEOF(err)
+	}
+	cdat, pdat := d.cur[1:], d.prev[1:]
+	switch d.cur[0] {
+	case 0:
+		// none
+	case 1:
+		// sub
+		for i := d.bpp; i < len(cdat); i++ {
+			cdat[i] += cdat[i-d.bpp]
+		}
+	case 2:
+		// up
+		for i, p := range pdat {
+			cdat[i] += p
+		}
+	case 3:
+		// average
+		for i := 0; i < d.bpp; i++ {
+			cdat[i] += pdat[i] / 2
+		}
+		for i := d.bpp; i < len(cdat); i++ {
+			cdat[i] += uint8((int(cdat[i-d.bpp]) + int(pdat[i])) / 2)
+		}
+	case 4:
+		// paeth
+		for i := range cdat {
+			var a, c uint8
+			if i >= d.bpp {
+				a, c = cdat[i-d.bpp], pdat[i-d.bpp]
+			}
+			cdat[i] += paeth(a, pdat[i], c)
+		}
+	default:
+		return png.FormatError("bad filter type")
+	}
+	d.y++
+	return nil
+}
+
+// end checks the image data ends after the last row, which also checks its
+// zlib checksum.
+func (d *pngBands) end() error {
+	var b [1]byte
+	_, err := io.ReadFull(d.z, b[:])
+	switch err {
+	case io.EOF:
+		return nil
+	case nil:
+		return png.FormatError("too much pixel data")
+	}
+	return err
+}
+
+// paeth returns the Paeth predictor of a byte from those to its left, above
+// and above left.
+func paeth(a, b, c uint8) uint8 {
+	p := int(a) + int(b) - int(c)
+	pa, pb, pc := abs(p-int(a)), abs(p-int(b)), abs(p-int(c))
+	if pa <= pb && pa <= pc {
+		return a
+	}
+	if pb <= pc {
+		return b
+	}
+	return c
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
+
+// writePNGChunk writes a chunk with its length and CRC.
+func writePNGChunk(w *bytes.Buffer, typ string, data []byte) {
+	var n [4]byte
+	binary.BigEndian.PutUint32(n[:], uint32(len(data)))
+	w.Write(n[:])
+	crc := crc32.NewIEEE()
+	crc.Write([]byte(typ))
+	crc.Write(data)
+	w.WriteString(typ)
+	w.Write(data)
+	binary.BigEndian.PutUint32(n[:], crc.Sum32())
+	w.Write(n[:])
+}
+
+// unexpectedEOF turns io.EOF into io.ErrUnexpectedEOF, for reads that stop
+// short of something the file must have.
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// streamedGray is the gray image of a PNG that is decoded a band of rows
+// at a time as it is read. It must be read once, row by row or in the 16
+// row blocks of the JPEG encoder, so a large image can be converted and
+// encoded without ever holding it in full. Decode errors, and reads out of
+// order, are kept for Err as At can't return them.
+type streamedGray struct {
+	bands *pngBands
+	// bg is the color transparent images are flattened onto, none to
+	// keep their alpha channel.
+	bg   color.Color
+	band image.Image
+	y0   int
+	err  error
+}
+
+// newStreamedGray returns the gray image of the PNG decoded by bands,
+// flattened onto bg unless it is nil.
+func newStreamedGray(bands *pngBands, bg color.Color) *streamedGray {
+	return &streamedGray{bands: bands, bg: bg}
+}
+
+func (v *streamedGray) ColorModel() color.Model {
+	if v.Opaque() {
+		return color.GrayModel
+	}
+	return color.NRGBAModel
+}
+
+func (v *streamedGray) Bounds() image.Rectangle { return v.bands.Bounds() }
+func (v *streamedGray) Opaque() bool            { return v.bg != nil || v.bands.Opaque() }
+
+// Err returns the error that stopped decoding, if any.
+func (v *streamedGray) Err() error { return v.err }
+
+func (v *streamedGray) At(x, y int) color.Color {
+	if v.err != nil || !image.Pt(x, y).In(v.Bounds()) {
+		return color.Gray{}
+	}
+	if y < v.y0 {
+		v.err = errStreamOrder
+		return color.Gray{}
+	}
+	for v.band == nil || y >= v.y0+v.band.Bounds().Dy() {
+		if v.band != nil {
+			v.y0 += v.band.Bounds().Dy()
+		}
+		band, err := v.bands.next(streamBandRows)
+		if err != nil {
+			v.err = unexpectedEOF(err)
+			return color.Gray{}
+		}
+		v.band = v.gray(band)
+	}
+	return v.band.At(x, y-v.y0)
+}
+
+// gray converts a decoded band as convertToGrayscale converts whole
+// images, then flattens it onto the background if there is one.
+func (v *streamedGray) gray(band image.Image) image.Image {
+	b := band.Bounds()
+	if v.bands.Opaque() {
+		gray := image.NewGray(b)
+		grayRows(gray, band, b.Min.Y, b.Max.Y)
+		return gray
+	}
+	nrgba := image.NewNRGBA(b)
+	grayAlphaRows(nrgba, band, b.Min.Y, b.Max.Y)
+	if v.bg != nil {
+		return flatten(nrgba, v.bg)
+	}
+	return nrgba
+}
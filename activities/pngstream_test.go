@@ -0,0 +1,255 @@
+package activities
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"math/rand"
+	"testing"
+
+	"github.com/joberly/demo-temporal/internal/storage"
+
+	"go.uber.org/zap"
+)
+
+// pngTestImages returns images that encode to each PNG color type and bit
+// depth, with the encoder choosing its filters.
+func pngTestImages(w, h int) map[string]image.Image {
+	images := testImages(w, h)
+	rng := rand.New(rand.NewSource(2))
+	r := image.Rect(0, 0, w, h)
+
+	gray16 := image.NewGray16(r)
+	rng.Read(gray16.Pix)
+	nrgba64 := image.NewNRGBA64(r)
+	rng.Read(nrgba64.Pix)
+	rgba64 := image.NewRGBA64(r)
+	rng.Read(rgba64.Pix)
+	for i := 6; i < len(rgba64.Pix); i += 8 {
+		rgba64.Pix[i], rgba64.Pix[i+1] = 0xff, 0xff
+	}
+
+	// a 16 color palette with transparency is written 4 bits a pixel
+	small := image.NewPaletted(r, color.Palette{color.Transparent})
+	for i := 1; i < 16; i++ {
+		small.Palette = append(small.Palette, color.NRGBA{uint8(i * 16), uint8(255 - i*16), 0x80, uint8(i * 17)})
+	}
+	for i := range small.Pix {
+		small.Pix[i] = uint8(rng.Intn(16))
+	}
+
+	return map[string]image.Image{
+		"gray":          images["gray"],
+		"gray16":        gray16,
+		"rgb":           images["rgba"],
+		"rgb16":         rgba64,
+		"nrgba":         images["nrgba"],
+		"nrgba64":       nrgba64,
+		"paletted":      images["paletted"],
+		"paletted 4bit": small,
+	}
+}
+
+func encodePNG(t testing.TB, img image.Image) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func newTestPNGBands(t *testing.T, data []byte) *pngBands {
+	t.Helper()
+	if !pngStreamable(data) {
+		t.Fatal("PNG is not streamable")
+	}
+	bands, err := newPNGBands(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bands
+}
+
+func TestPNGBandsMatchDecode(t *testing.T) {
+	for name, img := range pngTestImages(37, 29) {
+		t.Run(name, func(t *testing.T) {
+			data := encodePNG(t, img)
+			want, err := png.Decode(bytes.NewReader(data))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			bands := newTestPNGBands(t, data)
+			y0 := 0
+			for {
+				band, err := bands.next(5)
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got, want := fmt.Sprintf("%T", band), fmt.Sprintf("%T", want); got != want {
+					t.Fatalf("band is %s, want %s", got, want)
+				}
+				b := band.Bounds()
+				for y := b.Min.Y; y < b.Max.Y; y++ {
+					for x := b.Min.X; x < b.Max.X; x++ {
+						if got, want := band.At(x, y), want.At(x, y0+y); got != want {
+							t.Fatalf("pixel (%d, %d) = %v, want %v", x, y0+y, got, want)
+						}
+					}
+				}
+				y0 += b.Dy()
+			}
+			if y0 != want.Bounds().Dy() {
+				t.Errorf("decoded %d rows, want %d", y0, want.Bounds().Dy())
+			}
+		})
+	}
+}
+
+func TestStreamedGrayMatchesConvert(t *testing.T) {
+	a := &Activities{}
+	for name, img := range pngTestImages(37, 150) {
+		t.Run(name, func(t *testing.T) {
+			data := encodePNG(t, img)
+			decoded, err := png.Decode(bytes.NewReader(data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			converted, err := a.convertToGrayscale(context.Background(), decoded)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, bg := range []color.Color{nil, color.White} {
+				want := converted
+				if bg != nil {
+					want = flatten(converted, bg)
+				}
+				got := newStreamedGray(newTestPNGBands(t, data), bg)
+				if got.Bounds() != want.Bounds() {
+					t.Fatalf("bounds = %v, want %v", got.Bounds(), want.Bounds())
+				}
+				b := got.Bounds()
+				for y := b.Min.Y; y < b.Max.Y; y++ {
+					for x := b.Min.X; x < b.Max.X; x++ {
+						gr, gg, gb, ga := got.At(x, y).RGBA()
+						wr, wg, wb, wa := want.At(x, y).RGBA()
+						if gr != wr || gg != wg || gb != wb || ga != wa {
+							t.Fatalf("background %v: pixel (%d, %d) = %v, want %v", bg, x, y, got.At(x, y), want.At(x, y))
+						}
+					}
+				}
+				if err := got.Err(); err != nil {
+					t.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestStreamedGrayErrors(t *testing.T) {
+	data := encodePNG(t, pngTestImages(64, 200)["rgb"])
+	idat := bytes.Index(data, []byte("IDAT"))
+
+	corrupt := bytes.Clone(data)
+	corrupt[idat+100] ^= 0xff
+	truncated := data[:len(data)/2]
+
+	for name, data := range map[string][]byte{"corrupt": corrupt, "truncated": truncated} {
+		t.Run(name, func(t *testing.T) {
+			gray := newStreamedGray(newTestPNGBands(t, data), nil)
+			if err := jpeg.Encode(io.Discard, gray, nil); err != nil {
+				t.Fatal(err)
+			}
+			if gray.Err() == nil {
+				t.Error("Err = nil, want the decode error")
+			}
+		})
+	}
+
+	t.Run("out of order", func(t *testing.T) {
+		gray := newStreamedGray(newTestPNGBands(t, data), nil)
+		gray.At(0, 2*streamBandRows)
+		gray.At(0, 0)
+		if err := gray.Err(); !errors.Is(err, errStreamOrder) {
+			t.Errorf("Err = %v, want errStreamOrder", err)
+		}
+	})
+}
+
+func TestPNGStreamable(t *testing.T) {
+	data := encodePNG(t, image.NewGray(image.Rect(0, 0, 4, 4)))
+	if !pngStreamable(data) {
+		t.Error("non-interlaced PNG is not streamable")
+	}
+	interlaced := bytes.Clone(data)
+	interlaced[28] = 1
+	if pngStreamable(interlaced) {
+		t.Error("interlaced PNG is streamable")
+	}
+}
+
+func TestGrayscaleImageActivityStreamsPNG(t *testing.T) {
+	working, err := storage.NewLocal(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	processed, err := storage.NewLocal(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := &Activities{
+		logger: zap.NewNop(),
+		config: &Config{StreamingPixels: 1},
+		stores: &storage.Stores{Working: working, Processed: processed},
+	}
+	ctx := context.Background()
+
+	for name, data := range map[string][]byte{
+		"streamed": encodePNG(t, pngTestImages(67, 41)["nrgba"]),
+		"corrupt":  encodePNG(t, pngTestImages(67, 41)["nrgba"])[:500],
+	} {
+		t.Run(name, func(t *testing.T) {
+			err := working.Put(ctx, name, bytes.NewReader(data), &storage.PutOptions{ContentType: "image/png", Size: int64(len(data))})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = a.GrayscaleImageActivity(ctx, name)
+			if name == "corrupt" {
+				if err == nil {
+					t.Fatal("converting a corrupt image succeeded")
+				}
+				if _, _, err := processed.Get(ctx, name); !errors.Is(err, storage.ErrNotExist) {
+					t.Errorf("Get err = %v, want the broken image left unstored", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			r, _, err := processed.Get(ctx, name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer r.Close()
+			img, err := jpeg.Decode(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if img.Bounds() != image.Rect(0, 0, 67, 41) {
+				t.Errorf("bounds = %v", img.Bounds())
+			}
+		})
+	}
+}
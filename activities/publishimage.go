@@ -0,0 +1,110 @@
+package activities
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"io"
+
+	"github.com/joberly/demo-temporal/internal/pipeline"
+	"github.com/joberly/demo-temporal/internal/storage"
+
+	"go.temporal.io/sdk/temporal"
+	"go.uber.org/zap"
+)
+
+// PublishImageInput is the input to PublishImageActivity.
+type PublishImageInput struct {
+	ImageID string
+	// Source is the working store key of the final pipeline image.
+	Source string
+	Output pipeline.Output
+}
+
+// PublishImageResult describes the image written by PublishImageActivity.
+type PublishImageResult struct {
+	Format      string
+	ContentType string
+	Width       int
+	Height      int
+}
+
+// PublishImageActivity is a Temporal activity that encodes the final
+// working image in the requested output format and stores it for download.
+func (a *Activities) PublishImageActivity(ctx context.Context, input PublishImageInput) (*PublishImageResult, error) {
+	a.logger.Info("publishing image", zap.String("imageID", input.ImageID))
+
+	if input.Output.Format == pipeline.FormatWebP {
+		return a.passthroughWebP(ctx, input)
+	}
+
+	img, _, err := a.loadImage(ctx, a.stores.Working, input.Source)
+	if err != nil {
+		return nil, err
+	}
+
+	format, err := a.saveImage(ctx, a.stores.Processed, input.ImageID, img, input.Output)
+	if err != nil {
+		return nil, err
+	}
+
+	size := img.Bounds().Size()
+	a.logger.Info("image published",
+		zap.String("imageID", input.ImageID),
+		zap.String("format", format),
+	)
+	return &PublishImageResult{
+		Format:      format,
+		ContentType: contentTypes[format],
+		Width:       size.X,
+		Height:      size.Y,
+	}, nil
+}
+
+// passthroughWebP stores the working image unchanged. There is no WebP
+// encoder so this only works when the source is already WebP.
+func (a *Activities) passthroughWebP(ctx context.Context, input PublishImageInput) (*PublishImageResult, error) {
+	file, info, err := a.stores.Working.Get(ctx, input.Source)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	if err := a.checkImageBytes(info.Size); err != nil {
+		return nil, err
+	}
+
+	// check the format, keeping the header bytes for the copy
+	var header bytes.Buffer
+	config, format, err := image.DecodeConfig(io.TeeReader(file, &header))
+	if err != nil {
+		return nil, err
+	}
+	if err := a.checkImagePixels(config); err != nil {
+		return nil, err
+	}
+	if format != pipeline.FormatWebP {
+		return nil, temporal.NewNonRetryableApplicationError(
+			"webp output requires a webp upload, got "+format,
+			ErrTypeInvalidPipeline, nil)
+	}
+
+	err = a.stores.Processed.Put(ctx, input.ImageID, &heartbeatReader{ctx: ctx, r: io.MultiReader(&header, file)}, &storage.PutOptions{
+		ContentType: contentTypes[pipeline.FormatWebP],
+		Size:        info.Size,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	a.logger.Info("image published",
+		zap.String("imageID", input.ImageID),
+		zap.String("format", format),
+	)
+	return &PublishImageResult{
+		Format:      format,
+		ContentType: contentTypes[format],
+		Width:       config.Width,
+		Height:      config.Height,
+	}, nil
+}
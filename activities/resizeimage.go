@@ -0,0 +1,90 @@
+package activities
+
+import (
+	"context"
+	"image"
+
+	"github.com/joberly/demo-temporal/internal/pipeline"
+
+	"go.uber.org/zap"
+)
+
+// ResizeImageInput is the input to ResizeImageActivity.
+type ResizeImageInput struct {
+	ImageID string
+	// Source is the working store key of the final pipeline image.
+	Source     string
+	Renditions []pipeline.Rendition
+	Output     pipeline.Output
+}
+
+// RenditionResult describes a rendition written by ResizeImageActivity.
+type RenditionResult struct {
+	Name        string
+	Width       int
+	Height      int
+	ContentType string
+}
+
+// ResizeImageActivity is a Temporal activity that produces resized
+// renditions of a working image and stores them for download.
+func (a *Activities) ResizeImageActivity(ctx context.Context, input ResizeImageInput) ([]RenditionResult, error) {
+	a.logger.Info("resizing image",
+		zap.String("imageID", input.ImageID),
+		zap.Int("renditions", len(input.Renditions)),
+	)
+
+	img, _, err := a.loadImage(ctx, a.stores.Working, input.Source)
+	if err != nil {
+		return nil, err
+	}
+	bounds := img.Bounds()
+
+	// webp output passes the upload through unchanged but renditions have
+	// to be encoded, so they fall back to lossless png
+	output := input.Output
+	if output.Format == pipeline.FormatWebP {
+		output = pipeline.Output{Format: pipeline.FormatPNG}
+	}
+
+	results := make([]RenditionResult, 0, len(input.Renditions))
+	for _, r := range input.Renditions {
+		// heartbeat so cancellation reaches us between renditions
+		heartbeat(ctx, r.Name)
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		// never enlarge an image that already fits inside the box
+		var resized image.Image
+		fitsInside := (r.Width == 0 || bounds.Dx() <= r.Width) &&
+			(r.Height == 0 || bounds.Dy() <= r.Height)
+		if fitsInside && (r.Fit == "" || r.Fit == pipeline.FitInside) {
+			resized = img
+		} else {
+			resized = resizeImage(img, r.Width, r.Height, r.Fit, r.Kernel)
+		}
+
+		key := pipeline.RenditionKey(input.ImageID, r.Name)
+		format, err := a.saveImage(ctx, a.stores.Processed, key, resized, output)
+		if err != nil {
+			return nil, err
+		}
+
+		size := resized.Bounds().Size()
+		results = append(results, RenditionResult{
+			Name:        r.Name,
+			Width:       size.X,
+			Height:      size.Y,
+			ContentType: contentTypes[format],
+		})
+		a.logger.Info("rendition stored",
+			zap.String("imageID", input.ImageID),
+			zap.String("rendition", r.Name),
+			zap.Int("width", size.X),
+			zap.Int("height", size.Y),
+		)
+	}
+
+	return results, nil
+}
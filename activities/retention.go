@@ -0,0 +1,150 @@
+package activities
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/joberly/demo-temporal/internal/retention"
+	"github.com/joberly/demo-temporal/internal/storage"
+
+	"go.uber.org/zap"
+)
+
+// listExpiredPageSize is how many keys are listed from the store at once.
+const listExpiredPageSize = 1000
+
+// maxListExpiredPages is how many pages one ListExpiredActivity reads at
+// most, so stores holding few expired images don't keep it running for
+// the whole store.
+const maxListExpiredPages = 20
+
+// ListExpiredInput is the input to ListExpiredActivity.
+type ListExpiredInput struct {
+	Rules retention.Rules
+	// TombstoneTTL is how long tombstones are kept, zero keeps them
+	// forever.
+	TombstoneTTL time.Duration
+	// Now is the time expiry is measured from.
+	Now time.Time
+	// StartAfter skips keys up to and including this one.
+	StartAfter string
+	// Limit is the most keys to return.
+	Limit int
+}
+
+// ListExpiredResult is a batch of expired processed images and
+// tombstones.
+type ListExpiredResult struct {
+	Keys []string
+	// Next is the last key looked at, the next batch starts after it.
+	Next string
+	// Done is set once there are no expired images after Keys.
+	Done bool
+}
+
+// ListExpiredActivity is a Temporal activity that lists processed images
+// that have outlived their retention, and tombstones that have outlived
+// theirs, in key order. The store is read a page at a time from
+// StartAfter, so a batch may hold no keys when none of the pages it read
+// had expired, it is continued from Next.
+func (a *Activities) ListExpiredActivity(ctx context.Context, input ListExpiredInput) (*ListExpiredResult, error) {
+	result := &ListExpiredResult{Next: input.StartAfter}
+	for page := 0; page < maxListExpiredPages; page++ {
+		infos, more, err := storage.ListPage(ctx, a.stores.Processed, "", result.Next, listExpiredPageSize)
+		if err != nil {
+			return nil, err
+		}
+		for _, info := range infos {
+			if input.Limit > 0 && len(result.Keys) == input.Limit {
+				return a.listedExpired(result), nil
+			}
+			result.Next = info.Key
+			if input.Rules.Expired(info.Key, info.LastModified, input.Now) ||
+				retention.TombstoneExpired(info.Key, info.LastModified, input.Now, input.TombstoneTTL) {
+				result.Keys = append(result.Keys, info.Key)
+			}
+		}
+		if !more {
+			result.Done = true
+			return a.listedExpired(result), nil
+		}
+		heartbeat(ctx, result.Next)
+	}
+	return a.listedExpired(result), nil
+}
+
+func (a *Activities) listedExpired(result *ListExpiredResult) *ListExpiredResult {
+	a.logger.Info("listed expired images",
+		zap.Int("count", len(result.Keys)),
+		zap.String("next", result.Next),
+		zap.Bool("done", result.Done),
+	)
+	return result
+}
+
+// DeleteExpiredInput is the input to DeleteExpiredActivity.
+type DeleteExpiredInput struct {
+	Keys []string
+	Now  time.Time
+}
+
+// DeleteExpiredResult records what DeleteExpiredActivity reclaimed.
+type DeleteExpiredResult struct {
+	Deleted int
+	Bytes   int64
+	// Tombstones is how many expired tombstones were removed.
+	Tombstones int
+}
+
+// DeleteExpiredActivity is a Temporal activity that deletes expired
+// processed images, leaving a tombstone for each so downloads can tell an
+// expired image from one that never existed. Expired tombstones are
+// removed outright.
+func (a *Activities) DeleteExpiredActivity(ctx context.Context, input DeleteExpiredInput) (*DeleteExpiredResult, error) {
+	result := &DeleteExpiredResult{}
+	for _, key := range input.Keys {
+		if retention.IsTombstone(key) {
+			if err := a.stores.Processed.Delete(ctx, key); err != nil {
+				return nil, err
+			}
+			result.Tombstones++
+			heartbeat(ctx, key)
+			continue
+		}
+
+		info, err := a.stores.Processed.Stat(ctx, key)
+		if errors.Is(err, storage.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		// write the tombstone first so the image is never simply missing
+		expiredAt := input.Now.UTC().Format(time.RFC3339)
+		err = a.stores.Processed.Put(ctx, retention.TombstoneKey(key), strings.NewReader(expiredAt),
+			&storage.PutOptions{
+				ContentType: "text/plain",
+				Size:        int64(len(expiredAt)),
+			})
+		if err != nil {
+			return nil, err
+		}
+		if err := a.stores.Processed.Delete(ctx, key); err != nil {
+			return nil, err
+		}
+
+		result.Deleted++
+		result.Bytes += info.Size
+		heartbeat(ctx, key)
+	}
+
+	a.logger.Info("deleted expired images",
+		zap.Int("deleted", result.Deleted),
+		zap.Int64("bytes", result.Bytes),
+		zap.Int("tombstones", result.Tombstones),
+	)
+	return result, nil
+}
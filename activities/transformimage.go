@@ -0,0 +1,48 @@
+package activities
+
+import (
+	"context"
+
+	"github.com/joberly/demo-temporal/internal/pipeline"
+
+	"go.uber.org/zap"
+)
+
+// TransformImageInput is the input to TransformImageActivity.
+type TransformImageInput struct {
+	ImageID string
+	// Source is the working store key of the image to transform.
+	Source string
+	// Target is the working store key the transformed image is written to.
+	Target string
+	Step   pipeline.Step
+}
+
+// TransformImageActivity is a Temporal activity that applies a single
+// pipeline step to a working image.
+func (a *Activities) TransformImageActivity(ctx context.Context, input TransformImageInput) error {
+	a.logger.Info("transforming image",
+		zap.String("imageID", input.ImageID),
+		zap.String("op", input.Step.Op),
+	)
+
+	img, _, err := a.loadImage(ctx, a.stores.Working, input.Source)
+	if err != nil {
+		return err
+	}
+
+	img, err = a.applyStep(ctx, img, input.Step)
+	if err != nil {
+		return err
+	}
+
+	if err := a.saveWorkingImage(ctx, input.Target, img); err != nil {
+		return err
+	}
+
+	a.logger.Info("image transformed",
+		zap.String("imageID", input.ImageID),
+		zap.String("op", input.Step.Op),
+	)
+	return nil
+}
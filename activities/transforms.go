@@ -0,0 +1,311 @@
+package activities
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+
+	"github.com/joberly/demo-temporal/internal/pipeline"
+
+	"go.temporal.io/sdk/temporal"
+	"golang.org/x/image/draw"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+)
+
+// ErrTypeInvalidPipeline is the application error type returned when a
+// pipeline step cannot be applied to an image.
+const ErrTypeInvalidPipeline = "InvalidPipeline"
+
+// applyStep applies a single pipeline step to img.
+func (a *Activities) applyStep(ctx context.Context, img image.Image, step pipeline.Step) (image.Image, error) {
+	switch step.Op {
+	case pipeline.OpGrayscale:
+		return a.convertToGrayscale(ctx, img)
+	case pipeline.OpResize:
+		return resizeImage(img, step.Width, step.Height, step.Fit, step.Kernel), nil
+	case pipeline.OpCrop:
+		return cropImage(img, step.X, step.Y, step.Width, step.Height)
+	case pipeline.OpRotate:
+		return rotateImage(img, step.Angle), nil
+	case pipeline.OpBlur:
+		return blurImage(ctx, toRGBA(img), step.Sigma)
+	case pipeline.OpSharpen:
+		return sharpenImage(ctx, toRGBA(img), step.Sigma, step.Amount)
+	case pipeline.OpWatermark:
+		return watermarkImage(img, step.Text, step.Position, step.Opacity), nil
+	default:
+		return nil, temporal.NewNonRetryableApplicationError(
+			fmt.Sprintf("unsupported operation: %s", step.Op), ErrTypeInvalidPipeline, nil)
+	}
+}
+
+// toRGBA returns img as an RGBA image with its origin at zero.
+func toRGBA(img image.Image) *image.RGBA {
+	if rgba, ok := img.(*image.RGBA); ok && rgba.Rect.Min == (image.Point{}) {
+		return rgba
+	}
+	b := img.Bounds()
+	rgba := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(rgba, rgba.Bounds(), img, b.Min, draw.Src)
+	return rgba
+}
+
+// kernels maps kernel names to their resampling implementations.
+var kernels = map[string]draw.Interpolator{
+	pipeline.KernelNearest:        draw.NearestNeighbor,
+	pipeline.KernelApproxBiLinear: draw.ApproxBiLinear,
+	pipeline.KernelBiLinear:       draw.BiLinear,
+	pipeline.KernelCatmullRom:     draw.CatmullRom,
+}
+
+// resizeImage scales img into a width by height box according to fit. When
+// one of the dimensions is zero it is chosen to preserve the aspect ratio.
+func resizeImage(img image.Image, width, height int, fit, kernel string) image.Image {
+	b := img.Bounds()
+	srcW, srcH := b.Dx(), b.Dy()
+	src := b
+
+	switch {
+	case width == 0:
+		width = max(1, srcW*height/srcH)
+	case height == 0:
+		height = max(1, srcH*width/srcW)
+	case fit == pipeline.FitStretch:
+	case fit == pipeline.FitFill:
+		// crop the source around its center to the aspect ratio of the box
+		if srcW*height > srcH*width {
+			w := max(1, srcH*width/height)
+			src.Min.X += (srcW - w) / 2
+			src.Max.X = src.Min.X + w
+		} else {
+			h := max(1, srcW*height/width)
+			src.Min.Y += (srcH - h) / 2
+			src.Max.Y = src.Min.Y + h
+		}
+	default:
+		// shrink whichever dimension of the box the image does not fill
+		if srcW*height > srcH*width {
+			height = max(1, srcH*width/srcW)
+		} else {
+			width = max(1, srcW*height/srcH)
+		}
+	}
+
+	interp, ok := kernels[kernel]
+	if !ok {
+		interp = draw.CatmullRom
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	interp.Scale(dst, dst.Bounds(), img, src, draw.Src, nil)
+	return dst
+}
+
+// cropImage cuts the given rectangle, relative to the image origin, out of
+// img. Rectangles extending past the image are clipped.
+func cropImage(img image.Image, x, y, width, height int) (image.Image, error) {
+	b := img.Bounds()
+	rect := image.Rect(x, y, x+width, y+height).Add(b.Min).Intersect(b)
+	if rect.Empty() {
+		return nil, temporal.NewNonRetryableApplicationError(
+			fmt.Sprintf("crop area %dx%d+%d+%d is outside the %dx%d image",
+				width, height, x, y, b.Dx(), b.Dy()),
+			ErrTypeInvalidPipeline, nil)
+	}
+
+	// share the pixels of decoded images rather than copying them
+	if sub, ok := img.(interface {
+		SubImage(image.Rectangle) image.Image
+	}); ok {
+		return sub.SubImage(rect), nil
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, rect.Dx(), rect.Dy()))
+	draw.Draw(dst, dst.Bounds(), img, rect.Min, draw.Src)
+	return dst, nil
+}
+
+// rotateImage rotates img clockwise by a multiple of 90 degrees.
+func rotateImage(img image.Image, angle int) image.Image {
+	src := toRGBA(img)
+	w, h := src.Rect.Dx(), src.Rect.Dy()
+
+	angle = ((angle % 360) + 360) % 360
+	var dst *image.RGBA
+	if angle == 90 || angle == 270 {
+		dst = image.NewRGBA(image.Rect(0, 0, h, w))
+	} else {
+		dst = image.NewRGBA(image.Rect(0, 0, w, h))
+	}
+
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var dx, dy int
+			switch angle {
+			case 90:
+				dx, dy = h-1-y, x
+			case 180:
+				dx, dy = w-1-x, h-1-y
+			case 270:
+				dx, dy = y, w-1-x
+			default:
+				dx, dy = x, y
+			}
+			si := src.PixOffset(x, y)
+			di := dst.PixOffset(dx, dy)
+			copy(dst.Pix[di:di+4], src.Pix[si:si+4])
+		}
+	}
+	return dst
+}
+
+// gaussianKernel returns a normalized one dimensional gaussian kernel.
+func gaussianKernel(sigma float64) []float64 {
+	radius := int(math.Ceil(sigma * 3))
+	kernel := make([]float64, 2*radius+1)
+	sum := 0.0
+	for i := range kernel {
+		d := float64(i - radius)
+		kernel[i] = math.Exp(-d * d / (2 * sigma * sigma))
+		sum += kernel[i]
+	}
+	for i := range kernel {
+		kernel[i] /= sum
+	}
+	return kernel
+}
+
+// blurImage applies a gaussian blur to src using two separable passes.
+func blurImage(ctx context.Context, src *image.RGBA, sigma float64) (*image.RGBA, error) {
+	kernel := gaussianKernel(sigma)
+	radius := len(kernel) / 2
+	w, h := src.Rect.Dx(), src.Rect.Dy()
+
+	pass := func(dst, src *image.RGBA, dx, dy int) error {
+		for y := 0; y < h; y++ {
+			heartbeat(ctx)
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			for x := 0; x < w; x++ {
+				var sum [4]float64
+				for i, k := range kernel {
+					sx := clamp(x+(i-radius)*dx, 0, w-1)
+					sy := clamp(y+(i-radius)*dy, 0, h-1)
+					si := src.PixOffset(sx, sy)
+					for c := 0; c < 4; c++ {
+						sum[c] += k * float64(src.Pix[si+c])
+					}
+				}
+				di := dst.PixOffset(x, y)
+				for c := 0; c < 4; c++ {
+					dst.Pix[di+c] = uint8(clamp(int(sum[c]+0.5), 0, 255))
+				}
+			}
+		}
+		return nil
+	}
+
+	tmp := image.NewRGBA(src.Rect)
+	if err := pass(tmp, src, 1, 0); err != nil {
+		return nil, err
+	}
+	dst := image.NewRGBA(src.Rect)
+	if err := pass(dst, tmp, 0, 1); err != nil {
+		return nil, err
+	}
+	return dst, nil
+}
+
+// sharpenImage applies an unsharp mask to src, adding amount times the
+// difference between src and a blurred copy of it.
+func sharpenImage(ctx context.Context, src *image.RGBA, sigma, amount float64) (*image.RGBA, error) {
+	if sigma == 0 {
+		sigma = 1
+	}
+	if amount == 0 {
+		amount = 1
+	}
+
+	blurred, err := blurImage(ctx, src, sigma)
+	if err != nil {
+		return nil, err
+	}
+
+	dst := image.NewRGBA(src.Rect)
+	for i := 0; i < len(src.Pix); i += 4 {
+		alpha := int(src.Pix[i+3])
+		for c := 0; c < 3; c++ {
+			o := float64(src.Pix[i+c])
+			v := o + amount*(o-float64(blurred.Pix[i+c]))
+			// color values are premultiplied so must not exceed alpha
+			dst.Pix[i+c] = uint8(clamp(int(v+0.5), 0, alpha))
+		}
+		dst.Pix[i+3] = src.Pix[i+3]
+	}
+	return dst, nil
+}
+
+// watermarkImage draws text over a copy of img at the given position. The
+// text is scaled to span roughly a quarter of the image width.
+func watermarkImage(img image.Image, text, position string, opacity float64) image.Image {
+	b := img.Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(dst, dst.Bounds(), img, b.Min, draw.Src)
+
+	// render the text at its natural size into a mask
+	face := basicfont.Face7x13
+	metrics := face.Metrics()
+	textWidth := font.MeasureString(face, text).Ceil()
+	textHeight := metrics.Height.Ceil()
+	mask := image.NewAlpha(image.Rect(0, 0, textWidth, textHeight))
+	drawer := &font.Drawer{
+		Dst:  mask,
+		Src:  image.Opaque,
+		Face: face,
+		Dot:  fixed.P(0, metrics.Ascent.Ceil()),
+	}
+	drawer.DrawString(text)
+
+	// scale the mask up so the text is legible on large images
+	scale := max(1, dst.Rect.Dx()/4/textWidth)
+	scaled := image.NewAlpha(image.Rect(0, 0, textWidth*scale, textHeight*scale))
+	draw.NearestNeighbor.Scale(scaled, scaled.Bounds(), mask, mask.Bounds(), draw.Src, nil)
+
+	margin := scaled.Rect.Dy() / 2
+	size := scaled.Rect.Size()
+	var at image.Point
+	switch position {
+	case pipeline.PositionTopLeft:
+		at = image.Pt(margin, margin)
+	case pipeline.PositionTopRight:
+		at = image.Pt(dst.Rect.Dx()-size.X-margin, margin)
+	case pipeline.PositionBottomLeft:
+		at = image.Pt(margin, dst.Rect.Dy()-size.Y-margin)
+	case pipeline.PositionCenter:
+		at = image.Pt((dst.Rect.Dx()-size.X)/2, (dst.Rect.Dy()-size.Y)/2)
+	default:
+		at = image.Pt(dst.Rect.Dx()-size.X-margin, dst.Rect.Dy()-size.Y-margin)
+	}
+
+	if opacity == 0 {
+		opacity = 0.5
+	}
+	ink := image.NewUniform(color.NRGBA{R: 255, G: 255, B: 255, A: uint8(opacity * 255)})
+	draw.DrawMask(dst, image.Rectangle{Min: at, Max: at.Add(size)}, ink, image.Point{},
+		scaled, image.Point{}, draw.Over)
+	return dst
+}
+
+func clamp(v, lo, hi int) int {
+	if v < lo {
+		return lo
+	}
+	if v > hi {
+		return hi
+	}
+	return v
+}
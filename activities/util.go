@@ -1,34 +1,57 @@
 package activities
 
 import (
+	"context"
 	"io"
-	"os"
 
+	"github.com/joberly/demo-temporal/internal/storage"
+
+	"go.temporal.io/sdk/activity"
 	"go.uber.org/zap"
 )
 
-func (a *Activities) copyFile(src, dst string) error {
-	// open source file in uploads dir
-	srcFile, err := os.Open(src)
+func (a *Activities) copyObject(ctx context.Context, src storage.Blob, dst storage.Blob, key string) error {
+	// stream the object from the source store into the destination store,
+	// heartbeating as it goes
+	r, info, err := src.Get(ctx, key)
 	if err != nil {
-		a.logger.Error("failed to open source file", zap.Error(err))
+		a.logger.Error("failed to copy object", zap.String("key", key), zap.Error(err))
 		return err
 	}
-	defer srcFile.Close()
+	defer r.Close()
 
-	// create destination file in working dir
-	dstFile, err := os.Create(dst)
+	err = dst.Put(ctx, key, &heartbeatReader{ctx: ctx, r: r}, &storage.PutOptions{
+		ContentType: info.ContentType,
+		Size:        info.Size,
+	})
 	if err != nil {
-		a.logger.Error("failed to create destination file", zap.Error(err))
+		a.logger.Error("failed to copy object", zap.String("key", key), zap.Error(err))
 		return err
 	}
-	defer dstFile.Close()
 
-	// copy file contents
-	if _, err := io.Copy(dstFile, srcFile); err != nil {
-		a.logger.Error("failed to copy file contents", zap.Error(err))
-		return err
+	return nil
+}
+
+// heartbeat records activity progress so Temporal can detect stuck workers
+// and deliver cancellation. It does nothing outside of an activity.
+func heartbeat(ctx context.Context, details ...interface{}) {
+	if activity.IsActivity(ctx) {
+		activity.RecordHeartbeat(ctx, details...)
 	}
+}
 
-	return nil
+// heartbeatReader heartbeats the number of bytes read so far each time it
+// is read, keeping activities that move large objects from timing out. The
+// SDK throttles the heartbeats it sends on to the server.
+type heartbeatReader struct {
+	ctx context.Context
+	r   io.Reader
+	n   int64
+}
+
+func (h *heartbeatReader) Read(p []byte) (int, error) {
+	n, err := h.r.Read(p)
+	h.n += int64(n)
+	heartbeat(h.ctx, h.n)
+	return n, err
 }
@@ -0,0 +1,119 @@
+package activities
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+
+	"github.com/joberly/demo-temporal/internal/imagetype"
+
+	"go.temporal.io/sdk/temporal"
+	"go.uber.org/zap"
+)
+
+// Application error types returned when an upload is not an image that can
+// be processed. Like ErrTypeImageTooLarge these are never retried.
+const (
+	// ErrTypeUnsupportedFormat is returned for files that are not a
+	// supported image format.
+	ErrTypeUnsupportedFormat = "UnsupportedFormat"
+	// ErrTypeContentTypeMismatch is returned when the content type given
+	// with an upload does not match its contents.
+	ErrTypeContentTypeMismatch = "ContentTypeMismatch"
+	// ErrTypeInvalidImage is returned for images with a corrupt header.
+	ErrTypeInvalidImage = "InvalidImage"
+)
+
+// ValidateImageInput is the input to ValidateImageActivity.
+type ValidateImageInput struct {
+	ImageID string
+	// ContentType is the content type the image was uploaded with. The
+	// type recorded by the upload store is used when it is empty.
+	ContentType string
+}
+
+// ValidateImageResult describes a valid upload.
+type ValidateImageResult struct {
+	Format      string
+	ContentType string
+	Width       int
+	Height      int
+	Size        int64
+}
+
+// ValidateImageActivity is a Temporal activity that checks an upload is a
+// supported image within the configured limits before any work is done on
+// it.
+func (a *Activities) ValidateImageActivity(ctx context.Context, input ValidateImageInput) (*ValidateImageResult, error) {
+	a.logger.Info("validating image", zap.String("imageID", input.ImageID))
+
+	file, info, err := a.stores.Upload.Get(ctx, input.ImageID)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	if err := a.checkImageBytes(info.Size); err != nil {
+		return nil, err
+	}
+
+	// identify the format from the magic bytes, keeping them for the header
+	// decode
+	var header bytes.Buffer
+	_, err = io.CopyN(&header, file, imagetype.HeaderSize)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	format := imagetype.Sniff(header.Bytes())
+	if format == "" {
+		return nil, temporal.NewNonRetryableApplicationError(
+			"file is not a supported image", ErrTypeUnsupportedFormat, nil)
+	}
+
+	// the upload must be what the client said it was
+	declared := input.ContentType
+	if declared == "" {
+		declared = info.ContentType
+	}
+	if !imagetype.IsGeneric(declared) && imagetype.FromContentType(declared) != format {
+		return nil, temporal.NewNonRetryableApplicationError(
+			fmt.Sprintf("uploaded as %s but contains %s", declared, imagetype.ContentType(format)),
+			ErrTypeContentTypeMismatch, nil)
+	}
+
+	// check the dimensions from the image header
+	config, _, err := image.DecodeConfig(io.MultiReader(&header, &limitedReader{a: a, r: file}))
+	if err != nil {
+		var appErr *temporal.ApplicationError
+		if errors.As(err, &appErr) {
+			return nil, err
+		}
+		return nil, temporal.NewNonRetryableApplicationError(
+			"invalid image header: "+err.Error(), ErrTypeInvalidImage, nil)
+	}
+	if config.Width <= 0 || config.Height <= 0 {
+		return nil, temporal.NewNonRetryableApplicationError(
+			fmt.Sprintf("invalid image dimensions %dx%d", config.Width, config.Height),
+			ErrTypeInvalidImage, nil)
+	}
+	if err := a.checkImagePixels(config); err != nil {
+		return nil, err
+	}
+
+	a.logger.Info("image valid",
+		zap.String("imageID", input.ImageID),
+		zap.String("format", format),
+		zap.Int("width", config.Width),
+		zap.Int("height", config.Height),
+	)
+	return &ValidateImageResult{
+		Format:      format,
+		ContentType: imagetype.ContentType(format),
+		Width:       config.Width,
+		Height:      config.Height,
+		Size:        info.Size,
+	}, nil
+}
@@ -0,0 +1,283 @@
+package activities
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/joberly/demo-temporal/internal/signedurl"
+
+	"go.temporal.io/sdk/activity"
+	"go.temporal.io/sdk/temporal"
+	"go.uber.org/zap"
+)
+
+// Application error types returned by NotifyWebhookActivity. Their details
+// hold the deliveries attempted so far.
+const (
+	// ErrTypeWebhookDelivery is returned when a webhook could not be
+	// delivered and is retried.
+	ErrTypeWebhookDelivery = "WebhookDelivery"
+	// ErrTypeWebhookRejected is returned when the receiver rejects a
+	// webhook in a way that retrying won't fix.
+	ErrTypeWebhookRejected = "WebhookRejected"
+	// ErrTypeUnknownWebhookClient is returned when no secret is configured
+	// for the client a webhook is for.
+	ErrTypeUnknownWebhookClient = "UnknownWebhookClient"
+)
+
+// Webhook events.
+const (
+	WebhookEventCompleted = "image.completed"
+	WebhookEventFailed    = "image.failed"
+	WebhookEventCancelled = "image.cancelled"
+)
+
+// Webhook headers.
+const (
+	WebhookTimestampHeader = "X-Webhook-Timestamp"
+	WebhookSignatureHeader = "X-Webhook-Signature"
+	WebhookIDHeader        = "X-Webhook-Id"
+)
+
+// Webhook is a callback registered with an upload.
+type Webhook struct {
+	URL string `json:"url"`
+	// ClientID selects the secret the webhook is signed with.
+	ClientID string `json:"clientId,omitempty"`
+}
+
+// WebhookPayload is the JSON body of a webhook.
+type WebhookPayload struct {
+	Event         string              `json:"event"`
+	ImageID       string              `json:"imageId"`
+	WorkflowID    string              `json:"workflowId"`
+	RunID         string              `json:"runId"`
+	State         string              `json:"state,omitempty"`
+	Status        string              `json:"status"`
+	Error         string              `json:"error,omitempty"`
+	ErrorType     string              `json:"errorType,omitempty"`
+	Output        *PublishImageResult `json:"output,omitempty"`
+	Renditions    []RenditionResult   `json:"renditions,omitempty"`
+	DownloadURL   string              `json:"downloadUrl,omitempty"`
+	RenditionURLs map[string]string   `json:"renditionUrls,omitempty"`
+}
+
+// NotifyWebhookInput is the input to NotifyWebhookActivity.
+type NotifyWebhookInput struct {
+	Webhook Webhook
+	Payload WebhookPayload
+}
+
+// WebhookDelivery records one attempt to deliver a webhook.
+type WebhookDelivery struct {
+	Attempt    int32
+	Time       time.Time
+	StatusCode int    `json:",omitempty"`
+	Error      string `json:",omitempty"`
+}
+
+// NotifyWebhookActivity is a Temporal activity that POSTs a signed payload
+// to a webhook. Each attempt is recorded in the heartbeat details so the
+// full delivery history is returned however many retries it takes.
+func (a *Activities) NotifyWebhookActivity(ctx context.Context, input NotifyWebhookInput) ([]WebhookDelivery, error) {
+	info := activity.GetInfo(ctx)
+	a.logger.Info("notifying webhook",
+		zap.String("imageID", input.Payload.ImageID),
+		zap.String("event", input.Payload.Event),
+		zap.Int32("attempt", info.Attempt),
+	)
+
+	// pick up the deliveries made by earlier attempts
+	var deliveries []WebhookDelivery
+	if activity.HasHeartbeatDetails(ctx) {
+		if err := activity.GetHeartbeatDetails(ctx, &deliveries); err != nil {
+			a.logger.Warn("failed to decode webhook deliveries", zap.Error(err))
+		}
+	}
+	return a.notifyWebhook(ctx, input, info.WorkflowExecution.ID, info.Attempt, deliveries)
+}
+
+// notifyWebhook makes one attempt to deliver a webhook, sent with id as its
+// webhook id, following the deliveries made so far.
+func (a *Activities) notifyWebhook(ctx context.Context, input NotifyWebhookInput, id string, attempt int32, deliveries []WebhookDelivery) ([]WebhookDelivery, error) {
+	secret, ok := a.config.WebhookSecrets[input.Webhook.ClientID]
+	if !ok {
+		return nil, temporal.NewNonRetryableApplicationError(
+			fmt.Sprintf("no webhook secret for client %q", input.Webhook.ClientID),
+			ErrTypeUnknownWebhookClient, nil, deliveries)
+	}
+
+	// link to the downloads of a processed image
+	payload := input.Payload
+	if payload.Event == WebhookEventCompleted && a.config.PublicURL != "" {
+		payload.DownloadURL = a.downloadURL(payload.ImageID, "")
+		for _, r := range payload.Renditions {
+			if payload.RenditionURLs == nil {
+				payload.RenditionURLs = map[string]string{}
+			}
+			payload.RenditionURLs[r.Name] = a.downloadURL(payload.ImageID, r.Name)
+		}
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return nil, temporal.NewNonRetryableApplicationError(err.Error(), ErrTypeWebhookRejected, err, deliveries)
+	}
+
+	delivery := WebhookDelivery{Attempt: attempt, Time: time.Now().UTC()}
+	delivery.StatusCode, err = a.postWebhook(ctx, input.Webhook.URL, id, secret, body)
+	if err != nil {
+		delivery.Error = err.Error()
+	}
+	deliveries = append(deliveries, delivery)
+	heartbeat(ctx, deliveries)
+
+	switch {
+	case errors.Is(err, errWebhookDestination):
+		return nil, temporal.NewNonRetryableApplicationError(err.Error(), ErrTypeWebhookRejected, err, deliveries)
+	case err != nil:
+		return nil, temporal.NewApplicationError(err.Error(), ErrTypeWebhookDelivery, deliveries)
+	case delivery.StatusCode >= 200 && delivery.StatusCode < 300:
+		a.logger.Info("webhook delivered",
+			zap.String("imageID", payload.ImageID),
+			zap.Int("statusCode", delivery.StatusCode),
+		)
+		return deliveries, nil
+	case delivery.StatusCode >= 400 && delivery.StatusCode < 500 &&
+		delivery.StatusCode != http.StatusRequestTimeout && delivery.StatusCode != http.StatusTooManyRequests:
+		return nil, temporal.NewNonRetryableApplicationError(
+			fmt.Sprintf("webhook rejected with status %d", delivery.StatusCode),
+			ErrTypeWebhookRejected, nil, deliveries)
+	default:
+		return nil, temporal.NewApplicationError(
+			fmt.Sprintf("webhook failed with status %d", delivery.StatusCode),
+			ErrTypeWebhookDelivery, deliveries)
+	}
+}
+
+// postWebhook sends a signed webhook body, returning the response status.
+// The signature is an HMAC-SHA256 of the timestamp and body so receivers
+// can reject replays of old deliveries.
+func (a *Activities) postWebhook(ctx context.Context, url, id, secret string, body []byte) (int, error) {
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WebhookIDHeader, id)
+	req.Header.Set(WebhookTimestampHeader, timestamp)
+	req.Header.Set(WebhookSignatureHeader, "sha256="+WebhookSignature(secret, timestamp, body))
+
+	resp, err := a.httpClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	return resp.StatusCode, nil
+}
+
+// WebhookSignature returns the hex encoded signature of a webhook body sent
+// at timestamp, which receivers compare with the signature header.
+func WebhookSignature(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// downloadURL returns the link to download an image, or one of its
+// renditions, signed when download signing keys are configured. Links are
+// signed afresh on each attempt so retried deliveries don't carry expired
+// links.
+func (a *Activities) downloadURL(imageID, rendition string) string {
+	u := a.config.PublicURL + "/download/" + imageID
+	if rendition != "" {
+		u += "/" + rendition
+	}
+	if !a.signer.Enabled() {
+		return u
+	}
+	u, _ = a.signer.Sign(u, signedurl.Target{ImageID: imageID, Rendition: rendition}, time.Now())
+	return u
+}
+
+// errWebhookDestination is returned when a webhook would be sent to an
+// address webhooks may not be sent to.
+var errWebhookDestination = errors.New("webhook destination not allowed")
+
+// reservedNetworks are public looking networks that are not reachable on
+// the internet and so are refused as webhook destinations too.
+var reservedNetworks = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+	netip.MustParsePrefix("240.0.0.0/4"),
+}
+
+// newWebhookClient returns the client webhooks are sent with. It only
+// connects to public addresses, or those in the allowed networks, so
+// uploads can't use webhooks to reach the worker's own network, such as
+// the Temporal frontend or a cloud metadata service. Addresses are checked
+// once names are resolved, on every connection including redirects.
+func newWebhookClient(config *Config) *http.Client {
+	dialer := &net.Dialer{
+		Timeout: 30 * time.Second,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			addrPort, err := netip.ParseAddrPort(address)
+			if err != nil {
+				return err
+			}
+			if !webhookAddrAllowed(addrPort.Addr(), config.WebhookAllowedNetworks) {
+				return fmt.Errorf("%w: %s", errWebhookDestination, addrPort.Addr())
+			}
+			return nil
+		},
+	}
+	return &http.Client{
+		Timeout: config.WebhookTimeout,
+		// no proxy, it would be the address checked
+		Transport: &http.Transport{
+			DialContext:         dialer.DialContext,
+			ForceAttemptHTTP2:   true,
+			MaxIdleConns:        100,
+			IdleConnTimeout:     90 * time.Second,
+			TLSHandshakeTimeout: 10 * time.Second,
+		},
+	}
+}
+
+// webhookAddrAllowed reports whether webhooks may be sent to addr.
+func webhookAddrAllowed(addr netip.Addr, allowed []netip.Prefix) bool {
+	addr = addr.Unmap()
+	for _, p := range allowed {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	if !addr.IsGlobalUnicast() || addr.IsPrivate() {
+		return false
+	}
+	for _, p := range reservedNetworks {
+		if p.Contains(addr) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,301 @@
+package activities
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/joberly/demo-temporal/internal/signedurl"
+
+	"go.temporal.io/sdk/temporal"
+	"go.uber.org/zap"
+)
+
+func TestWebhookAddrAllowed(t *testing.T) {
+	allowed := []netip.Prefix{netip.MustParsePrefix("10.1.0.0/16")}
+	tests := []struct {
+		addr string
+		want bool
+	}{
+		{"93.184.216.34", true},
+		{"2606:2800:220:1:248:1893:25c8:1946", true},
+		{"127.0.0.1", false},
+		{"::1", false},
+		{"::ffff:127.0.0.1", false},
+		{"169.254.169.254", false},
+		{"fe80::1", false},
+		{"10.0.0.5", false},
+		{"10.1.2.3", true},
+		{"172.16.0.1", false},
+		{"192.168.1.1", false},
+		{"fd00::1", false},
+		{"100.64.0.1", false},
+		{"0.0.0.0", false},
+		{"224.0.0.1", false},
+	}
+	for _, tt := range tests {
+		if got := webhookAddrAllowed(netip.MustParseAddr(tt.addr), allowed); got != tt.want {
+			t.Errorf("webhookAddrAllowed(%s) = %v, want %v", tt.addr, got, tt.want)
+		}
+	}
+}
+
+func TestWebhookClientRefusesLoopback(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	client := newWebhookClient(&Config{WebhookTimeout: 5 * time.Second})
+	req, _ := http.NewRequestWithContext(context.Background(), http.MethodPost, server.URL, nil)
+	if _, err := client.Do(req); !errors.Is(err, errWebhookDestination) {
+		t.Errorf("Do = %v, want errWebhookDestination", err)
+	}
+
+	client = newWebhookClient(&Config{
+		WebhookTimeout:         5 * time.Second,
+		WebhookAllowedNetworks: []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")},
+	})
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("Do with loopback allowed = %v", err)
+	}
+	resp.Body.Close()
+}
+
+// webhookReceiver is a webhook endpoint answering with a set status and
+// keeping the last request it received.
+type webhookReceiver struct {
+	server *httptest.Server
+
+	mu     sync.Mutex
+	status int
+	header http.Header
+	body   []byte
+}
+
+func newWebhookReceiver(t *testing.T) *webhookReceiver {
+	r := &webhookReceiver{status: http.StatusOK}
+	r.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		r.header, r.body = req.Header, body
+		if req.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		w.WriteHeader(r.status)
+	}))
+	t.Cleanup(r.server.Close)
+	return r
+}
+
+func (r *webhookReceiver) respondWith(status int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.status = status
+}
+
+func (r *webhookReceiver) last() (http.Header, []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.header, r.body
+}
+
+// newWebhookActivities returns Activities sending webhooks to loopback
+// receivers, signed with the secret of tenant acme.
+func newWebhookActivities() *Activities {
+	config := &Config{
+		PublicURL:              "https://images.example.com",
+		WebhookSecrets:         map[string]string{"acme": "acme-secret"},
+		WebhookTimeout:         5 * time.Second,
+		WebhookAllowedNetworks: []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")},
+		DownloadURLs: signedurl.Config{
+			Keys:   []signedurl.Key{{ID: "k1", Secret: "download-secret"}},
+			Expiry: time.Hour,
+		},
+	}
+	return New(&ActivitiesParams{Logger: zap.NewNop(), Config: config})
+}
+
+func TestNotifyWebhookSigned(t *testing.T) {
+	receiver := newWebhookReceiver(t)
+	a := newWebhookActivities()
+	input := NotifyWebhookInput{
+		Webhook: Webhook{URL: receiver.server.URL + "/hooks", ClientID: "acme"},
+		Payload: WebhookPayload{
+			Event:      WebhookEventCompleted,
+			ImageID:    "img-1",
+			WorkflowID: "wf-1",
+			RunID:      "run-1",
+			Status:     "completed",
+			Output:     &PublishImageResult{Format: "jpeg", ContentType: "image/jpeg", Width: 640, Height: 480},
+			Renditions: []RenditionResult{{Name: "thumb", Width: 64, Height: 48}, {Name: "large", Width: 1280, Height: 960}},
+		},
+	}
+
+	deliveries, err := a.notifyWebhook(context.Background(), input, "wf-1", 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deliveries) != 1 || deliveries[0].Attempt != 1 || deliveries[0].StatusCode != http.StatusOK {
+		t.Errorf("deliveries = %+v, want one delivered attempt", deliveries)
+	}
+
+	header, body := receiver.last()
+	if got := header.Get("Content-Type"); got != "application/json" {
+		t.Errorf("Content-Type = %q", got)
+	}
+	if got := header.Get(WebhookIDHeader); got != "wf-1" {
+		t.Errorf("%s = %q, want the workflow id", WebhookIDHeader, got)
+	}
+	timestamp := header.Get(WebhookTimestampHeader)
+	sent, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil || time.Since(time.Unix(sent, 0)).Abs() > time.Minute {
+		t.Errorf("%s = %q, want the time it was sent", WebhookTimestampHeader, timestamp)
+	}
+	if got, want := header.Get(WebhookSignatureHeader), "sha256="+WebhookSignature("acme-secret", timestamp, body); got != want {
+		t.Errorf("%s = %q, want %q", WebhookSignatureHeader, got, want)
+	}
+
+	var payload WebhookPayload
+	if err := json.Unmarshal(body, &payload); err != nil {
+		t.Fatal(err)
+	}
+	if payload.Event != WebhookEventCompleted || payload.ImageID != "img-1" || payload.WorkflowID != "wf-1" ||
+		payload.RunID != "run-1" || payload.Output == nil || payload.Output.Width != 640 || len(payload.Renditions) != 2 {
+		t.Errorf("payload = %+v", payload)
+	}
+
+	// download links are signed for the image and each rendition
+	checkLink := func(link, rendition string) {
+		t.Helper()
+		path := "/download/img-1"
+		if rendition != "" {
+			path += "/" + rendition
+		}
+		u, err := url.Parse(link)
+		if err != nil || !strings.HasPrefix(link, "https://images.example.com"+path+"?") {
+			t.Errorf("link = %q, want %s", link, path)
+			return
+		}
+		target := signedurl.Target{ImageID: "img-1", Rendition: rendition}
+		if err := a.signer.Verify(target, u.Query(), time.Now()); err != nil {
+			t.Errorf("link %q doesn't verify: %v", link, err)
+		}
+	}
+	checkLink(payload.DownloadURL, "")
+	if len(payload.RenditionURLs) != 2 {
+		t.Errorf("renditionUrls = %v, want thumb and large", payload.RenditionURLs)
+	}
+	for _, name := range []string{"thumb", "large"} {
+		checkLink(payload.RenditionURLs[name], name)
+	}
+
+	// failed images have nothing to download
+	input.Payload = WebhookPayload{Event: WebhookEventFailed, ImageID: "img-1", Status: "failed", Error: "bad image"}
+	if _, err := a.notifyWebhook(context.Background(), input, "wf-1", 1, nil); err != nil {
+		t.Fatal(err)
+	}
+	_, body = receiver.last()
+	payload = WebhookPayload{}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		t.Fatal(err)
+	}
+	if payload.Event != WebhookEventFailed || payload.Error != "bad image" || payload.DownloadURL != "" || payload.RenditionURLs != nil {
+		t.Errorf("failed payload = %+v", payload)
+	}
+}
+
+func TestNotifyWebhookRetries(t *testing.T) {
+	receiver := newWebhookReceiver(t)
+	a := newWebhookActivities()
+	input := NotifyWebhookInput{
+		Webhook: Webhook{URL: receiver.server.URL, ClientID: "acme"},
+		Payload: WebhookPayload{Event: WebhookEventCompleted, ImageID: "img-1", Status: "completed"},
+	}
+	earlier := []WebhookDelivery{{Attempt: 1, StatusCode: http.StatusServiceUnavailable}}
+
+	tests := []struct {
+		status int
+		// errType is empty when the webhook is delivered
+		errType   string
+		retryable bool
+	}{
+		{http.StatusOK, "", false},
+		{http.StatusAccepted, "", false},
+		{http.StatusNoContent, "", false},
+		{http.StatusBadRequest, ErrTypeWebhookRejected, false},
+		{http.StatusUnauthorized, ErrTypeWebhookRejected, false},
+		{http.StatusNotFound, ErrTypeWebhookRejected, false},
+		{http.StatusGone, ErrTypeWebhookRejected, false},
+		{http.StatusRequestTimeout, ErrTypeWebhookDelivery, true},
+		{http.StatusTooManyRequests, ErrTypeWebhookDelivery, true},
+		{http.StatusInternalServerError, ErrTypeWebhookDelivery, true},
+		{http.StatusBadGateway, ErrTypeWebhookDelivery, true},
+		{http.StatusServiceUnavailable, ErrTypeWebhookDelivery, true},
+	}
+	for _, tt := range tests {
+		receiver.respondWith(tt.status)
+		deliveries, err := a.notifyWebhook(context.Background(), input, "wf-1", 2, earlier)
+		if tt.errType == "" {
+			if err != nil || len(deliveries) != 2 || deliveries[1].StatusCode != tt.status {
+				t.Errorf("status %d: notifyWebhook = %+v, %v, want delivered", tt.status, deliveries, err)
+			}
+			continue
+		}
+		history := checkWebhookError(t, err, tt.errType, tt.retryable)
+		if len(history) != 2 || history[0] != earlier[0] || history[1].Attempt != 2 || history[1].StatusCode != tt.status {
+			t.Errorf("status %d: deliveries = %+v, want the earlier attempt and this one", tt.status, history)
+		}
+	}
+
+	t.Run("unreachable", func(t *testing.T) {
+		closed := newWebhookReceiver(t)
+		closed.server.Close()
+		input := input
+		input.Webhook.URL = closed.server.URL
+		_, err := a.notifyWebhook(context.Background(), input, "wf-1", 1, nil)
+		history := checkWebhookError(t, err, ErrTypeWebhookDelivery, true)
+		if len(history) != 1 || history[0].Error == "" || history[0].StatusCode != 0 {
+			t.Errorf("deliveries = %+v, want the connection error", history)
+		}
+	})
+
+	t.Run("unknown client", func(t *testing.T) {
+		input := input
+		input.Webhook.ClientID = "globex"
+		_, err := a.notifyWebhook(context.Background(), input, "wf-1", 1, nil)
+		checkWebhookError(t, err, ErrTypeUnknownWebhookClient, false)
+	})
+}
+
+// checkWebhookError checks err is an application error of errType,
+// returning the deliveries in its details.
+func checkWebhookError(t *testing.T, err error, errType string, retryable bool) []WebhookDelivery {
+	t.Helper()
+	var appErr *temporal.ApplicationError
+	if !errors.As(err, &appErr) {
+		t.Fatalf("err = %v, want an application error", err)
+	}
+	if appErr.Type() != errType || appErr.NonRetryable() == retryable {
+		t.Errorf("err = %s %v retryable %v, want %s retryable %v",
+			appErr.Type(), err, !appErr.NonRetryable(), errType, retryable)
+	}
+	var deliveries []WebhookDelivery
+	if appErr.HasDetails() {
+		if err := appErr.Details(&deliveries); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return deliveries
+}
@@ -15,6 +15,10 @@ func main() {
 			NewRouter,
 			api.NewConfig,
 			api.NewTemporalClient,
+			api.NewStores,
+			api.NewJobStore,
+			api.NewAuthenticator,
+			api.NewRateLimiter,
 			api.New,
 		),
 		fx.Invoke(func(a *api.Api) {
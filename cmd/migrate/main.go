@@ -0,0 +1,112 @@
+// Command migrate manages the schema of the job database.
+//
+//	migrate up          apply every pending migration
+//	migrate down        revert the newest applied migration
+//	migrate to VERSION  apply or revert migrations until at VERSION
+//	migrate status      list migrations and when they were applied
+//
+// The database is configured with the same DEMO_POSTGRES_* variables as
+// the api and worker.
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"strconv"
+	"time"
+
+	"github.com/joberly/demo-temporal/internal/jobs"
+	"github.com/joberly/demo-temporal/internal/migrate"
+
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+)
+
+const usage = `usage: migrate up | down | to VERSION | status`
+
+func main() {
+	if err := run(os.Args[1:]); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func run(args []string) error {
+	if len(args) == 0 {
+		return errors.New(usage)
+	}
+
+	logger, err := zap.NewDevelopment()
+	if err != nil {
+		return err
+	}
+	defer logger.Sync()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	db, err := jobs.OpenPostgres(ctx, newConfig())
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	migrator, err := migrate.New(db, logger)
+	if err != nil {
+		return err
+	}
+
+	switch args[0] {
+	case "up":
+		return migrator.Up(ctx)
+	case "down":
+		return migrator.Down(ctx)
+	case "to":
+		if len(args) != 2 {
+			return errors.New(usage)
+		}
+		version, err := strconv.Atoi(args[1])
+		if err != nil {
+			return fmt.Errorf("invalid version %q", args[1])
+		}
+		return migrator.To(ctx, version)
+	case "status":
+		statuses, err := migrator.Status(ctx)
+		if err != nil {
+			return err
+		}
+		for _, status := range statuses {
+			applied := "pending"
+			if status.AppliedAt != nil {
+				applied = "applied " + status.AppliedAt.Format(time.RFC3339)
+			}
+			fmt.Printf("%04d %-30s %s\n", status.Version, status.Name, applied)
+		}
+		return nil
+	default:
+		return errors.New(usage)
+	}
+}
+
+// newConfig reads the database settings from the environment.
+func newConfig() *jobs.PostgresConfig {
+	viper.AutomaticEnv()
+	viper.SetEnvPrefix("demo")
+	viper.SetDefault("POSTGRES_HOST", "localhost")
+	viper.SetDefault("POSTGRES_PORT", "5432")
+	viper.SetDefault("POSTGRES_USER", "postgres")
+	viper.SetDefault("POSTGRES_DB", "postgres")
+	viper.SetDefault("POSTGRES_SSLMODE", "disable")
+
+	return &jobs.PostgresConfig{
+		Host:     viper.GetString("POSTGRES_HOST"),
+		Port:     viper.GetString("POSTGRES_PORT"),
+		User:     viper.GetString("POSTGRES_USER"),
+		Password: viper.GetString("POSTGRES_PASSWORD"),
+		Database: viper.GetString("POSTGRES_DB"),
+		SSLMode:  viper.GetString("POSTGRES_SSLMODE"),
+	}
+}
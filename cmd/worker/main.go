@@ -12,6 +12,8 @@ func main() {
 			NewLogger,
 			worker.NewConfig,
 			worker.NewTemporalClient,
+			worker.NewStores,
+			worker.NewJobStore,
 			worker.New,
 		),
 		fx.Invoke(func(w *worker.Worker) {
@@ -1,18 +1,36 @@
 package api
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
 	"net/http"
-	"os"
-	"path/filepath"
+	"net/url"
+	"path"
 	"regexp"
+	"strings"
 
+	"github.com/joberly/demo-temporal/activities"
+	"github.com/joberly/demo-temporal/internal/auth"
+	"github.com/joberly/demo-temporal/internal/imagetype"
+	"github.com/joberly/demo-temporal/internal/jobs"
+	"github.com/joberly/demo-temporal/internal/pipeline"
+	"github.com/joberly/demo-temporal/internal/ratelimit"
+	"github.com/joberly/demo-temporal/internal/retention"
+	"github.com/joberly/demo-temporal/internal/signedurl"
+	"github.com/joberly/demo-temporal/internal/storage"
+	"github.com/joberly/demo-temporal/internal/tenant"
 	"github.com/joberly/demo-temporal/workflows"
 
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	enumspb "go.temporal.io/api/enums/v1"
 	"go.temporal.io/api/serviceerror"
+	"go.temporal.io/api/workflowservice/v1"
 	"go.temporal.io/sdk/client"
+	"go.temporal.io/sdk/temporal"
 	"go.uber.org/fx"
 	"go.uber.org/zap"
 )
@@ -20,53 +38,181 @@ import (
 // ApiParams holds the dependencies for the API.
 type ApiParams struct {
 	fx.In
-	Router *gin.Engine
-	Logger *zap.Logger
-	Config *Config
-	Client client.Client
+	Router  *gin.Engine
+	Logger  *zap.Logger
+	Config  *Config
+	Client  client.Client
+	Stores  *storage.Stores
+	Jobs    jobs.Store
+	Auth    *auth.Authenticator
+	Limiter ratelimit.Limiter
 }
 
 // Api is the API server.
 type Api struct {
-	router *gin.Engine
-	logger *zap.Logger
-	config *Config
-	client client.Client
+	router  *gin.Engine
+	logger  *zap.Logger
+	config  *Config
+	client  client.Client
+	stores  *storage.Stores
+	jobs    jobs.Store
+	auth    *auth.Authenticator
+	signer  *signedurl.Signer
+	limiter ratelimit.Limiter
 }
 
 func New(params ApiParams) (*Api, error) {
+	// refuse to serve against a database the migrations haven't caught up
+	// with rather than fail on each request
+	if checker, ok := params.Jobs.(jobs.SchemaChecker); ok {
+		if err := checker.CheckSchema(context.Background()); err != nil {
+			params.Logger.Error("job store schema check failed, run the migrate command", zap.Error(err))
+			return nil, err
+		}
+	}
+
 	return &Api{
-		router: params.Router,
-		logger: params.Logger,
-		config: params.Config,
-		client: params.Client,
+		router:  params.Router,
+		logger:  params.Logger,
+		config:  params.Config,
+		client:  params.Client,
+		stores:  params.Stores,
+		jobs:    params.Jobs,
+		auth:    params.Auth,
+		signer:  signedurl.New(&params.Config.DownloadURLs),
+		limiter: params.Limiter,
 	}, nil
 }
 
 func (a *Api) Run() {
-	a.router.POST("/upload", a.uploadHandler)
-	a.router.GET("/status/:workflowId/run/:runId", a.statusHandler)
-	a.router.GET("/download/:imageId", a.downloadHandler)
+	// each class of route is rate limited separately
+	uploads := a.rateLimit(ratelimit.ClassUpload)
+	statuses := a.rateLimit(ratelimit.ClassStatus)
+	downloads := a.rateLimit(ratelimit.ClassDownload)
+	others := a.rateLimit(ratelimit.ClassDefault)
+
+	// signed upload urls and storage events carry their own credentials
+	a.router.PUT("/uploads/:imageId", uploads, a.putUploadHandler)
+	a.router.POST("/storage/events", a.storageEventsHandler)
+
+	authed := a.router.Group("/", a.authenticate)
+	authed.POST("/upload", uploads, a.uploadHandler)
+	authed.POST("/uploads", uploads, a.createUploadHandler)
+	authed.POST("/uploads/:imageId/complete", uploads, a.completeUploadHandler)
+	resumable := authed.Group("/resumable", tusResumable)
+	resumable.POST("", uploads, a.createResumableHandler)
+	resumable.HEAD("/:imageId", statuses, a.headResumableHandler)
+	resumable.PATCH("/:imageId", others, a.patchResumableHandler)
+	resumable.DELETE("/:imageId", others, a.deleteResumableHandler)
+	resumable.POST("/:imageId/complete", uploads, a.completeResumableHandler)
+	authed.POST("/batches", uploads, a.createBatchHandler)
+	authed.GET("/batches/:batchId", statuses, a.batchHandler)
+	authed.GET("/batches/:batchId/download", downloads, a.batchDownloadHandler)
+	authed.DELETE("/batches/:batchId", others, a.cancelBatchHandler)
+	authed.GET("/status/:workflowId/run/:runId", statuses, a.statusHandler)
+	authed.GET("/status/:workflowId/stream", statuses, a.statusStreamHandler)
+	authed.GET("/status/:workflowId/ws", statuses, a.statusSocketHandler)
+	authed.GET("/images", statuses, a.listImagesHandler)
+	authed.GET("/images/:imageId", statuses, a.imageHandler)
+	authed.DELETE("/jobs/:workflowId", others, a.cancelJobHandler)
+	authed.POST("/jobs/:workflowId/cancel", others, a.cancelJobHandler)
+
+	// downloads take either a signed url or credentials
+	a.router.GET("/download/:imageId", a.authenticateDownload, downloads, a.downloadHandler)
+	a.router.GET("/download/:imageId/:rendition", a.authenticateDownload, downloads, a.downloadHandler)
+	a.router.OPTIONS("/resumable", tusResumable, a.resumableOptionsHandler)
 	a.router.GET("/health", a.healthHandler)
 	a.router.GET("/metrics", gin.WrapH(promhttp.Handler()))
 
+	if a.config.ResumableSweepInterval > 0 {
+		go a.sweepResumableUploads(a.config.ResumableSweepInterval)
+	}
+
 	if err := a.router.Run(":8080"); err != nil {
 		a.logger.Error("failed to start server", zap.Error(err))
 	}
 }
 
 func (a *Api) uploadHandler(c *gin.Context) {
+	// refuse oversized uploads before reading them and stop reading those
+	// that turn out larger than they claimed
+	maxBytes := a.config.MaxUploadBytes
+	if !limitBody(c, maxBytes, multipartOverhead) {
+		return
+	}
+	if err := c.Request.ParseMultipartForm(multipartMemory); err != nil {
+		if isTooLarge(err) {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "upload too large", "limit": maxBytes})
+			return
+		}
+		a.logger.Error("failed to parse form", zap.Error(err))
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid multipart form"})
+		return
+	}
 	file, err := c.FormFile("file")
 	if err != nil {
 		a.logger.Error("failed to parse form", zap.Error(err))
 		c.JSON(http.StatusBadRequest, gin.H{"error": "file is required"})
 		return
 	}
+	if maxBytes > 0 && file.Size > maxBytes {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "upload too large", "limit": maxBytes})
+		return
+	}
+
+	steps, err := parsePipeline(c.PostForm("pipeline"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid pipeline: " + err.Error()})
+		return
+	}
+	renditions, err := parseRenditions(c.PostForm("renditions"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid renditions: " + err.Error()})
+		return
+	}
+
+	webhook, err := parseWebhook(c.PostForm("webhookUrl"), principal(c).Tenant)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid webhook: " + err.Error()})
+		return
+	}
+
+	src, err := file.Open()
+	if err != nil {
+		a.logger.Error("failed to open uploaded file", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to save file"})
+		return
+	}
+	defer src.Close()
+
+	// only images go on to the worker, recorded as the type they really are
+	format, ok := sniffImage(c, src, file.Header.Get("Content-Type"))
+	if !ok {
+		return
+	}
+	if _, err := src.Seek(0, io.SeekStart); err != nil {
+		a.logger.Error("failed to rewind uploaded file", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to save file"})
+		return
+	}
+	contentType := imagetype.ContentType(format)
+
+	// hold the tenant to its quota before taking the upload
+	p := principal(c)
+	if err := a.checkQuota(c.Request.Context(), p.Tenant, file.Size); err != nil {
+		if !respondQuota(c, p.Tenant, err) {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to check quota"})
+		}
+		return
+	}
 
 	uuid := uuid.New().String()
-	uploadFilePath := filepath.Join(a.config.UploadDir, uuid)
 
-	if err := c.SaveUploadedFile(file, uploadFilePath); err != nil {
+	err = a.stores.Upload.Put(c.Request.Context(), tenant.Key(p.Tenant, uuid), src, &storage.PutOptions{
+		ContentType: contentType,
+		Size:        file.Size,
+	})
+	if err != nil {
 		a.logger.Error("failed to save file", zap.Error(err))
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to save file"})
 		return
@@ -74,21 +220,41 @@ func (a *Api) uploadHandler(c *gin.Context) {
 
 	a.logger.Info("recieved file",
 		zap.String("uuid", uuid),
-		zap.String("path", uploadFilePath),
+		zap.String("tenant", p.Tenant),
+		zap.Int64("size", file.Size),
 	)
 
-	// start ImageProcessingWorkflow
-	wfOpts := client.StartWorkflowOptions{
-		ID:        uuid,
-		TaskQueue: a.config.TaskQueue,
+	err = a.recordUpload(c.Request.Context(), &jobs.Record{
+		ImageID:     uuid,
+		Owner:       a.owner(c, c.PostForm("owner")),
+		Tenant:      p.Tenant,
+		Filename:    sanitizeFilename(file.Filename),
+		ContentType: contentType,
+		Size:        file.Size,
+		Pipeline:    steps,
+		Renditions:  renditions,
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to start process"})
+		return
 	}
-	wfRun, err := a.client.ExecuteWorkflow(c.Request.Context(),
-		wfOpts, workflows.ImageProcessingWorkflow, uuid)
+
+	// start ImageProcessingWorkflow
+	wfRun, err := a.startImageProcessing(c.Request.Context(),
+		workflows.ImageProcessingWorkflowInput{
+			ImageID:     uuid,
+			Tenant:      p.Tenant,
+			ContentType: contentType,
+			Pipeline:    steps,
+			Renditions:  renditions,
+			Webhook:     webhook,
+		})
 	if err != nil {
-		a.logger.Error("failed to start workflow", zap.Error(err))
+		a.failJob(c.Request.Context(), uuid, err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to start process"})
 		return
 	}
+	a.recordRun(c.Request.Context(), wfRun)
 
 	// workflow started successfully
 	c.JSON(http.StatusAccepted,
@@ -101,13 +267,113 @@ func (a *Api) uploadHandler(c *gin.Context) {
 	)
 }
 
+// parsePipeline decodes and validates a JSON pipeline spec. An empty spec
+// selects the default pipeline.
+func parsePipeline(spec string) (pipeline.Pipeline, error) {
+	if strings.TrimSpace(spec) == "" {
+		return nil, nil
+	}
+
+	var steps pipeline.Pipeline
+	dec := json.NewDecoder(strings.NewReader(spec))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&steps); err != nil {
+		return nil, err
+	}
+	if err := steps.Validate(); err != nil {
+		return nil, err
+	}
+	return steps, nil
+}
+
+// parseRenditions decodes and validates a JSON list of renditions. An
+// empty spec selects the default renditions.
+func parseRenditions(spec string) ([]pipeline.Rendition, error) {
+	if strings.TrimSpace(spec) == "" {
+		return nil, nil
+	}
+
+	var renditions []pipeline.Rendition
+	dec := json.NewDecoder(strings.NewReader(spec))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&renditions); err != nil {
+		return nil, err
+	}
+	if err := pipeline.ValidateRenditions(renditions); err != nil {
+		return nil, err
+	}
+	return renditions, nil
+}
+
+// parseWebhook returns the webhook registered with an upload, if any. The
+// webhook is signed with the secret of the tenant of the caller, callers
+// can't pick another so they can't have webhooks signed as someone else.
+func parseWebhook(rawURL, tenant string) (*activities.Webhook, error) {
+	if rawURL == "" {
+		return nil, nil
+	}
+	webhook := &activities.Webhook{URL: rawURL, ClientID: tenant}
+	if err := validateWebhook(webhook); err != nil {
+		return nil, err
+	}
+	return webhook, nil
+}
+
+// validateWebhook checks a webhook has an absolute http or https URL.
+func validateWebhook(webhook *activities.Webhook) error {
+	u, err := url.Parse(webhook.URL)
+	if err != nil {
+		return err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.New("url must be an absolute http or https url")
+	}
+	return nil
+}
+
+// startImageProcessing starts the image processing workflow for an image.
+// Starting a workflow for an image that already has one returns the
+// existing run so that duplicate completions are harmless.
+func (a *Api) startImageProcessing(ctx context.Context, input workflows.ImageProcessingWorkflowInput) (client.WorkflowRun, error) {
+	wfOpts := client.StartWorkflowOptions{
+		ID:                    input.ImageID,
+		TaskQueue:             a.config.TaskQueue,
+		WorkflowIDReusePolicy: enumspb.WORKFLOW_ID_REUSE_POLICY_REJECT_DUPLICATE,
+		SearchAttributes:      a.searchAttributes(input.Tenant),
+	}
+	wfRun, err := a.client.ExecuteWorkflow(ctx, wfOpts, workflows.ImageProcessingWorkflow, input)
+	if temporal.IsWorkflowExecutionAlreadyStartedError(err) {
+		return a.client.GetWorkflow(ctx, input.ImageID, ""), nil
+	}
+	if err != nil {
+		a.logger.Error("failed to start workflow", zap.Error(err))
+		return nil, err
+	}
+	return wfRun, nil
+}
+
+// extensions maps the content types of processed images to file name
+// extensions.
+var extensions = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+	"image/gif":  ".gif",
+	"image/webp": ".webp",
+}
+
+// imageIDPattern matches the uuids used as image ids.
+var imageIDPattern = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+// isImageID checks an image id to be sure it's just a uuid.
+func isImageID(imageID string) bool {
+	return imageIDPattern.MatchString(imageID)
+}
+
 func (a *Api) downloadHandler(c *gin.Context) {
 	imageID := c.Param("imageId")
 
 	// check the image id to be sure it's just a uuid
-	regexPattern := `^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`
-	matched, _ := regexp.MatchString(regexPattern, imageID)
-	if !matched {
+	if !isImageID(imageID) {
 		a.logger.Error("invalid image id", zap.String("imageId", imageID))
 		c.JSON(http.StatusBadRequest, gin.H{
 			"imageId": imageID,
@@ -116,25 +382,79 @@ func (a *Api) downloadHandler(c *gin.Context) {
 		return
 	}
 
-	// check if the file exists
-	downloadFilePath := filepath.Join(a.config.ProcessedDir, imageID)
-	_, err := os.Stat(downloadFilePath)
-	if os.IsNotExist(err) {
+	if !c.GetBool(signedDownloadKey) && !a.authorizeImage(c, imageID) {
+		return
+	}
+
+	// images are stored under the prefix of their tenant
+	key, err := a.imageKey(c.Request.Context(), imageID)
+	if err != nil {
+		a.logger.Error("failed to get job record", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"imageId": imageID,
+			"error":   "failed to open file",
+		})
+		return
+	}
+
+	// select a rendition when one was asked for
+	if rendition := c.Param("rendition"); rendition != "" {
+		if !pipeline.IsRenditionName(rendition) {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"imageId":   imageID,
+				"rendition": rendition,
+				"error":     "invalid rendition",
+			})
+			return
+		}
+		key = pipeline.RenditionKey(key, rendition)
+	}
+
+	// open the processed image
+	reader, info, err := a.stores.Processed.Get(c.Request.Context(), key)
+	if errors.Is(err, storage.ErrNotExist) {
+		// tell images removed by the retention sweep from unknown ones
+		if _, serr := a.stores.Processed.Stat(c.Request.Context(), retention.TombstoneKey(key)); serr == nil {
+			a.logger.Info("file expired", zap.String("imageId", imageID))
+			c.JSON(http.StatusGone, gin.H{
+				"imageId": imageID,
+				"error":   "file expired",
+			})
+			return
+		}
 		a.logger.Error("file not found", zap.String("imageId", imageID))
 		c.JSON(http.StatusNotFound, gin.H{"error": "file not found"})
 		return
 	}
 	if err != nil {
-		a.logger.Error("failed to stat file", zap.Error(err))
+		a.logger.Error("failed to open file", zap.Error(err))
 		c.JSON(http.StatusInternalServerError, gin.H{
 			"imageId": imageID,
-			"error":   "failed to stat file",
+			"error":   "failed to open file",
 		})
 		return
 	}
+	defer reader.Close()
 
-	// serve the file
-	c.File(downloadFilePath)
+	// serve the file with a name matching its format
+	filename := path.Base(key)
+	if ext, ok := extensions[info.ContentType]; ok {
+		filename += ext
+	}
+	c.DataFromReader(http.StatusOK, info.Size, info.ContentType, reader,
+		map[string]string{
+			"Content-Disposition": `inline; filename="` + filename + `"`,
+		})
+}
+
+// errorStatuses maps the error types of workflows that failed because of
+// the request to the HTTP status reported for them.
+var errorStatuses = map[string]int{
+	activities.ErrTypeInvalidPipeline:     http.StatusBadRequest,
+	activities.ErrTypeUnsupportedFormat:   http.StatusUnsupportedMediaType,
+	activities.ErrTypeContentTypeMismatch: http.StatusUnsupportedMediaType,
+	activities.ErrTypeInvalidImage:        http.StatusUnprocessableEntity,
+	activities.ErrTypeImageTooLarge:       http.StatusRequestEntityTooLarge,
 }
 
 func (a *Api) statusHandler(c *gin.Context) {
@@ -145,8 +465,13 @@ func (a *Api) statusHandler(c *gin.Context) {
 		zap.String("workflowId", workflowID),
 		zap.String("runId", runID))
 
+	// workflow ids are image ids
+	if !a.authorizeImage(c, workflowID) {
+		return
+	}
+
 	// get Temporal workflow status
-	_, err := a.client.DescribeWorkflowExecution(c.Request.Context(),
+	desc, err := a.client.DescribeWorkflowExecution(c.Request.Context(),
 		workflowID, runID)
 	if err != nil {
 		switch err.(type) {
@@ -168,28 +493,79 @@ func (a *Api) statusHandler(c *gin.Context) {
 	}
 
 	// query workflow status
-	var status workflows.ImageProcessingWorkflowStatus
-	encVal, err := a.client.QueryWorkflow(c.Request.Context(), workflowID, runID, "status")
+	status, err := a.queryStatus(c.Request.Context(), workflowID, runID)
 	if err != nil {
-		a.logger.Error("failed to query workflow status", zap.Error(err))
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get detailed status"})
+		return
 	}
 
-	// decode status
-	err = encVal.Get(&status)
+	fillAttempts(status, desc)
+	body := statusBody(workflowID, runID, status)
+	a.addDownloadLinks(c, body, workflowID, status)
+	c.JSON(statusCode(status), body)
+}
+
+// fillAttempts fills in the attempts of running stages from the pending
+// activities of a workflow.
+func fillAttempts(status *workflows.ImageProcessingWorkflowStatus, desc *workflowservice.DescribeWorkflowExecutionResponse) {
+	for _, pending := range desc.GetPendingActivities() {
+		for i := range status.Stages {
+			stage := &status.Stages[i]
+			if stage.State == workflows.StageRunning && stage.Activity == pending.GetActivityType().GetName() {
+				stage.Attempts = pending.GetAttempt()
+			}
+		}
+	}
+}
+
+// statusCode returns the HTTP status reporting a workflow status. Failures
+// caused by the upload are reported as client errors.
+func statusCode(status *workflows.ImageProcessingWorkflowStatus) int {
+	if errorStatus, ok := errorStatuses[status.ErrorType]; ok {
+		return errorStatus
+	}
+	return http.StatusOK
+}
+
+// queryStatus queries the status of an image processing workflow.
+func (a *Api) queryStatus(ctx context.Context, workflowID, runID string) (*workflows.ImageProcessingWorkflowStatus, error) {
+	encVal, err := a.client.QueryWorkflow(ctx, workflowID, runID, "status")
 	if err != nil {
+		a.logger.Error("failed to query workflow status", zap.Error(err))
+		return nil, err
+	}
+
+	// decode status
+	var status workflows.ImageProcessingWorkflowStatus
+	if err := encVal.Get(&status); err != nil {
 		a.logger.Error("failed to decode status", zap.Error(err))
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to decode status"})
+		return nil, err
 	}
+	return &status, nil
+}
 
-	c.JSON(http.StatusOK,
-		gin.H{
-			"workflowId": workflowID,
-			"runId":      runID,
-			"status":     status.Status,
-			"error":      status.Error,
-		},
-	)
+// statusBody returns the response body reporting a workflow status.
+func statusBody(workflowID, runID string, status *workflows.ImageProcessingWorkflowStatus) gin.H {
+	return gin.H{
+		"workflowId": workflowID,
+		"runId":      runID,
+		"version":    status.Version,
+		"state":      status.CurrentState(),
+		"progress":   status.Progress,
+		"stages":     status.Stages,
+		"startedAt":  status.StartedAt,
+		"endedAt":    status.EndedAt,
+		"status":     status.Status,
+		"error":      status.Error,
+		"errorType":  status.ErrorType,
+		"errorCode":  status.ErrorCode,
+		"image":      status.Image,
+		"step":       status.Step,
+		"steps":      status.Steps,
+		"output":     status.Output,
+		"renditions": status.Renditions,
+		"webhook":    status.Webhook,
+	}
 }
 
 func (a *Api) healthHandler(c *gin.Context) {
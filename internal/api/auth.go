@@ -0,0 +1,73 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/joberly/demo-temporal/internal/auth"
+	"github.com/joberly/demo-temporal/internal/jobs"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+// authenticate is middleware attaching the principal making a request to
+// its context, rejecting requests without valid credentials.
+func (a *Api) authenticate(c *gin.Context) {
+	p, err := a.auth.Authenticate(c.Request)
+	if errors.Is(err, auth.ErrNoCredentials) || errors.Is(err, auth.ErrInvalidCredentials) {
+		c.Header("WWW-Authenticate", `Bearer realm="demo-temporal"`)
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+		return
+	}
+	if err != nil {
+		a.logger.Error("failed to authenticate request", zap.Error(err))
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "failed to authenticate"})
+		return
+	}
+	c.Request = c.Request.WithContext(auth.NewContext(c.Request.Context(), p))
+	c.Next()
+}
+
+// principal returns the principal attached by authenticate.
+func principal(c *gin.Context) *auth.Principal {
+	p, ok := auth.FromContext(c.Request.Context())
+	if !ok {
+		// routes without authenticate act for nobody
+		return &auth.Principal{}
+	}
+	return p
+}
+
+// owner returns the owner of images uploaded by the request. Without
+// authentication the owner asked for is used as it is.
+func (a *Api) owner(c *gin.Context, requested string) string {
+	if !a.auth.Enabled() {
+		return requested
+	}
+	return principal(c).Subject
+}
+
+// authorizeImage checks the caller owns imageID and belongs to its tenant,
+// responding with not found when it doesn't so that the images of others
+// can't be discovered.
+func (a *Api) authorizeImage(c *gin.Context, imageID string) bool {
+	p := principal(c)
+	if p.Admin {
+		return true
+	}
+
+	record, err := a.jobs.Get(c.Request.Context(), imageID)
+	if err != nil && !errors.Is(err, jobs.ErrNotFound) {
+		a.logger.Error("failed to get job record", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get job record"})
+		return false
+	}
+	if err != nil || !p.Owns(record.Owner) || record.Tenant != p.Tenant {
+		a.logger.Info("image not owned by caller",
+			zap.String("imageId", imageID), zap.String("subject", p.Subject))
+		c.JSON(http.StatusNotFound, gin.H{"imageId": imageID, "error": "not found"})
+		return false
+	}
+	return true
+}
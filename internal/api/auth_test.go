@@ -0,0 +1,95 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/joberly/demo-temporal/internal/auth"
+	"github.com/joberly/demo-temporal/internal/jobs"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+func init() {
+	gin.SetMode(gin.TestMode)
+}
+
+// failingJobs is a job store whose reads fail.
+type failingJobs struct {
+	jobs.Store
+}
+
+func (failingJobs) Get(ctx context.Context, imageID string) (*jobs.Record, error) {
+	return nil, errors.New("connection refused")
+}
+
+// authorizeImageStatus returns the status of a request for imageID made by
+// p, which is answered with 200 when authorizeImage lets it through.
+func authorizeImageStatus(a *Api, p *auth.Principal, imageID string) int {
+	router := gin.New()
+	router.GET("/images/:id", func(c *gin.Context) {
+		if p != nil {
+			c.Request = c.Request.WithContext(auth.NewContext(c.Request.Context(), p))
+		}
+		if a.authorizeImage(c, c.Param("id")) {
+			c.Status(http.StatusOK)
+		}
+	})
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/images/"+imageID, nil))
+	return w.Code
+}
+
+func TestAuthorizeImage(t *testing.T) {
+	store := jobs.NewMemoryStore()
+	ctx := context.Background()
+	for _, record := range []*jobs.Record{
+		{ImageID: "alice-default", Owner: "alice"},
+		{ImageID: "alice-acme", Owner: "alice", Tenant: "acme"},
+		{ImageID: "bob-acme", Owner: "bob", Tenant: "acme"},
+	} {
+		if err := store.Put(ctx, record); err != nil {
+			t.Fatal(err)
+		}
+	}
+	a := &Api{logger: zap.NewNop(), jobs: store}
+
+	alice := &auth.Principal{Subject: "alice"}
+	aliceAcme := &auth.Principal{Subject: "alice", Tenant: "acme"}
+	bobAcme := &auth.Principal{Subject: "bob", Tenant: "acme"}
+	admin := &auth.Principal{Subject: "root", Admin: true}
+	tests := []struct {
+		name    string
+		p       *auth.Principal
+		imageID string
+		want    int
+	}{
+		{"owner", alice, "alice-default", http.StatusOK},
+		{"owner in tenant", aliceAcme, "alice-acme", http.StatusOK},
+		// others' images and images of other tenants look missing
+		{"other owner", bobAcme, "alice-acme", http.StatusNotFound},
+		{"owner in another tenant", alice, "alice-acme", http.StatusNotFound},
+		{"owner from another tenant", aliceAcme, "alice-default", http.StatusNotFound},
+		{"missing", alice, "missing", http.StatusNotFound},
+		{"no principal", nil, "alice-default", http.StatusNotFound},
+		// admins see every image of every tenant
+		{"admin", admin, "bob-acme", http.StatusOK},
+		{"admin default tenant", admin, "alice-default", http.StatusOK},
+		{"admin missing", admin, "missing", http.StatusOK},
+	}
+	for _, tt := range tests {
+		if got := authorizeImageStatus(a, tt.p, tt.imageID); got != tt.want {
+			t.Errorf("%s: status = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+
+	// store failures aren't reported as missing images
+	a.jobs = failingJobs{}
+	if got := authorizeImageStatus(a, alice, "alice-default"); got != http.StatusInternalServerError {
+		t.Errorf("status with a failing store = %d, want 500", got)
+	}
+}
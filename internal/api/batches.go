@@ -0,0 +1,589 @@
+package api
+
+import (
+	"archive/zip"
+	"context"
+	"errors"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"path"
+	"strconv"
+
+	"github.com/joberly/demo-temporal/internal/auth"
+	"github.com/joberly/demo-temporal/internal/imagetype"
+	"github.com/joberly/demo-temporal/internal/jobs"
+	"github.com/joberly/demo-temporal/internal/pipeline"
+	"github.com/joberly/demo-temporal/internal/storage"
+	"github.com/joberly/demo-temporal/internal/tenant"
+	"github.com/joberly/demo-temporal/workflows"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	enumspb "go.temporal.io/api/enums/v1"
+	"go.temporal.io/api/serviceerror"
+	"go.temporal.io/sdk/client"
+	"go.uber.org/zap"
+)
+
+// errImageBusy is returned for images listed in a batch while they are
+// still being processed.
+var errImageBusy = errors.New("image is being processed")
+
+// batchWorkflowID returns the workflow id of a batch. Batch ids are uuids
+// like image ids, the prefix keeps the two kinds of workflow apart.
+func batchWorkflowID(batchID string) string {
+	return "batch-" + batchID
+}
+
+type createBatchRequest struct {
+	Owner       string               `json:"owner"`
+	ImageIDs    []string             `json:"imageIds"`
+	Pipeline    pipeline.Pipeline    `json:"pipeline"`
+	Renditions  []pipeline.Rendition `json:"renditions"`
+	Concurrency int                  `json:"concurrency"`
+}
+
+// batchFile is an image uploaded with a batch, checked before any of the
+// batch is stored.
+type batchFile struct {
+	header      *multipart.FileHeader
+	contentType string
+}
+
+// createBatchHandler processes a batch of images, given either as a
+// multipart form of files, along with the ids of images uploaded before,
+// or as JSON listing image ids only.
+func (a *Api) createBatchHandler(c *gin.Context) {
+	var req createBatchRequest
+	var files []*multipart.FileHeader
+	if c.ContentType() == "multipart/form-data" {
+		if !limitBody(c, a.config.BatchMaxBytes, multipartOverhead) {
+			return
+		}
+		if err := c.Request.ParseMultipartForm(multipartMemory); err != nil {
+			if isTooLarge(err) {
+				c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "batch too large", "limit": a.config.BatchMaxBytes})
+				return
+			}
+			a.logger.Error("failed to parse form", zap.Error(err))
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid multipart form"})
+			return
+		}
+		files = c.Request.MultipartForm.File["files"]
+
+		var err error
+		req.Owner = c.PostForm("owner")
+		req.ImageIDs = splitList(c.PostForm("imageIds"))
+		if req.Pipeline, err = parsePipeline(c.PostForm("pipeline")); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid pipeline: " + err.Error()})
+			return
+		}
+		if req.Renditions, err = parseRenditions(c.PostForm("renditions")); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid renditions: " + err.Error()})
+			return
+		}
+		if concurrency := c.PostForm("concurrency"); concurrency != "" {
+			if req.Concurrency, err = strconv.Atoi(concurrency); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "invalid concurrency"})
+				return
+			}
+		}
+	} else {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request body"})
+			return
+		}
+		if err := req.Pipeline.Validate(); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid pipeline: " + err.Error()})
+			return
+		}
+		if err := pipeline.ValidateRenditions(req.Renditions); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid renditions: " + err.Error()})
+			return
+		}
+	}
+
+	total := len(files) + len(req.ImageIDs)
+	if total == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "files or imageIds are required"})
+		return
+	}
+	if maxImages := a.config.BatchMaxImages; maxImages > 0 && total > maxImages {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "too many images", "limit": maxImages})
+		return
+	}
+	concurrency := req.Concurrency
+	if concurrency == 0 {
+		concurrency = a.config.BatchConcurrency
+	}
+	if concurrency < 0 || (a.config.BatchMaxConcurrency > 0 && concurrency > a.config.BatchMaxConcurrency) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid concurrency", "limit": a.config.BatchMaxConcurrency})
+		return
+	}
+
+	// check everything before storing any of the batch
+	p := principal(c)
+	ctx := c.Request.Context()
+	batchFiles, ok := a.checkBatchFiles(c, p.Tenant, files)
+	if !ok {
+		return
+	}
+	var size int64
+	for _, file := range files {
+		size += file.Size
+	}
+	seen := map[string]bool{}
+	previous := map[string]*jobs.Record{}
+	var uploads []*jobs.Record
+	for _, imageID := range req.ImageIDs {
+		if !isImageID(imageID) || seen[imageID] {
+			c.JSON(http.StatusBadRequest, gin.H{"imageId": imageID, "error": "invalid or repeated image id"})
+			return
+		}
+		seen[imageID] = true
+
+		upload, prior, err := a.batchImage(ctx, p, imageID)
+		switch {
+		case errors.Is(err, errUploadNotFound):
+			c.JSON(http.StatusNotFound, gin.H{"imageId": imageID, "error": "upload not found"})
+			return
+		case errors.Is(err, errUploadIncomplete):
+			c.JSON(http.StatusConflict, gin.H{"imageId": imageID, "error": "upload incomplete"})
+			return
+		case errors.Is(err, errImageBusy):
+			c.JSON(http.StatusConflict, gin.H{"imageId": imageID, "error": "image is being processed"})
+			return
+		case err != nil:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to start batch"})
+			return
+		}
+		if err := a.checkImageSize(p.Tenant, upload.Size); err != nil {
+			respondImageQuota(c, p.Tenant, "imageId", imageID, err)
+			return
+		}
+		// images processed before were held to the daily quota then
+		if prior != nil {
+			previous[imageID] = prior
+		} else {
+			size += upload.Size
+		}
+		uploads = append(uploads, upload)
+	}
+	// every image of the batch is active until it has been processed
+	if err := a.checkUsage(ctx, p.Tenant, total, size); err != nil {
+		if !respondQuota(c, p.Tenant, err) {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to check quota"})
+		}
+		return
+	}
+
+	// store the files, listed ahead of the images uploaded before
+	owner := a.owner(c, req.Owner)
+	var stored []*jobs.Record
+	for _, file := range batchFiles {
+		imageID := uuid.New().String()
+		if err := a.storeBatchFile(ctx, tenant.Key(p.Tenant, imageID), file); err != nil {
+			a.abandonBatch(ctx, stored, nil, nil, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to save file"})
+			return
+		}
+		stored = append(stored, &jobs.Record{
+			ImageID:     imageID,
+			Owner:       owner,
+			Tenant:      p.Tenant,
+			Filename:    sanitizeFilename(file.header.Filename),
+			ContentType: file.contentType,
+			Size:        file.header.Size,
+		})
+	}
+	uploads = append(stored, uploads...)
+
+	batchID := uuid.New().String()
+	input := workflows.BatchImageProcessingWorkflowInput{
+		BatchID:          batchID,
+		Owner:            owner,
+		Tenant:           p.Tenant,
+		MaxConcurrency:   concurrency,
+		SearchAttributes: a.searchAttributes(p.Tenant),
+	}
+	images := make([]gin.H, 0, len(uploads))
+	var recorded []*jobs.Record
+	for _, upload := range uploads {
+		upload.Pipeline = req.Pipeline
+		upload.Renditions = req.Renditions
+		if previous[upload.ImageID] != nil {
+			// forget the earlier outcome so the image is queued again
+			err := a.jobs.Update(ctx, upload.ImageID, func(record *jobs.Record) {
+				record.State = ""
+				record.RunID = ""
+			})
+			if err != nil {
+				a.logger.Error("failed to reset job record", zap.String("imageId", upload.ImageID), zap.Error(err))
+				a.abandonBatch(ctx, stored, recorded, previous, err)
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to start batch"})
+				return
+			}
+			// the reset is undone should the batch not start
+			recorded = append(recorded, upload)
+		}
+		if err := a.recordUpload(ctx, upload); err != nil {
+			a.abandonBatch(ctx, stored, recorded, previous, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to start batch"})
+			return
+		}
+		if previous[upload.ImageID] == nil {
+			recorded = append(recorded, upload)
+		}
+		input.Images = append(input.Images, workflows.ImageProcessingWorkflowInput{
+			ImageID:     upload.ImageID,
+			Tenant:      upload.Tenant,
+			ContentType: upload.ContentType,
+			Pipeline:    req.Pipeline,
+			Renditions:  req.Renditions,
+		})
+		images = append(images, gin.H{"imageId": upload.ImageID, "filename": upload.Filename})
+	}
+
+	wfRun, err := a.client.ExecuteWorkflow(ctx, client.StartWorkflowOptions{
+		ID:                    batchWorkflowID(batchID),
+		TaskQueue:             a.config.TaskQueue,
+		WorkflowIDReusePolicy: enumspb.WORKFLOW_ID_REUSE_POLICY_REJECT_DUPLICATE,
+		SearchAttributes:      a.searchAttributes(p.Tenant),
+	}, workflows.BatchImageProcessingWorkflow, input)
+	if err != nil {
+		a.logger.Error("failed to start batch workflow", zap.Error(err))
+		a.abandonBatch(ctx, stored, recorded, previous, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to start batch"})
+		return
+	}
+
+	a.logger.Info("started batch",
+		zap.String("batchId", batchID),
+		zap.String("tenant", p.Tenant),
+		zap.Int("images", len(uploads)),
+	)
+
+	batchURL := a.config.PublicURL + "/batches/" + batchID
+	c.JSON(http.StatusAccepted,
+		gin.H{
+			"batchId":     batchID,
+			"workflowId":  wfRun.GetID(),
+			"runId":       wfRun.GetRunID(),
+			"images":      images,
+			"statusUrl":   batchURL,
+			"downloadUrl": batchURL + "/download",
+		},
+	)
+}
+
+// abandonBatch cleans up after a batch that failed to start with reason.
+// The files stored with the batch are removed and the jobs recorded for
+// it are marked failed, images uploaded before are kept so they can be
+// processed again. Images processed before get their previous records
+// back, keeping the outcome and outputs of their earlier run.
+func (a *Api) abandonBatch(ctx context.Context, stored, recorded []*jobs.Record, previous map[string]*jobs.Record, reason error) {
+	for _, upload := range stored {
+		a.rejectUpload(ctx, upload.Key(), reason)
+	}
+	for _, upload := range recorded {
+		prior, ok := previous[upload.ImageID]
+		if !ok {
+			a.failJob(ctx, upload.ImageID, reason)
+			continue
+		}
+		if err := a.jobs.Put(ctx, prior); err != nil {
+			a.logger.Error("failed to restore job record", zap.String("imageId", upload.ImageID), zap.Error(err))
+		}
+	}
+}
+
+// checkBatchFiles checks the files of a batch are images within the
+// upload limits and the image size of tenant, responding and returning
+// false when one isn't.
+func (a *Api) checkBatchFiles(c *gin.Context, t string, files []*multipart.FileHeader) ([]batchFile, bool) {
+	var checked []batchFile
+	for _, header := range files {
+		if maxBytes := a.config.MaxUploadBytes; maxBytes > 0 && header.Size > maxBytes {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{
+				"filename": sanitizeFilename(header.Filename),
+				"error":    "upload too large",
+				"limit":    maxBytes,
+			})
+			return nil, false
+		}
+		if err := a.checkImageSize(t, header.Size); err != nil {
+			respondImageQuota(c, t, "filename", sanitizeFilename(header.Filename), err)
+			return nil, false
+		}
+
+		src, err := header.Open()
+		if err != nil {
+			a.logger.Error("failed to open uploaded file", zap.Error(err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to save file"})
+			return nil, false
+		}
+		format, ok := sniffImage(c, src, header.Header.Get("Content-Type"))
+		src.Close()
+		if !ok {
+			return nil, false
+		}
+		checked = append(checked, batchFile{header: header, contentType: imagetype.ContentType(format)})
+	}
+	return checked, true
+}
+
+// storeBatchFile stores a file of a batch in the upload store under key.
+func (a *Api) storeBatchFile(ctx context.Context, key string, file batchFile) error {
+	src, err := file.header.Open()
+	if err != nil {
+		a.logger.Error("failed to open uploaded file", zap.Error(err))
+		return err
+	}
+	defer src.Close()
+
+	err = a.stores.Upload.Put(ctx, key, src, &storage.PutOptions{
+		ContentType: file.contentType,
+		Size:        file.header.Size,
+	})
+	if err != nil {
+		a.logger.Error("failed to save file", zap.String("key", key), zap.Error(err))
+	}
+	return err
+}
+
+// batchImage returns the upload of an image listed in a batch, which is
+// either an image processed before or a direct upload not yet completed.
+// Images p may not process are not found. Images processed before, which
+// have been held to their tenant's quota already, come with their
+// previous record.
+func (a *Api) batchImage(ctx context.Context, p *auth.Principal, imageID string) (upload, previous *jobs.Record, err error) {
+	record, err := a.jobs.Get(ctx, imageID)
+	switch {
+	case err == nil:
+		if !p.Owns(record.Owner) || record.Tenant != p.Tenant {
+			return nil, nil, errUploadNotFound
+		}
+		if record.Active() {
+			return nil, nil, errImageBusy
+		}
+		upload = &jobs.Record{
+			ImageID:     imageID,
+			Owner:       record.Owner,
+			Tenant:      record.Tenant,
+			Filename:    record.Filename,
+			ContentType: record.ContentType,
+		}
+		previous = record
+	case errors.Is(err, jobs.ErrNotFound):
+		pending, err := a.getUploadRecord(ctx, imageID)
+		if err != nil {
+			return nil, nil, err
+		}
+		if !p.Owns(pending.Owner) || pending.Tenant != p.Tenant {
+			return nil, nil, errUploadNotFound
+		}
+		upload = &jobs.Record{
+			ImageID:     imageID,
+			Owner:       pending.Owner,
+			Tenant:      pending.Tenant,
+			Filename:    pending.Filename,
+			ContentType: pending.ContentType,
+			Resumable:   pending.Resumable,
+		}
+	default:
+		a.logger.Error("failed to get job record", zap.Error(err))
+		return nil, nil, err
+	}
+
+	// the upload must still be there to be processed again
+	info, err := a.stores.Upload.Stat(ctx, upload.Key())
+	if errors.Is(err, storage.ErrNotExist) {
+		if previous != nil {
+			return nil, nil, errUploadNotFound
+		}
+		return nil, nil, errUploadIncomplete
+	}
+	if err != nil {
+		a.logger.Error("failed to stat upload", zap.Error(err))
+		return nil, nil, err
+	}
+	upload.Size = info.Size
+	return upload, previous, nil
+}
+
+// batchHandler reports the progress of a batch and how each of its images
+// has gone.
+func (a *Api) batchHandler(c *gin.Context) {
+	batchID := c.Param("batchId")
+	status, ok := a.batchStatus(c, batchID)
+	if !ok {
+		return
+	}
+
+	images := make([]gin.H, 0, len(status.Images))
+	for _, image := range status.Images {
+		images = append(images, gin.H{
+			"imageId":   image.ImageID,
+			"runId":     image.RunID,
+			"state":     image.State,
+			"error":     image.Error,
+			"errorCode": image.ErrorCode,
+			"statusUrl": a.config.PublicURL + "/images/" + image.ImageID,
+		})
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"batchId":     batchID,
+		"workflowId":  batchWorkflowID(batchID),
+		"state":       status.State,
+		"progress":    status.Progress,
+		"total":       status.Total,
+		"pending":     status.Pending,
+		"running":     status.Running,
+		"completed":   status.Completed,
+		"failed":      status.Failed,
+		"cancelled":   status.Cancelled,
+		"startedAt":   status.StartedAt,
+		"endedAt":     status.EndedAt,
+		"images":      images,
+		"downloadUrl": a.config.PublicURL + "/batches/" + batchID + "/download",
+	})
+}
+
+// batchDownloadHandler streams a zip of the processed images of a batch
+// and their renditions. Images that haven't been processed, or have
+// expired, are left out.
+func (a *Api) batchDownloadHandler(c *gin.Context) {
+	batchID := c.Param("batchId")
+	status, ok := a.batchStatus(c, batchID)
+	if !ok {
+		return
+	}
+	ctx := c.Request.Context()
+
+	// collect the outputs of the processed images before responding
+	type entry struct{ key, name string }
+	var entries []entry
+	for _, image := range status.Images {
+		if image.State != workflows.StateCompleted {
+			continue
+		}
+		record, err := a.jobs.Get(ctx, image.ImageID)
+		if errors.Is(err, jobs.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			a.logger.Error("failed to get job record", zap.Error(err))
+			c.JSON(http.StatusInternalServerError, gin.H{"batchId": batchID, "error": "failed to get job record"})
+			return
+		}
+		key := record.Key()
+		if output := record.Status.Output; output != nil {
+			entries = append(entries, entry{key, path.Base(key) + extensions[output.ContentType]})
+		}
+		for _, rendition := range record.Status.Renditions {
+			renditionKey := pipeline.RenditionKey(key, rendition.Name)
+			entries = append(entries, entry{renditionKey, path.Base(renditionKey) + extensions[rendition.ContentType]})
+		}
+	}
+	if len(entries) == 0 {
+		c.JSON(http.StatusConflict, gin.H{"batchId": batchID, "error": "no processed images"})
+		return
+	}
+
+	c.Header("Content-Type", "application/zip")
+	c.Header("Content-Disposition", `attachment; filename="batch-`+batchID+`.zip"`)
+	c.Status(http.StatusOK)
+
+	// images are compressed already, so they are stored as they are
+	zw := zip.NewWriter(c.Writer)
+	for _, e := range entries {
+		reader, info, err := a.stores.Processed.Get(ctx, e.key)
+		if errors.Is(err, storage.ErrNotExist) {
+			a.logger.Info("leaving missing file out of batch download", zap.String("key", e.key))
+			continue
+		}
+		if err != nil {
+			// the response has started, all that can be done is cut it short
+			a.logger.Error("failed to open file", zap.String("key", e.key), zap.Error(err))
+			return
+		}
+		w, err := zw.CreateHeader(&zip.FileHeader{
+			Name:     e.name,
+			Method:   zip.Store,
+			Modified: info.LastModified,
+		})
+		if err == nil {
+			_, err = io.Copy(w, reader)
+		}
+		reader.Close()
+		if err != nil {
+			a.logger.Error("failed to write batch download", zap.String("batchId", batchID), zap.Error(err))
+			return
+		}
+	}
+	if err := zw.Close(); err != nil {
+		a.logger.Error("failed to write batch download", zap.String("batchId", batchID), zap.Error(err))
+	}
+}
+
+// cancelBatchHandler cancels a batch along with the images it is
+// processing.
+func (a *Api) cancelBatchHandler(c *gin.Context) {
+	batchID := c.Param("batchId")
+	if _, ok := a.batchStatus(c, batchID); !ok {
+		return
+	}
+
+	err := a.client.CancelWorkflow(c.Request.Context(), batchWorkflowID(batchID), "")
+	var notFound *serviceerror.NotFound
+	if errors.As(err, &notFound) {
+		// also returned for batches that have already finished
+		c.JSON(http.StatusNotFound, gin.H{"batchId": batchID, "error": "no running batch"})
+		return
+	}
+	if err != nil {
+		a.logger.Error("failed to cancel batch", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"batchId": batchID, "error": "failed to cancel batch"})
+		return
+	}
+
+	c.JSON(http.StatusAccepted, gin.H{
+		"batchId": batchID,
+		"message": "cancellation requested",
+	})
+}
+
+// batchStatus queries the status of a batch, responding and returning
+// false when it can't be found or belongs to someone else.
+func (a *Api) batchStatus(c *gin.Context, batchID string) (*workflows.BatchImageProcessingWorkflowStatus, bool) {
+	if !isImageID(batchID) {
+		c.JSON(http.StatusBadRequest, gin.H{"batchId": batchID, "error": "invalid batch id"})
+		return nil, false
+	}
+
+	encVal, err := a.client.QueryWorkflow(c.Request.Context(), batchWorkflowID(batchID), "", "status")
+	var notFound *serviceerror.NotFound
+	if errors.As(err, &notFound) {
+		c.JSON(http.StatusNotFound, gin.H{"batchId": batchID, "error": "not found"})
+		return nil, false
+	}
+	if err != nil {
+		a.logger.Error("failed to query batch status", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"batchId": batchID, "error": "failed to get batch status"})
+		return nil, false
+	}
+	var status workflows.BatchImageProcessingWorkflowStatus
+	if err := encVal.Get(&status); err != nil {
+		a.logger.Error("failed to decode batch status", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"batchId": batchID, "error": "failed to get batch status"})
+		return nil, false
+	}
+
+	p := principal(c)
+	if !p.Admin && (!p.Owns(status.Owner) || status.Tenant != p.Tenant) {
+		c.JSON(http.StatusNotFound, gin.H{"batchId": batchID, "error": "not found"})
+		return nil, false
+	}
+	return &status, true
+}
@@ -0,0 +1,90 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/joberly/demo-temporal/activities"
+	"github.com/joberly/demo-temporal/internal/auth"
+	"github.com/joberly/demo-temporal/internal/jobs"
+	"github.com/joberly/demo-temporal/internal/storage"
+	"github.com/joberly/demo-temporal/workflows"
+
+	"github.com/gin-gonic/gin"
+	"go.temporal.io/sdk/client"
+	"go.uber.org/zap"
+)
+
+// unavailableClient is a Temporal client that can't start workflows.
+type unavailableClient struct {
+	client.Client
+}
+
+func (unavailableClient) ExecuteWorkflow(ctx context.Context, options client.StartWorkflowOptions, workflow interface{}, args ...interface{}) (client.WorkflowRun, error) {
+	return nil, errors.New("connection refused")
+}
+
+func TestAbandonedBatchRestoresRecords(t *testing.T) {
+	ctx := context.Background()
+	store := jobs.NewMemoryStore()
+	completed := &jobs.Record{
+		ImageID:     "6f1c1a52-3b0e-4a43-9a0e-1f6d1c1e2b01",
+		Owner:       "alice",
+		Filename:    "cat.png",
+		ContentType: "image/png",
+		Size:        4,
+		WorkflowID:  "6f1c1a52-3b0e-4a43-9a0e-1f6d1c1e2b01",
+		RunID:       "run-1",
+		State:       workflows.StateCompleted,
+		Status: workflows.ImageProcessingWorkflowStatus{
+			State:  workflows.StateCompleted,
+			Output: &activities.PublishImageResult{Format: "png", ContentType: "image/png"},
+		},
+	}
+	if err := store.Put(ctx, completed); err != nil {
+		t.Fatal(err)
+	}
+	uploads, err := storage.NewLocal(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	stores := &storage.Stores{Upload: uploads}
+	if err := stores.Upload.Put(ctx, completed.Key(), strings.NewReader("\x89PNG"), &storage.PutOptions{Size: 4}); err != nil {
+		t.Fatal(err)
+	}
+	a := &Api{
+		logger: zap.NewNop(),
+		config: &Config{},
+		client: unavailableClient{},
+		stores: stores,
+		jobs:   store,
+		auth:   &auth.Authenticator{},
+	}
+
+	router := gin.New()
+	router.POST("/batches", func(c *gin.Context) {
+		c.Request = c.Request.WithContext(auth.NewContext(c.Request.Context(), &auth.Principal{Subject: "alice"}))
+		a.createBatchHandler(c)
+	})
+	w := httptest.NewRecorder()
+	body := `{"owner":"alice","imageIds":["` + completed.ImageID + `"],"pipeline":[{"op":"grayscale"}]}`
+	r := httptest.NewRequest("POST", "/batches", strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	router.ServeHTTP(w, r)
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("status = %d, want 500: %s", w.Code, w.Body)
+	}
+
+	// the earlier run isn't taken for the failed batch
+	record, err := store.Get(ctx, completed.ImageID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record.State != workflows.StateCompleted || record.RunID != "run-1" || record.Status.Output == nil || record.Status.Error != "" {
+		t.Errorf("record = %+v, want the completed record", record)
+	}
+}
@@ -1,7 +1,21 @@
 package api
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/joberly/demo-temporal/internal/auth"
+	"github.com/joberly/demo-temporal/internal/jobs"
+	"github.com/joberly/demo-temporal/internal/ratelimit"
+	"github.com/joberly/demo-temporal/internal/signedurl"
+	"github.com/joberly/demo-temporal/internal/storage"
+	"github.com/joberly/demo-temporal/internal/tenant"
+	"github.com/joberly/demo-temporal/workflows"
 
 	"github.com/spf13/viper"
 	"go.temporal.io/sdk/client"
@@ -10,11 +24,56 @@ import (
 
 // Config holds the configuration for the API.
 type Config struct {
-	UploadDir    string
-	ProcessedDir string
+	Storage storage.Config
+	// Jobs selects where job records are kept, it must match the worker.
+	Jobs         jobs.Config
 	TemporalHost string
 	TemporalPort string
 	TaskQueue    string
+
+	// MaxUploadBytes is the size of the largest upload accepted, unlimited
+	// when zero.
+	MaxUploadBytes int64
+	// PublicURL is the base URL clients use to reach the API.
+	PublicURL string
+	// UploadURLExpiry is how long a direct upload URL remains valid.
+	UploadURLExpiry time.Duration
+	// ResumableUploadExpiry is how long a resumable upload may take to be
+	// finalized before it is abandoned.
+	ResumableUploadExpiry time.Duration
+	// ResumableSweepInterval is how often abandoned resumable uploads are
+	// removed.
+	ResumableSweepInterval time.Duration
+	// UnstartedJobExpiry is how long a job may be recorded as active without
+	// a workflow before it no longer counts towards its tenant's quota.
+	// Images of a batch have no workflow until their turn comes.
+	UnstartedJobExpiry time.Duration
+	// BatchMaxImages is the most images in a batch, unlimited when zero.
+	BatchMaxImages int
+	// BatchMaxBytes is the size of the largest batch upload accepted,
+	// unlimited when zero.
+	BatchMaxBytes int64
+	// BatchConcurrency is how many images of a batch are processed at once
+	// unless the batch asks for another number, up to BatchMaxConcurrency.
+	BatchConcurrency    int
+	BatchMaxConcurrency int
+	// UploadSigningSecret signs direct upload URLs served by the API when
+	// the upload store cannot presign URLs itself.
+	UploadSigningSecret string `json:"-"`
+	// StorageEventsToken is the bearer token expected on storage
+	// notification callbacks.
+	StorageEventsToken string `json:"-"`
+	// Auth configures how callers are authenticated.
+	Auth auth.Config
+	// DownloadURLs configures the signed download URLs given in statuses.
+	DownloadURLs signedurl.Config
+	// Quotas limits what each tenant may process.
+	Quotas tenant.Quotas
+	// TenantSearchAttribute is the keyword search attribute workflows are
+	// tagged with their tenant under, none when empty.
+	TenantSearchAttribute string
+	// RateLimits limits how often callers may use each class of route.
+	RateLimits ratelimit.Config
 }
 
 func NewConfig(logger *zap.Logger) (*Config, error) {
@@ -22,16 +81,177 @@ func NewConfig(logger *zap.Logger) (*Config, error) {
 	viper.SetEnvPrefix("demo")
 	viper.SetDefault("UPLOAD_DIR", "/tmp/uploads")
 	viper.SetDefault("PROCESSED_DIR", "/tmp/processed")
+	viper.SetDefault("STORAGE_DRIVER", storage.DriverLocal)
+	viper.SetDefault("S3_REGION", "us-east-1")
+	viper.SetDefault("S3_USE_PATH_STYLE", true)
+	viper.SetDefault("JOBS_DRIVER", jobs.DriverBlob)
+	viper.SetDefault("POSTGRES_HOST", "localhost")
+	viper.SetDefault("POSTGRES_PORT", "5432")
+	viper.SetDefault("POSTGRES_USER", "postgres")
+	viper.SetDefault("POSTGRES_DB", "postgres")
+	viper.SetDefault("POSTGRES_SSLMODE", "disable")
 	viper.SetDefault("TEMPORAL_HOST", "localhost")
 	viper.SetDefault("TEMPORAL_PORT", "7233")
 	viper.SetDefault("TASK_QUEUE", "image-processing")
+	viper.SetDefault("PUBLIC_URL", "http://localhost:8081")
+	viper.SetDefault("UPLOAD_URL_EXPIRY", "15m")
+	viper.SetDefault("MAX_UPLOAD_BYTES", 100<<20)
+	viper.SetDefault("RESUMABLE_UPLOAD_EXPIRY", 24*time.Hour)
+	viper.SetDefault("RESUMABLE_SWEEP_INTERVAL", 10*time.Minute)
+	viper.SetDefault("UNSTARTED_JOB_EXPIRY", 24*time.Hour)
+	viper.SetDefault("BATCH_MAX_IMAGES", 500)
+	viper.SetDefault("BATCH_MAX_BYTES", 1<<30)
+	viper.SetDefault("BATCH_CONCURRENCY", workflows.DefaultBatchConcurrency)
+	viper.SetDefault("BATCH_MAX_CONCURRENCY", 50)
+	viper.SetDefault("DOWNLOAD_URL_EXPIRY", time.Hour)
+	viper.SetDefault("RATE_LIMIT_DRIVER", ratelimit.DriverMemory)
+	viper.SetDefault("RATE_LIMIT_UPLOAD_RATE", "60/m")
+	viper.SetDefault("RATE_LIMIT_UPLOAD_BURST", 10)
+	viper.SetDefault("RATE_LIMIT_STATUS_RATE", "10/s")
+	viper.SetDefault("RATE_LIMIT_STATUS_BURST", 50)
+	viper.SetDefault("RATE_LIMIT_DOWNLOAD_RATE", "20/s")
+	viper.SetDefault("RATE_LIMIT_DOWNLOAD_BURST", 100)
+	viper.SetDefault("RATE_LIMIT_DEFAULT_RATE", "5/s")
+	viper.SetDefault("RATE_LIMIT_DEFAULT_BURST", 20)
+	viper.SetDefault("REDIS_ADDR", "localhost:6379")
+	viper.SetDefault("REDIS_KEY_PREFIX", "demo:ratelimit:")
+
+	downloadKeys, err := signedurl.ParseKeys(viper.GetString("DOWNLOAD_SIGNING_KEYS"))
+	if err != nil {
+		logger.Error("invalid download signing keys", zap.Error(err))
+		return nil, err
+	}
+
+	apiKeys, err := auth.ParseAPIKeys(viper.GetString("AUTH_API_KEYS"))
+	if err != nil {
+		logger.Error("invalid api keys", zap.Error(err))
+		return nil, err
+	}
+	tenants, err := auth.ParseTenants(viper.GetString("AUTH_TENANTS"))
+	if err != nil {
+		logger.Error("invalid tenants", zap.Error(err))
+		return nil, err
+	}
+
+	rateLimits, err := loadRateLimits()
+	if err != nil {
+		logger.Error("invalid rate limits", zap.Error(err))
+		return nil, err
+	}
+
+	// the default quota applies to every tenant, tenant quotas override
+	// some or all of its settings
+	defaultQuota := tenant.Quota{
+		MaxConcurrentJobs: viper.GetInt("TENANT_MAX_CONCURRENT_JOBS"),
+		MaxBytesPerDay:    viper.GetInt64("TENANT_MAX_BYTES_PER_DAY"),
+		MaxImageBytes:     viper.GetInt64("TENANT_MAX_IMAGE_BYTES"),
+	}
+	quotas, err := tenant.ParseQuotas(viper.GetString("TENANT_QUOTAS"), defaultQuota)
+	if err != nil {
+		logger.Error("invalid tenant quotas", zap.Error(err))
+		return nil, err
+	}
 
 	config := &Config{
-		UploadDir:    viper.GetString("UPLOAD_DIR"),
-		ProcessedDir: viper.GetString("PROCESSED_DIR"),
+		Storage: storage.Config{
+			Driver:       viper.GetString("STORAGE_DRIVER"),
+			UploadDir:    viper.GetString("UPLOAD_DIR"),
+			ProcessedDir: viper.GetString("PROCESSED_DIR"),
+			S3: storage.S3Config{
+				Endpoint:        viper.GetString("S3_ENDPOINT"),
+				PublicEndpoint:  viper.GetString("S3_PUBLIC_ENDPOINT"),
+				Region:          viper.GetString("S3_REGION"),
+				Bucket:          viper.GetString("S3_BUCKET"),
+				AccessKeyID:     viper.GetString("S3_ACCESS_KEY_ID"),
+				SecretAccessKey: viper.GetString("S3_SECRET_ACCESS_KEY"),
+				UsePathStyle:    viper.GetBool("S3_USE_PATH_STYLE"),
+			},
+		},
+		Jobs: jobs.Config{
+			Driver: viper.GetString("JOBS_DRIVER"),
+			Postgres: jobs.PostgresConfig{
+				Host:     viper.GetString("POSTGRES_HOST"),
+				Port:     viper.GetString("POSTGRES_PORT"),
+				User:     viper.GetString("POSTGRES_USER"),
+				Password: viper.GetString("POSTGRES_PASSWORD"),
+				Database: viper.GetString("POSTGRES_DB"),
+				SSLMode:  viper.GetString("POSTGRES_SSLMODE"),
+			},
+		},
 		TemporalHost: viper.GetString("TEMPORAL_HOST"),
 		TemporalPort: viper.GetString("TEMPORAL_PORT"),
 		TaskQueue:    viper.GetString("TASK_QUEUE"),
+
+		MaxUploadBytes:         viper.GetInt64("MAX_UPLOAD_BYTES"),
+		PublicURL:              strings.TrimSuffix(viper.GetString("PUBLIC_URL"), "/"),
+		UploadURLExpiry:        viper.GetDuration("UPLOAD_URL_EXPIRY"),
+		UploadSigningSecret:    viper.GetString("UPLOAD_SIGNING_SECRET"),
+		StorageEventsToken:     viper.GetString("STORAGE_EVENTS_TOKEN"),
+		ResumableUploadExpiry:  viper.GetDuration("RESUMABLE_UPLOAD_EXPIRY"),
+		ResumableSweepInterval: viper.GetDuration("RESUMABLE_SWEEP_INTERVAL"),
+		UnstartedJobExpiry:     viper.GetDuration("UNSTARTED_JOB_EXPIRY"),
+		BatchMaxImages:         viper.GetInt("BATCH_MAX_IMAGES"),
+		BatchMaxBytes:          viper.GetInt64("BATCH_MAX_BYTES"),
+		BatchConcurrency:       viper.GetInt("BATCH_CONCURRENCY"),
+		BatchMaxConcurrency:    viper.GetInt("BATCH_MAX_CONCURRENCY"),
+		Auth: auth.Config{
+			APIKeys:      apiKeys,
+			DatabaseKeys: viper.GetBool("AUTH_DATABASE_KEYS"),
+			JWTSecret:    viper.GetString("AUTH_JWT_SECRET"),
+			JWKSFile:     viper.GetString("AUTH_JWKS_FILE"),
+			JWTIssuer:    viper.GetString("AUTH_JWT_ISSUER"),
+			JWTAudience:  viper.GetString("AUTH_JWT_AUDIENCE"),
+			Admins:       splitList(viper.GetString("AUTH_ADMINS")),
+			Tenants:      tenants,
+		},
+		DownloadURLs: signedurl.Config{
+			Keys:   downloadKeys,
+			KeyID:  viper.GetString("DOWNLOAD_SIGNING_KEY_ID"),
+			Expiry: viper.GetDuration("DOWNLOAD_URL_EXPIRY"),
+			BindIP: viper.GetBool("DOWNLOAD_URL_BIND_IP"),
+		},
+		Quotas: tenant.Quotas{
+			Default: defaultQuota,
+			Tenants: quotas,
+		},
+		TenantSearchAttribute: viper.GetString("TENANT_SEARCH_ATTRIBUTE"),
+		RateLimits: ratelimit.Config{
+			Driver: viper.GetString("RATE_LIMIT_DRIVER"),
+			Redis: ratelimit.RedisConfig{
+				Addr:      viper.GetString("REDIS_ADDR"),
+				Username:  viper.GetString("REDIS_USERNAME"),
+				Password:  viper.GetString("REDIS_PASSWORD"),
+				DB:        viper.GetInt("REDIS_DB"),
+				KeyPrefix: viper.GetString("REDIS_KEY_PREFIX"),
+			},
+			Rules: rateLimits,
+		},
+	}
+	if err := config.DownloadURLs.Validate(); err != nil {
+		logger.Error("invalid download signing key id", zap.Error(err))
+		return nil, err
+	}
+
+	if config.UploadSigningSecret == "" {
+		// without a configured secret, upload URLs only survive until restart
+		secret := make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			logger.Error("failed to generate upload signing secret", zap.Error(err))
+			return nil, err
+		}
+		config.UploadSigningSecret = hex.EncodeToString(secret)
+		logger.Warn("no upload signing secret configured, using a random one")
+	}
+
+	if len(config.DownloadURLs.Keys) == 0 {
+		// as with upload URLs, download URLs only survive until restart
+		secret := make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			logger.Error("failed to generate download signing key", zap.Error(err))
+			return nil, err
+		}
+		config.DownloadURLs.Keys = []signedurl.Key{{ID: "generated", Secret: hex.EncodeToString(secret)}}
+		logger.Warn("no download signing keys configured, using a random one")
 	}
 
 	configJson, err := json.Marshal(config)
@@ -49,3 +269,74 @@ func NewTemporalClient(config *Config, logger *zap.Logger) (client.Client, error
 		HostPort: config.TemporalHost + ":" + config.TemporalPort,
 	})
 }
+
+func NewStores(config *Config, logger *zap.Logger) (*storage.Stores, error) {
+	stores, err := storage.NewStores(&config.Storage)
+	if err != nil {
+		logger.Error("failed to create storage", zap.Error(err))
+		return nil, err
+	}
+	return stores, nil
+}
+
+func NewJobStore(config *Config, stores *storage.Stores, logger *zap.Logger) (jobs.Store, error) {
+	store, err := jobs.NewStore(context.Background(), &config.Jobs, stores.Upload)
+	if err != nil {
+		logger.Error("failed to create job store", zap.Error(err))
+		return nil, err
+	}
+	return store, nil
+}
+
+func NewAuthenticator(config *Config, store jobs.Store, logger *zap.Logger) (*auth.Authenticator, error) {
+	// database keys live alongside the job records
+	var keys auth.KeyStore
+	if pg, ok := store.(*jobs.PostgresStore); ok {
+		keys = auth.NewDatabaseKeys(pg.DB())
+	}
+	authenticator, err := auth.New(&config.Auth, keys)
+	if err != nil {
+		logger.Error("failed to create authenticator", zap.Error(err))
+		return nil, err
+	}
+	if !authenticator.Enabled() {
+		logger.Warn("no api keys or jwt keys configured, authentication is disabled")
+	}
+	return authenticator, nil
+}
+
+// loadRateLimits reads the rule of each route class from variables named
+// RATE_LIMIT_<class>_RATE and RATE_LIMIT_<class>_BURST. A zero rate or
+// burst leaves the class unlimited.
+func loadRateLimits() (map[string]ratelimit.Rule, error) {
+	rules := map[string]ratelimit.Rule{}
+	for _, class := range ratelimit.Classes {
+		name := "RATE_LIMIT_" + strings.ToUpper(class)
+		rate, err := ratelimit.ParseRate(viper.GetString(name + "_RATE"))
+		if err != nil {
+			return nil, fmt.Errorf("%s_RATE: %w", name, err)
+		}
+		rules[class] = ratelimit.Rule{Rate: rate, Burst: viper.GetInt(name + "_BURST")}
+	}
+	return rules, nil
+}
+
+func NewRateLimiter(config *Config, logger *zap.Logger) (ratelimit.Limiter, error) {
+	limiter, err := ratelimit.New(&config.RateLimits)
+	if err != nil {
+		logger.Error("failed to create rate limiter", zap.Error(err))
+		return nil, err
+	}
+	return limiter, nil
+}
+
+// splitList splits a comma separated list, dropping empty items.
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
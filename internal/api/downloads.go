@@ -0,0 +1,91 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/joberly/demo-temporal/internal/retention"
+	"github.com/joberly/demo-temporal/internal/signedurl"
+	"github.com/joberly/demo-temporal/internal/storage"
+	"github.com/joberly/demo-temporal/internal/tenant"
+	"github.com/joberly/demo-temporal/workflows"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+// signedDownloadKey marks requests authorized by a signed download URL.
+const signedDownloadKey = "signedDownload"
+
+// downloadURL returns a signed link to download an image, or one of its
+// renditions, for the client making the request, and when it expires.
+func (a *Api) downloadURL(c *gin.Context, imageID, rendition string) (string, time.Time) {
+	u := a.config.PublicURL + "/download/" + imageID
+	if rendition != "" {
+		u += "/" + rendition
+	}
+	return a.signer.Sign(u, signedurl.Target{
+		ImageID:   imageID,
+		Rendition: rendition,
+		ClientIP:  c.ClientIP(),
+	}, time.Now())
+}
+
+// addDownloadLinks adds signed links to the downloads of a completed image
+// to a status body. Links are only given while the processed image is
+// available, images removed by the retention sweep are reported expired.
+func (a *Api) addDownloadLinks(c *gin.Context, body gin.H, imageID string, status *workflows.ImageProcessingWorkflowStatus) {
+	if status.CurrentState() != workflows.StateCompleted || status.Output == nil {
+		return
+	}
+	ctx := c.Request.Context()
+	key := tenant.Key(status.Tenant, imageID)
+	_, err := a.stores.Processed.Stat(ctx, key)
+	if errors.Is(err, storage.ErrNotExist) {
+		if _, serr := a.stores.Processed.Stat(ctx, retention.TombstoneKey(key)); serr == nil {
+			body["expired"] = true
+		}
+		return
+	}
+	if err != nil {
+		a.logger.Error("failed to stat processed image", zap.Error(err))
+		return
+	}
+
+	downloadURL, expiresAt := a.downloadURL(c, imageID, "")
+	body["downloadUrl"] = downloadURL
+	body["downloadExpiresAt"] = expiresAt
+	if len(status.Renditions) > 0 {
+		renditionURLs := map[string]string{}
+		for _, r := range status.Renditions {
+			renditionURLs[r.Name], _ = a.downloadURL(c, imageID, r.Name)
+		}
+		body["renditionUrls"] = renditionURLs
+	}
+}
+
+// authenticateDownload is middleware letting downloads through with either
+// a valid signed URL or the credentials of the image's owner.
+func (a *Api) authenticateDownload(c *gin.Context) {
+	if c.Query("signature") == "" {
+		a.authenticate(c)
+		return
+	}
+
+	err := a.signer.Verify(signedurl.Target{
+		ImageID:   c.Param("imageId"),
+		Rendition: c.Param("rendition"),
+		ClientIP:  c.ClientIP(),
+	}, c.Request.URL.Query(), time.Now())
+	switch {
+	case errors.Is(err, signedurl.ErrExpired):
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "download url expired"})
+		return
+	case err != nil:
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "invalid signature"})
+		return
+	}
+	c.Set(signedDownloadKey, true)
+	c.Next()
+}
@@ -0,0 +1,279 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/joberly/demo-temporal/internal/jobs"
+	"github.com/joberly/demo-temporal/workflows"
+
+	"github.com/gin-gonic/gin"
+	enumspb "go.temporal.io/api/enums/v1"
+	"go.temporal.io/api/serviceerror"
+	"go.temporal.io/sdk/client"
+	"go.uber.org/zap"
+)
+
+// imageHandler reports the status of the latest job processing an image
+// along with links to its downloads. The workflow id of a job is its image
+// id, so clients don't need to keep the run id. Once the workflow is no
+// longer retained by Temporal the job record kept by the worker is used.
+func (a *Api) imageHandler(c *gin.Context) {
+	imageID := c.Param("imageId")
+	if !isImageID(imageID) {
+		c.JSON(http.StatusBadRequest, gin.H{"imageId": imageID, "error": "invalid image id"})
+		return
+	}
+	if !a.authorizeImage(c, imageID) {
+		return
+	}
+	ctx := c.Request.Context()
+
+	desc, err := a.client.DescribeWorkflowExecution(ctx, imageID, "")
+	var notFound *serviceerror.NotFound
+	var invalid *serviceerror.InvalidArgument
+	switch {
+	case errors.As(err, &notFound) || errors.As(err, &invalid):
+		a.logger.Info("workflow not found, using job record", zap.String("imageId", imageID))
+	case err != nil:
+		a.logger.Error("failed to get status", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get execution status"})
+		return
+	default:
+		info := desc.GetWorkflowExecutionInfo()
+		runID := info.GetExecution().GetRunId()
+		status, err := a.queryStatus(ctx, imageID, runID)
+		if err == nil {
+			fillAttempts(status, desc)
+			c.JSON(statusCode(status), a.imageBody(c, imageID, runID, status, "workflow"))
+			return
+		}
+		// closed workflows can't always be queried, for instance when
+		// their worker code has moved on, but they have left a record
+		if info.GetStatus() == enumspb.WORKFLOW_EXECUTION_STATUS_RUNNING {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get detailed status"})
+			return
+		}
+	}
+
+	record, err := a.jobs.Get(ctx, imageID)
+	if errors.Is(err, jobs.ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"imageId": imageID, "error": "not found"})
+		return
+	}
+	if err != nil {
+		a.logger.Error("failed to get job record", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get job record"})
+		return
+	}
+	c.JSON(statusCode(&record.Status),
+		a.imageBody(c, imageID, record.RunID, &record.Status, "record"))
+}
+
+// imageBody returns the response body reporting the status of an image.
+// Source tells whether the status came from the workflow or its record.
+func (a *Api) imageBody(c *gin.Context, imageID, runID string, status *workflows.ImageProcessingWorkflowStatus, source string) gin.H {
+	body := statusBody(imageID, runID, status)
+	body["imageId"] = imageID
+	body["source"] = source
+	a.addDownloadLinks(c, body, imageID, status)
+	return body
+}
+
+// recordUpload records an upload in its job record before its workflow is
+// started, so that its owner is known before anyone can ask after it. The
+// worker may have recorded an earlier outcome already, in which case only
+// the details of the upload are filled in. Jobs whose workflow failed to
+// start, which have no run, are queued again.
+func (a *Api) recordUpload(ctx context.Context, upload *jobs.Record) error {
+	err := a.jobs.Update(ctx, upload.ImageID, func(record *jobs.Record) {
+		record.Owner = upload.Owner
+		record.Tenant = upload.Tenant
+		record.Filename = upload.Filename
+		record.ContentType = upload.ContentType
+		record.Pipeline = upload.Pipeline
+		record.Renditions = upload.Renditions
+		record.WorkflowID = upload.ImageID
+		// images sent resumably stay marked when processed again
+		if upload.Resumable {
+			record.Resumable = true
+		}
+		if record.Size == 0 {
+			record.Size = upload.Size
+		}
+		if record.State == "" || (record.RunID == "" && !record.Active()) {
+			record.State = workflows.StateQueued
+			record.Status = workflows.ImageProcessingWorkflowStatus{
+				ImageID: upload.ImageID,
+				Tenant:  upload.Tenant,
+				Version: workflows.StatusVersion,
+				State:   workflows.StateQueued,
+				Status:  "starting",
+			}
+		}
+	})
+	if err != nil {
+		a.logger.Error("failed to record upload",
+			zap.String("imageId", upload.ImageID), zap.Error(err))
+	}
+	return err
+}
+
+// recordRun records the run id of a started workflow in its job record.
+func (a *Api) recordRun(ctx context.Context, run client.WorkflowRun) {
+	err := a.jobs.Update(ctx, run.GetID(), func(record *jobs.Record) {
+		// the worker records the run once it's done
+		if record.RunID == "" {
+			record.RunID = run.GetRunID()
+		}
+	})
+	if err != nil {
+		// the worker records the run when it finishes so this is not fatal
+		a.logger.Error("failed to record run",
+			zap.String("imageId", run.GetID()), zap.Error(err))
+	}
+}
+
+// failJob marks the job of imageID failed when its workflow could not be
+// started, so that it isn't counted as active for ever. Records the worker
+// has already settled are left alone.
+func (a *Api) failJob(ctx context.Context, imageID string, reason error) {
+	err := a.jobs.Update(ctx, imageID, func(record *jobs.Record) {
+		if record.Active() {
+			endJob(record, jobOutcome{
+				state:  workflows.StateFailed,
+				status: "error: failed to start workflow",
+				code:   workflows.ErrorCodeInternal,
+				reason: reason.Error(),
+			})
+		}
+	})
+	if err != nil {
+		a.logger.Error("failed to mark job failed",
+			zap.String("imageId", imageID), zap.Error(err))
+	}
+}
+
+// endJob records the outcome of a job in its record.
+func endJob(record *jobs.Record, outcome jobOutcome) {
+	now := time.Now().UTC()
+	record.State = outcome.state
+	status := &record.Status
+	if status.ImageID == "" {
+		status.ImageID = record.ImageID
+		status.Tenant = record.Tenant
+	}
+	status.State = outcome.state
+	status.Status = outcome.status
+	status.ErrorCode = outcome.code
+	status.Error = outcome.reason
+	if status.EndedAt == nil {
+		status.EndedAt = &now
+	}
+}
+
+// states are the workflow states images can be listed by.
+var states = map[string]bool{
+	workflows.StateQueued:     true,
+	workflows.StateValidating: true,
+	workflows.StateProcessing: true,
+	workflows.StateCompleted:  true,
+	workflows.StateFailed:     true,
+	workflows.StateCancelled:  true,
+}
+
+// listImagesHandler lists job records, newest first, optionally filtered
+// by state, owner, tenant and creation time. Pages are followed with the
+// returned cursor.
+func (a *Api) listImagesHandler(c *gin.Context) {
+	filter := jobs.Filter{
+		State:  c.Query("status"),
+		Owner:  c.Query("owner"),
+		Tenant: c.Query("tenant"),
+		Cursor: c.Query("cursor"),
+	}
+	// callers only see their own images
+	if p := principal(c); !p.Admin {
+		filter.Owner = p.Subject
+		filter.Tenant = p.Tenant
+	}
+	if filter.State != "" && !states[filter.State] {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid status"})
+		return
+	}
+	if since := c.Query("since"); since != "" {
+		t, err := time.Parse(time.RFC3339, since)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid since, expected an RFC 3339 time"})
+			return
+		}
+		filter.Since = t
+	}
+	if limit := c.Query("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid limit"})
+			return
+		}
+		filter.Limit = n
+	}
+
+	page, err := a.jobs.List(c.Request.Context(), filter)
+	if errors.Is(err, jobs.ErrInvalidCursor) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid cursor"})
+		return
+	}
+	if err != nil {
+		a.logger.Error("failed to list jobs", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to list images"})
+		return
+	}
+
+	images := make([]gin.H, 0, len(page.Records))
+	for _, record := range page.Records {
+		images = append(images, a.recordBody(c, record))
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"images":     images,
+		"nextCursor": page.NextCursor,
+	})
+}
+
+// recordBody returns the listing entry for a job record.
+func (a *Api) recordBody(c *gin.Context, record *jobs.Record) gin.H {
+	// outputs are the processed image and its renditions, stored under
+	// the keys given by pipeline.RenditionKey
+	var downloadURL string
+	renditionURLs := map[string]string{}
+	for _, key := range record.Outputs {
+		if name, ok := strings.CutPrefix(key, record.Key()+"."); ok {
+			renditionURLs[name], _ = a.downloadURL(c, record.ImageID, name)
+		} else {
+			downloadURL, _ = a.downloadURL(c, record.ImageID, "")
+		}
+	}
+	return gin.H{
+		"imageId":       record.ImageID,
+		"owner":         record.Owner,
+		"tenant":        record.Tenant,
+		"filename":      record.Filename,
+		"contentType":   record.ContentType,
+		"size":          record.Size,
+		"width":         record.Width,
+		"height":        record.Height,
+		"pipeline":      record.Pipeline,
+		"renditions":    record.Renditions,
+		"workflowId":    record.WorkflowID,
+		"runId":         record.RunID,
+		"state":         record.State,
+		"errorCode":     record.Status.ErrorCode,
+		"downloadUrl":   downloadURL,
+		"renditionUrls": renditionURLs,
+		"createdAt":     record.CreatedAt,
+		"updatedAt":     record.UpdatedAt,
+	}
+}
@@ -0,0 +1,56 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"go.temporal.io/api/serviceerror"
+	"go.uber.org/zap"
+)
+
+// cancelJobHandler asks Temporal to cancel an image processing workflow.
+// The workflow stops its current activity, cleans up after itself and then
+// reports a cancelled status.
+func (a *Api) cancelJobHandler(c *gin.Context) {
+	workflowID := c.Param("workflowId")
+
+	// workflow ids are image ids
+	if !isImageID(workflowID) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"workflowId": workflowID,
+			"error":      "invalid workflow id",
+		})
+		return
+	}
+
+	if !a.authorizeImage(c, workflowID) {
+		return
+	}
+
+	a.logger.Info("received cancel request", zap.String("workflowId", workflowID))
+
+	err := a.client.CancelWorkflow(c.Request.Context(), workflowID, "")
+	var notFound *serviceerror.NotFound
+	if errors.As(err, &notFound) {
+		// also returned for workflows that have already finished
+		c.JSON(http.StatusNotFound, gin.H{
+			"workflowId": workflowID,
+			"error":      "no running workflow",
+		})
+		return
+	}
+	if err != nil {
+		a.logger.Error("failed to cancel workflow", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"workflowId": workflowID,
+			"error":      "failed to cancel workflow",
+		})
+		return
+	}
+
+	c.JSON(http.StatusAccepted, gin.H{
+		"workflowId": workflowID,
+		"message":    "cancellation requested",
+	})
+}
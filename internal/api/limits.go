@@ -0,0 +1,150 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/joberly/demo-temporal/internal/imagetype"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// multipartOverhead is the room allowed in upload request bodies for
+	// multipart boundaries, headers and the other form fields.
+	multipartOverhead = 1 << 20
+	// multipartMemory is the most of a multipart upload held in memory,
+	// the rest is spooled to a temporary file.
+	multipartMemory = 8 << 20
+	// maxFilenameBytes is the length original file names are cut to.
+	maxFilenameBytes = 255
+)
+
+// limitBody refuses requests whose body is declared larger than limit,
+// plus overhead for what surrounds the upload, and stops reading bodies
+// past that. It responds with 413 and returns false when the declared size
+// is too large. A limit of zero leaves the body unlimited.
+func limitBody(c *gin.Context, limit, overhead int64) bool {
+	if limit <= 0 {
+		return true
+	}
+	if c.Request.ContentLength > limit+overhead {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{
+			"error": "upload too large",
+			"limit": limit,
+		})
+		return false
+	}
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, limit+overhead)
+	return true
+}
+
+// isTooLarge reports whether err came from reading past the limit set by
+// limitBody.
+func isTooLarge(err error) bool {
+	var maxBytesErr *http.MaxBytesError
+	return errors.As(err, &maxBytesErr)
+}
+
+// errNotImage is returned by detectImage for files that are not a
+// supported image.
+var errNotImage = errors.New("file is not a supported image")
+
+// typeMismatchError is returned by detectImage when an image is not the
+// type it was declared as.
+type typeMismatchError struct {
+	declared string
+	format   string
+}
+
+func (e *typeMismatchError) Error() string {
+	return fmt.Sprintf("uploaded as %s but contains %s", e.declared, imagetype.ContentType(e.format))
+}
+
+// allowedImageTypes are the content types of the supported images.
+var allowedImageTypes = []string{"image/jpeg", "image/png", "image/gif", "image/webp"}
+
+// detectImage identifies an upload from its leading bytes, returning
+// errNotImage when it is not a supported image or a typeMismatchError when
+// it is not the type it was declared as.
+func detectImage(header []byte, declared string) (string, error) {
+	format := imagetype.Sniff(header)
+	if format == "" {
+		return "", errNotImage
+	}
+	if !imagetype.IsGeneric(declared) && imagetype.FromContentType(declared) != format {
+		return "", &typeMismatchError{declared: declared, format: format}
+	}
+	return format, nil
+}
+
+// sniffImage identifies an upload from its leading bytes, read from r,
+// responding with 415 and returning false when it is not a supported image
+// or not the type it was declared as. The format is returned otherwise.
+func sniffImage(c *gin.Context, r io.Reader, declared string) (string, bool) {
+	header := make([]byte, imagetype.HeaderSize)
+	n, err := io.ReadFull(r, header)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		if isTooLarge(err) {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "upload too large"})
+		} else {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "failed to read upload"})
+		}
+		return "", false
+	}
+
+	format, err := detectImage(header[:n], declared)
+	if err != nil {
+		respondNotImage(c, err)
+		return "", false
+	}
+	return format, true
+}
+
+// isNotImage reports whether err is an upload refused by detectImage.
+func isNotImage(err error) bool {
+	var mismatch *typeMismatchError
+	return errors.Is(err, errNotImage) || errors.As(err, &mismatch)
+}
+
+// respondNotImage responds with 415 to an upload refused by detectImage.
+func respondNotImage(c *gin.Context, err error) {
+	var mismatch *typeMismatchError
+	if errors.As(err, &mismatch) {
+		c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": mismatch.Error()})
+		return
+	}
+	c.JSON(http.StatusUnsupportedMediaType, gin.H{
+		"error":   errNotImage.Error(),
+		"allowed": allowedImageTypes,
+	})
+}
+
+// sanitizeFilename returns the base name of a file name sent by a client
+// with control characters, quotes and leading dots removed, cut to
+// maxFilenameBytes. Names are only kept for display and never used to
+// build paths, this keeps them safe to show and put in headers.
+func sanitizeFilename(name string) string {
+	// clients may send a full path in either style
+	if i := strings.LastIndexAny(name, `/\`); i >= 0 {
+		name = name[i+1:]
+	}
+	name = strings.Map(func(r rune) rune {
+		if r == utf8.RuneError || unicode.IsControl(r) || r == '"' || r == '`' {
+			return -1
+		}
+		return r
+	}, name)
+	name = strings.TrimLeft(strings.TrimSpace(name), ".")
+
+	for len(name) > maxFilenameBytes {
+		_, size := utf8.DecodeLastRuneInString(name)
+		name = name[:len(name)-size]
+	}
+	return strings.TrimSpace(name)
+}
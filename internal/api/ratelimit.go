@@ -0,0 +1,58 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/joberly/demo-temporal/internal/auth"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+// rateLimit returns middleware limiting requests in a route class. Callers
+// are limited by their subject once authenticated and by their address
+// otherwise.
+func (a *Api) rateLimit(class string) gin.HandlerFunc {
+	rule := a.config.RateLimits.Rules[class]
+	if rule.Unlimited() {
+		return func(c *gin.Context) { c.Next() }
+	}
+
+	return func(c *gin.Context) {
+		key := class + ":ip:" + c.ClientIP()
+		if p := principal(c); p.Method != "" && p.Method != auth.MethodNone {
+			key = class + ":subject:" + p.Subject
+		}
+
+		result, err := a.limiter.Allow(c.Request.Context(), key, rule)
+		if err != nil {
+			// let requests through rather than fail them all while the
+			// limiter is unavailable
+			a.logger.Error("failed to check rate limit", zap.String("class", class), zap.Error(err))
+			c.Next()
+			return
+		}
+		if !result.Allowed {
+			c.Header("Retry-After", retryAfterSeconds(result.RetryAfter))
+			c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{
+				"error": "rate limit exceeded",
+				"class": class,
+			})
+			return
+		}
+		c.Header("X-RateLimit-Remaining", strconv.Itoa(result.Remaining))
+		c.Next()
+	}
+}
+
+// retryAfterSeconds returns the Retry-After header value for waiting d,
+// rounded up to a whole number of seconds.
+func retryAfterSeconds(d time.Duration) string {
+	seconds := int64((d + time.Second - 1) / time.Second)
+	if seconds < 1 {
+		seconds = 1
+	}
+	return strconv.FormatInt(seconds, 10)
+}
@@ -0,0 +1,612 @@
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/joberly/demo-temporal/internal/imagetype"
+	"github.com/joberly/demo-temporal/internal/jobs"
+	"github.com/joberly/demo-temporal/internal/storage"
+	"github.com/joberly/demo-temporal/internal/tenant"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"go.temporal.io/api/serviceerror"
+	"go.uber.org/zap"
+)
+
+// Resumable uploads follow the core of the tus protocol, version 1.0.0,
+// with its creation, expiration and termination extensions. The image is
+// sent in chunks, each PATCHed at the offset the upload has reached, and
+// processing starts once the client finalizes the upload.
+const (
+	tusVersion    = "1.0.0"
+	tusExtensions = "creation,expiration,termination"
+	// tusChunkType is the content type chunks must be sent as.
+	tusChunkType = "application/offset+octet-stream"
+)
+
+// errUploadExpired is the reason expired uploads are removed.
+var errUploadExpired = errors.New("upload expired")
+
+// chunkPrefix returns the upload store prefix the chunks of imageID are
+// kept under until the upload is finalized.
+func chunkPrefix(imageID string) string {
+	return "resumable/" + imageID + "/"
+}
+
+// chunkKey returns the upload store key of the chunk of imageID starting
+// at offset. Offsets are zero padded so keys sort in upload order.
+func chunkKey(imageID string, offset int64) string {
+	return fmt.Sprintf("%s%020d", chunkPrefix(imageID), offset)
+}
+
+// tusResumable sets the protocol version on responses and refuses
+// requests made for another version.
+func tusResumable(c *gin.Context) {
+	c.Header("Tus-Resumable", tusVersion)
+	if version := c.GetHeader("Tus-Resumable"); version != "" && version != tusVersion {
+		c.Header("Tus-Version", tusVersion)
+		c.AbortWithStatusJSON(http.StatusPreconditionFailed, gin.H{"error": "unsupported tus version"})
+		return
+	}
+	c.Next()
+}
+
+// resumableOptionsHandler describes the protocol supported to clients.
+func (a *Api) resumableOptionsHandler(c *gin.Context) {
+	c.Header("Tus-Version", tusVersion)
+	c.Header("Tus-Extension", tusExtensions)
+	if a.config.MaxUploadBytes > 0 {
+		c.Header("Tus-Max-Size", strconv.FormatInt(a.config.MaxUploadBytes, 10))
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// createResumableHandler creates a resumable upload of Upload-Length bytes.
+// The filename, filetype, owner, pipeline, renditions and webhookUrl of the
+// upload may be given in Upload-Metadata.
+func (a *Api) createResumableHandler(c *gin.Context) {
+	length, err := strconv.ParseInt(c.GetHeader("Upload-Length"), 10, 64)
+	if err != nil || length <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Upload-Length is required"})
+		return
+	}
+	if maxBytes := a.config.MaxUploadBytes; maxBytes > 0 && length > maxBytes {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "upload too large", "limit": maxBytes})
+		return
+	}
+
+	metadata, err := parseUploadMetadata(c.GetHeader("Upload-Metadata"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid Upload-Metadata: " + err.Error()})
+		return
+	}
+	steps, err := parsePipeline(metadata["pipeline"])
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid pipeline: " + err.Error()})
+		return
+	}
+	renditions, err := parseRenditions(metadata["renditions"])
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid renditions: " + err.Error()})
+		return
+	}
+	webhook, err := parseWebhook(metadata["webhookUrl"], principal(c).Tenant)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid webhook: " + err.Error()})
+		return
+	}
+	// the content is sniffed when the upload is finalized, only refuse
+	// what is declared as something else now
+	contentType := metadata["filetype"]
+	if !imagetype.IsGeneric(contentType) && imagetype.FromContentType(contentType) == "" {
+		c.JSON(http.StatusUnsupportedMediaType, gin.H{
+			"error":   "file is not a supported image",
+			"allowed": []string{"image/jpeg", "image/png", "image/gif", "image/webp"},
+		})
+		return
+	}
+
+	p := principal(c)
+	if err := a.checkQuota(c.Request.Context(), p.Tenant, length); err != nil {
+		if !respondQuota(c, p.Tenant, err) {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to check quota"})
+		}
+		return
+	}
+
+	imageID := uuid.New().String()
+	now := time.Now().UTC()
+	record := uploadRecord{
+		ImageID:     imageID,
+		Owner:       a.owner(c, metadata["owner"]),
+		Tenant:      p.Tenant,
+		Filename:    sanitizeFilename(metadata["filename"]),
+		ContentType: contentType,
+		Pipeline:    steps,
+		Renditions:  renditions,
+		Webhook:     webhook,
+		CreatedAt:   now,
+		ExpiresAt:   now.Add(a.config.ResumableUploadExpiry),
+		Resumable:   true,
+		Length:      length,
+	}
+	if err := a.putUploadRecord(c.Request.Context(), &record); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create upload"})
+		return
+	}
+
+	a.logger.Info("created resumable upload",
+		zap.String("imageId", imageID),
+		zap.Int64("length", length),
+	)
+
+	uploadURL := a.config.PublicURL + "/resumable/" + imageID
+	c.Header("Location", uploadURL)
+	c.Header("Upload-Expires", record.ExpiresAt.Format(http.TimeFormat))
+	c.JSON(http.StatusCreated,
+		gin.H{
+			"imageId":     imageID,
+			"uploadUrl":   uploadURL,
+			"expiresAt":   record.ExpiresAt,
+			"completeUrl": uploadURL + "/complete",
+		},
+	)
+}
+
+// headResumableHandler reports how much of a resumable upload has been
+// received.
+func (a *Api) headResumableHandler(c *gin.Context) {
+	record, ok := a.resumableUpload(c)
+	if !ok {
+		return
+	}
+	offset, _, err := a.resumableOffset(c.Request.Context(), record)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to read upload"})
+		return
+	}
+
+	c.Header("Cache-Control", "no-store")
+	c.Header("Upload-Offset", strconv.FormatInt(offset, 10))
+	c.Header("Upload-Length", strconv.FormatInt(record.Length, 10))
+	if !record.ExpiresAt.IsZero() {
+		c.Header("Upload-Expires", record.ExpiresAt.Format(http.TimeFormat))
+	}
+	c.Status(http.StatusOK)
+}
+
+// patchResumableHandler stores a chunk of a resumable upload sent at the
+// offset the upload has reached. Each chunk is stored whole or not at all,
+// so a client whose request fails asks for the offset and sends the chunk
+// again.
+func (a *Api) patchResumableHandler(c *gin.Context) {
+	record, ok := a.resumableUpload(c)
+	if !ok {
+		return
+	}
+	imageID := record.ImageID
+	if c.ContentType() != tusChunkType {
+		c.JSON(http.StatusUnsupportedMediaType, gin.H{
+			"imageId": imageID,
+			"error":   "chunks must be sent as " + tusChunkType,
+		})
+		return
+	}
+	offset, err := strconv.ParseInt(c.GetHeader("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"imageId": imageID, "error": "Upload-Offset is required"})
+		return
+	}
+
+	current, _, err := a.resumableOffset(c.Request.Context(), record)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"imageId": imageID, "error": "failed to save chunk"})
+		return
+	}
+	if offset != current {
+		c.Header("Upload-Offset", strconv.FormatInt(current, 10))
+		c.JSON(http.StatusConflict, gin.H{
+			"imageId": imageID,
+			"error":   "offset does not match the upload",
+			"offset":  current,
+		})
+		return
+	}
+	remaining := record.Length - current
+	if remaining == 0 {
+		c.JSON(http.StatusConflict, gin.H{"imageId": imageID, "error": "upload already complete"})
+		return
+	}
+	if c.Request.ContentLength > remaining {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{
+			"imageId": imageID,
+			"error":   "chunk exceeds the upload length",
+			"limit":   remaining,
+		})
+		return
+	}
+	if c.Request.ContentLength == 0 {
+		c.Header("Upload-Offset", strconv.FormatInt(current, 10))
+		c.Status(http.StatusNoContent)
+		return
+	}
+	if !limitBody(c, remaining, 0) {
+		return
+	}
+
+	key := chunkKey(imageID, offset)
+	err = a.stores.Upload.Put(c.Request.Context(), key, c.Request.Body, &storage.PutOptions{
+		ContentType: "application/octet-stream",
+		Size:        c.Request.ContentLength,
+	})
+	if isTooLarge(err) {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{
+			"imageId": imageID,
+			"error":   "chunk exceeds the upload length",
+			"limit":   remaining,
+		})
+		return
+	}
+	if err != nil {
+		a.logger.Error("failed to save chunk", zap.String("imageId", imageID), zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"imageId": imageID, "error": "failed to save chunk"})
+		return
+	}
+	info, err := a.stores.Upload.Stat(c.Request.Context(), key)
+	if err != nil {
+		a.logger.Error("failed to stat chunk", zap.String("imageId", imageID), zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"imageId": imageID, "error": "failed to save chunk"})
+		return
+	}
+
+	c.Header("Upload-Offset", strconv.FormatInt(offset+info.Size, 10))
+	c.Header("Upload-Expires", record.ExpiresAt.Format(http.TimeFormat))
+	c.Status(http.StatusNoContent)
+}
+
+// completeResumableHandler joins the chunks of a fully received resumable
+// upload into the image and starts processing it.
+func (a *Api) completeResumableHandler(c *gin.Context) {
+	record, ok := a.resumableUpload(c)
+	if !ok {
+		return
+	}
+	imageID := record.ImageID
+
+	if !record.Assembled {
+		offset, chunks, err := a.resumableOffset(c.Request.Context(), record)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"imageId": imageID, "error": "failed to start process"})
+			return
+		}
+		if offset != record.Length {
+			c.Header("Upload-Offset", strconv.FormatInt(offset, 10))
+			c.JSON(http.StatusConflict, gin.H{
+				"imageId": imageID,
+				"error":   "upload incomplete",
+				"offset":  offset,
+				"length":  record.Length,
+			})
+			return
+		}
+		if !a.assembleResumable(c, record, chunks) {
+			return
+		}
+	}
+
+	wfRun, err := a.completeUpload(c.Request.Context(), imageID, principal(c))
+	a.respondComplete(c, imageID, wfRun, err)
+}
+
+// assembleResumable joins the chunks of record into the image, checking it
+// is a supported image on the way, and removes them. It responds and
+// returns false when the image can't be assembled.
+func (a *Api) assembleResumable(c *gin.Context, record *uploadRecord, chunks []storage.ObjectInfo) bool {
+	ctx := c.Request.Context()
+	imageID := record.ImageID
+
+	chunkReader := &chunkReader{ctx: ctx, store: a.stores.Upload, chunks: chunks}
+	defer chunkReader.Close()
+	body := bufio.NewReaderSize(chunkReader, imagetype.HeaderSize)
+	header, _ := body.Peek(imagetype.HeaderSize)
+	format, ok := sniffImage(c, bytes.NewReader(header), record.ContentType)
+	if !ok {
+		return false
+	}
+	record.ContentType = imagetype.ContentType(format)
+
+	err := a.stores.Upload.Put(ctx, tenant.Key(record.Tenant, imageID), body, &storage.PutOptions{
+		ContentType: record.ContentType,
+		Size:        record.Length,
+	})
+	if err != nil {
+		a.logger.Error("failed to assemble upload", zap.String("imageId", imageID), zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"imageId": imageID, "error": "failed to start process"})
+		return false
+	}
+
+	record.Assembled = true
+	if err := a.putUploadRecord(ctx, record); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"imageId": imageID, "error": "failed to start process"})
+		return false
+	}
+	a.deleteChunks(ctx, imageID)
+
+	a.logger.Info("assembled resumable upload",
+		zap.String("imageId", imageID),
+		zap.Int("chunks", len(chunks)),
+	)
+	return true
+}
+
+// deleteResumableHandler abandons a resumable upload.
+func (a *Api) deleteResumableHandler(c *gin.Context) {
+	record, ok := a.resumableUpload(c)
+	if !ok {
+		return
+	}
+	imageID := record.ImageID
+	if record.Assembled {
+		c.JSON(http.StatusConflict, gin.H{"imageId": imageID, "error": "upload already complete"})
+		return
+	}
+
+	a.deleteChunks(c.Request.Context(), imageID)
+	if err := a.stores.Upload.Delete(c.Request.Context(), uploadRecordKey(imageID)); err != nil {
+		a.logger.Error("failed to delete upload record", zap.String("imageId", imageID), zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"imageId": imageID, "error": "failed to delete upload"})
+		return
+	}
+
+	a.logger.Info("deleted resumable upload", zap.String("imageId", imageID))
+	c.Status(http.StatusNoContent)
+}
+
+// resumableUpload returns the record of the resumable upload in the
+// request, responding and returning false when there is no such upload
+// for the caller, who may be an admin, or it has expired. Uploads being processed are found
+// from their job record.
+func (a *Api) resumableUpload(c *gin.Context) (*uploadRecord, bool) {
+	imageID := c.Param("imageId")
+	if !isImageID(imageID) {
+		c.JSON(http.StatusBadRequest, gin.H{"imageId": imageID, "error": "invalid image id"})
+		return nil, false
+	}
+
+	record, err := a.getUploadRecord(c.Request.Context(), imageID)
+	if errors.Is(err, errUploadNotFound) {
+		record, err = a.startedResumable(c.Request.Context(), imageID)
+	}
+	if errors.Is(err, errUploadNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"imageId": imageID, "error": "upload not found"})
+		return nil, false
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"imageId": imageID, "error": "failed to read upload"})
+		return nil, false
+	}
+	p := principal(c)
+	if !record.Resumable || (!p.Admin && (!p.Owns(record.Owner) || p.Tenant != record.Tenant)) {
+		c.JSON(http.StatusNotFound, gin.H{"imageId": imageID, "error": "upload not found"})
+		return nil, false
+	}
+	if !record.Assembled && time.Now().After(record.ExpiresAt) {
+		c.JSON(http.StatusGone, gin.H{"imageId": imageID, "error": "upload expired"})
+		return nil, false
+	}
+	return record, true
+}
+
+// resumableOffset returns how many bytes of record have been received and
+// the chunks holding them, in order.
+func (a *Api) resumableOffset(ctx context.Context, record *uploadRecord) (int64, []storage.ObjectInfo, error) {
+	if record.Assembled {
+		return record.Length, nil, nil
+	}
+	infos, err := a.stores.Upload.List(ctx, chunkPrefix(record.ImageID))
+	if err != nil {
+		a.logger.Error("failed to list chunks", zap.String("imageId", record.ImageID), zap.Error(err))
+		return 0, nil, err
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Key < infos[j].Key })
+
+	// only chunks following on from each other count
+	var offset int64
+	var chunks []storage.ObjectInfo
+	for _, info := range infos {
+		if info.Key != chunkKey(record.ImageID, offset) {
+			break
+		}
+		offset += info.Size
+		chunks = append(chunks, info)
+	}
+	return offset, chunks, nil
+}
+
+// deleteChunks removes the chunks of imageID, logging failures since
+// leftover chunks are removed again once the upload expires.
+func (a *Api) deleteChunks(ctx context.Context, imageID string) {
+	infos, err := a.stores.Upload.List(ctx, chunkPrefix(imageID))
+	if err != nil {
+		a.logger.Error("failed to list chunks", zap.String("imageId", imageID), zap.Error(err))
+		return
+	}
+	for _, info := range infos {
+		if err := a.stores.Upload.Delete(ctx, info.Key); err != nil {
+			a.logger.Error("failed to delete chunk", zap.String("key", info.Key), zap.Error(err))
+		}
+	}
+}
+
+// sweepResumableUploads removes the chunks and records of expired resumable
+// uploads every interval. It never returns.
+func (a *Api) sweepResumableUploads(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		a.sweepResumableUploadsOnce(context.Background())
+	}
+}
+
+func (a *Api) sweepResumableUploadsOnce(ctx context.Context) {
+	infos, err := a.stores.Upload.List(ctx, "pending/")
+	if err != nil {
+		a.logger.Error("failed to list uploads", zap.Error(err))
+		return
+	}
+
+	now := time.Now()
+	var swept int
+	for _, info := range infos {
+		imageID := strings.TrimSuffix(strings.TrimPrefix(info.Key, "pending/"), ".json")
+		record, err := a.getUploadRecord(ctx, imageID)
+		if err != nil || !record.Resumable || now.Before(record.ExpiresAt) {
+			continue
+		}
+		a.deleteChunks(ctx, imageID)
+		if record.Assembled {
+			// completing removes the record once processing has started,
+			// this catches records left behind when that failed
+			started, err := a.uploadStarted(ctx, imageID)
+			if err != nil {
+				a.logger.Error("failed to check upload", zap.String("imageId", imageID), zap.Error(err))
+				continue
+			}
+			// otherwise the assembled image was never processed and is
+			// abandoned along with the record
+			if !started {
+				a.rejectUpload(ctx, tenant.Key(record.Tenant, imageID), errUploadExpired)
+			}
+		}
+		if err := a.stores.Upload.Delete(ctx, info.Key); err != nil {
+			a.logger.Error("failed to delete upload record", zap.String("imageId", imageID), zap.Error(err))
+			continue
+		}
+		swept++
+	}
+	if swept > 0 {
+		a.logger.Info("removed expired resumable uploads", zap.Int("count", swept))
+	}
+}
+
+// uploadStarted reports whether processing of an upload has started.
+func (a *Api) uploadStarted(ctx context.Context, imageID string) (bool, error) {
+	job, err := a.jobs.Get(ctx, imageID)
+	if err == nil && job.RunID != "" {
+		return true, nil
+	}
+	if err != nil && !errors.Is(err, jobs.ErrNotFound) {
+		return false, err
+	}
+	_, err = a.client.DescribeWorkflowExecution(ctx, imageID, "")
+	var notFound *serviceerror.NotFound
+	if errors.As(err, &notFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// startedResumable stands in for the record of a resumable upload whose
+// processing has started, which completing removes, so that the upload is
+// still reported as complete and finalizing again returns its workflow.
+// Images that weren't sent as resumable uploads are not found.
+func (a *Api) startedResumable(ctx context.Context, imageID string) (*uploadRecord, error) {
+	job, err := a.jobs.Get(ctx, imageID)
+	if errors.Is(err, jobs.ErrNotFound) || (err == nil && !job.Resumable) {
+		return nil, errUploadNotFound
+	}
+	if err != nil {
+		a.logger.Error("failed to get job record", zap.Error(err))
+		return nil, err
+	}
+	return &uploadRecord{
+		ImageID:     imageID,
+		Owner:       job.Owner,
+		Tenant:      job.Tenant,
+		Filename:    job.Filename,
+		ContentType: job.ContentType,
+		CreatedAt:   job.CreatedAt,
+		Resumable:   true,
+		Length:      job.Size,
+		Assembled:   true,
+	}, nil
+}
+
+// chunkReader reads the chunks of an upload one after another, opening
+// each only once the one before has been read.
+type chunkReader struct {
+	ctx     context.Context
+	store   storage.Blob
+	chunks  []storage.ObjectInfo
+	current io.ReadCloser
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	for {
+		if r.current == nil {
+			if len(r.chunks) == 0 {
+				return 0, io.EOF
+			}
+			reader, _, err := r.store.Get(r.ctx, r.chunks[0].Key)
+			if err != nil {
+				return 0, err
+			}
+			r.current = reader
+			r.chunks = r.chunks[1:]
+		}
+
+		n, err := r.current.Read(p)
+		if errors.Is(err, io.EOF) {
+			r.current.Close()
+			r.current = nil
+			err = nil
+		}
+		if n > 0 || err != nil {
+			return n, err
+		}
+	}
+}
+
+// Close closes the chunk being read, if any.
+func (r *chunkReader) Close() error {
+	if r.current == nil {
+		return nil
+	}
+	err := r.current.Close()
+	r.current = nil
+	return err
+}
+
+// parseUploadMetadata decodes an Upload-Metadata header, a comma separated
+// list of keys each followed by a space and its base64 encoded value.
+// Values may be left out.
+func parseUploadMetadata(header string) (map[string]string, error) {
+	metadata := map[string]string{}
+	if strings.TrimSpace(header) == "" {
+		return metadata, nil
+	}
+	for _, pair := range strings.Split(header, ",") {
+		key, encoded, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		if key == "" {
+			return nil, errors.New("empty key")
+		}
+		value, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+		if err != nil {
+			return nil, fmt.Errorf("%s: value is not base64", key)
+		}
+		metadata[key] = string(value)
+	}
+	return metadata, nil
+}
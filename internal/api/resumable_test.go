@@ -0,0 +1,44 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/joberly/demo-temporal/internal/jobs"
+
+	"go.uber.org/zap"
+)
+
+func TestStartedResumable(t *testing.T) {
+	ctx := context.Background()
+	store := jobs.NewMemoryStore()
+	for _, record := range []*jobs.Record{
+		{ImageID: "resumable", Owner: "alice", Size: 42, Resumable: true},
+		{ImageID: "direct", Owner: "alice", Size: 42},
+	} {
+		if err := store.Put(ctx, record); err != nil {
+			t.Fatal(err)
+		}
+	}
+	a := &Api{logger: zap.NewNop(), jobs: store}
+
+	record, err := a.startedResumable(ctx, "resumable")
+	if err != nil || !record.Resumable || !record.Assembled || record.Length != 42 || record.Owner != "alice" {
+		t.Errorf("startedResumable = %+v, %v, want the assembled upload", record, err)
+	}
+	// images sent any other way aren't resumable uploads
+	for _, imageID := range []string{"direct", "missing"} {
+		if _, err := a.startedResumable(ctx, imageID); !errors.Is(err, errUploadNotFound) {
+			t.Errorf("startedResumable(%q) = %v, want errUploadNotFound", imageID, err)
+		}
+	}
+
+	// processing again keeps the record marked
+	if err := a.recordUpload(ctx, &jobs.Record{ImageID: "resumable", Owner: "alice"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.startedResumable(ctx, "resumable"); err != nil {
+		t.Errorf("startedResumable after processing again = %v", err)
+	}
+}
@@ -0,0 +1,171 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	enumspb "go.temporal.io/api/enums/v1"
+	"go.temporal.io/api/serviceerror"
+	"go.uber.org/zap"
+	"golang.org/x/net/websocket"
+)
+
+// statusEvents are the history events after which the status of a workflow
+// may have changed. The status only changes while the workflow runs, which
+// ends with a completed workflow task, or when the workflow closes.
+var statusEvents = map[enumspb.EventType]bool{
+	enumspb.EVENT_TYPE_WORKFLOW_TASK_COMPLETED:             true,
+	enumspb.EVENT_TYPE_WORKFLOW_EXECUTION_COMPLETED:        true,
+	enumspb.EVENT_TYPE_WORKFLOW_EXECUTION_FAILED:           true,
+	enumspb.EVENT_TYPE_WORKFLOW_EXECUTION_CANCELED:         true,
+	enumspb.EVENT_TYPE_WORKFLOW_EXECUTION_TERMINATED:       true,
+	enumspb.EVENT_TYPE_WORKFLOW_EXECUTION_TIMED_OUT:        true,
+	enumspb.EVENT_TYPE_WORKFLOW_EXECUTION_CONTINUED_AS_NEW: true,
+}
+
+// workflowRun identifies a run of a workflow and how far its history had
+// got when it was looked up.
+type workflowRun struct {
+	workflowID    string
+	runID         string
+	historyLength int64
+}
+
+// describeRun looks up the latest run of the workflow named in the request,
+// responding with an error when there is none.
+func (a *Api) describeRun(c *gin.Context) (*workflowRun, bool) {
+	workflowID := c.Param("workflowId")
+	if !a.authorizeImage(c, workflowID) {
+		return nil, false
+	}
+
+	resp, err := a.client.DescribeWorkflowExecution(c.Request.Context(), workflowID, "")
+	var notFound *serviceerror.NotFound
+	var invalid *serviceerror.InvalidArgument
+	if errors.As(err, &notFound) || errors.As(err, &invalid) {
+		a.logger.Info("workflow not found", zap.String("workflowId", workflowID))
+		c.JSON(http.StatusNotFound, gin.H{
+			"workflowId": workflowID,
+			"error":      "not found",
+		})
+		return nil, false
+	}
+	if err != nil {
+		a.logger.Error("failed to get status", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get execution status"})
+		return nil, false
+	}
+
+	info := resp.GetWorkflowExecutionInfo()
+	return &workflowRun{
+		workflowID:    workflowID,
+		runID:         info.GetExecution().GetRunId(),
+		historyLength: info.GetHistoryLength(),
+	}, true
+}
+
+// watchStatus calls send with the status of a workflow run and again each
+// time it changes until the run closes. Rather than polling, it long-polls
+// the run's history and only queries the status after events that can
+// change it.
+func (a *Api) watchStatus(ctx context.Context, run *workflowRun, send func(gin.H) error) error {
+	var last []byte
+	push := func() error {
+		status, err := a.queryStatus(ctx, run.workflowID, run.runID)
+		if err != nil {
+			return err
+		}
+		body := statusBody(run.workflowID, run.runID, status)
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		if bytes.Equal(encoded, last) {
+			return nil
+		}
+		last = encoded
+		return send(body)
+	}
+
+	if err := push(); err != nil {
+		return err
+	}
+
+	iter := a.client.GetWorkflowHistory(ctx, run.workflowID, run.runID, true,
+		enumspb.HISTORY_EVENT_FILTER_TYPE_ALL_EVENT)
+	for iter.HasNext() {
+		event, err := iter.Next()
+		if err != nil {
+			return err
+		}
+		// the first push already covers events from before we started
+		if event.GetEventId() <= run.historyLength || !statusEvents[event.GetEventType()] {
+			continue
+		}
+		if err := push(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// statusStreamHandler streams the status of a workflow as server-sent
+// events until the workflow closes.
+func (a *Api) statusStreamHandler(c *gin.Context) {
+	run, ok := a.describeRun(c)
+	if !ok {
+		return
+	}
+
+	a.logger.Info("streaming status",
+		zap.String("workflowId", run.workflowID),
+		zap.String("runId", run.runID))
+
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no")
+	err := a.watchStatus(c.Request.Context(), run, func(body gin.H) error {
+		c.SSEvent("status", body)
+		c.Writer.Flush()
+		return nil
+	})
+	if err != nil && c.Request.Context().Err() == nil {
+		c.SSEvent("error", gin.H{"error": "failed to get status"})
+		c.Writer.Flush()
+	}
+}
+
+// statusSocketHandler streams the status of a workflow as JSON messages
+// over a WebSocket until the workflow closes.
+func (a *Api) statusSocketHandler(c *gin.Context) {
+	run, ok := a.describeRun(c)
+	if !ok {
+		return
+	}
+
+	websocket.Handler(func(ws *websocket.Conn) {
+		defer ws.Close()
+		a.logger.Info("streaming status over websocket",
+			zap.String("workflowId", run.workflowID),
+			zap.String("runId", run.runID))
+
+		// clients never send anything, so stop when their side closes
+		ctx, cancel := context.WithCancel(c.Request.Context())
+		defer cancel()
+		go func() {
+			io.Copy(io.Discard, ws)
+			cancel()
+		}()
+
+		err := a.watchStatus(ctx, run, func(body gin.H) error {
+			return websocket.JSON.Send(ws, body)
+		})
+		if err != nil && ctx.Err() == nil {
+			websocket.JSON.Send(ws, gin.H{"error": "failed to get status"})
+		}
+	}).ServeHTTP(c.Writer, c.Request)
+}
@@ -0,0 +1,281 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/joberly/demo-temporal/internal/jobs"
+	"github.com/joberly/demo-temporal/workflows"
+
+	"github.com/gin-gonic/gin"
+	enumspb "go.temporal.io/api/enums/v1"
+	"go.temporal.io/api/serviceerror"
+	"go.uber.org/zap"
+)
+
+// concurrentJobsRetryAfter is how long clients are asked to wait when a
+// tenant is running as many jobs as it may.
+const concurrentJobsRetryAfter = 30 * time.Second
+
+// quotaError is returned when an upload would take a tenant over its quota.
+type quotaError struct {
+	// Status is the HTTP status reporting the error.
+	Status  int
+	Message string
+	Limit   int64
+	// RetryAfter is how long until the upload may succeed, zero when it
+	// never will.
+	RetryAfter time.Duration
+}
+
+func (e *quotaError) Error() string {
+	return fmt.Sprintf("%s (limit %d)", e.Message, e.Limit)
+}
+
+// checkQuota returns a quotaError when processing an image of size bytes
+// would take tenant over its quota. Size is zero when it isn't known yet.
+// Quotas are checked rather than reserved, so concurrent uploads may take a
+// tenant slightly over them.
+func (a *Api) checkQuota(ctx context.Context, t string, size int64) error {
+	if err := a.checkImageSize(t, size); err != nil {
+		return err
+	}
+	return a.checkUsage(ctx, t, 1, size)
+}
+
+// checkUsage returns a quotaError when starting n more jobs, processing
+// size bytes in all, would take tenant over its quota. The size of each
+// image is checked on its own with checkImageSize.
+func (a *Api) checkUsage(ctx context.Context, t string, n int, size int64) error {
+	quota := a.config.Quotas.For(t)
+	if quota.MaxConcurrentJobs <= 0 && quota.MaxBytesPerDay <= 0 {
+		return nil
+	}
+
+	// days start at midnight UTC
+	now := time.Now().UTC()
+	day := now.Truncate(24 * time.Hour)
+	usage, err := a.jobs.Usage(ctx, t, day)
+	if err != nil {
+		a.logger.Error("failed to get tenant usage", zap.String("tenant", t), zap.Error(err))
+		return err
+	}
+	if quota.MaxConcurrentJobs > 0 && n > quota.MaxConcurrentJobs {
+		return &quotaError{
+			Status:  http.StatusRequestEntityTooLarge,
+			Message: "more images than may be processed at once",
+			Limit:   int64(quota.MaxConcurrentJobs),
+		}
+	}
+	// jobs whose outcome was never recorded would hold the tenant at its
+	// limit for ever, so settle them before refusing
+	if quota.MaxConcurrentJobs > 0 && usage.ActiveJobs+n > quota.MaxConcurrentJobs {
+		settled, err := a.reconcileJobs(ctx, t)
+		if err != nil {
+			a.logger.Error("failed to reconcile jobs", zap.String("tenant", t), zap.Error(err))
+		}
+		usage.ActiveJobs -= settled
+	}
+	if quota.MaxConcurrentJobs > 0 && usage.ActiveJobs+n > quota.MaxConcurrentJobs {
+		return &quotaError{
+			Status:     http.StatusTooManyRequests,
+			Message:    "too many images being processed",
+			Limit:      int64(quota.MaxConcurrentJobs),
+			RetryAfter: concurrentJobsRetryAfter,
+		}
+	}
+	if quota.MaxBytesPerDay > 0 && usage.Bytes+size > quota.MaxBytesPerDay {
+		return &quotaError{
+			Status:     http.StatusTooManyRequests,
+			Message:    "daily upload quota exceeded",
+			Limit:      quota.MaxBytesPerDay,
+			RetryAfter: day.Add(24 * time.Hour).Sub(now),
+		}
+	}
+	return nil
+}
+
+// reconcileAfter is how long a job record must go without an update before
+// it is checked against its workflow.
+const reconcileAfter = time.Minute
+
+// activeStates are the states of jobs that have yet to finish.
+var activeStates = []string{
+	workflows.StateQueued,
+	workflows.StateValidating,
+	workflows.StateProcessing,
+}
+
+// jobOutcome is how a job the worker did not record the outcome of ended.
+type jobOutcome struct {
+	state string
+	// status describes the outcome like the workflow status would.
+	status string
+	code   string
+	reason string
+}
+
+// closedOutcomes maps the statuses of closed workflows to the outcome of
+// their job.
+var closedOutcomes = map[enumspb.WorkflowExecutionStatus]jobOutcome{
+	enumspb.WORKFLOW_EXECUTION_STATUS_COMPLETED:  {workflows.StateCompleted, "processing complete", "", ""},
+	enumspb.WORKFLOW_EXECUTION_STATUS_FAILED:     {workflows.StateFailed, "error: workflow failed", workflows.ErrorCodeInternal, "workflow failed"},
+	enumspb.WORKFLOW_EXECUTION_STATUS_TIMED_OUT:  {workflows.StateFailed, "error: workflow timed out", workflows.ErrorCodeTimeout, "workflow timed out"},
+	enumspb.WORKFLOW_EXECUTION_STATUS_TERMINATED: {workflows.StateFailed, "error: workflow terminated", workflows.ErrorCodeInternal, "workflow terminated"},
+	enumspb.WORKFLOW_EXECUTION_STATUS_CANCELED:   {workflows.StateCancelled, "cancelled", workflows.ErrorCodeCancelled, ""},
+}
+
+// reconcileJobs settles the records of tenant's jobs that are still active
+// although their workflow has closed without recording its outcome, as
+// when it was terminated, timed out or predates job records. Jobs whose
+// workflow can't be found are failed once UnstartedJobExpiry has passed.
+// It returns the number of jobs settled.
+func (a *Api) reconcileJobs(ctx context.Context, t string) (int, error) {
+	cutoff := time.Now().Add(-reconcileAfter)
+	settled := 0
+	for _, state := range activeStates {
+		filter := jobs.Filter{Tenant: t, State: state, Limit: jobs.MaxLimit}
+		for {
+			page, err := a.jobs.List(ctx, filter)
+			if err != nil {
+				return settled, err
+			}
+			for _, record := range page.Records {
+				// the default tenant's filter matches every tenant
+				if record.Tenant != t || record.UpdatedAt.After(cutoff) {
+					continue
+				}
+				ok, err := a.reconcileJob(ctx, record)
+				if err != nil {
+					return settled, err
+				}
+				if ok {
+					settled++
+				}
+			}
+			if page.NextCursor == "" {
+				break
+			}
+			filter.Cursor = page.NextCursor
+		}
+	}
+	return settled, nil
+}
+
+// reconcileJob settles the record of a job whose workflow has closed or
+// can't be found, reporting whether it did.
+func (a *Api) reconcileJob(ctx context.Context, record *jobs.Record) (bool, error) {
+	var outcome jobOutcome
+	desc, err := a.client.DescribeWorkflowExecution(ctx, record.ImageID, "")
+	var notFound *serviceerror.NotFound
+	var invalid *serviceerror.InvalidArgument
+	switch {
+	case errors.As(err, &notFound) || errors.As(err, &invalid):
+		// images of a batch have no workflow until their turn comes
+		if time.Since(record.UpdatedAt) < a.config.UnstartedJobExpiry {
+			return false, nil
+		}
+		outcome = jobOutcome{workflows.StateFailed, "error: workflow not found", workflows.ErrorCodeInternal, "workflow not found"}
+	case err != nil:
+		return false, err
+	default:
+		var closed bool
+		outcome, closed = closedOutcomes[desc.GetWorkflowExecutionInfo().GetStatus()]
+		if !closed {
+			return false, nil
+		}
+	}
+
+	settled := false
+	err = a.jobs.Update(ctx, record.ImageID, func(r *jobs.Record) {
+		// the worker may have recorded the outcome since
+		if r.Active() {
+			endJob(r, outcome)
+			settled = true
+		}
+	})
+	if err != nil {
+		return false, err
+	}
+	if settled {
+		a.logger.Info("settled job without a recorded outcome",
+			zap.String("imageId", record.ImageID), zap.String("state", outcome.state))
+	}
+	return settled, nil
+}
+
+// checkImageSize returns a quotaError when an image of size bytes is larger
+// than tenant accepts.
+func (a *Api) checkImageSize(t string, size int64) error {
+	quota := a.config.Quotas.For(t)
+	if quota.MaxImageBytes > 0 && size > quota.MaxImageBytes {
+		return &quotaError{
+			Status:  http.StatusRequestEntityTooLarge,
+			Message: "image exceeds the maximum image size",
+			Limit:   quota.MaxImageBytes,
+		}
+	}
+	return nil
+}
+
+// respondQuota responds to a request refused by checkQuota, returning
+// false when err is not a quotaError.
+func respondQuota(c *gin.Context, t string, err error) bool {
+	var qerr *quotaError
+	if !errors.As(err, &qerr) {
+		return false
+	}
+	if qerr.RetryAfter > 0 {
+		c.Header("Retry-After", retryAfterSeconds(qerr.RetryAfter))
+	}
+	c.JSON(qerr.Status, gin.H{
+		"error":  qerr.Message,
+		"tenant": t,
+		"limit":  qerr.Limit,
+	})
+	return true
+}
+
+// respondImageQuota responds to a request refused by checkImageSize for
+// one of its images, named by field.
+func respondImageQuota(c *gin.Context, t, field, value string, err error) {
+	var qerr *quotaError
+	if !errors.As(err, &qerr) {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to check quota"})
+		return
+	}
+	c.JSON(qerr.Status, gin.H{
+		field:    value,
+		"error":  qerr.Message,
+		"tenant": t,
+		"limit":  qerr.Limit,
+	})
+}
+
+// imageKey returns the storage key of imageID, which is kept under the
+// prefix of the tenant that uploaded it. Images without a job record
+// predate tenants and belong to the default tenant.
+func (a *Api) imageKey(ctx context.Context, imageID string) (string, error) {
+	record, err := a.jobs.Get(ctx, imageID)
+	if errors.Is(err, jobs.ErrNotFound) {
+		return imageID, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return record.Key(), nil
+}
+
+// searchAttributes returns the search attributes of the workflow
+// processing an image of tenant, letting workflows be listed by tenant in
+// Temporal. The attribute must be registered as a keyword with the
+// Temporal namespace.
+func (a *Api) searchAttributes(t string) map[string]any {
+	if a.config.TenantSearchAttribute == "" || t == "" {
+		return nil
+	}
+	return map[string]any{a.config.TenantSearchAttribute: t}
+}
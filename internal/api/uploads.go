@@ -0,0 +1,555 @@
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/joberly/demo-temporal/activities"
+	"github.com/joberly/demo-temporal/internal/auth"
+	"github.com/joberly/demo-temporal/internal/imagetype"
+	"github.com/joberly/demo-temporal/internal/jobs"
+	"github.com/joberly/demo-temporal/internal/pipeline"
+	"github.com/joberly/demo-temporal/internal/storage"
+	"github.com/joberly/demo-temporal/internal/tenant"
+	"github.com/joberly/demo-temporal/workflows"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"go.temporal.io/sdk/client"
+	"go.uber.org/zap"
+)
+
+var (
+	errUploadNotFound   = errors.New("upload not found")
+	errUploadIncomplete = errors.New("upload incomplete")
+	errUploadTooLarge   = errors.New("upload too large")
+)
+
+// uploadRecord tracks a direct upload from creation until the image
+// processing workflow is started.
+type uploadRecord struct {
+	ImageID     string               `json:"imageId"`
+	Owner       string               `json:"owner,omitempty"`
+	Tenant      string               `json:"tenant,omitempty"`
+	Filename    string               `json:"filename,omitempty"`
+	ContentType string               `json:"contentType,omitempty"`
+	Pipeline    pipeline.Pipeline    `json:"pipeline,omitempty"`
+	Renditions  []pipeline.Rendition `json:"renditions,omitempty"`
+	Webhook     *activities.Webhook  `json:"webhook,omitempty"`
+	CreatedAt   time.Time            `json:"createdAt"`
+	ExpiresAt   time.Time            `json:"expiresAt"`
+	// Resumable uploads are sent in chunks of Length bytes in all, see
+	// resumable.go. Assembled is set once the chunks have been joined.
+	Resumable bool  `json:"resumable,omitempty"`
+	Length    int64 `json:"length,omitempty"`
+	Assembled bool  `json:"assembled,omitempty"`
+}
+
+// uploadRecordKey returns the upload store key of the record for imageID.
+func uploadRecordKey(imageID string) string {
+	return "pending/" + imageID + ".json"
+}
+
+type createUploadRequest struct {
+	Owner       string               `json:"owner"`
+	Filename    string               `json:"filename"`
+	ContentType string               `json:"contentType"`
+	Pipeline    pipeline.Pipeline    `json:"pipeline"`
+	Renditions  []pipeline.Rendition `json:"renditions"`
+	Webhook     *activities.Webhook  `json:"webhook"`
+}
+
+// createUploadHandler creates an upload record and returns a URL the
+// client can PUT the image to directly.
+func (a *Api) createUploadHandler(c *gin.Context) {
+	var req createUploadRequest
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request body"})
+			return
+		}
+	}
+	if err := req.Pipeline.Validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid pipeline: " + err.Error()})
+		return
+	}
+	if err := pipeline.ValidateRenditions(req.Renditions); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid renditions: " + err.Error()})
+		return
+	}
+	p := principal(c)
+	if req.Webhook != nil {
+		if err := validateWebhook(req.Webhook); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid webhook: " + err.Error()})
+			return
+		}
+		// signed with the secret of the caller's tenant, see parseWebhook
+		req.Webhook.ClientID = p.Tenant
+	}
+
+	// the size isn't known until the upload completes, when it is checked
+	// against the quota again
+	if err := a.checkQuota(c.Request.Context(), p.Tenant, 0); err != nil {
+		if !respondQuota(c, p.Tenant, err) {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to check quota"})
+		}
+		return
+	}
+
+	imageID := uuid.New().String()
+	now := time.Now().UTC()
+	record := uploadRecord{
+		ImageID:     imageID,
+		Owner:       a.owner(c, req.Owner),
+		Tenant:      p.Tenant,
+		Filename:    sanitizeFilename(req.Filename),
+		ContentType: req.ContentType,
+		Pipeline:    req.Pipeline,
+		Renditions:  req.Renditions,
+		Webhook:     req.Webhook,
+		CreatedAt:   now,
+		ExpiresAt:   now.Add(a.config.UploadURLExpiry),
+	}
+
+	if err := a.putUploadRecord(c.Request.Context(), &record); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create upload"})
+		return
+	}
+
+	// let the store presign the upload when it can so the image bytes never
+	// pass through the api
+	var uploadURL string
+	var err error
+	if presigner, ok := a.stores.Upload.(storage.Presigner); ok {
+		uploadURL, err = presigner.PresignPut(c.Request.Context(), tenant.Key(p.Tenant, imageID), a.config.UploadURLExpiry)
+		if err != nil {
+			a.logger.Error("failed to presign upload", zap.Error(err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create upload"})
+			return
+		}
+	} else {
+		uploadURL = a.signedUploadURL(imageID, record.ExpiresAt)
+	}
+
+	a.logger.Info("created upload", zap.String("imageId", imageID))
+
+	c.JSON(http.StatusCreated,
+		gin.H{
+			"imageId":      imageID,
+			"uploadUrl":    uploadURL,
+			"uploadMethod": http.MethodPut,
+			"expiresAt":    record.ExpiresAt,
+			"completeUrl":  a.config.PublicURL + "/uploads/" + imageID + "/complete",
+		},
+	)
+}
+
+// signedUploadURL returns an api URL accepting a PUT of imageID until
+// expiresAt, for stores that cannot presign URLs.
+func (a *Api) signedUploadURL(imageID string, expiresAt time.Time) string {
+	expires := strconv.FormatInt(expiresAt.Unix(), 10)
+	query := url.Values{}
+	query.Set("expires", expires)
+	query.Set("signature", a.uploadSignature(imageID, expires))
+	return a.config.PublicURL + "/uploads/" + imageID + "?" + query.Encode()
+}
+
+func (a *Api) uploadSignature(imageID, expires string) string {
+	mac := hmac.New(sha256.New, []byte(a.config.UploadSigningSecret))
+	mac.Write([]byte(imageID + "\n" + expires))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// putUploadHandler receives the image for a signed upload URL issued by
+// signedUploadURL.
+func (a *Api) putUploadHandler(c *gin.Context) {
+	imageID := c.Param("imageId")
+	if !isImageID(imageID) {
+		c.JSON(http.StatusBadRequest, gin.H{"imageId": imageID, "error": "invalid image id"})
+		return
+	}
+
+	// verify the url signature and expiry
+	expires := c.Query("expires")
+	signature := c.Query("signature")
+	expiresUnix, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil || !hmac.Equal([]byte(signature), []byte(a.uploadSignature(imageID, expires))) {
+		c.JSON(http.StatusForbidden, gin.H{"imageId": imageID, "error": "invalid signature"})
+		return
+	}
+	if time.Now().Unix() > expiresUnix {
+		c.JSON(http.StatusForbidden, gin.H{"imageId": imageID, "error": "upload url expired"})
+		return
+	}
+
+	size := c.Request.ContentLength
+	if size == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"imageId": imageID, "error": "file is required"})
+		return
+	}
+	if !limitBody(c, a.config.MaxUploadBytes, 0) {
+		return
+	}
+
+	// the upload is stored under the prefix of the tenant that created it
+	record, err := a.getUploadRecord(c.Request.Context(), imageID)
+	if errors.Is(err, errUploadNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"imageId": imageID, "error": "upload not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to save file"})
+		return
+	}
+	if quota := a.config.Quotas.For(record.Tenant); quota.MaxImageBytes > 0 && size > quota.MaxImageBytes {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{
+			"imageId": imageID,
+			"error":   "image exceeds the maximum image size",
+			"tenant":  record.Tenant,
+			"limit":   quota.MaxImageBytes,
+		})
+		return
+	}
+
+	// peek at the start of the body so only images are stored
+	body := bufio.NewReaderSize(c.Request.Body, imagetype.HeaderSize)
+	header, _ := body.Peek(imagetype.HeaderSize)
+	format, ok := sniffImage(c, bytes.NewReader(header), c.ContentType())
+	if !ok {
+		return
+	}
+
+	err = a.stores.Upload.Put(c.Request.Context(), tenant.Key(record.Tenant, imageID), body, &storage.PutOptions{
+		ContentType: imagetype.ContentType(format),
+		Size:        size,
+	})
+	if isTooLarge(err) {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"imageId": imageID, "error": "upload too large"})
+		return
+	}
+	if err != nil {
+		a.logger.Error("failed to save file", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to save file"})
+		return
+	}
+
+	a.logger.Info("recieved direct upload", zap.String("imageId", imageID))
+	c.Status(http.StatusOK)
+}
+
+// completeUploadHandler starts processing a direct upload once the client
+// has finished sending it to storage.
+func (a *Api) completeUploadHandler(c *gin.Context) {
+	imageID := c.Param("imageId")
+	if !isImageID(imageID) {
+		c.JSON(http.StatusBadRequest, gin.H{"imageId": imageID, "error": "invalid image id"})
+		return
+	}
+
+	wfRun, err := a.completeUpload(c.Request.Context(), imageID, principal(c))
+	a.respondComplete(c, imageID, wfRun, err)
+}
+
+// respondComplete responds to a request completing an upload with the
+// outcome of completeUpload.
+func (a *Api) respondComplete(c *gin.Context, imageID string, wfRun client.WorkflowRun, err error) {
+	if respondQuota(c, principal(c).Tenant, err) {
+		return
+	}
+	switch {
+	case errors.Is(err, errUploadNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"imageId": imageID, "error": "upload not found"})
+		return
+	case errors.Is(err, errUploadIncomplete):
+		c.JSON(http.StatusConflict, gin.H{"imageId": imageID, "error": "upload incomplete"})
+		return
+	case errors.Is(err, errUploadTooLarge):
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{
+			"imageId": imageID,
+			"error":   "upload too large",
+			"limit":   a.config.MaxUploadBytes,
+		})
+		return
+	case isNotImage(err):
+		respondNotImage(c, err)
+		return
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"imageId": imageID, "error": "failed to start process"})
+		return
+	}
+
+	c.JSON(http.StatusAccepted,
+		gin.H{
+			"message":    "upload complete",
+			"imageId":    imageID,
+			"workflowId": wfRun.GetID(),
+			"runId":      wfRun.GetRunID(),
+		},
+	)
+}
+
+// s3Event is the subset of an S3 bucket notification used to detect
+// completed uploads.
+type s3Event struct {
+	Records []struct {
+		EventName string `json:"eventName"`
+		S3        struct {
+			Object struct {
+				Key string `json:"key"`
+			} `json:"object"`
+		} `json:"s3"`
+	} `json:"Records"`
+}
+
+// storageEventsHandler receives S3-style bucket notifications and starts
+// processing for each completed upload.
+func (a *Api) storageEventsHandler(c *gin.Context) {
+	token := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+	if a.config.StorageEventsToken == "" ||
+		!hmac.Equal([]byte(token), []byte(a.config.StorageEventsToken)) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+		return
+	}
+
+	var event s3Event
+	if err := c.ShouldBindJSON(&event); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid event"})
+		return
+	}
+
+	for _, record := range event.Records {
+		// AWS uses "ObjectCreated:Put" while MinIO uses "s3:ObjectCreated:Put"
+		if !strings.Contains(record.EventName, "ObjectCreated:") {
+			continue
+		}
+		key, err := url.QueryUnescape(record.S3.Object.Key)
+		if err != nil {
+			continue
+		}
+		// only uploaded images start processing, not records, chunks or
+		// objects of the other stores
+		rest, found := strings.CutPrefix(key, storage.UploadPrefix)
+		t, imageID, ok := tenant.ParseKey(rest)
+		if !found || !ok || !isImageID(imageID) {
+			continue
+		}
+		if record, err := a.getUploadRecord(c.Request.Context(), imageID); err == nil && record.Tenant != t {
+			a.logger.Info("ignoring event for upload of another tenant", zap.String("key", key))
+			continue
+		}
+
+		_, err = a.completeUpload(c.Request.Context(), imageID, nil)
+		if errors.Is(err, errUploadNotFound) {
+			a.logger.Info("ignoring event for unknown upload", zap.String("key", key))
+			continue
+		}
+		// the client finds out when it completes the upload itself
+		var qerr *quotaError
+		if errors.As(err, &qerr) || errors.Is(err, errUploadTooLarge) || isNotImage(err) {
+			a.logger.Info("not processing upload",
+				zap.String("key", key), zap.Error(err))
+			continue
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to process event"})
+			return
+		}
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// putUploadRecord saves the record of a direct upload.
+func (a *Api) putUploadRecord(ctx context.Context, record *uploadRecord) error {
+	recordJson, err := json.Marshal(record)
+	if err != nil {
+		a.logger.Error("failed to marshal upload record", zap.Error(err))
+		return err
+	}
+	err = a.stores.Upload.Put(ctx, uploadRecordKey(record.ImageID),
+		bytes.NewReader(recordJson), &storage.PutOptions{
+			ContentType: "application/json",
+			Size:        int64(len(recordJson)),
+		})
+	if err != nil {
+		a.logger.Error("failed to save upload record", zap.Error(err))
+	}
+	return err
+}
+
+// getUploadRecord returns the record of a direct upload.
+func (a *Api) getUploadRecord(ctx context.Context, imageID string) (*uploadRecord, error) {
+	reader, _, err := a.stores.Upload.Get(ctx, uploadRecordKey(imageID))
+	if errors.Is(err, storage.ErrNotExist) {
+		return nil, errUploadNotFound
+	}
+	if err != nil {
+		a.logger.Error("failed to read upload record", zap.Error(err))
+		return nil, err
+	}
+	defer reader.Close()
+
+	var record uploadRecord
+	if err := json.NewDecoder(reader).Decode(&record); err != nil {
+		a.logger.Error("failed to decode upload record", zap.Error(err))
+		return nil, err
+	}
+	return &record, nil
+}
+
+// completeUpload starts the image processing workflow for a direct upload
+// once the uploaded object is present in storage. Uploads created by
+// someone other than p are not found unless p is an admin, as with
+// authorizeImage, and p is nil for storage notifications.
+// A quotaError is returned when the upload would take its tenant over its
+// quota. Uploads that are too large or not images are removed so the
+// client may upload again, the record of the upload is removed once the
+// workflow has started.
+func (a *Api) completeUpload(ctx context.Context, imageID string, p *auth.Principal) (client.WorkflowRun, error) {
+	record, err := a.getUploadRecord(ctx, imageID)
+	if errors.Is(err, errUploadNotFound) {
+		return a.startedUpload(ctx, imageID, p)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if p != nil && !p.Admin && (!p.Owns(record.Owner) || p.Tenant != record.Tenant) {
+		return nil, errUploadNotFound
+	}
+
+	key := tenant.Key(record.Tenant, imageID)
+	info, err := a.stores.Upload.Stat(ctx, key)
+	if errors.Is(err, storage.ErrNotExist) {
+		return nil, errUploadIncomplete
+	}
+	if err != nil {
+		a.logger.Error("failed to stat upload", zap.Error(err))
+		return nil, err
+	}
+	if info.Size == 0 {
+		return nil, errUploadIncomplete
+	}
+
+	// presigned uploads go straight to storage, so they are only checked
+	// now that they are there
+	if a.config.MaxUploadBytes > 0 && info.Size > a.config.MaxUploadBytes {
+		a.rejectUpload(ctx, key, errUploadTooLarge)
+		return nil, errUploadTooLarge
+	}
+	if err := a.checkImageSize(record.Tenant, info.Size); err != nil {
+		a.rejectUpload(ctx, key, err)
+		return nil, err
+	}
+	format, err := a.sniffUpload(ctx, key, record.ContentType)
+	if isNotImage(err) {
+		a.rejectUpload(ctx, key, err)
+		return nil, err
+	}
+	if err != nil {
+		return nil, err
+	}
+	contentType := imagetype.ContentType(format)
+
+	a.logger.Info("upload complete",
+		zap.String("imageId", imageID),
+		zap.Int64("size", info.Size),
+	)
+	// uploads completed before were held to the quota then, and are
+	// counted in the usage now
+	_, err = a.jobs.Get(ctx, imageID)
+	if errors.Is(err, jobs.ErrNotFound) {
+		err = a.checkQuota(ctx, record.Tenant, info.Size)
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = a.recordUpload(ctx, &jobs.Record{
+		ImageID:     imageID,
+		Owner:       record.Owner,
+		Tenant:      record.Tenant,
+		Filename:    record.Filename,
+		ContentType: contentType,
+		Size:        info.Size,
+		Pipeline:    record.Pipeline,
+		Renditions:  record.Renditions,
+		Resumable:   record.Resumable,
+	})
+	if err != nil {
+		return nil, err
+	}
+	wfRun, err := a.startImageProcessing(ctx, workflows.ImageProcessingWorkflowInput{
+		ImageID:     imageID,
+		Tenant:      record.Tenant,
+		ContentType: contentType,
+		Pipeline:    record.Pipeline,
+		Renditions:  record.Renditions,
+		Webhook:     record.Webhook,
+	})
+	if err != nil {
+		// the upload is kept so completing again retries
+		a.failJob(ctx, imageID, err)
+		return nil, err
+	}
+	a.recordRun(ctx, wfRun)
+
+	// completing again finds the workflow from the job record
+	if err := a.stores.Upload.Delete(ctx, uploadRecordKey(imageID)); err != nil {
+		a.logger.Error("failed to delete upload record", zap.String("imageId", imageID), zap.Error(err))
+	}
+	return wfRun, nil
+}
+
+// startedUpload returns the workflow processing an upload that was
+// completed before, whose upload record has since been removed.
+func (a *Api) startedUpload(ctx context.Context, imageID string, p *auth.Principal) (client.WorkflowRun, error) {
+	job, err := a.jobs.Get(ctx, imageID)
+	if errors.Is(err, jobs.ErrNotFound) {
+		return nil, errUploadNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if p != nil && !p.Admin && (!p.Owns(job.Owner) || p.Tenant != job.Tenant) {
+		return nil, errUploadNotFound
+	}
+	return a.client.GetWorkflow(ctx, imageID, job.RunID), nil
+}
+
+// sniffUpload identifies the uploaded image stored under key from its
+// leading bytes, as detectImage does.
+func (a *Api) sniffUpload(ctx context.Context, key, declared string) (string, error) {
+	reader, _, err := a.stores.Upload.Get(ctx, key)
+	if err != nil {
+		a.logger.Error("failed to read upload", zap.Error(err))
+		return "", err
+	}
+	defer reader.Close()
+
+	header := make([]byte, imagetype.HeaderSize)
+	n, err := io.ReadFull(reader, header)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+		a.logger.Error("failed to read upload", zap.Error(err))
+		return "", err
+	}
+	return detectImage(header[:n], declared)
+}
+
+// rejectUpload removes an upload refused for reason.
+func (a *Api) rejectUpload(ctx context.Context, key string, reason error) {
+	a.logger.Info("rejected upload", zap.String("key", key), zap.Error(reason))
+	if err := a.stores.Upload.Delete(ctx, key); err != nil {
+		a.logger.Error("failed to delete rejected upload", zap.String("key", key), zap.Error(err))
+	}
+}
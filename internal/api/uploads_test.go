@@ -0,0 +1,70 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/joberly/demo-temporal/internal/auth"
+	"github.com/joberly/demo-temporal/internal/jobs"
+	"github.com/joberly/demo-temporal/internal/storage"
+
+	"go.temporal.io/sdk/client"
+	"go.uber.org/zap"
+)
+
+// workflowClient is a Temporal client that finds every workflow.
+type workflowClient struct {
+	client.Client
+}
+
+func (workflowClient) GetWorkflow(ctx context.Context, workflowID string, runID string) client.WorkflowRun {
+	return nil
+}
+
+func TestCompleteUploadTenants(t *testing.T) {
+	ctx := context.Background()
+	uploads, err := storage.NewLocal(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := jobs.NewMemoryStore()
+	a := &Api{
+		logger: zap.NewNop(),
+		config: &Config{},
+		client: workflowClient{},
+		stores: &storage.Stores{Upload: uploads},
+		jobs:   store,
+	}
+	// a pending upload yet to be sent and one that has been processed
+	if err := a.putUploadRecord(ctx, &uploadRecord{ImageID: "pending", Owner: "bob", Tenant: "acme"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Put(ctx, &jobs.Record{ImageID: "started", Owner: "bob", Tenant: "acme", RunID: "run-1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		p    *auth.Principal
+		// want is the error completing the pending upload, the started
+		// one is found whenever the pending one is
+		want error
+	}{
+		{"owner", &auth.Principal{Subject: "bob", Tenant: "acme"}, errUploadIncomplete},
+		{"notification", nil, errUploadIncomplete},
+		{"other owner", &auth.Principal{Subject: "alice", Tenant: "acme"}, errUploadNotFound},
+		{"owner from another tenant", &auth.Principal{Subject: "bob"}, errUploadNotFound},
+		// admins reach the uploads of every tenant, as with images
+		{"admin", &auth.Principal{Subject: "root", Admin: true}, errUploadIncomplete},
+	}
+	for _, tt := range tests {
+		if _, err := a.completeUpload(ctx, "pending", tt.p); !errors.Is(err, tt.want) {
+			t.Errorf("%s: completeUpload of a pending upload = %v, want %v", tt.name, err, tt.want)
+		}
+		_, err := a.completeUpload(ctx, "started", tt.p)
+		if found := err == nil; found != (tt.want != errUploadNotFound) {
+			t.Errorf("%s: completeUpload of a started upload = %v", tt.name, err)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/joberly/demo-temporal/internal/tenant"
+)
+
+// KeyStore looks up API keys by their hash.
+type KeyStore interface {
+	// LookupAPIKey returns the principal of the API key with the hex
+	// SHA-256 hash, or ErrInvalidCredentials when there is none.
+	LookupAPIKey(ctx context.Context, hash string) (*Principal, error)
+}
+
+// HashAPIKey returns the hash API keys are stored under. Keys are random
+// so a plain SHA-256 is enough to keep them from being read back.
+func HashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// ParseAPIKeys parses API keys written as comma separated subject=hash
+// pairs, where hash is the hex SHA-256 of the key.
+func ParseAPIKeys(spec string) (map[string]string, error) {
+	keys := map[string]string{}
+	for _, pair := range strings.Split(spec, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		subject, hash, ok := strings.Cut(pair, "=")
+		hash = strings.ToLower(hash)
+		if _, err := hex.DecodeString(hash); !ok || subject == "" || err != nil || len(hash) != sha256.Size*2 {
+			return nil, fmt.Errorf("invalid api key for %q, expected subject=sha256 hex", subject)
+		}
+		keys[hash] = subject
+	}
+	return keys, nil
+}
+
+// ParseTenants parses the tenants of subjects written as comma separated
+// subject=tenant pairs.
+func ParseTenants(spec string) (map[string]string, error) {
+	tenants := map[string]string{}
+	for _, pair := range strings.Split(spec, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		subject, t, ok := strings.Cut(pair, "=")
+		if !ok || subject == "" || t == "" || !tenant.Valid(t) {
+			return nil, fmt.Errorf("invalid tenant for %q, expected subject=tenant", subject)
+		}
+		tenants[subject] = t
+	}
+	return tenants, nil
+}
+
+// StaticKeys is a KeyStore of API keys from the configuration, mapping
+// hashes to subjects.
+type StaticKeys map[string]string
+
+func (ks StaticKeys) LookupAPIKey(ctx context.Context, hash string) (*Principal, error) {
+	// compare every key in constant time rather than indexing the map so
+	// lookups don't leak how close a guess was
+	var subject string
+	for h, s := range ks {
+		if subtle.ConstantTimeCompare([]byte(h), []byte(hash)) == 1 {
+			subject = s
+		}
+	}
+	if subject == "" {
+		return nil, ErrInvalidCredentials
+	}
+	return &Principal{Subject: subject}, nil
+}
+
+// DatabaseKeys is a KeyStore of the unrevoked API keys in the api_keys
+// table, which also records the tenant of each key.
+type DatabaseKeys struct {
+	db *sql.DB
+}
+
+// NewDatabaseKeys returns a KeyStore looking keys up in db.
+func NewDatabaseKeys(db *sql.DB) *DatabaseKeys {
+	return &DatabaseKeys{db: db}
+}
+
+func (ks *DatabaseKeys) LookupAPIKey(ctx context.Context, hash string) (*Principal, error) {
+	var p Principal
+	err := ks.db.QueryRowContext(ctx,
+		`SELECT subject, tenant FROM api_keys WHERE key_hash = $1 AND revoked_at IS NULL`, hash).Scan(&p.Subject, &p.Tenant)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrInvalidCredentials
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
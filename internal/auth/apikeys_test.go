@@ -0,0 +1,204 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestParseAPIKeys(t *testing.T) {
+	alice, bob := HashAPIKey("alice-key"), HashAPIKey("bob-key")
+	tests := []struct {
+		spec string
+		want map[string]string
+		ok   bool
+	}{
+		{"", map[string]string{}, true},
+		{"alice=" + alice, map[string]string{alice: "alice"}, true},
+		// hashes are matched in lower case, and spaces and empty pairs
+		// are ignored
+		{" alice=" + strings.ToUpper(alice) + ",, bob=" + bob + " ", map[string]string{alice: "alice", bob: "bob"}, true},
+		{"alice", nil, false},
+		{"=" + alice, nil, false},
+		{"alice=" + alice[:62], nil, false},
+		{"alice=" + alice + "00", nil, false},
+		{"alice=" + strings.Repeat("zz", 32), nil, false},
+		{"alice=" + alice + ",bob", nil, false},
+	}
+	for _, tt := range tests {
+		got, err := ParseAPIKeys(tt.spec)
+		if (err == nil) != tt.ok || !equalMaps(got, tt.want) {
+			t.Errorf("ParseAPIKeys(%q) = %v, %v, want %v, ok %v", tt.spec, got, err, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestParseTenants(t *testing.T) {
+	tests := []struct {
+		spec string
+		want map[string]string
+		ok   bool
+	}{
+		{"", map[string]string{}, true},
+		{"alice=acme, bob=globex-2", map[string]string{"alice": "acme", "bob": "globex-2"}, true},
+		{"alice", nil, false},
+		{"alice=", nil, false},
+		{"=acme", nil, false},
+		{"alice=Acme", nil, false},
+		{"alice=../acme", nil, false},
+		{"alice=-acme", nil, false},
+	}
+	for _, tt := range tests {
+		got, err := ParseTenants(tt.spec)
+		if (err == nil) != tt.ok || !equalMaps(got, tt.want) {
+			t.Errorf("ParseTenants(%q) = %v, %v, want %v, ok %v", tt.spec, got, err, tt.want, tt.ok)
+		}
+	}
+}
+
+func equalMaps(a, b map[string]string) bool {
+	if len(a) != len(b) || (a == nil) != (b == nil) {
+		return false
+	}
+	for k, v := range a {
+		if w, ok := b[k]; !ok || w != v {
+			return false
+		}
+	}
+	return true
+}
+
+func TestStaticKeys(t *testing.T) {
+	ks := StaticKeys{HashAPIKey("alice-key"): "alice", HashAPIKey("bob-key"): "bob"}
+	tests := []struct {
+		key  string
+		want string
+	}{
+		{"alice-key", "alice"},
+		{"bob-key", "bob"},
+		{"carol-key", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		p, err := ks.LookupAPIKey(context.Background(), HashAPIKey(tt.key))
+		if tt.want == "" {
+			if !errors.Is(err, ErrInvalidCredentials) {
+				t.Errorf("LookupAPIKey(%q) = %v, %v, want ErrInvalidCredentials", tt.key, p, err)
+			}
+			continue
+		}
+		if err != nil || p.Subject != tt.want || p.Tenant != "" {
+			t.Errorf("LookupAPIKey(%q) = %+v, %v, want %s", tt.key, p, err, tt.want)
+		}
+	}
+}
+
+func TestDatabaseKeys(t *testing.T) {
+	db := &fakeKeyDB{keys: map[string]fakeKey{
+		HashAPIKey("alice-key"): {subject: "alice", tenant: "acme"},
+		HashAPIKey("bob-key"):   {subject: "bob"},
+		HashAPIKey("old-key"):   {subject: "alice", tenant: "acme", revoked: true},
+	}}
+	ks := NewDatabaseKeys(sql.OpenDB(db))
+	tests := []struct {
+		key     string
+		subject string
+		tenant  string
+	}{
+		{"alice-key", "alice", "acme"},
+		{"bob-key", "bob", ""},
+		{"old-key", "", ""},
+		{"carol-key", "", ""},
+	}
+	for _, tt := range tests {
+		p, err := ks.LookupAPIKey(context.Background(), HashAPIKey(tt.key))
+		if tt.subject == "" {
+			if !errors.Is(err, ErrInvalidCredentials) {
+				t.Errorf("LookupAPIKey(%q) = %v, %v, want ErrInvalidCredentials", tt.key, p, err)
+			}
+			continue
+		}
+		if err != nil || p.Subject != tt.subject || p.Tenant != tt.tenant {
+			t.Errorf("LookupAPIKey(%q) = %+v, %v, want %s of %q", tt.key, p, err, tt.subject, tt.tenant)
+		}
+	}
+
+	// database errors are not taken for unknown keys
+	db.err = errors.New("connection refused")
+	if _, err := ks.LookupAPIKey(context.Background(), HashAPIKey("alice-key")); err == nil || errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("LookupAPIKey err = %v, want the database error", err)
+	}
+}
+
+// fakeKeyDB is a database/sql driver answering the api_keys lookup. Keys
+// are left out as revoked only when the query asks for unrevoked keys.
+type fakeKeyDB struct {
+	keys map[string]fakeKey
+	err  error
+}
+
+type fakeKey struct {
+	subject, tenant string
+	revoked         bool
+}
+
+func (db *fakeKeyDB) Connect(context.Context) (driver.Conn, error) { return fakeKeyConn{db}, nil }
+func (db *fakeKeyDB) Driver() driver.Driver                        { return nil }
+
+type fakeKeyConn struct {
+	db *fakeKeyDB
+}
+
+func (c fakeKeyConn) Prepare(query string) (driver.Stmt, error) {
+	if !strings.Contains(query, "FROM api_keys WHERE key_hash = $1") {
+		return nil, errors.New("unexpected query: " + query)
+	}
+	return fakeKeyStmt{db: c.db, unrevoked: strings.Contains(query, "revoked_at IS NULL")}, nil
+}
+
+func (c fakeKeyConn) Close() error              { return nil }
+func (c fakeKeyConn) Begin() (driver.Tx, error) { return nil, errors.New("not supported") }
+
+type fakeKeyStmt struct {
+	db        *fakeKeyDB
+	unrevoked bool
+}
+
+func (s fakeKeyStmt) Close() error  { return nil }
+func (s fakeKeyStmt) NumInput() int { return 1 }
+
+func (s fakeKeyStmt) Exec([]driver.Value) (driver.Result, error) {
+	return nil, errors.New("not supported")
+}
+
+func (s fakeKeyStmt) Query(args []driver.Value) (driver.Rows, error) {
+	if s.db.err != nil {
+		return nil, s.db.err
+	}
+	hash, _ := args[0].(string)
+	key, ok := s.db.keys[hash]
+	if !ok || (key.revoked && s.unrevoked) {
+		return &fakeKeyRows{}, nil
+	}
+	return &fakeKeyRows{rows: [][]driver.Value{{key.subject, key.tenant}}}, nil
+}
+
+type fakeKeyRows struct {
+	rows [][]driver.Value
+}
+
+func (r *fakeKeyRows) Columns() []string { return []string{"subject", "tenant"} }
+func (r *fakeKeyRows) Close() error      { return nil }
+
+func (r *fakeKeyRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.rows[0])
+	r.rows = r.rows[1:]
+	return nil
+}
@@ -0,0 +1,189 @@
+// Package auth authenticates API callers with API keys or JWT bearer
+// tokens and identifies them by a Principal.
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/joberly/demo-temporal/internal/tenant"
+)
+
+var (
+	// ErrNoCredentials is returned when a request carries no credentials.
+	ErrNoCredentials = errors.New("no credentials")
+	// ErrInvalidCredentials is returned when a request carries credentials
+	// that are not accepted.
+	ErrInvalidCredentials = errors.New("invalid credentials")
+)
+
+// Methods a principal can be authenticated by.
+const (
+	MethodNone   = "none"
+	MethodAPIKey = "api_key"
+	MethodJWT    = "jwt"
+)
+
+// Principal identifies an authenticated caller.
+type Principal struct {
+	// Subject identifies the caller and owns the images it uploads.
+	Subject string
+	// Method is how the caller was authenticated.
+	Method string
+	// Admin callers can see every image.
+	Admin bool
+	// Tenant is the tenant the caller belongs to, empty for the default
+	// tenant.
+	Tenant string
+}
+
+// Owns reports whether the principal may see an image owned by owner.
+func (p *Principal) Owns(owner string) bool {
+	return p.Admin || p.Subject == owner
+}
+
+// anonymous is the principal of every request when authentication is
+// disabled.
+var anonymous = &Principal{Method: MethodNone, Admin: true}
+
+type principalKey struct{}
+
+// NewContext returns a context carrying p.
+func NewContext(ctx context.Context, p *Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, p)
+}
+
+// FromContext returns the principal carried by ctx.
+func FromContext(ctx context.Context) (*Principal, bool) {
+	p, ok := ctx.Value(principalKey{}).(*Principal)
+	return p, ok
+}
+
+// Config configures how callers are authenticated. Authentication is
+// disabled when no API keys, database keys or JWT verification keys are
+// configured.
+type Config struct {
+	// APIKeys maps the hex SHA-256 hashes of API keys to their subjects.
+	APIKeys map[string]string `json:"-"`
+	// DatabaseKeys looks API keys up in the api_keys table too.
+	DatabaseKeys bool
+	// JWTSecret verifies HMAC signed tokens.
+	JWTSecret string `json:"-"`
+	// JWKSFile is a JSON Web Key Set file of keys verifying RSA, ECDSA and
+	// Ed25519 signed tokens.
+	JWKSFile string
+	// JWTIssuer and JWTAudience are required of tokens when set.
+	JWTIssuer   string
+	JWTAudience string
+	// Admins lists the subjects that can see every image.
+	Admins []string
+	// Tenants maps subjects to their tenants. Database keys and tokens
+	// with a tenant claim name their own tenant.
+	Tenants map[string]string
+}
+
+// Authenticator authenticates requests.
+type Authenticator struct {
+	keys    []KeyStore
+	jwt     *jwtVerifier
+	admins  map[string]bool
+	tenants map[string]string
+}
+
+// New returns an Authenticator for config. Database keys are looked up in
+// db, which may be nil when config doesn't use them.
+func New(config *Config, db KeyStore) (*Authenticator, error) {
+	a := &Authenticator{admins: map[string]bool{}, tenants: config.Tenants}
+	for _, admin := range config.Admins {
+		a.admins[admin] = true
+	}
+	for subject, t := range config.Tenants {
+		if !tenant.Valid(t) {
+			return nil, fmt.Errorf("invalid tenant %q for %q", t, subject)
+		}
+	}
+	if len(config.APIKeys) > 0 {
+		a.keys = append(a.keys, StaticKeys(config.APIKeys))
+	}
+	if config.DatabaseKeys {
+		if db == nil {
+			return nil, errors.New("database api keys need the postgres job store")
+		}
+		a.keys = append(a.keys, db)
+	}
+	if config.JWTSecret != "" || config.JWKSFile != "" {
+		v, err := newJWTVerifier(config)
+		if err != nil {
+			return nil, err
+		}
+		a.jwt = v
+	}
+	return a, nil
+}
+
+// Enabled reports whether requests need credentials.
+func (a *Authenticator) Enabled() bool {
+	return len(a.keys) > 0 || a.jwt != nil
+}
+
+// Authenticate returns the principal making r. API keys are read from the
+// X-API-Key header and tokens from the Authorization header. GET requests
+// may also pass either in the access_token parameter, since browsers can't
+// set headers on EventSource and WebSocket requests.
+func (a *Authenticator) Authenticate(r *http.Request) (*Principal, error) {
+	if !a.Enabled() {
+		return anonymous, nil
+	}
+
+	credential := r.Header.Get("X-API-Key")
+	if credential == "" {
+		if scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " "); ok && strings.EqualFold(scheme, "Bearer") {
+			credential = strings.TrimSpace(token)
+		}
+	}
+	if credential == "" && r.Method == http.MethodGet {
+		credential = r.URL.Query().Get("access_token")
+	}
+	if credential == "" {
+		return nil, ErrNoCredentials
+	}
+
+	var p *Principal
+	var err error
+	if a.jwt != nil && strings.Count(credential, ".") == 2 {
+		p, err = a.jwt.verify(credential)
+	} else {
+		p, err = a.lookupKey(r.Context(), credential)
+	}
+	if err != nil {
+		return nil, err
+	}
+	p.Admin = a.admins[p.Subject]
+	if p.Tenant == "" {
+		p.Tenant = a.tenants[p.Subject]
+	}
+	if !tenant.Valid(p.Tenant) {
+		return nil, ErrInvalidCredentials
+	}
+	return p, nil
+}
+
+// lookupKey returns the principal of an API key.
+func (a *Authenticator) lookupKey(ctx context.Context, key string) (*Principal, error) {
+	hash := HashAPIKey(key)
+	for _, store := range a.keys {
+		p, err := store.LookupAPIKey(ctx, hash)
+		if errors.Is(err, ErrInvalidCredentials) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		p.Method = MethodAPIKey
+		return p, nil
+	}
+	return nil, ErrInvalidCredentials
+}
@@ -0,0 +1,142 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func TestAuthenticate(t *testing.T) {
+	db := &fakeKeyDB{keys: map[string]fakeKey{
+		HashAPIKey("dave-key"): {subject: "dave", tenant: "globex"},
+		HashAPIKey("eve-key"):  {subject: "eve", tenant: "Not Valid"},
+	}}
+	a, err := New(&Config{
+		APIKeys: map[string]string{
+			HashAPIKey("alice-key"): "alice",
+			HashAPIKey("bob-key"):   "bob",
+			HashAPIKey("root-key"):  "root",
+		},
+		DatabaseKeys: true,
+		JWTSecret:    testSecret,
+		Admins:       []string{"root"},
+		// database keys and tokens naming a tenant keep theirs
+		Tenants: map[string]string{"bob": "acme", "dave": "initech", "carol": "acme"},
+	}, NewDatabaseKeys(sql.OpenDB(db)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !a.Enabled() {
+		t.Fatal("Enabled = false with keys configured")
+	}
+
+	carolToken := signToken(t, jwt.SigningMethodHS256, []byte(testSecret), "", validClaims("carol"))
+	tenantToken := signToken(t, jwt.SigningMethodHS256, []byte(testSecret), "",
+		withClaim(validClaims("carol"), "tenant", "globex"))
+	badTenantToken := signToken(t, jwt.SigningMethodHS256, []byte(testSecret), "",
+		withClaim(validClaims("carol"), "tenant", "../acme"))
+
+	tests := []struct {
+		name    string
+		method  string
+		header  string
+		value   string
+		query   string
+		want    Principal
+		wantErr error
+	}{
+		{"api key", "GET", "X-API-Key", "alice-key", "", Principal{Subject: "alice", Method: MethodAPIKey}, nil},
+		{"configured tenant", "POST", "X-API-Key", "bob-key", "", Principal{Subject: "bob", Method: MethodAPIKey, Tenant: "acme"}, nil},
+		{"admin", "GET", "X-API-Key", "root-key", "", Principal{Subject: "root", Method: MethodAPIKey, Admin: true}, nil},
+		{"database key", "GET", "X-API-Key", "dave-key", "", Principal{Subject: "dave", Method: MethodAPIKey, Tenant: "globex"}, nil},
+		{"api key as bearer", "GET", "Authorization", "bearer alice-key", "", Principal{Subject: "alice", Method: MethodAPIKey}, nil},
+		{"token", "GET", "Authorization", "Bearer " + carolToken, "", Principal{Subject: "carol", Method: MethodJWT, Tenant: "acme"}, nil},
+		{"token tenant", "GET", "Authorization", "Bearer " + tenantToken, "", Principal{Subject: "carol", Method: MethodJWT, Tenant: "globex"}, nil},
+		{"query parameter", "GET", "", "", "alice-key", Principal{Subject: "alice", Method: MethodAPIKey}, nil},
+
+		{"no credentials", "GET", "", "", "", Principal{}, ErrNoCredentials},
+		{"query parameter on post", "POST", "", "", "alice-key", Principal{}, ErrNoCredentials},
+		{"other scheme", "GET", "Authorization", "Basic YWxpY2U6a2V5", "", Principal{}, ErrNoCredentials},
+		{"unknown key", "GET", "X-API-Key", "mallory-key", "", Principal{}, ErrInvalidCredentials},
+		{"invalid stored tenant", "GET", "X-API-Key", "eve-key", "", Principal{}, ErrInvalidCredentials},
+		{"invalid token tenant", "GET", "Authorization", "Bearer " + badTenantToken, "", Principal{}, ErrInvalidCredentials},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(tt.method, "/images", nil)
+		if tt.header != "" {
+			r.Header.Set(tt.header, tt.value)
+		}
+		if tt.query != "" {
+			r.URL.RawQuery = "access_token=" + tt.query
+		}
+		p, err := a.Authenticate(r)
+		if tt.wantErr != nil {
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("%s: Authenticate = %+v, %v, want %v", tt.name, p, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil || *p != tt.want {
+			t.Errorf("%s: Authenticate = %+v, %v, want %+v", tt.name, p, err, tt.want)
+		}
+	}
+}
+
+func TestAuthenticateDisabled(t *testing.T) {
+	a, err := New(&Config{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.Enabled() {
+		t.Fatal("Enabled = true without keys")
+	}
+	p, err := a.Authenticate(httptest.NewRequest("GET", "/images", nil))
+	if err != nil || p.Method != MethodNone || !p.Admin {
+		t.Errorf("Authenticate = %+v, %v, want an anonymous admin", p, err)
+	}
+}
+
+func TestNewErrors(t *testing.T) {
+	tests := map[string]*Config{
+		"invalid tenant":             {Tenants: map[string]string{"alice": "Acme Corp"}},
+		"database keys without a db": {DatabaseKeys: true},
+		"missing jwks":               {JWKSFile: "/nonexistent/jwks.json"},
+	}
+	for name, config := range tests {
+		if _, err := New(config, nil); err == nil {
+			t.Errorf("%s: New succeeded", name)
+		}
+	}
+}
+
+func TestPrincipalContext(t *testing.T) {
+	if _, ok := FromContext(context.Background()); ok {
+		t.Error("FromContext found a principal in an empty context")
+	}
+	want := &Principal{Subject: "alice"}
+	if p, ok := FromContext(NewContext(context.Background(), want)); !ok || p != want {
+		t.Errorf("FromContext = %v, %v, want %v", p, ok, want)
+	}
+}
+
+func TestPrincipalOwns(t *testing.T) {
+	tests := []struct {
+		p     Principal
+		owner string
+		want  bool
+	}{
+		{Principal{Subject: "alice"}, "alice", true},
+		{Principal{Subject: "alice"}, "bob", false},
+		{Principal{Subject: "alice"}, "", false},
+		{Principal{Subject: "root", Admin: true}, "bob", true},
+	}
+	for _, tt := range tests {
+		if got := tt.p.Owns(tt.owner); got != tt.want {
+			t.Errorf("%+v.Owns(%q) = %v, want %v", tt.p, tt.owner, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,279 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	testSecret   = "hmac-secret"
+	testIssuer   = "https://issuer.example.com"
+	testAudience = "demo-api"
+)
+
+// testSigningKeys are the private keys of the JWKS files written by tests.
+type testSigningKeys struct {
+	ec  *ecdsa.PrivateKey
+	ed  ed25519.PrivateKey
+	rsa *rsa.PrivateKey
+}
+
+func newTestSigningKeys(t *testing.T) *testSigningKeys {
+	t.Helper()
+	ec, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, ed, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testSigningKeys{ec: ec, ed: ed, rsa: rsaKey}
+}
+
+// writeJWKS writes the public keys, keyed by key id, as a JWKS file and
+// returns its path.
+func writeJWKS(t *testing.T, keys map[string]crypto.PublicKey) string {
+	t.Helper()
+	enc := func(b []byte) string { return base64.RawURLEncoding.EncodeToString(b) }
+	var set struct {
+		Keys []map[string]string `json:"keys"`
+	}
+	for kid, key := range keys {
+		k := map[string]string{"kid": kid, "use": "sig"}
+		switch key := key.(type) {
+		case *ecdsa.PublicKey:
+			k["kty"], k["crv"], k["x"], k["y"] = "EC", "P-256", enc(key.X.Bytes()), enc(key.Y.Bytes())
+		case ed25519.PublicKey:
+			k["kty"], k["crv"], k["x"] = "OKP", "Ed25519", enc(key)
+		case *rsa.PublicKey:
+			k["kty"], k["n"], k["e"] = "RSA", enc(key.N.Bytes()), enc(big.NewInt(int64(key.E)).Bytes())
+		}
+		set.Keys = append(set.Keys, k)
+	}
+	// an encryption key is skipped
+	set.Keys = append(set.Keys, map[string]string{"kid": "enc", "use": "enc", "kty": "oct"})
+
+	data, err := json.Marshal(set)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// validClaims returns claims the test configurations accept for subject.
+func validClaims(subject string) jwt.MapClaims {
+	return jwt.MapClaims{
+		"sub": subject,
+		"iss": testIssuer,
+		"aud": testAudience,
+		"exp": time.Now().Add(time.Hour).Unix(),
+	}
+}
+
+// signToken signs claims with key, naming kid in the header when it is
+// set.
+func signToken(t *testing.T, method jwt.SigningMethod, key any, kid string, claims jwt.MapClaims) string {
+	t.Helper()
+	token := jwt.NewWithClaims(method, claims)
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
+	s, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// authenticateToken authenticates a request bearing token.
+func authenticateToken(a *Authenticator, token string) (*Principal, error) {
+	r := httptest.NewRequest("GET", "/images", nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+	return a.Authenticate(r)
+}
+
+func withClaim(claims jwt.MapClaims, name string, value any) jwt.MapClaims {
+	c := jwt.MapClaims{}
+	for k, v := range claims {
+		c[k] = v
+	}
+	if value == nil {
+		delete(c, name)
+	} else {
+		c[name] = value
+	}
+	return c
+}
+
+func TestJWTVerify(t *testing.T) {
+	keys := newTestSigningKeys(t)
+	jwks := writeJWKS(t, map[string]crypto.PublicKey{
+		"ec-1":  &keys.ec.PublicKey,
+		"ed-1":  keys.ed.Public(),
+		"rsa-1": &keys.rsa.PublicKey,
+	})
+	a, err := New(&Config{
+		JWTSecret:   testSecret,
+		JWKSFile:    jwks,
+		JWTIssuer:   testIssuer,
+		JWTAudience: testAudience,
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	valid := validClaims("alice")
+	edPublic := []byte(keys.ed.Public().(ed25519.PublicKey))
+	tests := []struct {
+		name  string
+		token string
+		want  string
+	}{
+		{"hmac", signToken(t, jwt.SigningMethodHS256, []byte(testSecret), "", valid), "alice"},
+		{"hmac with kid", signToken(t, jwt.SigningMethodHS512, []byte(testSecret), "ec-1", valid), "alice"},
+		{"ecdsa", signToken(t, jwt.SigningMethodES256, keys.ec, "ec-1", valid), "alice"},
+		{"ed25519", signToken(t, jwt.SigningMethodEdDSA, keys.ed, "ed-1", valid), "alice"},
+		{"rsa", signToken(t, jwt.SigningMethodRS256, keys.rsa, "rsa-1", valid), "alice"},
+		{"rsa pss", signToken(t, jwt.SigningMethodPS256, keys.rsa, "rsa-1", valid), "alice"},
+
+		{"wrong secret", signToken(t, jwt.SigningMethodHS256, []byte("guess"), "", valid), ""},
+		// a public key is never taken for an hmac secret
+		{"hmac with public key", signToken(t, jwt.SigningMethodHS256, edPublic, "ed-1", valid), ""},
+		{"none", signToken(t, jwt.SigningMethodNone, jwt.UnsafeAllowNoneSignatureType, "", valid), ""},
+		// kids pick the key, several keys need one
+		{"no kid", signToken(t, jwt.SigningMethodES256, keys.ec, "", valid), ""},
+		{"unknown kid", signToken(t, jwt.SigningMethodES256, keys.ec, "ec-2", valid), ""},
+		{"kid of another key", signToken(t, jwt.SigningMethodES256, keys.ec, "rsa-1", valid), ""},
+		{"encryption key", signToken(t, jwt.SigningMethodES256, keys.ec, "enc", valid), ""},
+
+		{"no exp", signToken(t, jwt.SigningMethodHS256, []byte(testSecret), "", withClaim(valid, "exp", nil)), ""},
+		{"expired", signToken(t, jwt.SigningMethodHS256, []byte(testSecret), "", withClaim(valid, "exp", time.Now().Add(-time.Minute).Unix())), ""},
+		{"not yet valid", signToken(t, jwt.SigningMethodHS256, []byte(testSecret), "", withClaim(valid, "nbf", time.Now().Add(time.Hour).Unix())), ""},
+		{"no issuer", signToken(t, jwt.SigningMethodHS256, []byte(testSecret), "", withClaim(valid, "iss", nil)), ""},
+		{"wrong issuer", signToken(t, jwt.SigningMethodHS256, []byte(testSecret), "", withClaim(valid, "iss", "https://evil.example.com")), ""},
+		{"no audience", signToken(t, jwt.SigningMethodHS256, []byte(testSecret), "", withClaim(valid, "aud", nil)), ""},
+		{"wrong audience", signToken(t, jwt.SigningMethodHS256, []byte(testSecret), "", withClaim(valid, "aud", "other-api")), ""},
+		{"one of the audiences", signToken(t, jwt.SigningMethodHS256, []byte(testSecret), "", withClaim(valid, "aud", []string{"other-api", testAudience})), "alice"},
+		{"no subject", signToken(t, jwt.SigningMethodHS256, []byte(testSecret), "", withClaim(valid, "sub", nil)), ""},
+		{"malformed", "a.b.c", ""},
+	}
+	for _, tt := range tests {
+		p, err := authenticateToken(a, tt.token)
+		if tt.want == "" {
+			if !errors.Is(err, ErrInvalidCredentials) {
+				t.Errorf("%s: Authenticate = %+v, %v, want ErrInvalidCredentials", tt.name, p, err)
+			}
+			continue
+		}
+		if err != nil || p.Subject != tt.want || p.Method != MethodJWT {
+			t.Errorf("%s: Authenticate = %+v, %v, want %s by jwt", tt.name, p, err, tt.want)
+		}
+	}
+}
+
+func TestJWTMethodsFollowKeys(t *testing.T) {
+	keys := newTestSigningKeys(t)
+	hmacToken := signToken(t, jwt.SigningMethodHS256, []byte(testSecret), "", validClaims("alice"))
+	ecToken := signToken(t, jwt.SigningMethodES256, keys.ec, "", validClaims("alice"))
+
+	tests := []struct {
+		name   string
+		config Config
+		// hmac and ec are whether the hmac and ecdsa tokens are accepted
+		hmac, ec bool
+	}{
+		{"secret", Config{JWTSecret: testSecret}, true, false},
+		{"jwks", Config{JWKSFile: writeJWKS(t, map[string]crypto.PublicKey{"ec-1": &keys.ec.PublicKey})}, false, true},
+	}
+	for _, tt := range tests {
+		tt.config.JWTIssuer, tt.config.JWTAudience = testIssuer, testAudience
+		a, err := New(&tt.config, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := authenticateToken(a, hmacToken); (err == nil) != tt.hmac {
+			t.Errorf("%s: hmac token err = %v, want accepted %v", tt.name, err, tt.hmac)
+		}
+		if _, err := authenticateToken(a, ecToken); (err == nil) != tt.ec {
+			t.Errorf("%s: ecdsa token err = %v, want accepted %v", tt.name, err, tt.ec)
+		}
+	}
+}
+
+func TestJWTSingleKeyDefault(t *testing.T) {
+	keys := newTestSigningKeys(t)
+	a, err := New(&Config{JWKSFile: writeJWKS(t, map[string]crypto.PublicKey{"ed-1": keys.ed.Public()})}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims := validClaims("alice")
+
+	tests := []struct {
+		name string
+		kid  string
+		ok   bool
+	}{
+		// the only key verifies tokens that don't name one
+		{"no kid", "", true},
+		{"its kid", "ed-1", true},
+		{"another kid", "ed-2", false},
+	}
+	for _, tt := range tests {
+		_, err := authenticateToken(a, signToken(t, jwt.SigningMethodEdDSA, keys.ed, tt.kid, claims))
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: Authenticate err = %v, want accepted %v", tt.name, err, tt.ok)
+		}
+	}
+}
+
+func TestLoadJWKSErrors(t *testing.T) {
+	dir := t.TempDir()
+	tests := map[string]string{
+		"not json":       `{`,
+		"no keys":        `{"keys": []}`,
+		"only enc keys":  `{"keys": [{"kty": "RSA", "use": "enc", "n": "AQAB", "e": "AQAB"}]}`,
+		"unknown type":   `{"keys": [{"kty": "oct", "kid": "a"}]}`,
+		"unknown curve":  `{"keys": [{"kty": "EC", "crv": "P-192", "x": "AQ", "y": "AQ"}]}`,
+		"off the curve":  `{"keys": [{"kty": "EC", "crv": "P-256", "x": "AQ", "y": "AQ"}]}`,
+		"short ed25519":  `{"keys": [{"kty": "OKP", "crv": "Ed25519", "x": "AQ"}]}`,
+		"missing rsa n":  `{"keys": [{"kty": "RSA", "e": "AQAB"}]}`,
+		"huge exponent":  `{"keys": [{"kty": "RSA", "n": "AQAB", "e": "AQAAAAAAAAAA"}]}`,
+		"bad base64 rsa": `{"keys": [{"kty": "RSA", "n": "!!", "e": "AQAB"}]}`,
+	}
+	for name, data := range tests {
+		path := filepath.Join(dir, name+".json")
+		if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := LoadJWKS(path); err == nil {
+			t.Errorf("%s: LoadJWKS succeeded", name)
+		}
+		if _, err := New(&Config{JWKSFile: path}, nil); err == nil {
+			t.Errorf("%s: New succeeded", name)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+// Package imagetype identifies image formats from their leading bytes.
+package imagetype
+
+import (
+	"bytes"
+	"mime"
+	"strings"
+)
+
+// Supported image formats, named as the image package names them.
+const (
+	JPEG = "jpeg"
+	PNG  = "png"
+	GIF  = "gif"
+	WebP = "webp"
+)
+
+// HeaderSize is the number of leading bytes Sniff needs to identify every
+// supported format.
+const HeaderSize = 12
+
+// contentTypes maps formats to their MIME types.
+var contentTypes = map[string]string{
+	JPEG: "image/jpeg",
+	PNG:  "image/png",
+	GIF:  "image/gif",
+	WebP: "image/webp",
+}
+
+// aliases maps nonstandard MIME types seen from clients to formats.
+var aliases = map[string]string{
+	"image/jpg":   JPEG,
+	"image/pjpeg": JPEG,
+	"image/x-png": PNG,
+}
+
+// Sniff returns the format of an image from its leading bytes, or an empty
+// string when the bytes do not start a supported image.
+func Sniff(header []byte) string {
+	switch {
+	case bytes.HasPrefix(header, []byte("\xff\xd8\xff")):
+		return JPEG
+	case bytes.HasPrefix(header, []byte("\x89PNG\r\n\x1a\n")):
+		return PNG
+	case bytes.HasPrefix(header, []byte("GIF87a")), bytes.HasPrefix(header, []byte("GIF89a")):
+		return GIF
+	case len(header) >= 12 && bytes.Equal(header[:4], []byte("RIFF")) && bytes.Equal(header[8:12], []byte("WEBP")):
+		return WebP
+	}
+	return ""
+}
+
+// ContentType returns the MIME type of a format.
+func ContentType(format string) string {
+	return contentTypes[format]
+}
+
+// FromContentType returns the format named by a MIME type, or an empty
+// string when it is not a supported image type.
+func FromContentType(contentType string) string {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return ""
+	}
+	mediaType = strings.ToLower(mediaType)
+	for format, ct := range contentTypes {
+		if ct == mediaType {
+			return format
+		}
+	}
+	return aliases[mediaType]
+}
+
+// IsGeneric reports whether a content type says nothing about the format,
+// as is sent by clients that do not know what they are uploading.
+func IsGeneric(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return contentType == ""
+	}
+	return mediaType == "application/octet-stream" || mediaType == "binary/octet-stream"
+}
@@ -0,0 +1,127 @@
+package jobs
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/joberly/demo-temporal/internal/storage"
+)
+
+// recordPrefix is the key prefix of records in a blob store.
+const recordPrefix = "jobs/"
+
+// BlobStore is a Store keeping each record as a JSON object in a blob
+// store. It keeps no index: List and Usage read every record, costing a
+// store listing and a get per record on each call, so it suits small
+// deployments only. Use PostgresStore when there are more than a few
+// thousand records.
+type BlobStore struct {
+	blob storage.Blob
+	// mu serialises updates made through this store. Updates from other
+	// processes may still interleave.
+	mu sync.Mutex
+}
+
+// NewBlobStore returns a Store keeping records in blob.
+func NewBlobStore(blob storage.Blob) *BlobStore {
+	return &BlobStore{blob: blob}
+}
+
+// recordKey returns the key of the record of imageID.
+func recordKey(imageID string) string {
+	return recordPrefix + imageID + ".json"
+}
+
+func (s *BlobStore) Put(ctx context.Context, record *Record) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	return s.blob.Put(ctx, recordKey(record.ImageID), bytes.NewReader(data), &storage.PutOptions{
+		ContentType: "application/json",
+		Size:        int64(len(data)),
+	})
+}
+
+func (s *BlobStore) Get(ctx context.Context, imageID string) (*Record, error) {
+	return s.get(ctx, recordKey(imageID))
+}
+
+func (s *BlobStore) get(ctx context.Context, key string) (*Record, error) {
+	reader, _, err := s.blob.Get(ctx, key)
+	if errors.Is(err, storage.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	var record Record
+	if err := json.NewDecoder(reader).Decode(&record); err != nil {
+		return nil, err
+	}
+	return &record, nil
+}
+
+func (s *BlobStore) Update(ctx context.Context, imageID string, fn func(*Record)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	record, err := s.Get(ctx, imageID)
+	if errors.Is(err, ErrNotFound) {
+		record = &Record{ImageID: imageID}
+	} else if err != nil {
+		return err
+	}
+	fn(record)
+	touch(record)
+	return s.Put(ctx, record)
+}
+
+// List reads every record to select a page, see BlobStore.
+func (s *BlobStore) List(ctx context.Context, filter Filter) (*Page, error) {
+	records, err := s.all(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return listRecords(records, filter)
+}
+
+// Usage reads every record, see BlobStore. It runs before each upload is
+// accepted when quotas are enforced.
+func (s *BlobStore) Usage(ctx context.Context, tenant string, since time.Time) (*Usage, error) {
+	records, err := s.all(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return recordUsage(records, tenant, since), nil
+}
+
+// all reads every record.
+func (s *BlobStore) all(ctx context.Context) ([]*Record, error) {
+	infos, err := s.blob.List(ctx, recordPrefix)
+	if err != nil {
+		return nil, err
+	}
+	var records []*Record
+	for _, info := range infos {
+		if !strings.HasSuffix(info.Key, ".json") {
+			continue
+		}
+		record, err := s.get(ctx, info.Key)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
@@ -0,0 +1,62 @@
+package jobs
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+
+	"github.com/joberly/demo-temporal/internal/storage"
+)
+
+const (
+	// DriverBlob keeps records in the upload store.
+	DriverBlob = "blob"
+	// DriverPostgres keeps records in a Postgres database.
+	DriverPostgres = "postgres"
+	// DriverMemory keeps records in memory, so they are only seen by the
+	// process that made them.
+	DriverMemory = "memory"
+)
+
+// Config selects and configures the job record store.
+type Config struct {
+	Driver   string
+	Postgres PostgresConfig
+}
+
+// PostgresConfig describes how to connect to Postgres.
+type PostgresConfig struct {
+	Host     string
+	Port     string
+	User     string
+	Password string `json:"-"`
+	Database string
+	SSLMode  string
+}
+
+// DSN returns the connection string for the database.
+func (c *PostgresConfig) DSN() string {
+	u := url.URL{
+		Scheme:   "postgres",
+		User:     url.UserPassword(c.User, c.Password),
+		Host:     c.Host + ":" + c.Port,
+		Path:     "/" + c.Database,
+		RawQuery: url.Values{"sslmode": {c.SSLMode}}.Encode(),
+	}
+	return u.String()
+}
+
+// NewStore creates the job record store described by config. The blob
+// driver keeps records in blob.
+func NewStore(ctx context.Context, config *Config, blob storage.Blob) (Store, error) {
+	switch config.Driver {
+	case DriverBlob, "":
+		return NewBlobStore(blob), nil
+	case DriverPostgres:
+		return NewPostgresStore(ctx, &config.Postgres)
+	case DriverMemory:
+		return NewMemoryStore(), nil
+	default:
+		return nil, fmt.Errorf("unknown job store driver: %q", config.Driver)
+	}
+}
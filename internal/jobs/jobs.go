@@ -0,0 +1,254 @@
+// Package jobs keeps a record of each image processing job that outlives
+// the workflow that ran it.
+package jobs
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/joberly/demo-temporal/internal/pipeline"
+	"github.com/joberly/demo-temporal/internal/tenant"
+	"github.com/joberly/demo-temporal/workflows"
+)
+
+var (
+	// ErrNotFound is returned when there is no record of a job.
+	ErrNotFound = errors.New("job not found")
+	// ErrInvalidCursor is returned when a list cursor was not issued by
+	// the store.
+	ErrInvalidCursor = errors.New("invalid cursor")
+)
+
+const (
+	// DefaultLimit is the number of records listed when no limit is given.
+	DefaultLimit = 50
+	// MaxLimit is the largest number of records listed at once.
+	MaxLimit = 200
+)
+
+// Record describes an uploaded image and the job processing it.
+type Record struct {
+	ImageID string
+	// Owner is the client the image belongs to.
+	Owner string
+	// Tenant is the tenant of the owner, empty for the default tenant.
+	Tenant      string
+	Filename    string
+	ContentType string
+	Size        int64
+	Width       int
+	Height      int
+	Pipeline    pipeline.Pipeline
+	Renditions  []pipeline.Rendition
+	// Resumable reports whether the image was sent as a resumable upload.
+	Resumable  bool
+	WorkflowID string
+	RunID      string
+	// State is the state of the workflow, one of the workflows State
+	// constants.
+	State string
+	// Status is the status of the workflow when the record was last
+	// updated.
+	Status workflows.ImageProcessingWorkflowStatus
+	// Outputs lists the processed store keys of the image and its
+	// renditions once processing has completed.
+	Outputs   []string
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// Key returns the storage key of the image.
+func (r *Record) Key() string {
+	return tenant.Key(r.Tenant, r.ImageID)
+}
+
+// Active reports whether the job has yet to finish. Jobs are active from
+// the moment their upload is recorded until the worker records their
+// outcome.
+func (r *Record) Active() bool {
+	switch r.State {
+	case workflows.StateCompleted, workflows.StateFailed, workflows.StateCancelled:
+		return false
+	default:
+		return true
+	}
+}
+
+// Filter selects the records to list. Empty fields match every record.
+type Filter struct {
+	State  string
+	Owner  string
+	Tenant string
+	// Since matches records created at or after it.
+	Since time.Time
+	// Cursor continues a listing from the page that returned it.
+	Cursor string
+	// Limit is the most records to return, DefaultLimit when zero.
+	Limit int
+}
+
+// Page is one page of a listing, newest records first.
+type Page struct {
+	Records []*Record
+	// NextCursor continues the listing, it is empty on the last page.
+	NextCursor string
+}
+
+// Usage is what a tenant has processed, measured against its quota.
+type Usage struct {
+	// ActiveJobs is the number of jobs that have yet to finish.
+	ActiveJobs int
+	// Bytes is the total size of the images uploaded since a given time.
+	Bytes int64
+}
+
+// Store keeps job records.
+type Store interface {
+	// Put saves a record, replacing any earlier record of the same image.
+	Put(ctx context.Context, record *Record) error
+	// Get returns the record of the job processing imageID.
+	Get(ctx context.Context, imageID string) (*Record, error)
+	// Update applies fn to the record of imageID, creating the record when
+	// there is none, and saves the result. The api and worker each fill in
+	// what they know so neither overwrites the other.
+	Update(ctx context.Context, imageID string, fn func(*Record)) error
+	// List returns the records matching filter, newest first.
+	List(ctx context.Context, filter Filter) (*Page, error)
+	// Usage returns the jobs of tenant that have yet to finish and the
+	// bytes it has uploaded since the given time.
+	Usage(ctx context.Context, tenant string, since time.Time) (*Usage, error)
+}
+
+// SchemaChecker is implemented by stores whose schema is managed by the
+// migrate command.
+type SchemaChecker interface {
+	// CheckSchema returns an error when the schema is out of date.
+	CheckSchema(ctx context.Context) error
+}
+
+// limit returns the number of records to list.
+func (f Filter) limit() int {
+	switch {
+	case f.Limit <= 0:
+		return DefaultLimit
+	case f.Limit > MaxLimit:
+		return MaxLimit
+	default:
+		return f.Limit
+	}
+}
+
+// matches reports whether record is selected by the filter, ignoring the
+// cursor.
+func (f Filter) matches(record *Record) bool {
+	return (f.State == "" || record.State == f.State) &&
+		(f.Owner == "" || record.Owner == f.Owner) &&
+		(f.Tenant == "" || record.Tenant == f.Tenant) &&
+		(f.Since.IsZero() || !record.CreatedAt.Before(f.Since))
+}
+
+// cursor marks a position in a listing by the creation time and image id
+// of the last record returned.
+type cursor struct {
+	createdAt time.Time
+	imageID   string
+}
+
+// encodeCursor returns the cursor continuing a listing after record.
+func encodeCursor(record *Record) string {
+	s := strconv.FormatInt(record.CreatedAt.UnixNano(), 10) + ":" + record.ImageID
+	return base64.RawURLEncoding.EncodeToString([]byte(s))
+}
+
+// decodeCursor parses a cursor returned by encodeCursor. An empty cursor
+// starts at the beginning of the listing and returns nil.
+func decodeCursor(s string) (*cursor, error) {
+	if s == "" {
+		return nil, nil
+	}
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	nanos, imageID, ok := strings.Cut(string(data), ":")
+	if !ok {
+		return nil, ErrInvalidCursor
+	}
+	n, err := strconv.ParseInt(nanos, 10, 64)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	return &cursor{createdAt: time.Unix(0, n).UTC(), imageID: imageID}, nil
+}
+
+// before reports whether a comes before b in a listing.
+func before(a, b *Record) bool {
+	if !a.CreatedAt.Equal(b.CreatedAt) {
+		return a.CreatedAt.After(b.CreatedAt)
+	}
+	return a.ImageID > b.ImageID
+}
+
+// after reports whether record comes after the cursor in a listing.
+func (c *cursor) after(record *Record) bool {
+	if c == nil {
+		return true
+	}
+	return before(&Record{CreatedAt: c.createdAt, ImageID: c.imageID}, record)
+}
+
+// listRecords returns the page of records selected by filter, for stores
+// that list by scanning every record.
+func listRecords(records []*Record, filter Filter) (*Page, error) {
+	c, err := decodeCursor(filter.Cursor)
+	if err != nil {
+		return nil, err
+	}
+	var matched []*Record
+	for _, record := range records {
+		if filter.matches(record) && c.after(record) {
+			matched = append(matched, record)
+		}
+	}
+	sort.Slice(matched, func(i, j int) bool { return before(matched[i], matched[j]) })
+
+	page := &Page{Records: matched}
+	if limit := filter.limit(); len(matched) > limit {
+		page.Records = matched[:limit]
+		page.NextCursor = encodeCursor(page.Records[limit-1])
+	}
+	return page, nil
+}
+
+// recordUsage returns the usage of tenant, for stores that measure it by
+// scanning every record.
+func recordUsage(records []*Record, tenant string, since time.Time) *Usage {
+	usage := &Usage{}
+	for _, record := range records {
+		if record.Tenant != tenant {
+			continue
+		}
+		if record.Active() {
+			usage.ActiveJobs++
+		}
+		if !record.CreatedAt.Before(since) {
+			usage.Bytes += record.Size
+		}
+	}
+	return usage
+}
+
+// touch sets the update time of a record, and its creation time when it is
+// new.
+func touch(record *Record) {
+	now := time.Now().UTC()
+	if record.CreatedAt.IsZero() {
+		record.CreatedAt = now
+	}
+	record.UpdatedAt = now
+}
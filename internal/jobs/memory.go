@@ -0,0 +1,69 @@
+package jobs
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// MemoryStore is a Store keeping records in memory, for tests and single
+// process deployments.
+type MemoryStore struct {
+	mu      sync.Mutex
+	records map[string]Record
+}
+
+// NewMemoryStore returns an empty MemoryStore.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{records: map[string]Record{}}
+}
+
+func (s *MemoryStore) Put(ctx context.Context, record *Record) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.records[record.ImageID] = *record
+	return nil
+}
+
+func (s *MemoryStore) Get(ctx context.Context, imageID string) (*Record, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	record, ok := s.records[imageID]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &record, nil
+}
+
+func (s *MemoryStore) Update(ctx context.Context, imageID string, fn func(*Record)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	record, ok := s.records[imageID]
+	if !ok {
+		record = Record{ImageID: imageID}
+	}
+	fn(&record)
+	touch(&record)
+	s.records[imageID] = record
+	return nil
+}
+
+func (s *MemoryStore) List(ctx context.Context, filter Filter) (*Page, error) {
+	return listRecords(s.all(), filter)
+}
+
+func (s *MemoryStore) Usage(ctx context.Context, tenant string, since time.Time) (*Usage, error) {
+	return recordUsage(s.all(), tenant, since), nil
+}
+
+// all returns a copy of every record.
+func (s *MemoryStore) all() []*Record {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	records := make([]*Record, 0, len(s.records))
+	for _, record := range s.records {
+		record := record
+		records = append(records, &record)
+	}
+	return records
+}
@@ -0,0 +1,273 @@
+package jobs
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/joberly/demo-temporal/internal/migrate"
+	"github.com/joberly/demo-temporal/workflows"
+
+	"go.uber.org/zap"
+	// registers the postgres driver with database/sql
+	_ "github.com/lib/pq"
+)
+
+// recordColumns are the columns holding a record, in the order scanned by
+// scanRecord.
+const recordColumns = `image_id, owner, tenant, filename, content_type, size, width, height,
+	pipeline, renditions, resumable, workflow_id, run_id, state, status, outputs, created_at, updated_at`
+
+// PostgresStore is a Store keeping records in a Postgres table.
+type PostgresStore struct {
+	db *sql.DB
+}
+
+// NewPostgresStore connects to the database described by config. The
+// jobs table is created by the migrate command.
+func NewPostgresStore(ctx context.Context, config *PostgresConfig) (*PostgresStore, error) {
+	db, err := OpenPostgres(ctx, config)
+	if err != nil {
+		return nil, err
+	}
+	return &PostgresStore{db: db}, nil
+}
+
+// OpenPostgres connects to the database described by config.
+func OpenPostgres(ctx context.Context, config *PostgresConfig) (*sql.DB, error) {
+	db, err := sql.Open("postgres", config.DSN())
+	if err != nil {
+		return nil, err
+	}
+	if err := db.PingContext(ctx); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("connecting to postgres: %w", err)
+	}
+	return db, nil
+}
+
+// CheckSchema returns migrate.ErrSchemaOutOfDate when migrations have yet
+// to be applied to the database.
+func (s *PostgresStore) CheckSchema(ctx context.Context) error {
+	migrator, err := migrate.New(s.db, zap.NewNop())
+	if err != nil {
+		return err
+	}
+	return migrator.Check(ctx)
+}
+
+// DB returns the database holding the records.
+func (s *PostgresStore) DB() *sql.DB {
+	return s.db
+}
+
+// Close closes the database connections.
+func (s *PostgresStore) Close() error {
+	return s.db.Close()
+}
+
+func (s *PostgresStore) Put(ctx context.Context, record *Record) error {
+	return putRecord(ctx, s.db, record)
+}
+
+func (s *PostgresStore) Get(ctx context.Context, imageID string) (*Record, error) {
+	row := s.db.QueryRowContext(ctx,
+		`SELECT `+recordColumns+` FROM jobs WHERE image_id = $1`, imageID)
+	return scanRecord(row)
+}
+
+func (s *PostgresStore) Update(ctx context.Context, imageID string, fn func(*Record)) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// make sure there is a row to lock so concurrent updates of a new
+	// record queue up behind each other
+	_, err = tx.ExecContext(ctx,
+		`INSERT INTO jobs (image_id, created_at, updated_at) VALUES ($1, now(), now())
+		ON CONFLICT (image_id) DO NOTHING`, imageID)
+	if err != nil {
+		return err
+	}
+	row := tx.QueryRowContext(ctx,
+		`SELECT `+recordColumns+` FROM jobs WHERE image_id = $1 FOR UPDATE`, imageID)
+	record, err := scanRecord(row)
+	if err != nil {
+		return err
+	}
+	fn(record)
+	touch(record)
+	if err := putRecord(ctx, tx, record); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *PostgresStore) List(ctx context.Context, filter Filter) (*Page, error) {
+	c, err := decodeCursor(filter.Cursor)
+	if err != nil {
+		return nil, err
+	}
+
+	var where []string
+	var args []any
+	arg := func(v any) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+	if filter.State != "" {
+		where = append(where, "state = "+arg(filter.State))
+	}
+	if filter.Owner != "" {
+		where = append(where, "owner = "+arg(filter.Owner))
+	}
+	if filter.Tenant != "" {
+		where = append(where, "tenant = "+arg(filter.Tenant))
+	}
+	if !filter.Since.IsZero() {
+		where = append(where, "created_at >= "+arg(filter.Since))
+	}
+	if c != nil {
+		where = append(where, "(created_at, image_id) < ("+arg(c.createdAt)+", "+arg(c.imageID)+")")
+	}
+	query := `SELECT ` + recordColumns + ` FROM jobs`
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	// fetch one more than the limit to tell whether there is another page
+	limit := filter.limit()
+	query += " ORDER BY created_at DESC, image_id DESC LIMIT " + arg(limit+1)
+
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	page := &Page{}
+	for rows.Next() {
+		record, err := scanRecord(rows)
+		if err != nil {
+			return nil, err
+		}
+		page.Records = append(page.Records, record)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(page.Records) > limit {
+		page.Records = page.Records[:limit]
+		page.NextCursor = encodeCursor(page.Records[limit-1])
+	}
+	return page, nil
+}
+
+func (s *PostgresStore) Usage(ctx context.Context, tenant string, since time.Time) (*Usage, error) {
+	var usage Usage
+	err := s.db.QueryRowContext(ctx, `SELECT
+			count(*) FILTER (WHERE state NOT IN ($2, $3, $4)),
+			coalesce(sum(size) FILTER (WHERE created_at >= $5), 0)
+		FROM jobs WHERE tenant = $1`,
+		tenant, workflows.StateCompleted, workflows.StateFailed, workflows.StateCancelled, since,
+	).Scan(&usage.ActiveJobs, &usage.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	return &usage, nil
+}
+
+// execer is implemented by both sql.DB and sql.Tx.
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+}
+
+// putRecord inserts or replaces a record.
+func putRecord(ctx context.Context, db execer, record *Record) error {
+	pipeline, err := json.Marshal(record.Pipeline)
+	if err != nil {
+		return err
+	}
+	renditions, err := json.Marshal(record.Renditions)
+	if err != nil {
+		return err
+	}
+	status, err := json.Marshal(record.Status)
+	if err != nil {
+		return err
+	}
+	outputs, err := json.Marshal(record.Outputs)
+	if err != nil {
+		return err
+	}
+	_, err = db.ExecContext(ctx, `INSERT INTO jobs (`+recordColumns+`)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18)
+		ON CONFLICT (image_id) DO UPDATE SET
+			owner = EXCLUDED.owner,
+			tenant = EXCLUDED.tenant,
+			filename = EXCLUDED.filename,
+			content_type = EXCLUDED.content_type,
+			size = EXCLUDED.size,
+			width = EXCLUDED.width,
+			height = EXCLUDED.height,
+			pipeline = EXCLUDED.pipeline,
+			renditions = EXCLUDED.renditions,
+			resumable = EXCLUDED.resumable,
+			workflow_id = EXCLUDED.workflow_id,
+			run_id = EXCLUDED.run_id,
+			state = EXCLUDED.state,
+			status = EXCLUDED.status,
+			outputs = EXCLUDED.outputs,
+			created_at = EXCLUDED.created_at,
+			updated_at = EXCLUDED.updated_at`,
+		record.ImageID, record.Owner, record.Tenant, record.Filename, record.ContentType,
+		record.Size, record.Width, record.Height, pipeline, renditions, record.Resumable,
+		record.WorkflowID, record.RunID, record.State, status, outputs,
+		record.CreatedAt, record.UpdatedAt)
+	return err
+}
+
+// scanner is implemented by both sql.Row and sql.Rows.
+type scanner interface {
+	Scan(dest ...any) error
+}
+
+// scanRecord reads a record selected with recordColumns.
+func scanRecord(row scanner) (*Record, error) {
+	var record Record
+	var pipeline, renditions, status, outputs []byte
+	err := row.Scan(&record.ImageID, &record.Owner, &record.Tenant, &record.Filename, &record.ContentType,
+		&record.Size, &record.Width, &record.Height, &pipeline, &renditions, &record.Resumable,
+		&record.WorkflowID, &record.RunID, &record.State, &status, &outputs,
+		&record.CreatedAt, &record.UpdatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, col := range []struct {
+		data []byte
+		v    any
+	}{
+		{pipeline, &record.Pipeline},
+		{renditions, &record.Renditions},
+		{status, &record.Status},
+		{outputs, &record.Outputs},
+	} {
+		if len(col.data) == 0 {
+			continue
+		}
+		if err := json.Unmarshal(col.data, col.v); err != nil {
+			return nil, err
+		}
+	}
+	record.CreatedAt = record.CreatedAt.UTC()
+	record.UpdatedAt = record.UpdatedAt.UTC()
+	return &record, nil
+}
@@ -0,0 +1,308 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/joberly/demo-temporal/internal/storage"
+	"github.com/joberly/demo-temporal/workflows"
+)
+
+// stores returns a constructor for each store the contract tests run
+// against. Postgres needs a database and is left to integration tests.
+func stores() map[string]func(t *testing.T) Store {
+	return map[string]func(t *testing.T) Store{
+		"memory": func(t *testing.T) Store {
+			return NewMemoryStore()
+		},
+		"blob": func(t *testing.T) Store {
+			blob, err := storage.NewLocal(t.TempDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+			return NewBlobStore(blob)
+		},
+	}
+}
+
+// runStores runs test against a new store of each kind.
+func runStores(t *testing.T, test func(t *testing.T, ctx context.Context, store Store)) {
+	for name, newStore := range stores() {
+		t.Run(name, func(t *testing.T) {
+			test(t, context.Background(), newStore(t))
+		})
+	}
+}
+
+var baseTime = time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+// putRecords saves records, failing the test on error.
+func putRecords(t *testing.T, ctx context.Context, store Store, records ...*Record) {
+	t.Helper()
+	for _, record := range records {
+		if err := store.Put(ctx, record); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// imageIDs returns the image ids of records in order.
+func imageIDs(records []*Record) []string {
+	ids := make([]string, len(records))
+	for i, record := range records {
+		ids[i] = record.ImageID
+	}
+	return ids
+}
+
+func equalIDs(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestStoreGetPut(t *testing.T) {
+	runStores(t, func(t *testing.T, ctx context.Context, store Store) {
+		if _, err := store.Get(ctx, "missing"); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("Get(missing) err = %v, want ErrNotFound", err)
+		}
+
+		putRecords(t, ctx, store, &Record{ImageID: "a", Owner: "alice", Size: 10, CreatedAt: baseTime})
+		putRecords(t, ctx, store, &Record{ImageID: "a", Owner: "alice", Size: 20, CreatedAt: baseTime})
+		got, err := store.Get(ctx, "a")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Owner != "alice" || got.Size != 20 || !got.CreatedAt.Equal(baseTime) {
+			t.Errorf("Get(a) = %+v, want the replacing record", got)
+		}
+	})
+}
+
+func TestStoreUpdate(t *testing.T) {
+	runStores(t, func(t *testing.T, ctx context.Context, store Store) {
+		err := store.Update(ctx, "a", func(r *Record) { r.Owner = "alice" })
+		if err != nil {
+			t.Fatal(err)
+		}
+		created, err := store.Get(ctx, "a")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if created.ImageID != "a" || created.Owner != "alice" || created.CreatedAt.IsZero() {
+			t.Fatalf("created record = %+v", created)
+		}
+
+		err = store.Update(ctx, "a", func(r *Record) { r.State = workflows.StateCompleted })
+		if err != nil {
+			t.Fatal(err)
+		}
+		updated, err := store.Get(ctx, "a")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if updated.Owner != "alice" || updated.State != workflows.StateCompleted {
+			t.Errorf("updated record = %+v, want owner kept and state set", updated)
+		}
+		if !updated.CreatedAt.Equal(created.CreatedAt) || updated.UpdatedAt.Before(created.UpdatedAt) {
+			t.Errorf("times = %v, %v, want creation kept, update advanced from %v, %v",
+				updated.CreatedAt, updated.UpdatedAt, created.CreatedAt, created.UpdatedAt)
+		}
+	})
+}
+
+func TestStoreListOrder(t *testing.T) {
+	runStores(t, func(t *testing.T, ctx context.Context, store Store) {
+		putRecords(t, ctx, store,
+			&Record{ImageID: "old", CreatedAt: baseTime},
+			&Record{ImageID: "new", CreatedAt: baseTime.Add(2 * time.Hour)},
+			// records created at the same time are ordered by image id
+			&Record{ImageID: "tie-a", CreatedAt: baseTime.Add(time.Hour)},
+			&Record{ImageID: "tie-b", CreatedAt: baseTime.Add(time.Hour)},
+		)
+		page, err := store.List(ctx, Filter{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := []string{"new", "tie-b", "tie-a", "old"}
+		if got := imageIDs(page.Records); !equalIDs(got, want) {
+			t.Errorf("List = %v, want %v", got, want)
+		}
+		if page.NextCursor != "" {
+			t.Errorf("NextCursor = %q on the last page", page.NextCursor)
+		}
+	})
+}
+
+func TestStoreListPages(t *testing.T) {
+	runStores(t, func(t *testing.T, ctx context.Context, store Store) {
+		// pairs share a creation time so pages split ties
+		var want []string
+		for i := 9; i >= 0; i-- {
+			record := &Record{
+				ImageID:   fmt.Sprintf("img-%02d", i),
+				Owner:     "alice",
+				CreatedAt: baseTime.Add(time.Duration(i/2) * time.Minute),
+			}
+			putRecords(t, ctx, store, record)
+			want = append(want, record.ImageID)
+		}
+		putRecords(t, ctx, store, &Record{ImageID: "other", Owner: "bob", CreatedAt: baseTime})
+
+		var got []string
+		filter := Filter{Owner: "alice", Limit: 3}
+		for pages := 0; ; pages++ {
+			if pages > len(want) {
+				t.Fatalf("listing did not end, got %v", got)
+			}
+			page, err := store.List(ctx, filter)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(page.Records) > filter.Limit {
+				t.Fatalf("page has %d records, limit %d", len(page.Records), filter.Limit)
+			}
+			got = append(got, imageIDs(page.Records)...)
+			if page.NextCursor == "" {
+				break
+			}
+			filter.Cursor = page.NextCursor
+		}
+		if !equalIDs(got, want) {
+			t.Errorf("pages = %v, want %v", got, want)
+		}
+
+		// records added ahead of a cursor don't shift the pages after it
+		first, err := store.List(ctx, Filter{Owner: "alice", Limit: 4})
+		if err != nil {
+			t.Fatal(err)
+		}
+		putRecords(t, ctx, store, &Record{ImageID: "newest", Owner: "alice", CreatedAt: baseTime.Add(time.Hour)})
+		next, err := store.List(ctx, Filter{Owner: "alice", Limit: 4, Cursor: first.NextCursor})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := imageIDs(next.Records); !equalIDs(got, want[4:8]) {
+			t.Errorf("second page = %v, want %v", got, want[4:8])
+		}
+	})
+}
+
+func TestStoreListLimit(t *testing.T) {
+	runStores(t, func(t *testing.T, ctx context.Context, store Store) {
+		for i := 0; i < MaxLimit+1; i++ {
+			putRecords(t, ctx, store, &Record{
+				ImageID:   fmt.Sprintf("img-%03d", i),
+				CreatedAt: baseTime.Add(time.Duration(i) * time.Second),
+			})
+		}
+		for _, tt := range []struct {
+			limit int
+			want  int
+		}{
+			{0, DefaultLimit},
+			{-1, DefaultLimit},
+			{7, 7},
+			{MaxLimit + 100, MaxLimit},
+		} {
+			page, err := store.List(ctx, Filter{Limit: tt.limit})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(page.Records) != tt.want || page.NextCursor == "" {
+				t.Errorf("limit %d: %d records, cursor %q, want %d and a cursor",
+					tt.limit, len(page.Records), page.NextCursor, tt.want)
+			}
+		}
+	})
+}
+
+func TestStoreListInvalidCursor(t *testing.T) {
+	runStores(t, func(t *testing.T, ctx context.Context, store Store) {
+		putRecords(t, ctx, store, &Record{ImageID: "a", CreatedAt: baseTime})
+		for _, c := range []string{"not base64!", "bm8tY29sb24", "eDph"} {
+			if _, err := store.List(ctx, Filter{Cursor: c}); !errors.Is(err, ErrInvalidCursor) {
+				t.Errorf("List(cursor %q) err = %v, want ErrInvalidCursor", c, err)
+			}
+		}
+	})
+}
+
+func TestStoreListFilters(t *testing.T) {
+	runStores(t, func(t *testing.T, ctx context.Context, store Store) {
+		putRecords(t, ctx, store,
+			&Record{ImageID: "a1", Owner: "alice", Tenant: "acme", State: workflows.StateCompleted, CreatedAt: baseTime},
+			&Record{ImageID: "a2", Owner: "alice", Tenant: "acme", State: workflows.StateProcessing, CreatedAt: baseTime.Add(time.Hour)},
+			&Record{ImageID: "b1", Owner: "bob", Tenant: "acme", State: workflows.StateCompleted, CreatedAt: baseTime.Add(2 * time.Hour)},
+			&Record{ImageID: "c1", Owner: "carol", State: workflows.StateFailed, CreatedAt: baseTime.Add(3 * time.Hour)},
+		)
+		tests := []struct {
+			name   string
+			filter Filter
+			want   []string
+		}{
+			{"all", Filter{}, []string{"c1", "b1", "a2", "a1"}},
+			{"state", Filter{State: workflows.StateCompleted}, []string{"b1", "a1"}},
+			{"owner", Filter{Owner: "alice"}, []string{"a2", "a1"}},
+			{"tenant", Filter{Tenant: "acme"}, []string{"b1", "a2", "a1"}},
+			{"since", Filter{Since: baseTime.Add(2 * time.Hour)}, []string{"c1", "b1"}},
+			{"combined", Filter{Tenant: "acme", Owner: "alice", State: workflows.StateCompleted}, []string{"a1"}},
+			{"none", Filter{Owner: "dave"}, nil},
+		}
+		for _, tt := range tests {
+			page, err := store.List(ctx, tt.filter)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := imageIDs(page.Records); !equalIDs(got, tt.want) {
+				t.Errorf("%s: List = %v, want %v", tt.name, got, tt.want)
+			}
+		}
+	})
+}
+
+func TestStoreUsage(t *testing.T) {
+	runStores(t, func(t *testing.T, ctx context.Context, store Store) {
+		day := baseTime.Truncate(24 * time.Hour)
+		putRecords(t, ctx, store,
+			// yesterday's jobs count while active but not towards bytes
+			&Record{ImageID: "y1", Tenant: "acme", Size: 1000, State: workflows.StateProcessing, CreatedAt: day.Add(-time.Hour)},
+			&Record{ImageID: "y2", Tenant: "acme", Size: 1000, State: workflows.StateCompleted, CreatedAt: day.Add(-time.Hour)},
+			// a record without a state yet is active from its upload
+			&Record{ImageID: "t1", Tenant: "acme", Size: 10, CreatedAt: day},
+			&Record{ImageID: "t2", Tenant: "acme", Size: 20, State: workflows.StateCompleted, CreatedAt: day.Add(time.Hour)},
+			&Record{ImageID: "t3", Tenant: "acme", Size: 40, State: workflows.StateFailed, CreatedAt: day.Add(time.Hour)},
+			&Record{ImageID: "t4", Tenant: "acme", Size: 80, State: workflows.StateCancelled, CreatedAt: day.Add(time.Hour)},
+			// other tenants, including the default, are counted apart
+			&Record{ImageID: "o1", Tenant: "globex", Size: 500, State: workflows.StateProcessing, CreatedAt: day},
+			&Record{ImageID: "d1", Size: 300, CreatedAt: day},
+		)
+		tests := []struct {
+			tenant string
+			want   Usage
+		}{
+			{"acme", Usage{ActiveJobs: 2, Bytes: 150}},
+			{"globex", Usage{ActiveJobs: 1, Bytes: 500}},
+			{"", Usage{ActiveJobs: 1, Bytes: 300}},
+			{"initech", Usage{}},
+		}
+		for _, tt := range tests {
+			got, err := store.Usage(ctx, tt.tenant, day)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if *got != tt.want {
+				t.Errorf("Usage(%q) = %+v, want %+v", tt.tenant, *got, tt.want)
+			}
+		}
+	})
+}
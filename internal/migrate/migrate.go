@@ -0,0 +1,338 @@
+// Package migrate creates and evolves the schema of the metadata database
+// from versioned SQL files embedded in the binary.
+//
+// Migrations live in the migrations directory as pairs of files named
+// NNNN_name.up.sql and NNNN_name.down.sql, where NNNN is the version. Each
+// migration runs in a transaction together with the update of the
+// schema_migrations table recording it, and migrations are serialised
+// across processes with a Postgres advisory lock.
+package migrate
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+//go:embed migrations/*.sql
+var files embed.FS
+
+// lockID identifies the advisory lock held while migrating.
+const lockID = 7_201_405_173
+
+// ErrSchemaOutOfDate is returned by Check when migrations are pending.
+var ErrSchemaOutOfDate = errors.New("database schema is out of date")
+
+// Migration is one version of the schema.
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+// Status reports whether a migration has been applied.
+type Status struct {
+	Version   int
+	Name      string
+	AppliedAt *time.Time
+}
+
+var filePattern = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+// Migrations returns the embedded migrations in version order.
+func Migrations() ([]Migration, error) {
+	entries, err := fs.ReadDir(files, "migrations")
+	if err != nil {
+		return nil, err
+	}
+	byVersion := map[int]*Migration{}
+	for _, entry := range entries {
+		m := filePattern.FindStringSubmatch(entry.Name())
+		if m == nil {
+			return nil, fmt.Errorf("unexpected migration file %q", entry.Name())
+		}
+		version, _ := strconv.Atoi(m[1])
+		sql, err := fs.ReadFile(files, "migrations/"+entry.Name())
+		if err != nil {
+			return nil, err
+		}
+		migration := byVersion[version]
+		if migration == nil {
+			migration = &Migration{Version: version, Name: m[2]}
+			byVersion[version] = migration
+		}
+		if migration.Name != m[2] {
+			return nil, fmt.Errorf("migration %d has files named %q and %q", version, migration.Name, m[2])
+		}
+		if m[3] == "up" {
+			migration.Up = string(sql)
+		} else {
+			migration.Down = string(sql)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, migration := range byVersion {
+		if migration.Version <= 0 || migration.Up == "" || migration.Down == "" {
+			return nil, fmt.Errorf("migration %d needs a positive version and both up and down files", migration.Version)
+		}
+		migrations = append(migrations, *migration)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return migrations, nil
+}
+
+// Migrator applies migrations to a database.
+type Migrator struct {
+	db         *sql.DB
+	logger     *zap.Logger
+	migrations []Migration
+}
+
+// New returns a Migrator applying the embedded migrations to db.
+func New(db *sql.DB, logger *zap.Logger) (*Migrator, error) {
+	migrations, err := Migrations()
+	if err != nil {
+		return nil, err
+	}
+	return &Migrator{db: db, logger: logger, migrations: migrations}, nil
+}
+
+// Latest returns the version of the newest migration, zero when there are
+// none.
+func (m *Migrator) Latest() int {
+	if len(m.migrations) == 0 {
+		return 0
+	}
+	return m.migrations[len(m.migrations)-1].Version
+}
+
+// querier is implemented by sql.DB, sql.Conn and sql.Tx.
+type querier interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+}
+
+// createTable creates the table recording applied migrations.
+func createTable(ctx context.Context, q querier) error {
+	_, err := q.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version    INTEGER PRIMARY KEY,
+		applied_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	)`)
+	return err
+}
+
+// applied returns the applied migration versions and when they were
+// applied. A missing schema_migrations table means none have been.
+func applied(ctx context.Context, q querier) (map[int]time.Time, error) {
+	var exists bool
+	rows, err := q.QueryContext(ctx, `SELECT to_regclass('schema_migrations') IS NOT NULL`)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		err = rows.Scan(&exists)
+	}
+	rows.Close()
+	if err != nil {
+		return nil, err
+	}
+	versions := map[int]time.Time{}
+	if !exists {
+		return versions, nil
+	}
+
+	rows, err = q.QueryContext(ctx, `SELECT version, applied_at FROM schema_migrations`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var version int
+		var at time.Time
+		if err := rows.Scan(&version, &at); err != nil {
+			return nil, err
+		}
+		versions[version] = at
+	}
+	return versions, rows.Err()
+}
+
+// current returns the newest applied version, zero when none are.
+func current(versions map[int]time.Time) int {
+	version := 0
+	for v := range versions {
+		version = max(version, v)
+	}
+	return version
+}
+
+// Version returns the version of the schema, zero when no migrations have
+// been applied.
+func (m *Migrator) Version(ctx context.Context) (int, error) {
+	versions, err := applied(ctx, m.db)
+	if err != nil {
+		return 0, err
+	}
+	return current(versions), nil
+}
+
+// Status lists every migration and when it was applied.
+func (m *Migrator) Status(ctx context.Context) ([]Status, error) {
+	versions, err := applied(ctx, m.db)
+	if err != nil {
+		return nil, err
+	}
+	statuses := make([]Status, 0, len(m.migrations))
+	for _, migration := range m.migrations {
+		status := Status{Version: migration.Version, Name: migration.Name}
+		if at, ok := versions[migration.Version]; ok {
+			status.AppliedAt = &at
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses, nil
+}
+
+// Check returns ErrSchemaOutOfDate when the schema is older than the
+// newest migration. A newer schema is accepted so that replicas still
+// running the previous release keep working through a rollout.
+func (m *Migrator) Check(ctx context.Context) error {
+	version, err := m.Version(ctx)
+	if err != nil {
+		return err
+	}
+	if version < m.Latest() {
+		return fmt.Errorf("%w: at version %d, want %d", ErrSchemaOutOfDate, version, m.Latest())
+	}
+	return nil
+}
+
+// Up applies every pending migration.
+func (m *Migrator) Up(ctx context.Context) error {
+	return m.To(ctx, m.Latest())
+}
+
+// Down reverts the newest applied migration.
+func (m *Migrator) Down(ctx context.Context) error {
+	return m.migrate(ctx, func(version int) int {
+		target := 0
+		for _, migration := range m.migrations {
+			if migration.Version < version {
+				target = migration.Version
+			}
+		}
+		return target
+	})
+}
+
+// To applies or reverts migrations until the schema is at version. Zero
+// reverts every migration.
+func (m *Migrator) To(ctx context.Context, version int) error {
+	if version != 0 && m.find(version) == nil {
+		return fmt.Errorf("unknown migration version %d", version)
+	}
+	return m.migrate(ctx, func(int) int { return version })
+}
+
+// find returns the migration with version, or nil.
+func (m *Migrator) find(version int) *Migration {
+	for i := range m.migrations {
+		if m.migrations[i].Version == version {
+			return &m.migrations[i]
+		}
+	}
+	return nil
+}
+
+// migrate moves the schema to the version returned by target, which is
+// given the current version once the migration lock is held.
+func (m *Migrator) migrate(ctx context.Context, target func(current int) int) error {
+	// the advisory lock belongs to a session so hold on to one connection
+	conn, err := m.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	m.logger.Info("waiting for migration lock")
+	if _, err := conn.ExecContext(ctx, `SELECT pg_advisory_lock($1)`, lockID); err != nil {
+		return err
+	}
+	defer func() {
+		// unlock with a fresh context so a cancelled migration still
+		// releases the lock
+		_, err := conn.ExecContext(context.Background(), `SELECT pg_advisory_unlock($1)`, lockID)
+		if err != nil {
+			m.logger.Error("failed to release migration lock", zap.Error(err))
+		}
+	}()
+
+	if err := createTable(ctx, conn); err != nil {
+		return err
+	}
+	versions, err := applied(ctx, conn)
+	if err != nil {
+		return err
+	}
+	from := current(versions)
+	to := target(from)
+
+	// apply pending migrations up to the target in order, then revert
+	// applied ones above it newest first
+	for _, migration := range m.migrations {
+		if _, ok := versions[migration.Version]; !ok && migration.Version <= to {
+			if err := m.apply(ctx, conn, migration, true); err != nil {
+				return err
+			}
+		}
+	}
+	for i := len(m.migrations) - 1; i >= 0; i-- {
+		migration := m.migrations[i]
+		if _, ok := versions[migration.Version]; ok && migration.Version > to {
+			if err := m.apply(ctx, conn, migration, false); err != nil {
+				return err
+			}
+		}
+	}
+	if from == to {
+		m.logger.Info("schema is up to date", zap.Int("version", to))
+	}
+	return nil
+}
+
+// apply runs a migration up or down in a transaction along with recording
+// it in schema_migrations.
+func (m *Migrator) apply(ctx context.Context, conn *sql.Conn, migration Migration, up bool) error {
+	direction, script, record := "down", migration.Down, `DELETE FROM schema_migrations WHERE version = $1`
+	if up {
+		direction, script, record = "up", migration.Up, `INSERT INTO schema_migrations (version) VALUES ($1)`
+	}
+	m.logger.Info("migrating",
+		zap.Int("version", migration.Version),
+		zap.String("name", migration.Name),
+		zap.String("direction", direction))
+
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, script); err != nil {
+		return fmt.Errorf("migration %d %s: %w", migration.Version, direction, err)
+	}
+	if _, err := tx.ExecContext(ctx, record, migration.Version); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,23 @@
+-- job records written by the api and worker, see internal/jobs
+CREATE TABLE IF NOT EXISTS jobs (
+	image_id     TEXT PRIMARY KEY,
+	owner        TEXT NOT NULL DEFAULT '',
+	filename     TEXT NOT NULL DEFAULT '',
+	content_type TEXT NOT NULL DEFAULT '',
+	size         BIGINT NOT NULL DEFAULT 0,
+	width        INTEGER NOT NULL DEFAULT 0,
+	height       INTEGER NOT NULL DEFAULT 0,
+	pipeline     JSONB,
+	renditions   JSONB,
+	workflow_id  TEXT NOT NULL DEFAULT '',
+	run_id       TEXT NOT NULL DEFAULT '',
+	state        TEXT NOT NULL DEFAULT '',
+	status       JSONB,
+	outputs      JSONB,
+	created_at   TIMESTAMPTZ NOT NULL,
+	updated_at   TIMESTAMPTZ NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS jobs_created_at_idx ON jobs (created_at DESC, image_id DESC);
+CREATE INDEX IF NOT EXISTS jobs_owner_created_at_idx ON jobs (owner, created_at DESC, image_id DESC);
+CREATE INDEX IF NOT EXISTS jobs_state_created_at_idx ON jobs (state, created_at DESC, image_id DESC);
@@ -0,0 +1,8 @@
+-- api keys accepted by the api, see internal/auth. Keys are stored as the
+-- hex SHA-256 of the key.
+CREATE TABLE api_keys (
+	key_hash   TEXT PRIMARY KEY,
+	subject    TEXT NOT NULL,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+	revoked_at TIMESTAMPTZ
+);
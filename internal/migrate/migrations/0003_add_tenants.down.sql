@@ -0,0 +1,4 @@
+DROP INDEX IF EXISTS jobs_tenant_created_at_idx;
+DROP INDEX IF EXISTS jobs_tenant_state_idx;
+ALTER TABLE api_keys DROP COLUMN IF EXISTS tenant;
+ALTER TABLE jobs DROP COLUMN IF EXISTS tenant;
@@ -0,0 +1,7 @@
+-- tenants of job records and api keys, see internal/tenant. The empty
+-- tenant is the default tenant.
+ALTER TABLE jobs ADD COLUMN tenant TEXT NOT NULL DEFAULT '';
+ALTER TABLE api_keys ADD COLUMN tenant TEXT NOT NULL DEFAULT '';
+
+CREATE INDEX jobs_tenant_state_idx ON jobs (tenant, state);
+CREATE INDEX jobs_tenant_created_at_idx ON jobs (tenant, created_at DESC, image_id DESC);
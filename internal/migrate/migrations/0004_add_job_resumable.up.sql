@@ -0,0 +1,2 @@
+-- marks the jobs of images sent as resumable uploads, see internal/api.
+ALTER TABLE jobs ADD COLUMN resumable BOOLEAN NOT NULL DEFAULT FALSE;
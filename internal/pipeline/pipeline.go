@@ -0,0 +1,392 @@
+package pipeline
+
+import (
+	"fmt"
+	"image/color"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Operations that may appear in a pipeline.
+const (
+	OpGrayscale = "grayscale"
+	OpResize    = "resize"
+	OpCrop      = "crop"
+	OpRotate    = "rotate"
+	OpBlur      = "blur"
+	OpSharpen   = "sharpen"
+	OpWatermark = "watermark"
+	OpFormat    = "format"
+)
+
+// Output formats that may be selected with a format step.
+const (
+	FormatJPEG = "jpeg"
+	FormatPNG  = "png"
+	FormatGIF  = "gif"
+	// FormatWebP stores the uploaded WebP file unchanged. It is only
+	// available for pipelines without transforms since there is no WebP
+	// encoder.
+	FormatWebP = "webp"
+)
+
+// PNG compression levels.
+const (
+	CompressionDefault = "default"
+	CompressionNone    = "none"
+	CompressionSpeed   = "speed"
+	CompressionBest    = "best"
+)
+
+// GIF dithering modes.
+const (
+	DitherFloydSteinberg = "floyd-steinberg"
+	DitherNone           = "none"
+)
+
+// DefaultQuality is the JPEG quality used when none is given.
+const DefaultQuality = 90
+
+// Fit modes used when resizing into a box.
+const (
+	// FitInside scales the image to fit within the box, keeping its aspect
+	// ratio.
+	FitInside = "inside"
+	// FitFill scales the image to cover the box, keeping its aspect ratio,
+	// and crops whatever falls outside it.
+	FitFill = "fill"
+	// FitStretch scales the image to exactly the box.
+	FitStretch = "stretch"
+)
+
+// Resampling kernels from golang.org/x/image/draw.
+const (
+	KernelNearest        = "nearest"
+	KernelApproxBiLinear = "approx-bilinear"
+	KernelBiLinear       = "bilinear"
+	KernelCatmullRom     = "catmull-rom"
+)
+
+// Watermark positions.
+const (
+	PositionTopLeft     = "top-left"
+	PositionTopRight    = "top-right"
+	PositionBottomLeft  = "bottom-left"
+	PositionBottomRight = "bottom-right"
+	PositionCenter      = "center"
+)
+
+const (
+	// MaxSteps is the maximum number of steps in a pipeline.
+	MaxSteps = 16
+	// MaxDimension is the largest width or height a step may produce.
+	MaxDimension = 16384
+	// MaxSigma is the largest blur or sharpen radius.
+	MaxSigma = 64
+	// MaxWatermarkLength is the maximum length of watermark text.
+	MaxWatermarkLength = 128
+	// MaxRenditions is the maximum number of renditions per image.
+	MaxRenditions = 8
+)
+
+// Step is a single operation in a pipeline. Only the fields used by the
+// operation are set.
+type Step struct {
+	Op string `json:"op"`
+
+	// resize and crop
+	Width  int `json:"width,omitempty"`
+	Height int `json:"height,omitempty"`
+
+	// resize
+	Fit    string `json:"fit,omitempty"`
+	Kernel string `json:"kernel,omitempty"`
+
+	// crop
+	X int `json:"x,omitempty"`
+	Y int `json:"y,omitempty"`
+
+	// rotate, in degrees clockwise
+	Angle int `json:"angle,omitempty"`
+
+	// blur and sharpen
+	Sigma float64 `json:"sigma,omitempty"`
+
+	// sharpen
+	Amount float64 `json:"amount,omitempty"`
+
+	// watermark
+	Text     string  `json:"text,omitempty"`
+	Position string  `json:"position,omitempty"`
+	Opacity  float64 `json:"opacity,omitempty"`
+
+	// format
+	Format      string `json:"format,omitempty"`
+	Quality     int    `json:"quality,omitempty"`
+	Compression string `json:"compression,omitempty"`
+	Colors      int    `json:"colors,omitempty"`
+	Dither      string `json:"dither,omitempty"`
+	Background  string `json:"background,omitempty"`
+}
+
+// Pipeline is an ordered list of operations applied to an image.
+type Pipeline []Step
+
+// Default is the pipeline used when an upload does not specify one.
+var Default = Pipeline{{Op: OpGrayscale}}
+
+// Output describes how the final image of a pipeline is encoded.
+type Output struct {
+	// Format is the output format. When empty, images with transparency
+	// are saved as PNG and all others as JPEG.
+	Format string
+	// Quality is the JPEG quality, 1 to 100.
+	Quality int
+	// Compression is the PNG compression level.
+	Compression string
+	// Colors is the size of the GIF palette, 2 to 256.
+	Colors int
+	// Dither is the GIF dithering mode.
+	Dither string
+	// Background is the hex color transparent areas are flattened onto
+	// for formats without an alpha channel.
+	Background string
+}
+
+// Output returns the encoding selected by the pipeline's format step.
+func (p Pipeline) Output() Output {
+	for _, step := range p {
+		if step.Op == OpFormat {
+			return Output{
+				Format:      step.Format,
+				Quality:     step.Quality,
+				Compression: step.Compression,
+				Colors:      step.Colors,
+				Dither:      step.Dither,
+				Background:  step.Background,
+			}
+		}
+	}
+	return Output{}
+}
+
+// Transforms returns the steps that change the image, omitting the format
+// step which only affects encoding.
+func (p Pipeline) Transforms() Pipeline {
+	var steps Pipeline
+	for _, step := range p {
+		if step.Op != OpFormat {
+			steps = append(steps, step)
+		}
+	}
+	return steps
+}
+
+// Validate checks that every step of the pipeline is well formed.
+func (p Pipeline) Validate() error {
+	if len(p) > MaxSteps {
+		return fmt.Errorf("pipeline has %d steps, maximum is %d", len(p), MaxSteps)
+	}
+	for i, step := range p {
+		if err := step.validate(); err != nil {
+			return fmt.Errorf("step %d (%s): %w", i+1, step.Op, err)
+		}
+		if step.Op == OpFormat && i != len(p)-1 {
+			return fmt.Errorf("step %d (%s): must be the last step", i+1, step.Op)
+		}
+		if step.Op == OpFormat && step.Format == FormatWebP && len(p) > 1 {
+			return fmt.Errorf("step %d (%s): webp output cannot follow other steps", i+1, step.Op)
+		}
+	}
+	return nil
+}
+
+func (s Step) validate() error {
+	switch s.Op {
+	case OpGrayscale:
+		return nil
+
+	case OpResize:
+		return checkResize(s.Width, s.Height, s.Fit, s.Kernel)
+
+	case OpCrop:
+		if s.Width <= 0 || s.Height <= 0 {
+			return fmt.Errorf("width and height are required")
+		}
+		if s.X < 0 || s.Y < 0 {
+			return fmt.Errorf("x and y must not be negative")
+		}
+		return checkDimensions(s.Width, s.Height)
+
+	case OpRotate:
+		switch s.Angle {
+		case 90, 180, 270, -90, -180, -270:
+			return nil
+		}
+		return fmt.Errorf("angle must be a multiple of 90 degrees")
+
+	case OpBlur:
+		if s.Sigma <= 0 || s.Sigma > MaxSigma {
+			return fmt.Errorf("sigma must be between 0 and %d", MaxSigma)
+		}
+		return nil
+
+	case OpSharpen:
+		if s.Sigma < 0 || s.Sigma > MaxSigma {
+			return fmt.Errorf("sigma must be between 0 and %d", MaxSigma)
+		}
+		if s.Amount < 0 || s.Amount > 10 {
+			return fmt.Errorf("amount must be between 0 and 10")
+		}
+		return nil
+
+	case OpWatermark:
+		if strings.TrimSpace(s.Text) == "" {
+			return fmt.Errorf("text is required")
+		}
+		if len(s.Text) > MaxWatermarkLength {
+			return fmt.Errorf("text must be at most %d bytes", MaxWatermarkLength)
+		}
+		switch s.Position {
+		case "", PositionTopLeft, PositionTopRight, PositionBottomLeft,
+			PositionBottomRight, PositionCenter:
+		default:
+			return fmt.Errorf("unknown position: %q", s.Position)
+		}
+		if s.Opacity < 0 || s.Opacity > 1 {
+			return fmt.Errorf("opacity must be between 0 and 1")
+		}
+		return nil
+
+	case OpFormat:
+		switch s.Format {
+		case FormatJPEG, FormatPNG, FormatGIF, FormatWebP:
+		default:
+			return fmt.Errorf("unsupported format: %q", s.Format)
+		}
+		if s.Quality < 0 || s.Quality > 100 {
+			return fmt.Errorf("quality must be between 1 and 100")
+		}
+		switch s.Compression {
+		case "", CompressionDefault, CompressionNone, CompressionSpeed, CompressionBest:
+		default:
+			return fmt.Errorf("unknown compression: %q", s.Compression)
+		}
+		if s.Colors != 0 && (s.Colors < 2 || s.Colors > 256) {
+			return fmt.Errorf("colors must be between 2 and 256")
+		}
+		switch s.Dither {
+		case "", DitherFloydSteinberg, DitherNone:
+		default:
+			return fmt.Errorf("unknown dither: %q", s.Dither)
+		}
+		if s.Background != "" {
+			if _, err := ParseColor(s.Background); err != nil {
+				return err
+			}
+		}
+		return nil
+
+	case "":
+		return fmt.Errorf("op is required")
+
+	default:
+		return fmt.Errorf("unknown operation")
+	}
+}
+
+// ParseColor parses a color in #rrggbb form.
+func ParseColor(s string) (color.RGBA, error) {
+	var c color.RGBA
+	if len(s) != 7 || s[0] != '#' {
+		return c, fmt.Errorf("invalid color: %q", s)
+	}
+	v, err := strconv.ParseUint(s[1:], 16, 32)
+	if err != nil {
+		return c, fmt.Errorf("invalid color: %q", s)
+	}
+	return color.RGBA{R: uint8(v >> 16), G: uint8(v >> 8), B: uint8(v), A: 0xff}, nil
+}
+
+func checkResize(width, height int, fit, kernel string) error {
+	if width <= 0 && height <= 0 {
+		return fmt.Errorf("width or height is required")
+	}
+	switch fit {
+	case "", FitInside:
+	case FitFill, FitStretch:
+		if width <= 0 || height <= 0 {
+			return fmt.Errorf("fit %q requires both width and height", fit)
+		}
+	default:
+		return fmt.Errorf("unknown fit: %q", fit)
+	}
+	switch kernel {
+	case "", KernelNearest, KernelApproxBiLinear, KernelBiLinear, KernelCatmullRom:
+	default:
+		return fmt.Errorf("unknown kernel: %q", kernel)
+	}
+	return checkDimensions(width, height)
+}
+
+func checkDimensions(width, height int) error {
+	if width < 0 || height < 0 {
+		return fmt.Errorf("width and height must not be negative")
+	}
+	if width > MaxDimension || height > MaxDimension {
+		return fmt.Errorf("width and height must be at most %d", MaxDimension)
+	}
+	return nil
+}
+
+// Rendition is a named, resized copy of the processed image.
+type Rendition struct {
+	Name   string `json:"name"`
+	Width  int    `json:"width,omitempty"`
+	Height int    `json:"height,omitempty"`
+	Fit    string `json:"fit,omitempty"`
+	Kernel string `json:"kernel,omitempty"`
+}
+
+// DefaultRenditions are produced when an upload does not list its own.
+var DefaultRenditions = []Rendition{
+	{Name: "thumb", Width: 150, Height: 150},
+	{Name: "medium", Width: 800, Height: 800},
+	{Name: "large", Width: 2048, Height: 2048},
+}
+
+// renditionNamePattern matches valid rendition names.
+var renditionNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,31}$`)
+
+// IsRenditionName reports whether name is a valid rendition name.
+func IsRenditionName(name string) bool {
+	return renditionNamePattern.MatchString(name)
+}
+
+// RenditionKey returns the processed store key of a rendition of an image.
+func RenditionKey(imageID, name string) string {
+	return imageID + "." + name
+}
+
+// ValidateRenditions checks that renditions are well formed and uniquely
+// named.
+func ValidateRenditions(renditions []Rendition) error {
+	if len(renditions) > MaxRenditions {
+		return fmt.Errorf("%d renditions requested, maximum is %d", len(renditions), MaxRenditions)
+	}
+	names := make(map[string]bool, len(renditions))
+	for _, r := range renditions {
+		if !IsRenditionName(r.Name) {
+			return fmt.Errorf("invalid rendition name: %q", r.Name)
+		}
+		if names[r.Name] {
+			return fmt.Errorf("duplicate rendition name: %q", r.Name)
+		}
+		names[r.Name] = true
+		if err := checkResize(r.Width, r.Height, r.Fit, r.Kernel); err != nil {
+			return fmt.Errorf("rendition %s: %w", r.Name, err)
+		}
+	}
+	return nil
+}
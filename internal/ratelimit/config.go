@@ -0,0 +1,37 @@
+package ratelimit
+
+import (
+	"errors"
+	"fmt"
+)
+
+const (
+	// DriverMemory keeps buckets in each api process.
+	DriverMemory = "memory"
+	// DriverRedis keeps buckets in Redis, shared by every api process.
+	DriverRedis = "redis"
+)
+
+// Config selects the limiter and sets the rule of each route class.
+type Config struct {
+	Driver string
+	Redis  RedisConfig
+	// Rules maps route classes to their rules. Classes without a rule
+	// are not limited.
+	Rules map[string]Rule
+}
+
+// New creates the limiter described by config.
+func New(config *Config) (Limiter, error) {
+	switch config.Driver {
+	case DriverMemory, "":
+		return NewMemoryLimiter(), nil
+	case DriverRedis:
+		if config.Redis.Addr == "" {
+			return nil, errors.New("the redis rate limiter needs an address")
+		}
+		return NewRedisLimiter(&config.Redis), nil
+	default:
+		return nil, fmt.Errorf("unknown rate limit driver: %q", config.Driver)
+	}
+}
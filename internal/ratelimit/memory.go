@@ -0,0 +1,85 @@
+package ratelimit
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+)
+
+// sweepInterval is how often a MemoryLimiter drops buckets that have
+// refilled, since a full bucket is the same as no bucket.
+const sweepInterval = time.Minute
+
+// bucket is the state of a token bucket.
+type bucket struct {
+	tokens  float64
+	updated time.Time
+	rule    Rule
+}
+
+// refill adds the tokens accrued since the bucket was last updated.
+func (b *bucket) refill(now time.Time) {
+	elapsed := now.Sub(b.updated).Seconds()
+	if elapsed > 0 {
+		b.tokens = math.Min(float64(b.rule.Burst), b.tokens+elapsed*b.rule.Rate)
+	}
+	b.updated = now
+}
+
+// MemoryLimiter is a Limiter keeping buckets in memory, so each process
+// limits callers separately.
+type MemoryLimiter struct {
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+	// now returns the current time.
+	now func() time.Time
+}
+
+// NewMemoryLimiter returns a MemoryLimiter with no buckets.
+func NewMemoryLimiter() *MemoryLimiter {
+	return &MemoryLimiter{buckets: map[string]*bucket{}, now: time.Now}
+}
+
+func (l *MemoryLimiter) Allow(ctx context.Context, key string, rule Rule) (*Result, error) {
+	if rule.Unlimited() {
+		return &Result{Allowed: true, Remaining: rule.Burst}, nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	l.sweep(now)
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(rule.Burst), updated: now, rule: rule}
+		l.buckets[key] = b
+	}
+	b.refill(now)
+	// a changed rule applies from now on
+	b.rule = rule
+	b.tokens = math.Min(float64(rule.Burst), b.tokens)
+
+	if b.tokens < 1 {
+		return &Result{RetryAfter: retryAfter(b.tokens, rule)}, nil
+	}
+	b.tokens--
+	return &Result{Allowed: true, Remaining: int(b.tokens)}, nil
+}
+
+// sweep drops the buckets that have refilled, at most once per
+// sweepInterval.
+func (l *MemoryLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < sweepInterval {
+		return
+	}
+	l.lastSweep = now
+	for key, b := range l.buckets {
+		b.refill(now)
+		if b.tokens >= float64(b.rule.Burst) {
+			delete(l.buckets, key)
+		}
+	}
+}
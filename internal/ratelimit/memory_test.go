@@ -0,0 +1,166 @@
+package ratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// testClock is a clock that only moves when told to.
+type testClock struct {
+	now time.Time
+}
+
+func (c *testClock) Now() time.Time {
+	return c.now
+}
+
+func (c *testClock) Advance(d time.Duration) {
+	c.now = c.now.Add(d)
+}
+
+// newTestLimiter returns a MemoryLimiter reading the time from a testClock.
+func newTestLimiter() (*MemoryLimiter, *testClock) {
+	clock := &testClock{now: time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)}
+	l := NewMemoryLimiter()
+	l.now = clock.Now
+	return l, clock
+}
+
+// allow takes a token, failing the test on error.
+func allow(t *testing.T, l Limiter, key string, rule Rule) *Result {
+	t.Helper()
+	result, err := l.Allow(context.Background(), key, rule)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return result
+}
+
+func TestMemoryLimiterBurst(t *testing.T) {
+	l, _ := newTestLimiter()
+	rule := Rule{Rate: 1, Burst: 3}
+
+	for want := 2; want >= 0; want-- {
+		result := allow(t, l, "alice", rule)
+		if !result.Allowed || result.Remaining != want || result.RetryAfter != 0 {
+			t.Fatalf("Allow = %+v, want allowed with %d remaining", result, want)
+		}
+	}
+	result := allow(t, l, "alice", rule)
+	if result.Allowed || result.Remaining != 0 || result.RetryAfter != time.Second {
+		t.Errorf("Allow on an empty bucket = %+v, want refused for 1s", result)
+	}
+}
+
+func TestMemoryLimiterRefill(t *testing.T) {
+	l, clock := newTestLimiter()
+	rule := Rule{Rate: 2, Burst: 2}
+	allow(t, l, "alice", rule)
+	allow(t, l, "alice", rule)
+
+	// half a token accrues in a quarter second at two tokens a second
+	clock.Advance(250 * time.Millisecond)
+	result := allow(t, l, "alice", rule)
+	if result.Allowed || result.RetryAfter != 250*time.Millisecond {
+		t.Errorf("Allow with half a token = %+v, want refused for 250ms", result)
+	}
+	// refused requests don't take the partial token
+	clock.Advance(250 * time.Millisecond)
+	if result := allow(t, l, "alice", rule); !result.Allowed || result.Remaining != 0 {
+		t.Errorf("Allow with a token = %+v, want allowed with none remaining", result)
+	}
+
+	// buckets refill up to their burst only
+	clock.Advance(time.Hour)
+	if result := allow(t, l, "alice", rule); !result.Allowed || result.Remaining != 1 {
+		t.Errorf("Allow after an hour = %+v, want allowed with 1 remaining", result)
+	}
+}
+
+func TestMemoryLimiterKeys(t *testing.T) {
+	l, _ := newTestLimiter()
+	rule := Rule{Rate: 1, Burst: 1}
+	allow(t, l, "upload:alice", rule)
+	if result := allow(t, l, "upload:alice", rule); result.Allowed {
+		t.Errorf("second Allow = %+v, want refused", result)
+	}
+	if result := allow(t, l, "upload:bob", rule); !result.Allowed {
+		t.Errorf("Allow for another key = %+v, want allowed", result)
+	}
+}
+
+func TestMemoryLimiterRuleChange(t *testing.T) {
+	l, clock := newTestLimiter()
+	allow(t, l, "alice", Rule{Rate: 1, Burst: 1})
+
+	// the bucket keeps its tokens and refills at the new rate from now on
+	clock.Advance(100 * time.Millisecond)
+	result := allow(t, l, "alice", Rule{Rate: 10, Burst: 5})
+	if result.Allowed {
+		t.Fatalf("Allow = %+v, want refused with 0.1 tokens", result)
+	}
+	if want := 90 * time.Millisecond; result.RetryAfter < want-time.Millisecond || result.RetryAfter > want+time.Millisecond {
+		t.Errorf("RetryAfter = %v, want about %v", result.RetryAfter, want)
+	}
+	clock.Advance(time.Second)
+	if result := allow(t, l, "alice", Rule{Rate: 10, Burst: 5}); !result.Allowed || result.Remaining != 4 {
+		t.Errorf("Allow after refilling = %+v, want allowed with 4 remaining", result)
+	}
+}
+
+func TestMemoryLimiterUnlimited(t *testing.T) {
+	l, _ := newTestLimiter()
+	for _, rule := range []Rule{{Rate: 0, Burst: 5}, {Rate: 1, Burst: 0}} {
+		for i := 0; i < 10; i++ {
+			if result := allow(t, l, "alice", rule); !result.Allowed {
+				t.Fatalf("Allow(%+v) = %+v, want allowed", rule, result)
+			}
+		}
+	}
+	if len(l.buckets) != 0 {
+		t.Errorf("%d buckets kept for unlimited rules", len(l.buckets))
+	}
+}
+
+func TestMemoryLimiterSweep(t *testing.T) {
+	l, clock := newTestLimiter()
+	allow(t, l, "slow", Rule{Rate: 1.0 / 3600, Burst: 2})
+	allow(t, l, "fast", Rule{Rate: 10, Burst: 2})
+
+	clock.Advance(sweepInterval)
+	allow(t, l, "other", Rule{Rate: 1, Burst: 2})
+	if _, ok := l.buckets["fast"]; ok {
+		t.Error("refilled bucket was not swept")
+	}
+	if _, ok := l.buckets["slow"]; !ok {
+		t.Error("bucket still refilling was swept")
+	}
+	if result := allow(t, l, "fast", Rule{Rate: 10, Burst: 2}); !result.Allowed || result.Remaining != 1 {
+		t.Errorf("Allow on a swept bucket = %+v, want a full bucket", result)
+	}
+}
+
+func TestParseRate(t *testing.T) {
+	tests := []struct {
+		s    string
+		want float64
+		ok   bool
+	}{
+		{"", 0, true},
+		{"10/s", 10, true},
+		{"120/m", 2, true},
+		{"3600/h", 1, true},
+		{"0.5/s", 0.5, true},
+		{"10", 0, false},
+		{"10/d", 0, false},
+		{"x/s", 0, false},
+		{"-1/s", 0, false},
+	}
+	for _, tt := range tests {
+		got, err := ParseRate(tt.s)
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("ParseRate(%q) = %v, %v, want %v, ok %v", tt.s, got, err, tt.want, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+// Package ratelimit limits how often callers may use the API with token
+// buckets. Each caller has a bucket per route class holding up to a burst
+// of tokens, refilled at a steady rate, and every request takes a token.
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Route classes, each limited separately.
+const (
+	// ClassUpload covers uploading images.
+	ClassUpload = "upload"
+	// ClassStatus covers looking up, listing and streaming statuses, which
+	// query Temporal.
+	ClassStatus = "status"
+	// ClassDownload covers downloading processed images.
+	ClassDownload = "download"
+	// ClassDefault covers every other limited route.
+	ClassDefault = "default"
+)
+
+// Classes lists the route classes.
+var Classes = []string{ClassUpload, ClassStatus, ClassDownload, ClassDefault}
+
+// Rule sets the size and refill rate of a bucket.
+type Rule struct {
+	// Rate is the number of tokens added per second.
+	Rate float64
+	// Burst is the most tokens a bucket holds, and so the most requests
+	// allowed at once.
+	Burst int
+}
+
+// Unlimited reports whether the rule allows every request.
+func (r Rule) Unlimited() bool {
+	return r.Rate <= 0 || r.Burst <= 0
+}
+
+// periods maps the units of rates to their lengths.
+var periods = map[string]time.Duration{
+	"s": time.Second,
+	"m": time.Minute,
+	"h": time.Hour,
+}
+
+// ParseRate parses a rate written as a count per second, minute or hour,
+// such as "10/s" or "100/m", returning the rate in tokens per second. An
+// empty rate is zero, which is unlimited.
+func ParseRate(s string) (float64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	count, unit, ok := strings.Cut(s, "/")
+	period, known := periods[unit]
+	n, err := strconv.ParseFloat(count, 64)
+	if !ok || !known || err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid rate %q, expected a count per s, m or h such as 10/s", s)
+	}
+	return n / period.Seconds(), nil
+}
+
+// Result is the outcome of taking a token.
+type Result struct {
+	Allowed bool
+	// Remaining is the number of whole tokens left in the bucket.
+	Remaining int
+	// RetryAfter is how long until a token is available when the request
+	// was not allowed.
+	RetryAfter time.Duration
+}
+
+// Limiter takes tokens from buckets.
+type Limiter interface {
+	// Allow takes a token from the bucket named key, filled according to
+	// rule, and reports whether there was one.
+	Allow(ctx context.Context, key string, rule Rule) (*Result, error)
+}
+
+// retryAfter returns how long until a bucket holding tokens has a whole
+// token again.
+func retryAfter(tokens float64, rule Rule) time.Duration {
+	return time.Duration((1 - tokens) / rule.Rate * float64(time.Second))
+}
@@ -0,0 +1,199 @@
+package ratelimit
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// defaultRedisTimeout bounds commands whose context has no deadline.
+	defaultRedisTimeout = time.Second
+	// redisPoolSize is the most idle connections kept open.
+	redisPoolSize = 16
+)
+
+// takeScript takes a token from the bucket hash in KEYS[1], refilling it at
+// ARGV[1] tokens per second up to ARGV[2] tokens. It runs atomically on the
+// server and uses the server's clock, so api replicas share buckets without
+// needing synchronised clocks. It returns whether a token was taken, the
+// whole tokens left and the milliseconds until the next token.
+const takeScript = `
+redis.replicate_commands()
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local time = redis.call('TIME')
+local now = tonumber(time[1]) * 1000 + math.floor(tonumber(time[2]) / 1000)
+
+local state = redis.call('HMGET', KEYS[1], 'tokens', 'updated')
+local tokens = tonumber(state[1])
+local updated = tonumber(state[2])
+if tokens == nil or updated == nil then
+	tokens = burst
+	updated = now
+end
+if now > updated then
+	tokens = math.min(burst, tokens + (now - updated) / 1000 * rate)
+	updated = now
+end
+
+local allowed = 0
+local wait = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	allowed = 1
+else
+	wait = math.ceil((1 - tokens) / rate * 1000)
+end
+
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'updated', tostring(updated))
+-- buckets expire once they would have refilled
+redis.call('PEXPIRE', KEYS[1], math.ceil(burst / rate * 1000) + 1000)
+return {allowed, math.floor(tokens), wait}
+`
+
+// takeScriptSHA is the SHA-1 the server knows takeScript by once loaded.
+var takeScriptSHA = func() string {
+	sum := sha1.Sum([]byte(takeScript))
+	return hex.EncodeToString(sum[:])
+}()
+
+// RedisConfig describes how to connect to Redis or a server compatible
+// with it.
+type RedisConfig struct {
+	// Addr is the host:port of the server.
+	Addr     string
+	Username string
+	Password string `json:"-"`
+	DB       int
+	// KeyPrefix is prepended to the keys of buckets.
+	KeyPrefix string
+}
+
+// RedisLimiter is a Limiter keeping buckets in Redis, so every api replica
+// sharing the server limits callers together. It speaks RESP itself and
+// needs Redis 5 or later, or a server that runs Lua scripts the same way.
+type RedisLimiter struct {
+	config *RedisConfig
+	dialer net.Dialer
+	// idle holds connections ready for reuse.
+	idle chan *respConn
+}
+
+// NewRedisLimiter returns a RedisLimiter for the server described by
+// config. Connections are made as they are needed.
+func NewRedisLimiter(config *RedisConfig) *RedisLimiter {
+	return &RedisLimiter{
+		config: config,
+		idle:   make(chan *respConn, redisPoolSize),
+	}
+}
+
+func (l *RedisLimiter) Allow(ctx context.Context, key string, rule Rule) (*Result, error) {
+	if rule.Unlimited() {
+		return &Result{Allowed: true, Remaining: rule.Burst}, nil
+	}
+
+	conn, err := l.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	args := []string{"1", l.config.KeyPrefix + key,
+		strconv.FormatFloat(rule.Rate, 'g', -1, 64), strconv.Itoa(rule.Burst)}
+	reply, err := conn.do(ctx, append([]string{"EVALSHA", takeScriptSHA}, args...)...)
+	var rerr respError
+	if errors.As(err, &rerr) && strings.HasPrefix(string(rerr), "NOSCRIPT") {
+		// the server hasn't seen the script yet, or has been restarted
+		reply, err = conn.do(ctx, append([]string{"EVAL", takeScript}, args...)...)
+	}
+	l.put(conn, err)
+	if err != nil {
+		return nil, err
+	}
+
+	values, ok := reply.([]any)
+	if !ok || len(values) != 3 {
+		return nil, fmt.Errorf("redis: unexpected reply %v", reply)
+	}
+	var n [3]int64
+	for i, v := range values {
+		if n[i], ok = v.(int64); !ok {
+			return nil, fmt.Errorf("redis: unexpected reply %v", reply)
+		}
+	}
+	return &Result{
+		Allowed:    n[0] == 1,
+		Remaining:  int(n[1]),
+		RetryAfter: time.Duration(n[2]) * time.Millisecond,
+	}, nil
+}
+
+// get returns an idle connection or opens a new one.
+func (l *RedisLimiter) get(ctx context.Context) (*respConn, error) {
+	select {
+	case conn := <-l.idle:
+		return conn, nil
+	default:
+	}
+
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, defaultRedisTimeout)
+		defer cancel()
+	}
+	nc, err := l.dialer.DialContext(ctx, "tcp", l.config.Addr)
+	if err != nil {
+		return nil, err
+	}
+	conn := newRESPConn(nc)
+	if l.config.Password != "" {
+		args := []string{"AUTH", l.config.Password}
+		if l.config.Username != "" {
+			args = []string{"AUTH", l.config.Username, l.config.Password}
+		}
+		if _, err := conn.do(ctx, args...); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if l.config.DB != 0 {
+		if _, err := conn.do(ctx, "SELECT", strconv.Itoa(l.config.DB)); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// put returns a connection for reuse, closing it instead when it failed
+// with anything but an error reply, since its state is then unknown.
+func (l *RedisLimiter) put(conn *respConn, err error) {
+	var rerr respError
+	if err != nil && !errors.As(err, &rerr) {
+		conn.Close()
+		return
+	}
+	select {
+	case l.idle <- conn:
+	default:
+		conn.Close()
+	}
+}
+
+// Close closes the idle connections.
+func (l *RedisLimiter) Close() error {
+	for {
+		select {
+		case conn := <-l.idle:
+			conn.Close()
+		default:
+			return nil
+		}
+	}
+}
@@ -0,0 +1,351 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRedis is a server speaking enough RESP to run the limiter against.
+// It knows only the take script, whose reply is set by the test, and logs
+// the commands it receives.
+type fakeRedis struct {
+	listener net.Listener
+
+	mu sync.Mutex
+	// username and password are the credentials required, none when the
+	// password is empty.
+	username string
+	password string
+	loaded   bool
+	reply    string
+	commands [][]string
+	dials    int
+	// fail maps commands to the raw reply sent instead of running them,
+	// once each. A reply of "close" closes the connection.
+	fail map[string]string
+}
+
+// newFakeRedis starts a fakeRedis answering takes with reply, stopped when
+// the test ends.
+func newFakeRedis(t *testing.T, reply string) *fakeRedis {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeRedis{listener: listener, reply: reply, fail: map[string]string{}}
+	t.Cleanup(func() { listener.Close() })
+	go s.serve()
+	return s
+}
+
+// requireAuth makes the server require AUTH with the given credentials.
+func (s *fakeRedis) requireAuth(username, password string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.username, s.password = username, password
+}
+
+func (s *fakeRedis) addr() string {
+	return s.listener.Addr().String()
+}
+
+func (s *fakeRedis) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.dials++
+		s.mu.Unlock()
+		go s.handle(conn)
+	}
+}
+
+// handle answers the commands sent on a connection. Commands are read with
+// the limiter's own reply parser, as they are arrays of bulk strings.
+func (s *fakeRedis) handle(nc net.Conn) {
+	defer nc.Close()
+	conn := newRESPConn(nc)
+	s.mu.Lock()
+	username, password := s.username, s.password
+	s.mu.Unlock()
+	authed := password == ""
+	for {
+		reply, err := conn.read()
+		if err != nil {
+			return
+		}
+		items, _ := reply.([]any)
+		args := make([]string, len(items))
+		for i, item := range items {
+			args[i], _ = item.(string)
+		}
+		if len(args) == 0 {
+			return
+		}
+
+		s.mu.Lock()
+		s.commands = append(s.commands, args)
+		out, failed := s.fail[args[0]]
+		delete(s.fail, args[0])
+		s.mu.Unlock()
+
+		switch {
+		case failed && out == "close":
+			return
+		case failed:
+		case args[0] == "AUTH":
+			authed = (len(args) == 2 && username == "" && args[1] == password) ||
+				(len(args) == 3 && args[1] == username && args[2] == password)
+			out = "+OK\r\n"
+			if !authed {
+				out = "-WRONGPASS invalid username-password pair\r\n"
+			}
+		case !authed:
+			out = "-NOAUTH Authentication required.\r\n"
+		case args[0] == "SELECT":
+			out = "+OK\r\n"
+		case args[0] == "EVALSHA":
+			out = s.take(args[1] == takeScriptSHA && s.isLoaded())
+		case args[0] == "EVAL":
+			if args[1] != takeScript {
+				out = "-ERR unknown script\r\n"
+				break
+			}
+			s.mu.Lock()
+			s.loaded = true
+			s.mu.Unlock()
+			out = s.take(true)
+		default:
+			out = "-ERR unknown command\r\n"
+		}
+		if _, err := nc.Write([]byte(out)); err != nil {
+			return
+		}
+	}
+}
+
+func (s *fakeRedis) isLoaded() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.loaded
+}
+
+// take returns the reply to running the take script, when it is known.
+func (s *fakeRedis) take(known bool) string {
+	if !known {
+		return "-NOSCRIPT No matching script. Please use EVAL.\r\n"
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.reply
+}
+
+// names returns the names of the commands received so far and forgets
+// them.
+func (s *fakeRedis) names() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var names []string
+	for _, args := range s.commands {
+		names = append(names, args[0])
+	}
+	s.commands = nil
+	return names
+}
+
+func (s *fakeRedis) dialCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.dials
+}
+
+// allowedReply is a take reply allowing the request with 4 tokens left.
+const allowedReply = "*3\r\n:1\r\n:4\r\n:0\r\n"
+
+func newTestRedisLimiter(t *testing.T, config *RedisConfig) *RedisLimiter {
+	l := NewRedisLimiter(config)
+	t.Cleanup(func() { l.Close() })
+	return l
+}
+
+func TestRedisLimiterLoadsScript(t *testing.T) {
+	server := newFakeRedis(t, allowedReply)
+	l := newTestRedisLimiter(t, &RedisConfig{Addr: server.addr(), KeyPrefix: "demo:"})
+	rule := Rule{Rate: 2, Burst: 5}
+
+	result := allow(t, l, "upload:alice", rule)
+	if !result.Allowed || result.Remaining != 4 || result.RetryAfter != 0 {
+		t.Errorf("Allow = %+v, want allowed with 4 remaining", result)
+	}
+	server.mu.Lock()
+	first := server.commands[0]
+	server.mu.Unlock()
+	want := []string{"EVALSHA", takeScriptSHA, "1", "demo:upload:alice", "2", "5"}
+	if strings.Join(first, " ") != strings.Join(want, " ") {
+		t.Errorf("command = %q, want %q", first, want)
+	}
+	if got := strings.Join(server.names(), " "); got != "EVALSHA EVAL" {
+		t.Errorf("commands = %s, want the script loaded after NOSCRIPT", got)
+	}
+
+	// the script is run by its hash once the server has it
+	allow(t, l, "upload:alice", rule)
+	if got := strings.Join(server.names(), " "); got != "EVALSHA" {
+		t.Errorf("commands = %s, want EVALSHA only", got)
+	}
+	if n := server.dialCount(); n != 1 {
+		t.Errorf("dialled %d times, want the connection reused", n)
+	}
+}
+
+func TestRedisLimiterRefused(t *testing.T) {
+	server := newFakeRedis(t, "*3\r\n:0\r\n:0\r\n:1500\r\n")
+	l := newTestRedisLimiter(t, &RedisConfig{Addr: server.addr()})
+
+	result := allow(t, l, "alice", Rule{Rate: 1, Burst: 1})
+	if result.Allowed || result.RetryAfter != 1500*time.Millisecond {
+		t.Errorf("Allow = %+v, want refused for 1.5s", result)
+	}
+}
+
+func TestRedisLimiterAuthSelect(t *testing.T) {
+	tests := []struct {
+		name   string
+		config RedisConfig
+		want   string
+	}{
+		{"none", RedisConfig{}, "EVALSHA EVAL"},
+		{"password", RedisConfig{Password: "secret"}, "AUTH EVALSHA EVAL"},
+		{"acl user", RedisConfig{Username: "api", Password: "secret", DB: 3}, "AUTH SELECT EVALSHA EVAL"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newFakeRedis(t, allowedReply)
+			server.requireAuth(tt.config.Username, tt.config.Password)
+			config := tt.config
+			config.Addr = server.addr()
+			l := newTestRedisLimiter(t, &config)
+
+			allow(t, l, "alice", Rule{Rate: 1, Burst: 5})
+			server.mu.Lock()
+			commands := server.commands
+			server.mu.Unlock()
+			if got := strings.Join(server.names(), " "); got != tt.want {
+				t.Errorf("commands = %s, want %s", got, tt.want)
+			}
+			if tt.config.DB != 0 {
+				if got := strings.Join(commands[1], " "); got != "SELECT 3" {
+					t.Errorf("select = %s, want SELECT 3", got)
+				}
+			}
+			if tt.config.Username != "" {
+				if got := strings.Join(commands[0], " "); got != "AUTH api secret" {
+					t.Errorf("auth = %s, want AUTH api secret", got)
+				}
+			}
+		})
+	}
+
+	t.Run("wrong password", func(t *testing.T) {
+		server := newFakeRedis(t, allowedReply)
+		server.requireAuth("", "secret")
+		l := newTestRedisLimiter(t, &RedisConfig{Addr: server.addr(), Password: "guess"})
+
+		_, err := l.Allow(context.Background(), "alice", Rule{Rate: 1, Burst: 5})
+		if err == nil || !strings.Contains(err.Error(), "WRONGPASS") {
+			t.Fatalf("Allow err = %v, want WRONGPASS", err)
+		}
+		if len(l.idle) != 0 {
+			t.Error("connection that failed to authenticate was pooled")
+		}
+	})
+}
+
+func TestRedisLimiterErrorReplyKeepsConnection(t *testing.T) {
+	server := newFakeRedis(t, allowedReply)
+	l := newTestRedisLimiter(t, &RedisConfig{Addr: server.addr()})
+	rule := Rule{Rate: 1, Burst: 5}
+	allow(t, l, "alice", rule)
+
+	server.mu.Lock()
+	server.fail["EVALSHA"] = "-BUSY Redis is busy running a script.\r\n"
+	server.mu.Unlock()
+	_, err := l.Allow(context.Background(), "alice", rule)
+	var rerr respError
+	if !errors.As(err, &rerr) || !strings.HasPrefix(string(rerr), "BUSY") {
+		t.Fatalf("Allow err = %v, want the BUSY reply", err)
+	}
+
+	// the connection is still in step, so it is used again
+	if result := allow(t, l, "alice", rule); !result.Allowed {
+		t.Errorf("Allow = %+v, want allowed", result)
+	}
+	if n := server.dialCount(); n != 1 {
+		t.Errorf("dialled %d times, want the connection kept after an error reply", n)
+	}
+}
+
+func TestRedisLimiterDropsBrokenConnection(t *testing.T) {
+	server := newFakeRedis(t, allowedReply)
+	l := newTestRedisLimiter(t, &RedisConfig{Addr: server.addr()})
+	rule := Rule{Rate: 1, Burst: 5}
+	allow(t, l, "alice", rule)
+
+	server.mu.Lock()
+	server.fail["EVALSHA"] = "close"
+	server.mu.Unlock()
+	if _, err := l.Allow(context.Background(), "alice", rule); err == nil {
+		t.Fatal("Allow on a closed connection succeeded")
+	}
+
+	if result := allow(t, l, "alice", rule); !result.Allowed {
+		t.Errorf("Allow = %+v, want allowed", result)
+	}
+	if n := server.dialCount(); n != 2 {
+		t.Errorf("dialled %d times, want a new connection after a broken one", n)
+	}
+}
+
+func TestRedisLimiterUnlimited(t *testing.T) {
+	// nothing listens here, unlimited rules must not connect
+	l := newTestRedisLimiter(t, &RedisConfig{Addr: "127.0.0.1:1"})
+	if result := allow(t, l, "alice", Rule{}); !result.Allowed {
+		t.Errorf("Allow = %+v, want allowed", result)
+	}
+}
+
+func TestRESPReplies(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	go func() {
+		defer server.Close()
+		buf := make([]byte, 1024)
+		server.Read(buf)
+		server.Write([]byte("*5\r\n+OK\r\n:-7\r\n$5\r\nhe\r\no\r\n$-1\r\n*1\r\n$0\r\n\r\n"))
+	}()
+
+	conn := newRESPConn(client)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	reply, err := conn.do(ctx, "PING")
+	if err != nil {
+		t.Fatal(err)
+	}
+	items, ok := reply.([]any)
+	if !ok || len(items) != 5 {
+		t.Fatalf("reply = %#v", reply)
+	}
+	if items[0] != "OK" || items[1] != int64(-7) || items[2] != "he\r\no" || items[3] != nil {
+		t.Errorf("reply = %#v", items)
+	}
+	if nested, ok := items[4].([]any); !ok || len(nested) != 1 || nested[0] != "" {
+		t.Errorf("nested array = %#v", items[4])
+	}
+}
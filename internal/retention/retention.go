@@ -0,0 +1,85 @@
+// Package retention decides when processed images expire and records the
+// images that have.
+package retention
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// tombstonePrefix is the key prefix under which expired images are
+// recorded in the processed store.
+const tombstonePrefix = "expired/"
+
+// Rule keeps processed images with keys starting with Prefix for TTL. An
+// empty prefix matches every image.
+type Rule struct {
+	Prefix string
+	TTL    time.Duration
+}
+
+// Rules is a set of retention rules.
+type Rules []Rule
+
+// TTL returns how long the image stored under key is kept. The rule with
+// the longest matching prefix applies and zero means it is kept forever.
+func (rs Rules) TTL(key string) time.Duration {
+	var match *Rule
+	for i, r := range rs {
+		if strings.HasPrefix(key, r.Prefix) && (match == nil || len(r.Prefix) > len(match.Prefix)) {
+			match = &rs[i]
+		}
+	}
+	if match == nil {
+		return 0
+	}
+	return match.TTL
+}
+
+// Expired reports whether an image stored under key and last modified at
+// modified has expired by now.
+func (rs Rules) Expired(key string, modified, now time.Time) bool {
+	ttl := rs.TTL(key)
+	return ttl > 0 && !IsTombstone(key) && now.Sub(modified) > ttl
+}
+
+// ParseRules parses rules written as comma separated prefix=ttl pairs, for
+// example "tenants/acme/=24h,tenants/trial/=1h".
+func ParseRules(spec string) (Rules, error) {
+	var rules Rules
+	for _, pair := range strings.Split(spec, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		prefix, ttl, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid retention rule %q", pair)
+		}
+		d, err := time.ParseDuration(ttl)
+		if err != nil {
+			return nil, fmt.Errorf("invalid retention rule %q: %w", pair, err)
+		}
+		rules = append(rules, Rule{Prefix: prefix, TTL: d})
+	}
+	return rules, nil
+}
+
+// TombstoneKey returns the processed store key recording that the image
+// stored under key has expired.
+func TombstoneKey(key string) string {
+	return tombstonePrefix + key
+}
+
+// TombstoneExpired reports whether the tombstone stored under key and
+// written at modified is older than ttl. Tombstones are kept forever when
+// ttl is zero.
+func TombstoneExpired(key string, modified, now time.Time, ttl time.Duration) bool {
+	return ttl > 0 && IsTombstone(key) && now.Sub(modified) > ttl
+}
+
+// IsTombstone reports whether key records an expired image.
+func IsTombstone(key string) bool {
+	return strings.HasPrefix(key, tombstonePrefix)
+}
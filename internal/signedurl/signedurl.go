@@ -0,0 +1,177 @@
+// Package signedurl signs and verifies expiring download URLs so links to
+// processed images can be handed to end users without credentials.
+//
+// A URL is signed with one of several keys, named by the kid parameter, so
+// keys can be rotated: add a new key and sign with it while the old key
+// keeps verifying links already handed out, then drop the old key once
+// they have expired.
+package signedurl
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrInvalidSignature is returned for URLs not signed by a known key.
+	ErrInvalidSignature = errors.New("invalid signature")
+	// ErrExpired is returned for URLs past their expiry.
+	ErrExpired = errors.New("url expired")
+)
+
+// Key is a signing key.
+type Key struct {
+	ID     string
+	Secret string
+}
+
+// Config configures URL signing.
+type Config struct {
+	// Keys verify signed URLs.
+	Keys []Key `json:"-"`
+	// KeyID names the key URLs are signed with, the first key when empty.
+	KeyID string
+	// Expiry is how long signed URLs remain valid.
+	Expiry time.Duration
+	// BindIP restricts signed URLs to the client address they were issued
+	// to.
+	BindIP bool
+}
+
+// ParseKeys parses keys written as comma separated id=secret pairs.
+func ParseKeys(spec string) ([]Key, error) {
+	var keys []Key
+	for _, pair := range strings.Split(spec, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		id, secret, ok := strings.Cut(pair, "=")
+		if !ok || id == "" || secret == "" {
+			return nil, fmt.Errorf("invalid signing key %q, expected id=secret", id)
+		}
+		keys = append(keys, Key{ID: id, Secret: secret})
+	}
+	return keys, nil
+}
+
+// Validate checks the signing key is one of the keys.
+func (c *Config) Validate() error {
+	if c.KeyID == "" {
+		return nil
+	}
+	for _, key := range c.Keys {
+		if key.ID == c.KeyID {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown signing key %q", c.KeyID)
+}
+
+// Signer signs and verifies URLs.
+type Signer struct {
+	keys   map[string][]byte
+	keyID  string
+	expiry time.Duration
+	bindIP bool
+}
+
+// New returns a Signer for config, which must be valid.
+func New(config *Config) *Signer {
+	s := &Signer{
+		keys:   map[string][]byte{},
+		keyID:  config.KeyID,
+		expiry: config.Expiry,
+		bindIP: config.BindIP,
+	}
+	for _, key := range config.Keys {
+		s.keys[key.ID] = []byte(key.Secret)
+	}
+	if s.keyID == "" && len(config.Keys) > 0 {
+		s.keyID = config.Keys[0].ID
+	}
+	return s
+}
+
+// Enabled reports whether the signer has a key to sign with.
+func (s *Signer) Enabled() bool {
+	return s != nil && s.keyID != ""
+}
+
+// Target is what a signed URL grants access to.
+type Target struct {
+	ImageID string
+	// Rendition is the rendition of the image, empty for the image itself.
+	Rendition string
+	// ClientIP is the address of the client, only used when URLs are bound
+	// to addresses.
+	ClientIP string
+}
+
+// Sign returns rawURL, the URL of target, with the parameters signing it
+// and the time it expires.
+func (s *Signer) Sign(rawURL string, target Target, now time.Time) (string, time.Time) {
+	expires := now.Add(s.expiry).Truncate(time.Second).UTC()
+	query := url.Values{}
+	query.Set("expires", strconv.FormatInt(expires.Unix(), 10))
+	query.Set("kid", s.keyID)
+	if s.bindIP {
+		query.Set("ip", "1")
+	}
+	query.Set("signature", s.signature(s.keys[s.keyID], target, query))
+
+	sep := "?"
+	if strings.Contains(rawURL, "?") {
+		sep = "&"
+	}
+	return rawURL + sep + query.Encode(), expires
+}
+
+// Verify checks query holds a valid signature of target.
+func (s *Signer) Verify(target Target, query url.Values, now time.Time) error {
+	if s == nil {
+		return ErrInvalidSignature
+	}
+	secret, ok := s.keys[query.Get("kid")]
+	if !ok {
+		return ErrInvalidSignature
+	}
+	expected := s.signature(secret, target, query)
+	if !hmac.Equal([]byte(query.Get("signature")), []byte(expected)) {
+		return ErrInvalidSignature
+	}
+	expires, err := strconv.ParseInt(query.Get("expires"), 10, 64)
+	if err != nil {
+		return ErrInvalidSignature
+	}
+	if now.Unix() > expires {
+		return ErrExpired
+	}
+	return nil
+}
+
+// signature returns the signature of target with the parameters in query.
+// The client address is only covered when the ip parameter says the URL
+// is bound to it.
+func (s *Signer) signature(secret []byte, target Target, query url.Values) string {
+	ip := ""
+	if query.Get("ip") == "1" {
+		ip = target.ClientIP
+	}
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(strings.Join([]string{
+		target.ImageID,
+		target.Rendition,
+		query.Get("expires"),
+		query.Get("kid"),
+		ip,
+	}, "\n")))
+	return hex.EncodeToString(mac.Sum(nil))
+}
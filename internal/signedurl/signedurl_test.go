@@ -0,0 +1,206 @@
+package signedurl
+
+import (
+	"errors"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+var now = time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+// sign signs the download URL of target, returning its query.
+func sign(t *testing.T, s *Signer, target Target) url.Values {
+	t.Helper()
+	signed, _ := s.Sign("https://api.example.com/download/"+target.ImageID, target, now)
+	u, err := url.Parse(signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u.Query()
+}
+
+func TestSignVerify(t *testing.T) {
+	s := New(&Config{Keys: []Key{{ID: "k1", Secret: "secret-1"}}, Expiry: time.Hour})
+	if !s.Enabled() {
+		t.Fatal("Enabled = false with a key")
+	}
+	target := Target{ImageID: "img-1", Rendition: "thumb"}
+
+	signed, expires := s.Sign("https://api.example.com/download/img-1?rendition=thumb", target, now.Add(500*time.Millisecond))
+	if !expires.Equal(now.Add(time.Hour)) {
+		t.Errorf("expires = %v, want %v", expires, now.Add(time.Hour))
+	}
+	u, err := url.Parse(signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := u.Query()
+	if query.Get("rendition") != "thumb" || query.Get("kid") != "k1" || query.Get("expires") != strconv.FormatInt(expires.Unix(), 10) {
+		t.Errorf("signed url = %s", signed)
+	}
+	if query.Has("ip") {
+		t.Errorf("signed url = %s, want it unbound", signed)
+	}
+	if err := s.Verify(target, query, now); err != nil {
+		t.Errorf("Verify = %v", err)
+	}
+	// links are valid up to the second they expire
+	if err := s.Verify(target, query, expires); err != nil {
+		t.Errorf("Verify at expiry = %v", err)
+	}
+	if err := s.Verify(target, query, expires.Add(time.Second)); !errors.Is(err, ErrExpired) {
+		t.Errorf("Verify after expiry = %v, want ErrExpired", err)
+	}
+}
+
+func TestVerifyRejects(t *testing.T) {
+	s := New(&Config{Keys: []Key{{ID: "k1", Secret: "secret-1"}}, Expiry: time.Hour})
+	target := Target{ImageID: "img-1", Rendition: "thumb"}
+	query := sign(t, s, target)
+
+	with := func(name, value string) url.Values {
+		q := url.Values{}
+		for k, v := range query {
+			q[k] = v
+		}
+		if value == "" {
+			q.Del(name)
+		} else {
+			q.Set(name, value)
+		}
+		return q
+	}
+	later := strconv.FormatInt(now.Add(24*time.Hour).Unix(), 10)
+	other := New(&Config{Keys: []Key{{ID: "k1", Secret: "secret-2"}}, Expiry: time.Hour})
+
+	tests := []struct {
+		name   string
+		signer *Signer
+		target Target
+		query  url.Values
+	}{
+		{"unknown kid", s, target, with("kid", "k2")},
+		{"no kid", s, target, with("kid", "")},
+		{"other secret", other, target, query},
+		{"no signer", nil, target, query},
+		{"tampered signature", s, target, with("signature", strings.Repeat("0", 64))},
+		{"no signature", s, target, with("signature", "")},
+		{"extended expiry", s, target, with("expires", later)},
+		{"other rendition", s, Target{ImageID: "img-1", Rendition: "large"}, query},
+		{"original instead of rendition", s, Target{ImageID: "img-1"}, query},
+		{"other image", s, Target{ImageID: "img-2", Rendition: "thumb"}, query},
+		// an unbound link can't be made bound after signing
+		{"ip added", s, Target{ImageID: "img-1", Rendition: "thumb", ClientIP: "203.0.113.7"}, with("ip", "1")},
+	}
+	for _, tt := range tests {
+		if err := tt.signer.Verify(tt.target, tt.query, now); !errors.Is(err, ErrInvalidSignature) {
+			t.Errorf("%s: Verify = %v, want ErrInvalidSignature", tt.name, err)
+		}
+	}
+}
+
+func TestRotateKeys(t *testing.T) {
+	target := Target{ImageID: "img-1"}
+	k1 := Key{ID: "k1", Secret: "secret-1"}
+	k2 := Key{ID: "k2", Secret: "secret-2"}
+	old := sign(t, New(&Config{Keys: []Key{k1}, Expiry: time.Hour}), target)
+
+	// the new key signs while the old one still verifies
+	rotated := New(&Config{Keys: []Key{k1, k2}, KeyID: "k2", Expiry: time.Hour})
+	if err := rotated.Verify(target, old, now); err != nil {
+		t.Errorf("Verify of a link signed with the old key = %v", err)
+	}
+	fresh := sign(t, rotated, target)
+	if fresh.Get("kid") != "k2" {
+		t.Errorf("kid = %q, want k2", fresh.Get("kid"))
+	}
+	if err := rotated.Verify(target, fresh, now); err != nil {
+		t.Errorf("Verify of a link signed with the new key = %v", err)
+	}
+
+	// links signed with a dropped key stop working
+	dropped := New(&Config{Keys: []Key{k2}, Expiry: time.Hour})
+	if err := dropped.Verify(target, old, now); !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("Verify with the old key dropped = %v, want ErrInvalidSignature", err)
+	}
+	if err := dropped.Verify(target, fresh, now); err != nil {
+		t.Errorf("Verify of a link signed with the new key = %v", err)
+	}
+}
+
+func TestBindIP(t *testing.T) {
+	s := New(&Config{Keys: []Key{{ID: "k1", Secret: "secret-1"}}, Expiry: time.Hour, BindIP: true})
+	target := Target{ImageID: "img-1", ClientIP: "203.0.113.7"}
+	query := sign(t, s, target)
+	if query.Get("ip") != "1" {
+		t.Fatalf("query = %v, want the ip parameter", query)
+	}
+	if query.Get("signature") == "" || strings.Contains(query.Encode(), "203.0.113.7") {
+		t.Errorf("query = %v, want the address signed but not shown", query)
+	}
+
+	if err := s.Verify(target, query, now); err != nil {
+		t.Errorf("Verify from the same address = %v", err)
+	}
+	moved := Target{ImageID: "img-1", ClientIP: "198.51.100.1"}
+	if err := s.Verify(moved, query, now); !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("Verify from another address = %v, want ErrInvalidSignature", err)
+	}
+	// dropping the parameter doesn't unbind the link
+	query.Del("ip")
+	if err := s.Verify(moved, query, now); !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("Verify without the ip parameter = %v, want ErrInvalidSignature", err)
+	}
+}
+
+func TestParseKeys(t *testing.T) {
+	tests := []struct {
+		spec string
+		want []Key
+		ok   bool
+	}{
+		{"", nil, true},
+		{"k1=secret", []Key{{"k1", "secret"}}, true},
+		{" k1=a=b , ,k2=c", []Key{{"k1", "a=b"}, {"k2", "c"}}, true},
+		{"k1", nil, false},
+		{"=secret", nil, false},
+		{"k1=", nil, false},
+	}
+	for _, tt := range tests {
+		got, err := ParseKeys(tt.spec)
+		if (err == nil) != tt.ok || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ParseKeys(%q) = %v, %v, want %v, ok %v", tt.spec, got, err, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	keys := []Key{{ID: "k1", Secret: "a"}, {ID: "k2", Secret: "b"}}
+	tests := []struct {
+		config Config
+		ok     bool
+	}{
+		{Config{Keys: keys}, true},
+		{Config{Keys: keys, KeyID: "k2"}, true},
+		{Config{Keys: keys, KeyID: "k3"}, false},
+		{Config{}, true},
+		{Config{KeyID: "k1"}, false},
+	}
+	for _, tt := range tests {
+		if err := tt.config.Validate(); (err == nil) != tt.ok {
+			t.Errorf("Validate(%+v) = %v, want ok %v", tt.config, err, tt.ok)
+		}
+	}
+
+	if s := New(&Config{}); s.Enabled() {
+		t.Error("Enabled = true without keys")
+	}
+	var s *Signer
+	if s.Enabled() {
+		t.Error("nil signer is enabled")
+	}
+}
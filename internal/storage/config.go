@@ -0,0 +1,87 @@
+package storage
+
+import "fmt"
+
+const (
+	// DriverLocal stores objects in local directories.
+	DriverLocal = "local"
+	// DriverS3 stores objects in an S3-compatible bucket.
+	DriverS3 = "s3"
+)
+
+// Key prefixes separating the stores sharing a bucket with the s3 driver.
+const (
+	UploadPrefix    = "uploads/"
+	WorkingPrefix   = "working/"
+	ProcessedPrefix = "processed/"
+)
+
+// Config selects and configures the storage backend.
+type Config struct {
+	Driver string
+
+	// local driver settings
+	UploadDir    string
+	WorkingDir   string
+	ProcessedDir string
+
+	// s3 driver settings
+	S3 S3Config
+}
+
+// NewStores creates the upload, working and processed stores described by
+// config. With the s3 driver all three share a bucket and are separated by
+// key prefix. Stores without a configured directory are left nil.
+func NewStores(config *Config) (*Stores, error) {
+	switch config.Driver {
+	case DriverLocal, "":
+		return newLocalStores(config)
+	case DriverS3:
+		return newS3Stores(config)
+	default:
+		return nil, fmt.Errorf("unknown storage driver: %q", config.Driver)
+	}
+}
+
+func newLocalStores(config *Config) (*Stores, error) {
+	stores := &Stores{}
+	dirs := []struct {
+		dir   string
+		store *Blob
+	}{
+		{config.UploadDir, &stores.Upload},
+		{config.WorkingDir, &stores.Working},
+		{config.ProcessedDir, &stores.Processed},
+	}
+	for _, d := range dirs {
+		if d.dir == "" {
+			continue
+		}
+		local, err := NewLocal(d.dir)
+		if err != nil {
+			return nil, err
+		}
+		*d.store = local
+	}
+	return stores, nil
+}
+
+func newS3Stores(config *Config) (*Stores, error) {
+	upload, err := NewS3(&config.S3, UploadPrefix)
+	if err != nil {
+		return nil, err
+	}
+	working, err := NewS3(&config.S3, WorkingPrefix)
+	if err != nil {
+		return nil, err
+	}
+	processed, err := NewS3(&config.S3, ProcessedPrefix)
+	if err != nil {
+		return nil, err
+	}
+	return &Stores{
+		Upload:    upload,
+		Working:   working,
+		Processed: processed,
+	}, nil
+}
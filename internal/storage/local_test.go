@@ -0,0 +1,87 @@
+package storage
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestLocalRejectsEscapingKeys(t *testing.T) {
+	ctx := context.Background()
+	l, err := NewLocal(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []string{"", "/", "../x", "a/../../x", "/abs", "a/./b", "a//b", "a/", ".."} {
+		if err := l.Put(ctx, key, strings.NewReader("x"), nil); err == nil {
+			t.Errorf("Put(%q) succeeded", key)
+		}
+		if _, _, err := l.Get(ctx, key); err == nil {
+			t.Errorf("Get(%q) succeeded", key)
+		}
+		if err := l.Delete(ctx, key); err == nil {
+			t.Errorf("Delete(%q) succeeded", key)
+		}
+	}
+}
+
+func TestLocalPutGetList(t *testing.T) {
+	ctx := context.Background()
+	l, err := NewLocal(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []string{"tenants/acme/a", "tenants/acme/b", "other"} {
+		if err := l.Put(ctx, key, strings.NewReader(key), nil); err != nil {
+			t.Fatalf("Put(%q): %v", key, err)
+		}
+	}
+	r, info, err := l.Get(ctx, "tenants/acme/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := io.ReadAll(r)
+	r.Close()
+	if string(data) != "tenants/acme/a" || info.Size != int64(len(data)) {
+		t.Errorf("Get = %q, %+v", data, info)
+	}
+
+	infos, err := l.List(ctx, "tenants/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 2 || infos[0].Key != "tenants/acme/a" || infos[1].Key != "tenants/acme/b" {
+		t.Errorf("List = %+v", infos)
+	}
+}
+
+func TestListPageWithoutPager(t *testing.T) {
+	ctx := context.Background()
+	l, err := NewLocal(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"b/1", "a.b", "a/1", "c"} {
+		if err := l.Put(ctx, key, strings.NewReader(key), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	infos, more, err := ListPage(ctx, l, "", "a.b", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !more || len(infos) != 2 || infos[0].Key != "a/1" || infos[1].Key != "b/1" {
+		t.Errorf("ListPage = %+v, %v", infos, more)
+	}
+	infos, more, err = ListPage(ctx, l, "", "b/1", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if more || len(infos) != 1 || infos[0].Key != "c" {
+		t.Errorf("ListPage = %+v, %v", infos, more)
+	}
+}
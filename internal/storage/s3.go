@@ -0,0 +1,318 @@
+package storage
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// S3Config holds the settings for an S3-compatible object store.
+type S3Config struct {
+	// Endpoint is the base URL of the service, e.g. http://minio:9000.
+	Endpoint string
+	// PublicEndpoint is the base URL clients use to reach the service
+	// with presigned URLs. It defaults to Endpoint.
+	PublicEndpoint  string
+	Region          string
+	Bucket          string
+	AccessKeyID     string
+	SecretAccessKey string `json:"-"`
+	// UsePathStyle addresses the bucket as part of the path instead of
+	// the host name. Most self-hosted S3-compatible services require it.
+	UsePathStyle bool
+}
+
+// S3 is a Blob backed by an S3-compatible object store. All keys are
+// stored below prefix within the bucket.
+type S3 struct {
+	config *S3Config
+	prefix string
+	base   *url.URL
+	public *url.URL
+	signer *signer
+	client *http.Client
+}
+
+// NewS3 creates an S3 store for the bucket in config with all keys stored
+// below prefix.
+func NewS3(config *S3Config, prefix string) (*S3, error) {
+	if config.Bucket == "" {
+		return nil, fmt.Errorf("s3 bucket is required")
+	}
+	base, err := bucketURL(config, config.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	public := base
+	if config.PublicEndpoint != "" {
+		public, err = bucketURL(config, config.PublicEndpoint)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &S3{
+		config: config,
+		prefix: prefix,
+		base:   base,
+		public: public,
+		signer: &signer{
+			accessKeyID:     config.AccessKeyID,
+			secretAccessKey: config.SecretAccessKey,
+			region:          config.Region,
+		},
+		client: http.DefaultClient,
+	}, nil
+}
+
+// bucketURL returns the base URL of the configured bucket at endpoint.
+func bucketURL(config *S3Config, endpoint string) (*url.URL, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid s3 endpoint: %w", err)
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("invalid s3 endpoint: %q", endpoint)
+	}
+
+	if config.UsePathStyle {
+		u.Path = "/" + config.Bucket
+	} else {
+		u.Host = config.Bucket + "." + u.Host
+		u.Path = ""
+	}
+	return u, nil
+}
+
+// objectURL returns the URL of the object stored under key.
+func (s *S3) objectURL(key string) *url.URL {
+	u := *s.base
+	setPath(&u, u.Path+"/"+s.prefix+key)
+	return &u
+}
+
+func (s *S3) PresignPut(ctx context.Context, key string, expires time.Duration) (string, error) {
+	u := *s.public
+	setPath(&u, u.Path+"/"+s.prefix+key)
+	return s.signer.presign(http.MethodPut, &u, expires, time.Now()).String(), nil
+}
+
+// do signs and sends a request, mapping error responses to Go errors.
+func (s *S3) do(req *http.Request) (*http.Response, error) {
+	s.signer.sign(req, time.Now())
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 == 2 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, ErrNotExist
+	}
+	var s3Err struct {
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	}
+	if err := xml.NewDecoder(resp.Body).Decode(&s3Err); err != nil || s3Err.Code == "" {
+		return nil, fmt.Errorf("s3 %s %s: %s", req.Method, req.URL.Path, resp.Status)
+	}
+	return nil, fmt.Errorf("s3 %s %s: %s: %s", req.Method, req.URL.Path, s3Err.Code, s3Err.Message)
+}
+
+func (s *S3) Put(ctx context.Context, key string, r io.Reader, opts *PutOptions) error {
+	size := int64(-1)
+	contentType := ""
+	if opts != nil {
+		size = opts.Size
+		contentType = opts.ContentType
+	}
+
+	// S3 requires the length up front, so spool unknown lengths to disk
+	if size < 0 {
+		tmp, err := os.CreateTemp("", "s3put-*")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(tmp.Name())
+		defer tmp.Close()
+
+		size, err = io.Copy(tmp, r)
+		if err != nil {
+			return err
+		}
+		if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		r = tmp
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, s.objectURL(key).String(), io.NopCloser(r))
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	if size == 0 {
+		req.Body = http.NoBody
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	resp, err := s.do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *S3) Get(ctx context.Context, key string) (io.ReadCloser, *ObjectInfo, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.objectURL(key).String(), nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	resp, err := s.do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	return resp.Body, objectInfo(key, resp), nil
+}
+
+func (s *S3) Stat(ctx context.Context, key string) (*ObjectInfo, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, s.objectURL(key).String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.do(req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	return objectInfo(key, resp), nil
+}
+
+func (s *S3) Delete(ctx context.Context, key string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, s.objectURL(key).String(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := s.do(req)
+	if err == ErrNotExist {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *S3) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	var infos []ObjectInfo
+	token := ""
+	for {
+		page, next, err := s.list(ctx, prefix, "", token, 0)
+		if err != nil {
+			return nil, err
+		}
+		infos = append(infos, page...)
+		if next == "" {
+			return infos, nil
+		}
+		token = next
+	}
+}
+
+func (s *S3) ListPage(ctx context.Context, prefix, startAfter string, limit int) ([]ObjectInfo, bool, error) {
+	if startAfter != "" {
+		startAfter = s.prefix + startAfter
+	}
+	infos, next, err := s.list(ctx, prefix, startAfter, "", limit)
+	if err != nil {
+		return nil, false, err
+	}
+	return infos, next != "", nil
+}
+
+// list sends a ListObjectsV2 request for up to maxKeys objects, or the
+// service's page size when it is zero, returning the continuation token of
+// the next page or "" after the last.
+func (s *S3) list(ctx context.Context, prefix, startAfter, token string, maxKeys int) ([]ObjectInfo, string, error) {
+	u := *s.base
+	u.Path = u.Path + "/"
+	q := url.Values{}
+	q.Set("list-type", "2")
+	q.Set("prefix", s.prefix+prefix)
+	if startAfter != "" {
+		q.Set("start-after", startAfter)
+	}
+	if token != "" {
+		q.Set("continuation-token", token)
+	}
+	if maxKeys > 0 {
+		q.Set("max-keys", strconv.Itoa(maxKeys))
+	}
+	u.RawQuery = q.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, "", err
+	}
+	resp, err := s.do(req)
+	if err != nil {
+		return nil, "", err
+	}
+
+	var result struct {
+		Contents []struct {
+			Key          string    `xml:"Key"`
+			Size         int64     `xml:"Size"`
+			LastModified time.Time `xml:"LastModified"`
+		} `xml:"Contents"`
+		IsTruncated           bool   `xml:"IsTruncated"`
+		NextContinuationToken string `xml:"NextContinuationToken"`
+	}
+	err = xml.NewDecoder(resp.Body).Decode(&result)
+	resp.Body.Close()
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to decode s3 list response: %w", err)
+	}
+
+	infos := make([]ObjectInfo, 0, len(result.Contents))
+	for _, c := range result.Contents {
+		infos = append(infos, ObjectInfo{
+			Key:          strings.TrimPrefix(c.Key, s.prefix),
+			Size:         c.Size,
+			LastModified: c.LastModified,
+		})
+	}
+	if !result.IsTruncated {
+		return infos, "", nil
+	}
+	return infos, result.NextContinuationToken, nil
+}
+
+func objectInfo(key string, resp *http.Response) *ObjectInfo {
+	info := &ObjectInfo{
+		Key:         key,
+		Size:        resp.ContentLength,
+		ContentType: resp.Header.Get("Content-Type"),
+	}
+	if n, err := strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64); err == nil {
+		info.Size = n
+	}
+	if t, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		info.LastModified = t
+	}
+	return info
+}
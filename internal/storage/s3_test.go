@@ -0,0 +1,416 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// verifySignature recomputes the header signature of req as a server would
+// and compares it with the one the client sent.
+func verifySignature(req *http.Request, s *signer) error {
+	auth := strings.TrimPrefix(req.Header.Get("Authorization"), sigV4Algorithm+" ")
+	fields := map[string]string{}
+	for _, field := range strings.Split(auth, ", ") {
+		k, v, _ := strings.Cut(field, "=")
+		fields[k] = v
+	}
+
+	now, err := time.Parse(amzDateFormat, req.Header.Get("X-Amz-Date"))
+	if err != nil {
+		return fmt.Errorf("bad X-Amz-Date: %w", err)
+	}
+	if want := s.accessKeyID + "/" + s.scope(now); fields["Credential"] != want {
+		return fmt.Errorf("credential = %s, want %s", fields["Credential"], want)
+	}
+
+	var canonicalHeaders strings.Builder
+	for _, h := range strings.Split(fields["SignedHeaders"], ";") {
+		v := req.Header.Get(h)
+		if h == "host" {
+			v = req.Host
+		}
+		canonicalHeaders.WriteString(h + ":" + strings.TrimSpace(v) + "\n")
+	}
+
+	want := s.signature(now, req.Method, req.URL, req.URL.Query(),
+		canonicalHeaders.String(), fields["SignedHeaders"],
+		req.Header.Get("X-Amz-Content-Sha256"), s.scope(now), req.Header.Get("X-Amz-Date"))
+	if fields["Signature"] != want {
+		return fmt.Errorf("signature = %s, want %s", fields["Signature"], want)
+	}
+	return nil
+}
+
+// verifyPresigned recomputes the query signature of a presigned request.
+func verifyPresigned(req *http.Request, s *signer) error {
+	query := req.URL.Query()
+	got := query.Get("X-Amz-Signature")
+	query.Del("X-Amz-Signature")
+
+	now, err := time.Parse(amzDateFormat, query.Get("X-Amz-Date"))
+	if err != nil {
+		return fmt.Errorf("bad X-Amz-Date: %w", err)
+	}
+	want := s.signature(now, req.Method, req.URL, query,
+		"host:"+req.Host+"\n", query.Get("X-Amz-SignedHeaders"),
+		unsignedPayload, s.scope(now), query.Get("X-Amz-Date"))
+	if got != want {
+		return fmt.Errorf("signature = %s, want %s", got, want)
+	}
+	return nil
+}
+
+type fakeObject struct {
+	data        []byte
+	contentType string
+	modified    time.Time
+}
+
+// fakeS3 is a path-style S3 bucket that checks the signature of every
+// request, answering 403 to those that don't match, and pages listings
+// pageSize keys at a time.
+type fakeS3 struct {
+	bucket   string
+	signer   *signer
+	pageSize int
+
+	mu      sync.Mutex
+	objects map[string]fakeObject
+	// paths are the escaped paths of the requests received
+	paths []string
+	// lengths are the Content-Length of the puts received
+	lengths []int64
+}
+
+func newFakeS3(t *testing.T) (*fakeS3, *S3) {
+	fake := &fakeS3{
+		bucket: "images",
+		signer: &signer{
+			accessKeyID:     "minioadmin",
+			secretAccessKey: "minioadmin",
+			region:          "us-east-1",
+		},
+		pageSize: 2,
+		objects:  map[string]fakeObject{},
+	}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+
+	s3, err := NewS3(&S3Config{
+		Endpoint:        server.URL,
+		Region:          fake.signer.region,
+		Bucket:          fake.bucket,
+		AccessKeyID:     fake.signer.accessKeyID,
+		SecretAccessKey: fake.signer.secretAccessKey,
+		UsePathStyle:    true,
+	}, "uploads/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fake, s3
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var err error
+	if r.URL.Query().Has("X-Amz-Signature") {
+		err = verifyPresigned(r, f.signer)
+	} else {
+		err = verifySignature(r, f.signer)
+	}
+	if err != nil {
+		f.error(w, http.StatusForbidden, "SignatureDoesNotMatch", err.Error())
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.paths = append(f.paths, r.URL.EscapedPath())
+
+	bucketPath := "/" + f.bucket + "/"
+	if !strings.HasPrefix(r.URL.Path, bucketPath) {
+		f.error(w, http.StatusNotFound, "NoSuchBucket", "no such bucket")
+		return
+	}
+	key := strings.TrimPrefix(r.URL.Path, bucketPath)
+
+	switch {
+	case key == "" && r.Method == http.MethodGet:
+		f.list(w, r)
+	case r.Method == http.MethodPut:
+		if len(r.TransferEncoding) > 0 {
+			f.error(w, http.StatusNotImplemented, "NotImplemented", "chunked transfer encoding")
+			return
+		}
+		data, _ := io.ReadAll(r.Body)
+		f.lengths = append(f.lengths, r.ContentLength)
+		f.objects[key] = fakeObject{
+			data:        data,
+			contentType: r.Header.Get("Content-Type"),
+			modified:    time.Now().UTC().Truncate(time.Second),
+		}
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		obj, ok := f.objects[key]
+		if !ok {
+			f.error(w, http.StatusNotFound, "NoSuchKey", "no such key")
+			return
+		}
+		w.Header().Set("Content-Type", obj.contentType)
+		w.Header().Set("Content-Length", fmt.Sprint(len(obj.data)))
+		w.Header().Set("Last-Modified", obj.modified.Format(http.TimeFormat))
+		if r.Method == http.MethodGet {
+			w.Write(obj.data)
+		}
+	case r.Method == http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		f.error(w, http.StatusMethodNotAllowed, "MethodNotAllowed", r.Method)
+	}
+}
+
+// list answers a ListObjectsV2 request, continuing after the key named by
+// the continuation token or start-after.
+func (f *fakeS3) list(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if query.Get("list-type") != "2" {
+		f.error(w, http.StatusBadRequest, "InvalidArgument", "list-type")
+		return
+	}
+	after := max(query.Get("continuation-token"), query.Get("start-after"))
+	var keys []string
+	for key := range f.objects {
+		if strings.HasPrefix(key, query.Get("prefix")) && key > after {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	pageSize := f.pageSize
+	if n, err := strconv.Atoi(query.Get("max-keys")); err == nil && n < pageSize {
+		pageSize = n
+	}
+
+	type content struct {
+		Key          string
+		Size         int
+		LastModified string
+	}
+	result := struct {
+		XMLName               xml.Name `xml:"ListBucketResult"`
+		Contents              []content
+		IsTruncated           bool
+		NextContinuationToken string `xml:",omitempty"`
+	}{}
+	if len(keys) > pageSize {
+		keys = keys[:pageSize]
+		result.IsTruncated = true
+		result.NextContinuationToken = keys[len(keys)-1]
+	}
+	for _, key := range keys {
+		obj := f.objects[key]
+		result.Contents = append(result.Contents, content{
+			Key:          key,
+			Size:         len(obj.data),
+			LastModified: obj.modified.Format(time.RFC3339),
+		})
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	xml.NewEncoder(w).Encode(result)
+}
+
+func (f *fakeS3) error(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "<Error><Code>%s</Code><Message>%s</Message></Error>", code, message)
+}
+
+// onlyReader hides any other interface of the wrapped reader so that its
+// length can't be discovered.
+type onlyReader struct{ io.Reader }
+
+func TestS3PutGet(t *testing.T) {
+	ctx := context.Background()
+	fake, s3 := newFakeS3(t)
+
+	tests := []struct {
+		name string
+		key  string
+		size int64
+	}{
+		{"known length", "a.png", 5},
+		{"unknown length", "b.png", -1},
+		{"reserved characters", "tenants/acme/a+b=c@d.png", 5},
+		{"empty", "empty.png", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := []byte("image")
+			if tt.size == 0 {
+				data = nil
+			}
+			err := s3.Put(ctx, tt.key, onlyReader{bytes.NewReader(data)}, &PutOptions{
+				ContentType: "image/png",
+				Size:        tt.size,
+			})
+			if err != nil {
+				t.Fatalf("Put: %v", err)
+			}
+			if got := fake.lengths[len(fake.lengths)-1]; got != int64(len(data)) {
+				t.Errorf("Content-Length = %d, want %d", got, len(data))
+			}
+
+			r, info, err := s3.Get(ctx, tt.key)
+			if err != nil {
+				t.Fatalf("Get: %v", err)
+			}
+			got, _ := io.ReadAll(r)
+			r.Close()
+			if !bytes.Equal(got, data) {
+				t.Errorf("Get = %q, want %q", got, data)
+			}
+			if info.Size != int64(len(data)) || info.ContentType != "image/png" {
+				t.Errorf("info = %+v", info)
+			}
+		})
+	}
+
+	// the key is sent with the reserved characters escaped, as signed
+	want := "/images/uploads/tenants/acme/a%2Bb%3Dc%40d.png"
+	found := false
+	for _, p := range fake.paths {
+		found = found || p == want
+	}
+	if !found {
+		t.Errorf("no request for %s in %v", want, fake.paths)
+	}
+}
+
+func TestS3NotExist(t *testing.T) {
+	ctx := context.Background()
+	_, s3 := newFakeS3(t)
+
+	if _, _, err := s3.Get(ctx, "missing.png"); !errors.Is(err, ErrNotExist) {
+		t.Errorf("Get = %v, want ErrNotExist", err)
+	}
+	if _, err := s3.Stat(ctx, "missing.png"); !errors.Is(err, ErrNotExist) {
+		t.Errorf("Stat = %v, want ErrNotExist", err)
+	}
+	if err := s3.Delete(ctx, "missing.png"); err != nil {
+		t.Errorf("Delete = %v, want nil", err)
+	}
+}
+
+func TestS3List(t *testing.T) {
+	ctx := context.Background()
+	fake, s3 := newFakeS3(t)
+
+	keys := []string{"a/1", "a/2", "a/3", "a/4", "a/5", "b/1"}
+	for _, key := range keys {
+		if err := s3.Put(ctx, key, strings.NewReader(key), &PutOptions{Size: int64(len(key))}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// an object outside the prefix of the store
+	fake.objects["other/a/6"] = fakeObject{}
+
+	infos, err := s3.List(ctx, "a/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, info := range infos {
+		got = append(got, info.Key)
+		if info.Size != 3 || info.LastModified.IsZero() {
+			t.Errorf("info = %+v", info)
+		}
+	}
+	if want := keys[:5]; strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("List = %v, want %v", got, want)
+	}
+}
+
+func TestS3ListPage(t *testing.T) {
+	ctx := context.Background()
+	fake, s3 := newFakeS3(t)
+	fake.pageSize = 1000
+
+	for _, key := range []string{"a", "b", "c", "d", "e"} {
+		if err := s3.Put(ctx, key, strings.NewReader(key), &PutOptions{Size: 1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var got []string
+	startAfter := ""
+	for pages := 0; ; pages++ {
+		if pages > 5 {
+			t.Fatal("paging doesn't end")
+		}
+		infos, more, err := s3.ListPage(ctx, "", startAfter, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(infos) > 2 {
+			t.Fatalf("page of %d objects, want at most 2", len(infos))
+		}
+		for _, info := range infos {
+			got = append(got, info.Key)
+			startAfter = info.Key
+		}
+		if !more {
+			break
+		}
+	}
+	if strings.Join(got, ",") != "a,b,c,d,e" {
+		t.Errorf("pages = %v", got)
+	}
+}
+
+func TestS3PresignPut(t *testing.T) {
+	ctx := context.Background()
+	fake, s3 := newFakeS3(t)
+
+	u, err := s3.PresignPut(ctx, "tenants/acme/a+b.png", 15*time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(u, "X-Amz-Expires=900") {
+		t.Errorf("url %s doesn't expire in 900s", u)
+	}
+
+	req, _ := http.NewRequest(http.MethodPut, u, strings.NewReader("image"))
+	req.Header.Set("Content-Type", "image/png")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("presigned put = %s", resp.Status)
+	}
+	if obj, ok := fake.objects["uploads/tenants/acme/a+b.png"]; !ok || string(obj.data) != "image" {
+		t.Errorf("object not stored: %v", fake.objects)
+	}
+
+	// a tampered key doesn't match the signature
+	req, _ = http.NewRequest(http.MethodPut, strings.Replace(u, "a%2Bb", "c", 1), strings.NewReader("image"))
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("tampered put = %s, want 403", resp.Status)
+	}
+}
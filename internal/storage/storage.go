@@ -0,0 +1,106 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sort"
+	"time"
+)
+
+// ErrNotExist is returned when an object does not exist in a store.
+var ErrNotExist = errors.New("object does not exist")
+
+// ObjectInfo describes an object held in a store.
+type ObjectInfo struct {
+	Key          string
+	Size         int64
+	ContentType  string
+	LastModified time.Time
+}
+
+// PutOptions holds optional settings for storing an object.
+type PutOptions struct {
+	// ContentType is recorded with the object where the backend supports it.
+	ContentType string
+	// Size is the length of the object in bytes or -1 when unknown.
+	Size int64
+}
+
+// Blob is a flat key/value store for binary objects. Keys use forward
+// slashes as separators regardless of the backend.
+type Blob interface {
+	// Put stores the contents of r under key, replacing any existing object.
+	Put(ctx context.Context, key string, r io.Reader, opts *PutOptions) error
+	// Get opens the object stored under key for reading. The caller must
+	// close the returned reader.
+	Get(ctx context.Context, key string) (io.ReadCloser, *ObjectInfo, error)
+	// Stat returns information about the object stored under key.
+	Stat(ctx context.Context, key string) (*ObjectInfo, error)
+	// Delete removes the object stored under key. Deleting an object that
+	// does not exist is not an error.
+	Delete(ctx context.Context, key string) error
+	// List returns information about all objects whose key begins with prefix.
+	List(ctx context.Context, prefix string) ([]ObjectInfo, error)
+}
+
+// Presigner is implemented by stores that can hand out URLs granting
+// clients temporary direct access to an object.
+type Presigner interface {
+	// PresignPut returns a URL that accepts an HTTP PUT of the object stored
+	// under key until expires elapses.
+	PresignPut(ctx context.Context, key string, expires time.Duration) (string, error)
+}
+
+// Pager is implemented by stores that can list objects a page at a time
+// without listing everything first.
+type Pager interface {
+	// ListPage returns up to limit objects whose key begins with prefix
+	// and sorts after startAfter, in key order. More is set when objects
+	// remain after the page.
+	ListPage(ctx context.Context, prefix, startAfter string, limit int) (infos []ObjectInfo, more bool, err error)
+}
+
+// ListPage returns a page of the objects in store as Pager does. Stores
+// that can't page are listed in full and sorted on every call, which is
+// only reasonable for small stores.
+func ListPage(ctx context.Context, store Blob, prefix, startAfter string, limit int) ([]ObjectInfo, bool, error) {
+	if pager, ok := store.(Pager); ok {
+		return pager.ListPage(ctx, prefix, startAfter, limit)
+	}
+	infos, err := store.List(ctx, prefix)
+	if err != nil {
+		return nil, false, err
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Key < infos[j].Key })
+	i := sort.Search(len(infos), func(i int) bool { return infos[i].Key > startAfter })
+	infos = infos[i:]
+	if len(infos) > limit {
+		return infos[:limit], true, nil
+	}
+	return infos, false, nil
+}
+
+// Stores groups the blob stores used by the image processing pipeline.
+type Stores struct {
+	// Upload holds images as received from clients.
+	Upload Blob
+	// Working holds intermediate copies while an image is being processed.
+	Working Blob
+	// Processed holds images that are ready for download.
+	Processed Blob
+}
+
+// Copy copies the object stored under srcKey in src to dstKey in dst.
+func Copy(ctx context.Context, dst Blob, dstKey string, src Blob, srcKey string) error {
+	r, info, err := src.Get(ctx, srcKey)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	return dst.Put(ctx, dstKey, r, &PutOptions{
+		ContentType: info.ContentType,
+		Size:        info.Size,
+	})
+}
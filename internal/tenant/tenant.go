@@ -0,0 +1,121 @@
+// Package tenant separates the images of the customers sharing a
+// deployment. Each tenant keeps its images under its own storage prefix
+// and is held to its own quota.
+package tenant
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// prefix is the key prefix under which tenants keep their images in the
+// upload, working and processed stores.
+const prefix = "tenants/"
+
+// name matches valid tenant names. Names are used in storage keys so they
+// are kept to characters that are safe in paths and object keys.
+var name = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,62}$`)
+
+// Valid reports whether s is a valid tenant name. The empty name is the
+// default tenant.
+func Valid(s string) bool {
+	return s == "" || name.MatchString(s)
+}
+
+// Prefix returns the key prefix of the images of tenant. The default
+// tenant keeps its images at the top of each store, as images were kept
+// before tenants were introduced.
+func Prefix(tenant string) string {
+	if tenant == "" {
+		return ""
+	}
+	return prefix + tenant + "/"
+}
+
+// Key returns the storage key of an image of tenant.
+func Key(tenant, imageID string) string {
+	return Prefix(tenant) + imageID
+}
+
+// ParseKey splits a storage key made by Key into the tenant and image id.
+// It returns false when key is not laid out as Key lays keys out.
+func ParseKey(key string) (tenant, imageID string, ok bool) {
+	if rest, found := strings.CutPrefix(key, prefix); found {
+		tenant, imageID, found = strings.Cut(rest, "/")
+		if !found || tenant == "" || !Valid(tenant) {
+			return "", "", false
+		}
+		key = imageID
+	}
+	if key == "" || strings.Contains(key, "/") {
+		return "", "", false
+	}
+	return tenant, key, true
+}
+
+// Quota limits what a tenant may process. Zero fields are unlimited.
+type Quota struct {
+	// MaxConcurrentJobs is the most images being processed at once.
+	MaxConcurrentJobs int
+	// MaxBytesPerDay is the most bytes uploaded per UTC day.
+	MaxBytesPerDay int64
+	// MaxImageBytes is the size of the largest image accepted.
+	MaxImageBytes int64
+}
+
+// Quotas holds the quota of every tenant.
+type Quotas struct {
+	// Default applies to tenants without a quota of their own.
+	Default Quota
+	Tenants map[string]Quota
+}
+
+// For returns the quota of tenant.
+func (q *Quotas) For(tenant string) Quota {
+	if quota, ok := q.Tenants[tenant]; ok {
+		return quota
+	}
+	return q.Default
+}
+
+// ParseQuotas parses tenant quotas written as comma separated
+// tenant:setting=value pairs, for example "acme:jobs=10,trial:bytes=1048576".
+// Settings are jobs, bytes (per day) and image (bytes). Settings a tenant
+// doesn't name are taken from defaults.
+func ParseQuotas(spec string, defaults Quota) (map[string]Quota, error) {
+	quotas := map[string]Quota{}
+	for _, pair := range strings.Split(spec, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		tenant, setting, ok := strings.Cut(pair, ":")
+		if !ok || tenant == "" || !Valid(tenant) {
+			return nil, fmt.Errorf("invalid tenant quota %q, expected tenant:setting=value", pair)
+		}
+		setting, value, ok := strings.Cut(setting, "=")
+		n, err := strconv.ParseInt(value, 10, 64)
+		if !ok || err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid tenant quota %q, expected tenant:setting=value", pair)
+		}
+
+		quota, ok := quotas[tenant]
+		if !ok {
+			quota = defaults
+		}
+		switch setting {
+		case "jobs":
+			quota.MaxConcurrentJobs = int(n)
+		case "bytes":
+			quota.MaxBytesPerDay = n
+		case "image":
+			quota.MaxImageBytes = n
+		default:
+			return nil, fmt.Errorf("unknown tenant quota setting %q", setting)
+		}
+		quotas[tenant] = quota
+	}
+	return quotas, nil
+}
@@ -1,7 +1,19 @@
 package worker
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"net/netip"
+	"strings"
+	"time"
+
+	"github.com/joberly/demo-temporal/activities"
+	"github.com/joberly/demo-temporal/internal/jobs"
+	"github.com/joberly/demo-temporal/internal/retention"
+	"github.com/joberly/demo-temporal/internal/signedurl"
+	"github.com/joberly/demo-temporal/internal/storage"
+	"github.com/joberly/demo-temporal/workflows"
 
 	"github.com/spf13/viper"
 	"go.temporal.io/sdk/client"
@@ -9,12 +21,24 @@ import (
 )
 
 type Config struct {
-	UploadDir    string
-	WorkingDir   string
-	ProcessedDir string
-	TemporalHost string
-	TemporalPort string
-	TaskQueue    string
+	Storage storage.Config
+	// Jobs selects where job records are kept, it must match the api.
+	Jobs       jobs.Config
+	Activities activities.Config
+	// ActivityPolicies holds the configured activity timeouts and retries,
+	// laid over workflows.DefaultActivityPolicies by each workflow.
+	ActivityPolicies workflows.ActivityPolicies
+	// RetentionRules sets how long processed images are kept. Nothing
+	// expires when it is empty.
+	RetentionRules     retention.Rules
+	RetentionInterval  time.Duration
+	RetentionBatchSize int
+	// RetentionTombstoneTTL is how long expired images answer 410 Gone
+	// before they are forgotten.
+	RetentionTombstoneTTL time.Duration
+	TemporalHost          string
+	TemporalPort          string
+	TaskQueue             string
 }
 
 func NewConfig(logger *zap.Logger) (*Config, error) {
@@ -23,17 +47,117 @@ func NewConfig(logger *zap.Logger) (*Config, error) {
 	viper.SetDefault("UPLOAD_DIR", "/tmp/uploads")
 	viper.SetDefault("WORKING_DIR", "/tmp/working")
 	viper.SetDefault("PROCESSED_DIR", "/tmp/processed")
+	viper.SetDefault("STORAGE_DRIVER", storage.DriverLocal)
+	viper.SetDefault("S3_REGION", "us-east-1")
+	viper.SetDefault("S3_USE_PATH_STYLE", true)
+	viper.SetDefault("MAX_IMAGE_BYTES", 100<<20)
+	viper.SetDefault("MAX_IMAGE_PIXELS", 100_000_000)
+	viper.SetDefault("STREAMING_PIXELS", 25_000_000)
+	viper.SetDefault("PUBLIC_URL", "http://localhost:8081")
+	viper.SetDefault("WEBHOOK_TIMEOUT", 10*time.Second)
+	viper.SetDefault("DOWNLOAD_URL_EXPIRY", time.Hour)
+	viper.SetDefault("RETENTION_INTERVAL", time.Hour)
+	viper.SetDefault("RETENTION_BATCH_SIZE", 100)
+	viper.SetDefault("RETENTION_TOMBSTONE_TTL", 30*24*time.Hour)
+	viper.SetDefault("JOBS_DRIVER", jobs.DriverBlob)
+	viper.SetDefault("POSTGRES_HOST", "localhost")
+	viper.SetDefault("POSTGRES_PORT", "5432")
+	viper.SetDefault("POSTGRES_USER", "postgres")
+	viper.SetDefault("POSTGRES_DB", "postgres")
+	viper.SetDefault("POSTGRES_SSLMODE", "disable")
 	viper.SetDefault("TEMPORAL_HOST", "localhost")
 	viper.SetDefault("TEMPORAL_PORT", "7233")
 	viper.SetDefault("TASK_QUEUE", "image-processing")
 
+	// a global ttl is a rule matching every image, more specific rules
+	// take precedence over it
+	rules, err := retention.ParseRules(viper.GetString("RETENTION_RULES"))
+	if err != nil {
+		logger.Error("invalid retention rules", zap.Error(err))
+		return nil, err
+	}
+	if ttl := viper.GetDuration("RETENTION_TTL"); ttl > 0 {
+		rules = append(rules, retention.Rule{TTL: ttl})
+	}
+
+	// webhooks are signed with the secret of the uploading tenant, the
+	// default secret covers the default tenant
+	secrets, err := parseWebhookSecrets(viper.GetString("WEBHOOK_SECRETS"))
+	if err != nil {
+		logger.Error("invalid webhook secrets", zap.Error(err))
+		return nil, err
+	}
+	if secret := viper.GetString("WEBHOOK_SECRET"); secret != "" {
+		secrets[""] = secret
+	}
+
+	// links in webhooks are signed with the same keys as the api's so the
+	// api accepts them
+	downloadKeys, err := signedurl.ParseKeys(viper.GetString("DOWNLOAD_SIGNING_KEYS"))
+	if err != nil {
+		logger.Error("invalid download signing keys", zap.Error(err))
+		return nil, err
+	}
+	webhookNetworks, err := parseNetworks(viper.GetString("WEBHOOK_ALLOWED_NETWORKS"))
+	if err != nil {
+		logger.Error("invalid webhook allowed networks", zap.Error(err))
+		return nil, err
+	}
+
 	config := &Config{
-		UploadDir:    viper.GetString("UPLOAD_DIR"),
-		WorkingDir:   viper.GetString("WORKING_DIR"),
-		ProcessedDir: viper.GetString("PROCESSED_DIR"),
-		TemporalHost: viper.GetString("TEMPORAL_HOST"),
-		TemporalPort: viper.GetString("TEMPORAL_PORT"),
-		TaskQueue:    viper.GetString("TASK_QUEUE"),
+		Storage: storage.Config{
+			Driver:       viper.GetString("STORAGE_DRIVER"),
+			UploadDir:    viper.GetString("UPLOAD_DIR"),
+			WorkingDir:   viper.GetString("WORKING_DIR"),
+			ProcessedDir: viper.GetString("PROCESSED_DIR"),
+			S3: storage.S3Config{
+				Endpoint:        viper.GetString("S3_ENDPOINT"),
+				PublicEndpoint:  viper.GetString("S3_PUBLIC_ENDPOINT"),
+				Region:          viper.GetString("S3_REGION"),
+				Bucket:          viper.GetString("S3_BUCKET"),
+				AccessKeyID:     viper.GetString("S3_ACCESS_KEY_ID"),
+				SecretAccessKey: viper.GetString("S3_SECRET_ACCESS_KEY"),
+				UsePathStyle:    viper.GetBool("S3_USE_PATH_STYLE"),
+			},
+		},
+		Jobs: jobs.Config{
+			Driver: viper.GetString("JOBS_DRIVER"),
+			Postgres: jobs.PostgresConfig{
+				Host:     viper.GetString("POSTGRES_HOST"),
+				Port:     viper.GetString("POSTGRES_PORT"),
+				User:     viper.GetString("POSTGRES_USER"),
+				Password: viper.GetString("POSTGRES_PASSWORD"),
+				Database: viper.GetString("POSTGRES_DB"),
+				SSLMode:  viper.GetString("POSTGRES_SSLMODE"),
+			},
+		},
+		Activities: activities.Config{
+			MaxImageBytes:          viper.GetInt64("MAX_IMAGE_BYTES"),
+			MaxImagePixels:         viper.GetInt64("MAX_IMAGE_PIXELS"),
+			StreamingPixels:        viper.GetInt64("STREAMING_PIXELS"),
+			PublicURL:              strings.TrimSuffix(viper.GetString("PUBLIC_URL"), "/"),
+			WebhookSecrets:         secrets,
+			WebhookTimeout:         viper.GetDuration("WEBHOOK_TIMEOUT"),
+			WebhookAllowedNetworks: webhookNetworks,
+			DownloadURLs: signedurl.Config{
+				Keys:   downloadKeys,
+				KeyID:  viper.GetString("DOWNLOAD_SIGNING_KEY_ID"),
+				Expiry: viper.GetDuration("DOWNLOAD_URL_EXPIRY"),
+			},
+		},
+		ActivityPolicies:      loadActivityPolicies(),
+		RetentionRules:        rules,
+		RetentionInterval:     viper.GetDuration("RETENTION_INTERVAL"),
+		RetentionBatchSize:    viper.GetInt("RETENTION_BATCH_SIZE"),
+		RetentionTombstoneTTL: viper.GetDuration("RETENTION_TOMBSTONE_TTL"),
+		TemporalHost:          viper.GetString("TEMPORAL_HOST"),
+		TemporalPort:          viper.GetString("TEMPORAL_PORT"),
+		TaskQueue:             viper.GetString("TASK_QUEUE"),
+	}
+
+	if err := config.Activities.DownloadURLs.Validate(); err != nil {
+		logger.Error("invalid download signing key id", zap.Error(err))
+		return nil, err
 	}
 
 	configJson, err := json.Marshal(config)
@@ -46,8 +170,117 @@ func NewConfig(logger *zap.Logger) (*Config, error) {
 	return config, nil
 }
 
+// policyNames maps the names used in activity policy variables to the
+// policies they set.
+var policyNames = map[string]string{
+	"DEFAULT":        workflows.DefaultPolicy,
+	"VALIDATE":       "ValidateImageActivity",
+	"COPY":           "CopyImageActivity",
+	"GRAYSCALE":      "GrayscaleImageActivity",
+	"TRANSFORM":      "TransformImageActivity",
+	"PUBLISH":        "PublishImageActivity",
+	"RESIZE":         "ResizeImageActivity",
+	"CLEANUP":        "CleanupActivity",
+	"LIST_EXPIRED":   "ListExpiredActivity",
+	"DELETE_EXPIRED": "DeleteExpiredActivity",
+	"WEBHOOK":        "NotifyWebhookActivity",
+	"RECORD_JOB":     "RecordJobActivity",
+}
+
+// loadActivityPolicies reads the activity policies set with variables named
+// ACTIVITY_<name>_<setting>, such as DEMO_ACTIVITY_RESIZE_MAXIMUM_ATTEMPTS.
+// Only policies with at least one setting are returned.
+func loadActivityPolicies() workflows.ActivityPolicies {
+	policies := workflows.ActivityPolicies{}
+	for name, policy := range policyNames {
+		key := func(setting string) string {
+			return "ACTIVITY_" + name + "_" + setting
+		}
+		p := workflows.ActivityPolicy{
+			StartToCloseTimeout:    viper.GetDuration(key("START_TO_CLOSE_TIMEOUT")),
+			ScheduleToCloseTimeout: viper.GetDuration(key("SCHEDULE_TO_CLOSE_TIMEOUT")),
+			HeartbeatTimeout:       viper.GetDuration(key("HEARTBEAT_TIMEOUT")),
+			InitialInterval:        viper.GetDuration(key("INITIAL_INTERVAL")),
+			BackoffCoefficient:     viper.GetFloat64(key("BACKOFF_COEFFICIENT")),
+			MaximumInterval:        viper.GetDuration(key("MAXIMUM_INTERVAL")),
+			MaximumAttempts:        viper.GetInt32(key("MAXIMUM_ATTEMPTS")),
+		}
+		if types := viper.GetString(key("NON_RETRYABLE_ERROR_TYPES")); types != "" {
+			p.NonRetryableErrorTypes = strings.Split(types, ",")
+		}
+		if p.StartToCloseTimeout != 0 || p.ScheduleToCloseTimeout != 0 || p.HeartbeatTimeout != 0 ||
+			p.InitialInterval != 0 || p.BackoffCoefficient != 0 || p.MaximumInterval != 0 ||
+			p.MaximumAttempts != 0 || p.NonRetryableErrorTypes != nil {
+			policies[policy] = p
+		}
+	}
+	return policies
+}
+
+// parseWebhookSecrets parses webhook secrets written as comma separated
+// tenant=secret pairs.
+func parseWebhookSecrets(spec string) (map[string]string, error) {
+	secrets := map[string]string{}
+	for _, pair := range strings.Split(spec, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		client, secret, ok := strings.Cut(pair, "=")
+		if !ok || client == "" || secret == "" {
+			return nil, errors.New("webhook secrets must be client=secret pairs")
+		}
+		secrets[client] = secret
+	}
+	return secrets, nil
+}
+
+// parseNetworks parses a comma separated list of networks in CIDR
+// notation, or single addresses.
+func parseNetworks(spec string) ([]netip.Prefix, error) {
+	var networks []netip.Prefix
+	for _, s := range strings.Split(spec, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if !strings.Contains(s, "/") {
+			addr, err := netip.ParseAddr(s)
+			if err != nil {
+				return nil, err
+			}
+			networks = append(networks, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		network, err := netip.ParsePrefix(s)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network.Masked())
+	}
+	return networks, nil
+}
+
 func NewTemporalClient(config *Config, logger *zap.Logger) (client.Client, error) {
 	return client.Dial(client.Options{
 		HostPort: config.TemporalHost + ":" + config.TemporalPort,
 	})
 }
+
+func NewStores(config *Config, logger *zap.Logger) (*storage.Stores, error) {
+	stores, err := storage.NewStores(&config.Storage)
+	if err != nil {
+		logger.Error("failed to create storage", zap.Error(err))
+		return nil, err
+	}
+	return stores, nil
+}
+
+func NewJobStore(config *Config, stores *storage.Stores, logger *zap.Logger) (jobs.Store, error) {
+	store, err := jobs.NewStore(context.Background(), &config.Jobs, stores.Upload)
+	if err != nil {
+		logger.Error("failed to create job store", zap.Error(err))
+		return nil, err
+	}
+	return store, nil
+}
@@ -0,0 +1,45 @@
+package worker
+
+import (
+	"context"
+
+	"github.com/joberly/demo-temporal/internal/jobs"
+	"github.com/joberly/demo-temporal/internal/pipeline"
+	"github.com/joberly/demo-temporal/workflows"
+
+	"go.uber.org/zap"
+)
+
+// RecordJobActivity is a Temporal activity that saves the outcome of an
+// image processing job in its job record so that it can be looked up once
+// the workflow is no longer retained. The details of the upload recorded by
+// the api are kept.
+func (w *Worker) RecordJobActivity(ctx context.Context, input workflows.RecordJobInput) error {
+	status := input.Status
+	err := w.jobs.Update(ctx, status.ImageID, func(record *jobs.Record) {
+		record.Tenant = status.Tenant
+		record.WorkflowID = input.WorkflowID
+		record.RunID = input.RunID
+		record.State = status.CurrentState()
+		record.Status = status
+		if status.Image != nil {
+			record.Size = status.Image.Size
+			record.Width = status.Image.Width
+			record.Height = status.Image.Height
+		}
+		record.Outputs = nil
+		if record.State == workflows.StateCompleted && status.Output != nil {
+			key := record.Key()
+			record.Outputs = append(record.Outputs, key)
+			for _, r := range status.Renditions {
+				record.Outputs = append(record.Outputs, pipeline.RenditionKey(key, r.Name))
+			}
+		}
+	})
+	if err != nil {
+		w.logger.Error("failed to record job",
+			zap.String("imageID", status.ImageID), zap.Error(err))
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,66 @@
+package worker
+
+import (
+	"context"
+	"errors"
+
+	"github.com/joberly/demo-temporal/workflows"
+
+	"go.temporal.io/api/serviceerror"
+	"go.temporal.io/sdk/client"
+	"go.temporal.io/sdk/temporal"
+	"go.uber.org/zap"
+)
+
+// retentionScheduleID is the id of the schedule running retention sweeps.
+const retentionScheduleID = "retention-sweep"
+
+// scheduleRetentionSweep creates or updates the schedule running
+// RetentionSweepWorkflow so that it matches the configuration. The schedule
+// is deleted when no retention is configured.
+func (w *Worker) scheduleRetentionSweep(ctx context.Context) error {
+	schedules := w.client.ScheduleClient()
+
+	if len(w.config.RetentionRules) == 0 {
+		err := schedules.GetHandle(ctx, retentionScheduleID).Delete(ctx)
+		var notFound *serviceerror.NotFound
+		if err != nil && !errors.As(err, &notFound) {
+			return err
+		}
+		return nil
+	}
+
+	spec := client.ScheduleSpec{
+		Intervals: []client.ScheduleIntervalSpec{{Every: w.config.RetentionInterval}},
+	}
+	action := &client.ScheduleWorkflowAction{
+		ID:        retentionScheduleID,
+		Workflow:  workflows.RetentionSweepWorkflow,
+		TaskQueue: w.config.TaskQueue,
+		Args: []interface{}{workflows.RetentionSweepInput{
+			Rules:        w.config.RetentionRules,
+			TombstoneTTL: w.config.RetentionTombstoneTTL,
+			BatchSize:    w.config.RetentionBatchSize,
+		}},
+	}
+
+	_, err := schedules.Create(ctx, client.ScheduleOptions{
+		ID:     retentionScheduleID,
+		Spec:   spec,
+		Action: action,
+	})
+	if !errors.Is(err, temporal.ErrScheduleAlreadyRunning) {
+		return err
+	}
+
+	// the schedule already exists so bring it up to date
+	w.logger.Info("updating retention schedule", zap.String("scheduleId", retentionScheduleID))
+	return schedules.GetHandle(ctx, retentionScheduleID).Update(ctx, client.ScheduleUpdateOptions{
+		DoUpdate: func(input client.ScheduleUpdateInput) (*client.ScheduleUpdate, error) {
+			schedule := input.Description.Schedule
+			schedule.Spec = &spec
+			schedule.Action = action
+			return &client.ScheduleUpdate{Schedule: &schedule}, nil
+		},
+	})
+}
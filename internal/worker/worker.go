@@ -1,7 +1,11 @@
 package worker
 
 import (
+	"context"
+
 	"github.com/joberly/demo-temporal/activities"
+	"github.com/joberly/demo-temporal/internal/jobs"
+	"github.com/joberly/demo-temporal/internal/storage"
 	"github.com/joberly/demo-temporal/workflows"
 	"go.temporal.io/sdk/client"
 	"go.temporal.io/sdk/worker"
@@ -14,12 +18,16 @@ type WorkerParams struct {
 	Logger *zap.Logger
 	Config *Config
 	Client client.Client
+	Stores *storage.Stores
+	Jobs   jobs.Store
 }
 
 type Worker struct {
 	logger *zap.Logger
 	config *Config
 	client client.Client
+	stores *storage.Stores
+	jobs   jobs.Store
 	worker worker.Worker
 }
 
@@ -28,6 +36,8 @@ func New(params WorkerParams) (*Worker, error) {
 		logger: params.Logger,
 		config: params.Config,
 		client: params.Client,
+		stores: params.Stores,
+		jobs:   params.Jobs,
 	}, nil
 }
 
@@ -37,21 +47,41 @@ func (w *Worker) Run() {
 
 	// register workflows
 	w.worker.RegisterWorkflow(workflows.ImageProcessingWorkflow)
+	w.worker.RegisterWorkflow(workflows.RetentionSweepWorkflow)
+	w.worker.RegisterWorkflow(workflows.BatchImageProcessingWorkflow)
 
 	// create activities and register them
 	acts := activities.New(&activities.ActivitiesParams{
 		Logger: w.logger,
-		Config: &activities.Config{
-			UploadDir:    w.config.UploadDir,
-			WorkingDir:   w.config.WorkingDir,
-			ProcessedDir: w.config.ProcessedDir,
-		},
+		Config: &w.config.Activities,
+		Stores: w.stores,
 	})
 
 	// register activities
+	w.worker.RegisterActivity(w.ActivityPoliciesActivity)
+	w.worker.RegisterActivity(w.RecordJobActivity)
+	w.worker.RegisterActivity(acts.ValidateImageActivity)
 	w.worker.RegisterActivity(acts.CopyImageActivity)
 	w.worker.RegisterActivity(acts.GrayscaleImageActivity)
+	w.worker.RegisterActivity(acts.TransformImageActivity)
+	w.worker.RegisterActivity(acts.PublishImageActivity)
+	w.worker.RegisterActivity(acts.ResizeImageActivity)
+	w.worker.RegisterActivity(acts.CleanupActivity)
+	w.worker.RegisterActivity(acts.ListExpiredActivity)
+	w.worker.RegisterActivity(acts.DeleteExpiredActivity)
+	w.worker.RegisterActivity(acts.NotifyWebhookActivity)
+
+	// keep the retention schedule in line with the configuration
+	if err := w.scheduleRetentionSweep(context.Background()); err != nil {
+		w.logger.Error("failed to schedule retention sweep", zap.Error(err))
+	}
 
 	// start the worker
 	w.worker.Run(worker.InterruptCh())
 }
+
+// ActivityPoliciesActivity is a local activity that returns the activity
+// policies set in the worker configuration.
+func (w *Worker) ActivityPoliciesActivity(ctx context.Context) (workflows.ActivityPolicies, error) {
+	return w.config.ActivityPolicies, nil
+}
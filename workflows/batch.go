@@ -0,0 +1,218 @@
+package workflows
+
+import (
+	"errors"
+	"time"
+
+	enumspb "go.temporal.io/api/enums/v1"
+	"go.temporal.io/sdk/workflow"
+)
+
+// DefaultBatchConcurrency is how many images of a batch are processed at
+// once when the input sets no limit.
+const DefaultBatchConcurrency = 10
+
+// StatePartial is the state of a batch in which some images were processed
+// and others failed or were cancelled.
+const StatePartial = "partial"
+
+// BatchImageProcessingWorkflowInput is the input to
+// BatchImageProcessingWorkflow.
+type BatchImageProcessingWorkflowInput struct {
+	BatchID string
+	// Owner and Tenant are who the batch was created by, each image
+	// carries its own tenant.
+	Owner  string
+	Tenant string
+	// Images are processed by ImageProcessingWorkflow children, whose
+	// workflow ids are the image ids.
+	Images []ImageProcessingWorkflowInput
+	// MaxConcurrency limits the images processed at once.
+	// DefaultBatchConcurrency is used when it is zero.
+	MaxConcurrency int
+	// SearchAttributes are set on each child workflow.
+	SearchAttributes map[string]interface{}
+}
+
+// BatchImageProcessingWorkflowStatus is the status of a batch, reported by
+// the "status" query and returned once the batch is done.
+type BatchImageProcessingWorkflowStatus struct {
+	BatchID string
+	Owner   string `json:",omitempty"`
+	Tenant  string `json:",omitempty"`
+	// State is one of the State constants or StatePartial.
+	State string
+	// Progress is the percentage of images finished, however they ended.
+	Progress  int
+	Total     int
+	Pending   int
+	Running   int
+	Completed int
+	Failed    int
+	Cancelled int
+	Images    []BatchImage
+	StartedAt *time.Time `json:",omitempty"`
+	EndedAt   *time.Time `json:",omitempty"`
+}
+
+// BatchImage is the state of one image of a batch.
+type BatchImage struct {
+	ImageID string
+	// RunID is the run of the child workflow processing the image once
+	// it has started.
+	RunID string `json:",omitempty"`
+	// State is one of StateQueued, StateProcessing, StateCompleted,
+	// StateFailed or StateCancelled.
+	State     string
+	Error     string `json:",omitempty"`
+	ErrorCode string `json:",omitempty"`
+}
+
+// BatchImageProcessingWorkflow is a Temporal workflow that processes a
+// batch of images, each in an ImageProcessingWorkflow child, running up to
+// MaxConcurrency of them at once. Images that fail don't stop the others,
+// the batch ends once every image has finished and reports how each went.
+func BatchImageProcessingWorkflow(ctx workflow.Context, input BatchImageProcessingWorkflowInput) (*BatchImageProcessingWorkflowStatus, error) {
+	logger := workflow.GetLogger(ctx)
+	logger.Info("starting BatchImageProcessingWorkflow", "batchID", input.BatchID, "images", len(input.Images))
+
+	now := workflow.Now(ctx)
+	status := BatchImageProcessingWorkflowStatus{
+		BatchID:   input.BatchID,
+		Owner:     input.Owner,
+		Tenant:    input.Tenant,
+		State:     StateQueued,
+		Total:     len(input.Images),
+		Pending:   len(input.Images),
+		Images:    make([]BatchImage, len(input.Images)),
+		StartedAt: &now,
+	}
+	for i, image := range input.Images {
+		status.Images[i] = BatchImage{ImageID: image.ImageID, State: StateQueued}
+	}
+
+	// report the progress of the batch via the api
+	err := workflow.SetQueryHandler(ctx, "status",
+		func() (BatchImageProcessingWorkflowStatus, error) {
+			return status, nil
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	concurrency := input.MaxConcurrency
+	if concurrency <= 0 {
+		concurrency = DefaultBatchConcurrency
+	}
+
+	selector := workflow.NewSelector(ctx)
+	running, next := 0, 0
+	for {
+		// start images until the limit is reached, unless cancelled
+		for running < concurrency && next < len(input.Images) && ctx.Err() == nil {
+			i := next
+			next++
+			childCtx := workflow.WithChildOptions(ctx, workflow.ChildWorkflowOptions{
+				WorkflowID: input.Images[i].ImageID,
+				// images listed again in a later batch are processed again
+				WorkflowIDReusePolicy: enumspb.WORKFLOW_ID_REUSE_POLICY_ALLOW_DUPLICATE,
+				// cancelling the batch cancels its images
+				ParentClosePolicy: enumspb.PARENT_CLOSE_POLICY_REQUEST_CANCEL,
+				SearchAttributes:  input.SearchAttributes,
+			})
+			future := workflow.ExecuteChildWorkflow(childCtx, ImageProcessingWorkflow, input.Images[i])
+			status.startImage(i)
+			running++
+
+			selector.AddFuture(future.GetChildWorkflowExecution(), func(f workflow.Future) {
+				var execution workflow.Execution
+				if f.Get(ctx, &execution) == nil {
+					status.Images[i].RunID = execution.RunID
+				}
+			})
+			selector.AddFuture(future, func(f workflow.Future) {
+				running--
+				status.endImage(i, f.Get(ctx, nil))
+			})
+		}
+		if running == 0 {
+			break
+		}
+		selector.Select(ctx)
+	}
+
+	// images never started because the batch was cancelled
+	for i := next; i < len(input.Images); i++ {
+		status.Pending--
+		status.Cancelled++
+		status.Images[i].State = StateCancelled
+	}
+	status.finish(ctx)
+
+	logger.Info("finished BatchImageProcessingWorkflow",
+		"batchID", input.BatchID,
+		"completed", status.Completed,
+		"failed", status.Failed,
+		"cancelled", status.Cancelled)
+
+	if err := ctx.Err(); err != nil {
+		return &status, err
+	}
+	return &status, nil
+}
+
+// startImage marks image i as being processed.
+func (s *BatchImageProcessingWorkflowStatus) startImage(i int) {
+	s.Pending--
+	s.Running++
+	s.Images[i].State = StateProcessing
+	s.State = StateProcessing
+}
+
+// endImage records how image i ended and updates the progress.
+func (s *BatchImageProcessingWorkflowStatus) endImage(i int, err error) {
+	image := &s.Images[i]
+	s.Running--
+	switch stageState(err) {
+	case StageCompleted:
+		image.State = StateCompleted
+		s.Completed++
+	case StageCancelled:
+		image.State = StateCancelled
+		s.Cancelled++
+	default:
+		image.State = StateFailed
+		s.Failed++
+	}
+	if err != nil {
+		// report the failure of the child rather than the wrapping error
+		var imageStatus ImageProcessingWorkflowStatus
+		imageStatus.setError(err)
+		image.ErrorCode = imageStatus.ErrorCode
+		if cause := errors.Unwrap(err); cause != nil {
+			err = cause
+		}
+		image.Error = err.Error()
+	}
+	if s.Total > 0 {
+		s.Progress = (s.Completed + s.Failed + s.Cancelled) * 100 / s.Total
+	}
+}
+
+// finish sets the final state of the batch from how its images ended.
+func (s *BatchImageProcessingWorkflowStatus) finish(ctx workflow.Context) {
+	switch {
+	case s.Completed == s.Total:
+		s.State = StateCompleted
+	case ctx.Err() != nil:
+		s.State = StateCancelled
+	case s.Completed > 0:
+		s.State = StatePartial
+	default:
+		s.State = StateFailed
+	}
+	s.Progress = 100
+	now := workflow.Now(ctx)
+	s.EndedAt = &now
+}
@@ -1,63 +1,452 @@
 package workflows
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
 	"time"
 
+	"github.com/joberly/demo-temporal/activities"
+	"github.com/joberly/demo-temporal/internal/pipeline"
+	"github.com/joberly/demo-temporal/internal/tenant"
+
+	"go.temporal.io/sdk/temporal"
 	"go.temporal.io/sdk/workflow"
 )
 
+// ImageProcessingWorkflowInput is the input to ImageProcessingWorkflow.
+type ImageProcessingWorkflowInput struct {
+	ImageID string
+	// Tenant owns the image, which is stored under the tenant's prefix.
+	// It is empty for the default tenant.
+	Tenant string
+	// ContentType is the content type the image was uploaded with.
+	ContentType string
+	// Pipeline lists the operations applied to the image. The default
+	// pipeline is used when it is empty.
+	Pipeline pipeline.Pipeline
+	// Renditions lists the resized copies to produce. The default
+	// renditions are produced when it is nil.
+	Renditions []pipeline.Rendition
+	// Webhook is notified of the outcome once the workflow is done.
+	Webhook *activities.Webhook
+	// ActivityPolicies overrides the timeouts and retries of activities.
+	// The worker's configured policies are used when it is nil.
+	ActivityPolicies ActivityPolicies
+}
+
+// UnmarshalJSON accepts the bare image id that was the input of workflows
+// started before pipelines were configurable.
+func (in *ImageProcessingWorkflowInput) UnmarshalJSON(data []byte) error {
+	var imageID string
+	if err := json.Unmarshal(data, &imageID); err == nil {
+		*in = ImageProcessingWorkflowInput{ImageID: imageID}
+		return nil
+	}
+	type input ImageProcessingWorkflowInput
+	return json.Unmarshal(data, (*input)(in))
+}
+
 // ImageProcessingWorkflowStatus is the status of an image processing workflow.
 type ImageProcessingWorkflowStatus struct {
 	ImageID string
-	Status  string
-	Error   string
+	// Tenant owns the image.
+	Tenant string `json:",omitempty"`
+	// Version is StatusVersion for workflows reporting State, Progress and
+	// Stages, and zero for older workflows.
+	Version int
+	// State is one of the State constants.
+	State string
+	// Progress is the percentage of stages completed.
+	Progress int
+	// Stages lists the work the workflow does in order.
+	Stages    []Stage
+	StartedAt *time.Time `json:",omitempty"`
+	EndedAt   *time.Time `json:",omitempty"`
+	// Status is a description of what the workflow is doing.
+	Status string
+	Error  string
+	// ErrorType is the application error type of a failure, letting
+	// clients tell bad uploads from processing failures.
+	ErrorType string
+	// ErrorCode is a machine readable code for a failure, either one of the
+	// activity error types or one of the ErrorCode constants.
+	ErrorCode string
+	// Image describes the upload once it has been validated.
+	Image *activities.ValidateImageResult
+	// Step is the one-based index of the pipeline step being applied.
+	Step int
+	// Steps is the number of pipeline steps to apply.
+	Steps int
+	// Output describes the processed image once it has been published.
+	Output *activities.PublishImageResult
+	// Renditions lists the renditions available for download.
+	Renditions []activities.RenditionResult
+	// Webhook lists the attempts to deliver the webhook.
+	Webhook []activities.WebhookDelivery
+}
+
+// RecordJobInput is the input to RecordJobActivity, which keeps the
+// outcome of a workflow once the workflow itself is gone.
+type RecordJobInput struct {
+	WorkflowID string
+	RunID      string
+	Status     ImageProcessingWorkflowStatus
+}
+
+// workingKey returns the working store key of the image produced by the
+// given pipeline step.
+func workingKey(imageID string, step int) string {
+	return fmt.Sprintf("%s.%d", imageID, step)
 }
 
 // ImageProcessingWorkflow is a Temporal workflow that processes an image.
-func ImageProcessingWorkflow(ctx workflow.Context, imageID string) error {
+func ImageProcessingWorkflow(ctx workflow.Context, input ImageProcessingWorkflowInput) (err error) {
+	imageID := input.ImageID
 	workflow.GetLogger(ctx).Info("starting ImageProcessingWorkflow", "imageID", imageID)
 
-	// setup a timeout for all activities
-	ao := workflow.ActivityOptions{
-		StartToCloseTimeout: time.Minute * 5,
-	}
-	ctx = workflow.WithActivityOptions(ctx, ao)
-
 	// status of the workflow reported back via query
 	status := ImageProcessingWorkflowStatus{
 		ImageID: imageID,
+		Tenant:  input.Tenant,
 		Status:  "starting",
 	}
 
 	// setup a query handler to report the status of the workflow via the api
-	err := workflow.SetQueryHandler(ctx, "status",
+	err = workflow.SetQueryHandler(ctx, "status",
 		func() (ImageProcessingWorkflowStatus, error) {
 			return status, nil
 		},
 	)
 	if err != nil {
 		status.Status = "error"
-		status.Error = err.Error()
+		status.setError(err)
+		return err
+	}
+
+	// workflows report states and stages from this version on
+	version := workflow.GetVersion(ctx, "structured-status", workflow.DefaultVersion, 1)
+	if version != workflow.DefaultVersion {
+		now := workflow.Now(ctx)
+		status.Version = StatusVersion
+		status.State = StateQueued
+		status.StartedAt = &now
+	}
+
+	// record the final state once any cleanup is done
+	defer func() {
+		status.finish(ctx, err)
+	}()
+
+	// timeouts and retries of each activity come from the worker
+	// configuration, except in workflows started before they did
+	policies := legacyActivityPolicies
+	version = workflow.GetVersion(ctx, "activity-policies", workflow.DefaultVersion, 1)
+	if version != workflow.DefaultVersion {
+		policies, err = loadActivityPolicies(ctx, input.ActivityPolicies)
+		if err != nil {
+			status.Status = "error loading activity policies"
+			status.setError(err)
+			return err
+		}
+	}
+	// on cancellation wait for the running activity to stop before
+	// cleaning up after it
+	waitForCancellation := workflow.GetVersion(ctx, "cancellation", workflow.DefaultVersion, 1) != workflow.DefaultVersion
+	activityCtx := func(name string) workflow.Context {
+		ao := policies.Options(name)
+		ao.WaitForCancellation = waitForCancellation
+		return workflow.WithActivityOptions(ctx, ao)
+	}
+
+	// workflows started before pipelines were configurable keep running the
+	// fixed copy and grayscale sequence
+	version = workflow.GetVersion(ctx, "configurable-pipeline", workflow.DefaultVersion, 1)
+	if version == workflow.DefaultVersion {
+		return legacyImageProcessing(ctx, activityCtx, imageID, &status)
+	}
+
+	// keep a record of the outcome for lookups after the workflow has aged
+	// out of retention
+	version = workflow.GetVersion(ctx, "job-record", workflow.DefaultVersion, 1)
+	if version != workflow.DefaultVersion {
+		defer func() {
+			recordJob(ctx, policies, &status, err)
+		}()
+	}
+
+	// tell the webhook how things went once everything else is done
+	version = workflow.GetVersion(ctx, "webhook", workflow.DefaultVersion, 1)
+	if version != workflow.DefaultVersion && input.Webhook != nil {
+		defer func() {
+			notifyWebhook(ctx, policies, *input.Webhook, &status, err)
+		}()
+	}
+
+	// the image and everything made from it is stored under the tenant's
+	// prefix, which is empty for the default tenant
+	key := tenant.Key(input.Tenant, imageID)
+
+	// files are recorded here as they are created so that they can be
+	// cleaned up once the workflow is done, however it ends
+	cleanup := activities.CleanupInput{ImageID: key}
+	version = workflow.GetVersion(ctx, "cleanup", workflow.DefaultVersion, 1)
+	if version != workflow.DefaultVersion {
+		defer func() {
+			cleanupImage(ctx, policies, cleanup, err != nil)
+		}()
+	}
+
+	// check the whole pipeline before doing any work
+	steps := input.Pipeline
+	if len(steps) == 0 {
+		steps = pipeline.Default
+	}
+	renditions := input.Renditions
+	if renditions == nil {
+		renditions = pipeline.DefaultRenditions
+	}
+	err = steps.Validate()
+	if err == nil {
+		err = pipeline.ValidateRenditions(renditions)
+	}
+	if err != nil {
+		err = temporal.NewNonRetryableApplicationError(err.Error(),
+			activities.ErrTypeInvalidPipeline, nil)
+		status.Status = "invalid pipeline"
+		status.setError(err)
+		return err
+	}
+
+	// plan the stages of the workflow
+	transforms := steps.Transforms()
+	status.addStage("validate", "ValidateImageActivity")
+	status.addStage("copy", "CopyImageActivity")
+	for _, step := range transforms {
+		status.addStage(step.Op, "TransformImageActivity")
+	}
+	status.addStage("publish", "PublishImageActivity")
+	if len(renditions) > 0 {
+		status.addStage("resize", "ResizeImageActivity")
+	}
+
+	// check the upload is an image that can be processed
+	version = workflow.GetVersion(ctx, "validate-image", workflow.DefaultVersion, 1)
+	if version != workflow.DefaultVersion {
+		status.Status = "validating image"
+		status.beginStage(ctx)
+		err = workflow.ExecuteActivity(activityCtx("ValidateImageActivity"), "ValidateImageActivity",
+			activities.ValidateImageInput{
+				ImageID:     key,
+				ContentType: input.ContentType,
+			}).Get(ctx, &status.Image)
+		status.endStage(ctx, err)
+		if err != nil {
+			status.Status = "invalid image"
+			status.setError(err)
+			return err
+		}
+	}
+
+	workflow.GetLogger(ctx).Info("processing image", "imageID", imageID)
+
+	// copy image to working directory
+	status.Status = "copying image"
+	cleanup.Working = append(cleanup.Working, key)
+	status.beginStage(ctx)
+	err = workflow.ExecuteActivity(activityCtx("CopyImageActivity"), "CopyImageActivity", key).Get(ctx, nil)
+	status.endStage(ctx, err)
+	if err != nil {
+		status.Status = "error copying image"
+		status.setError(err)
+		return err
+	}
+
+	// apply each transform, each one reading the output of the previous
+	status.Steps = len(transforms)
+	source := key
+	for i, step := range transforms {
+		target := workingKey(key, i+1)
+		status.Step = i + 1
+		status.Status = fmt.Sprintf("applying %s", step.Op)
+		// grayscale steps do the same work as GrayscaleImageActivity so
+		// share its policy
+		policy := "TransformImageActivity"
+		if step.Op == pipeline.OpGrayscale {
+			policy = "GrayscaleImageActivity"
+		}
+		cleanup.Working = append(cleanup.Working, target)
+		status.beginStage(ctx)
+		err = workflow.ExecuteActivity(activityCtx(policy), "TransformImageActivity",
+			activities.TransformImageInput{
+				ImageID: key,
+				Source:  source,
+				Target:  target,
+				Step:    step,
+			}).Get(ctx, nil)
+		status.endStage(ctx, err)
+		if err != nil {
+			status.Status = fmt.Sprintf("error applying %s", step.Op)
+			status.setError(err)
+			return err
+		}
+		source = target
+	}
+
+	// encode the result for download
+	status.Status = "publishing image"
+	cleanup.Processed = append(cleanup.Processed, key)
+	status.beginStage(ctx)
+	err = workflow.ExecuteActivity(activityCtx("PublishImageActivity"), "PublishImageActivity",
+		activities.PublishImageInput{
+			ImageID: key,
+			Source:  source,
+			Output:  steps.Output(),
+		}).Get(ctx, &status.Output)
+	status.endStage(ctx, err)
+	if err != nil {
+		status.Status = "error publishing image"
+		status.setError(err)
 		return err
 	}
 
+	// produce the resized renditions
+	version = workflow.GetVersion(ctx, "renditions", workflow.DefaultVersion, 1)
+	if version != workflow.DefaultVersion && len(renditions) > 0 {
+		status.Status = "resizing image"
+		for _, r := range renditions {
+			cleanup.Processed = append(cleanup.Processed, pipeline.RenditionKey(key, r.Name))
+		}
+		status.beginStage(ctx)
+		err = workflow.ExecuteActivity(activityCtx("ResizeImageActivity"), "ResizeImageActivity",
+			activities.ResizeImageInput{
+				ImageID:    key,
+				Source:     source,
+				Renditions: renditions,
+				Output:     steps.Output(),
+			}).Get(ctx, &status.Renditions)
+		status.endStage(ctx, err)
+		if err != nil {
+			status.Status = "error resizing image"
+			status.setError(err)
+			return err
+		}
+	}
+
+	// workflow successfully completed
+	status.Status = "processing complete"
+	workflow.GetLogger(ctx).Info("image processing complete", "imageID", imageID)
+	return nil
+}
+
+// cleanupImage deletes the working copies of an image. Once processing has
+// succeeded the upload is deleted too, otherwise the upload is kept and
+// anything written for download is rolled back. It runs in a disconnected
+// context so that it still happens when the workflow is cancelled.
+func cleanupImage(ctx workflow.Context, policies ActivityPolicies, cleanup activities.CleanupInput, failed bool) {
+	if failed {
+		cleanup.Upload = nil
+	} else {
+		cleanup.Upload = []string{cleanup.ImageID}
+		cleanup.Processed = nil
+	}
+
+	ctx, _ = workflow.NewDisconnectedContext(ctx)
+	ctx = workflow.WithActivityOptions(ctx, policies.Options("CleanupActivity"))
+	err := workflow.ExecuteActivity(ctx, "CleanupActivity", cleanup).Get(ctx, nil)
+	if err != nil {
+		workflow.GetLogger(ctx).Error("failed to clean up image",
+			"imageID", cleanup.ImageID, "error", err)
+	}
+}
+
+// recordJob saves the final status of the workflow as its job record. It
+// runs last, in a disconnected context, so that the record holds the
+// outcome of cleanup and webhook deliveries too.
+func recordJob(ctx workflow.Context, policies ActivityPolicies, status *ImageProcessingWorkflowStatus, err error) {
+	status.finish(ctx, err)
+
+	info := workflow.GetInfo(ctx)
+	ctx, _ = workflow.NewDisconnectedContext(ctx)
+	ctx = workflow.WithActivityOptions(ctx, policies.Options("RecordJobActivity"))
+	err = workflow.ExecuteActivity(ctx, "RecordJobActivity",
+		RecordJobInput{
+			WorkflowID: info.WorkflowExecution.ID,
+			RunID:      info.WorkflowExecution.RunID,
+			Status:     *status,
+		}).Get(ctx, nil)
+	if err != nil {
+		workflow.GetLogger(ctx).Error("failed to record job",
+			"imageID", status.ImageID, "error", err)
+	}
+}
+
+// notifyWebhook delivers the outcome of the workflow to a webhook and
+// records the deliveries in the status. Like cleanup it runs in a
+// disconnected context so that cancelled workflows notify too.
+func notifyWebhook(ctx workflow.Context, policies ActivityPolicies, webhook activities.Webhook, status *ImageProcessingWorkflowStatus, err error) {
+	event := activities.WebhookEventCompleted
+	status.finish(ctx, err)
+	switch {
+	case temporal.IsCanceledError(err):
+		event = activities.WebhookEventCancelled
+	case err != nil:
+		event = activities.WebhookEventFailed
+	}
+
+	info := workflow.GetInfo(ctx)
+	ctx, _ = workflow.NewDisconnectedContext(ctx)
+	ctx = workflow.WithActivityOptions(ctx, policies.Options("NotifyWebhookActivity"))
+	err = workflow.ExecuteActivity(ctx, "NotifyWebhookActivity",
+		activities.NotifyWebhookInput{
+			Webhook: webhook,
+			Payload: activities.WebhookPayload{
+				Event:      event,
+				ImageID:    status.ImageID,
+				WorkflowID: info.WorkflowExecution.ID,
+				RunID:      info.WorkflowExecution.RunID,
+				State:      status.State,
+				Status:     status.Status,
+				Error:      status.Error,
+				ErrorType:  status.ErrorType,
+				Output:     status.Output,
+				Renditions: status.Renditions,
+			},
+		}).Get(ctx, &status.Webhook)
+	if err != nil {
+		// failed deliveries are carried in the error details
+		var appErr *temporal.ApplicationError
+		var timeoutErr *temporal.TimeoutError
+		switch {
+		case errors.As(err, &appErr) && appErr.HasDetails():
+			appErr.Details(&status.Webhook)
+		case errors.As(err, &timeoutErr) && timeoutErr.HasLastHeartbeatDetails():
+			timeoutErr.LastHeartbeatDetails(&status.Webhook)
+		}
+		workflow.GetLogger(ctx).Error("failed to notify webhook",
+			"imageID", status.ImageID, "error", err)
+	}
+}
+
+// legacyImageProcessing runs the fixed copy and grayscale sequence.
+func legacyImageProcessing(ctx workflow.Context, activityCtx func(string) workflow.Context, imageID string, status *ImageProcessingWorkflowStatus) error {
 	workflow.GetLogger(ctx).Info("processing image", "imageID", imageID)
 
 	// copy image to working directory
 	status.Status = "copying image"
-	err = workflow.ExecuteActivity(ctx, "CopyImageActivity", imageID).Get(ctx, nil)
+	err := workflow.ExecuteActivity(activityCtx("CopyImageActivity"), "CopyImageActivity", imageID).Get(ctx, nil)
 	if err != nil {
 		status.Status = "error copying image"
-		status.Error = err.Error()
+		status.setError(err)
 		return err
 	}
 
 	// convert image to grayscale
 	status.Status = "converting image to grayscale"
-	err = workflow.ExecuteActivity(ctx, "GrayscaleImageActivity", imageID).Get(ctx, nil)
+	err = workflow.ExecuteActivity(activityCtx("GrayscaleImageActivity"), "GrayscaleImageActivity", imageID).Get(ctx, nil)
 	if err != nil {
 		status.Status = "error converting image to grayscale"
-		status.Error = err.Error()
+		status.setError(err)
 		return err
 	}
 
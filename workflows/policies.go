@@ -0,0 +1,195 @@
+package workflows
+
+import (
+	"time"
+
+	"github.com/joberly/demo-temporal/activities"
+
+	"go.temporal.io/sdk/temporal"
+	"go.temporal.io/sdk/workflow"
+)
+
+// DefaultPolicy is the key of the policy every activity policy builds on.
+const DefaultPolicy = "default"
+
+// ActivityPolicy sets the timeouts and retries of an activity. Zero fields
+// are taken from the default policy.
+type ActivityPolicy struct {
+	StartToCloseTimeout    time.Duration
+	ScheduleToCloseTimeout time.Duration
+	HeartbeatTimeout       time.Duration
+	InitialInterval        time.Duration
+	BackoffCoefficient     float64
+	MaximumInterval        time.Duration
+	// MaximumAttempts limits the number of attempts. A negative value
+	// retries without limit.
+	MaximumAttempts        int32
+	NonRetryableErrorTypes []string
+}
+
+// ActivityPolicies maps activity names, or DefaultPolicy, to the policy
+// they run with.
+type ActivityPolicies map[string]ActivityPolicy
+
+// heartbeatTimeout is how long an activity that heartbeats may go without
+// one before its attempt is failed and retried elsewhere.
+const heartbeatTimeout = time.Minute
+
+// DefaultActivityPolicies are used for anything the worker configuration
+// does not set. Activities that heartbeat have a heartbeat timeout so a
+// lost worker is noticed within a minute rather than at the end of the
+// attempt.
+var DefaultActivityPolicies = ActivityPolicies{
+	DefaultPolicy: {
+		StartToCloseTimeout:    5 * time.Minute,
+		ScheduleToCloseTimeout: 30 * time.Minute,
+		InitialInterval:        time.Second,
+		BackoffCoefficient:     2,
+		MaximumInterval:        time.Minute,
+		MaximumAttempts:        5,
+		NonRetryableErrorTypes: []string{
+			activities.ErrTypeInvalidPipeline,
+			activities.ErrTypeUnsupportedFormat,
+			activities.ErrTypeContentTypeMismatch,
+			activities.ErrTypeInvalidImage,
+			activities.ErrTypeImageTooLarge,
+		},
+	},
+	"ValidateImageActivity": {
+		StartToCloseTimeout: time.Minute,
+	},
+	"CopyImageActivity": {
+		HeartbeatTimeout: heartbeatTimeout,
+	},
+	"GrayscaleImageActivity": {
+		HeartbeatTimeout: heartbeatTimeout,
+	},
+	"TransformImageActivity": {
+		HeartbeatTimeout: heartbeatTimeout,
+	},
+	"PublishImageActivity": {
+		HeartbeatTimeout: heartbeatTimeout,
+	},
+	"ResizeImageActivity": {
+		HeartbeatTimeout: heartbeatTimeout,
+	},
+	"CleanupActivity": {
+		HeartbeatTimeout: heartbeatTimeout,
+	},
+	"ListExpiredActivity": {
+		HeartbeatTimeout: heartbeatTimeout,
+	},
+	"DeleteExpiredActivity": {
+		HeartbeatTimeout: heartbeatTimeout,
+	},
+	// keep trying webhooks for a day in case the receiver is down
+	"NotifyWebhookActivity": {
+		StartToCloseTimeout:    time.Minute,
+		ScheduleToCloseTimeout: 24 * time.Hour,
+		HeartbeatTimeout:       heartbeatTimeout,
+		MaximumInterval:        time.Hour,
+		MaximumAttempts:        20,
+	},
+}
+
+// legacyActivityPolicies are the fixed options used by workflows started
+// before activity policies were configurable.
+var legacyActivityPolicies = ActivityPolicies{
+	DefaultPolicy: {
+		StartToCloseTimeout: 5 * time.Minute,
+	},
+	"GrayscaleImageActivity": {
+		HeartbeatTimeout: time.Minute,
+	},
+}
+
+// activityPoliciesTimeout bounds the local activity reading the worker's
+// activity policies.
+const activityPoliciesTimeout = 10 * time.Second
+
+// overlay returns p with the non-zero fields of o replacing its own.
+func (p ActivityPolicy) overlay(o ActivityPolicy) ActivityPolicy {
+	if o.StartToCloseTimeout != 0 {
+		p.StartToCloseTimeout = o.StartToCloseTimeout
+	}
+	if o.ScheduleToCloseTimeout != 0 {
+		p.ScheduleToCloseTimeout = o.ScheduleToCloseTimeout
+	}
+	if o.HeartbeatTimeout != 0 {
+		p.HeartbeatTimeout = o.HeartbeatTimeout
+	}
+	if o.InitialInterval != 0 {
+		p.InitialInterval = o.InitialInterval
+	}
+	if o.BackoffCoefficient != 0 {
+		p.BackoffCoefficient = o.BackoffCoefficient
+	}
+	if o.MaximumInterval != 0 {
+		p.MaximumInterval = o.MaximumInterval
+	}
+	if o.MaximumAttempts != 0 {
+		p.MaximumAttempts = o.MaximumAttempts
+	}
+	if o.NonRetryableErrorTypes != nil {
+		p.NonRetryableErrorTypes = o.NonRetryableErrorTypes
+	}
+	return p
+}
+
+// Merge returns the policies in ps with those in o laid over them.
+func (ps ActivityPolicies) Merge(o ActivityPolicies) ActivityPolicies {
+	merged := make(ActivityPolicies, len(ps)+len(o))
+	for name, p := range ps {
+		merged[name] = p
+	}
+	for name, p := range o {
+		merged[name] = merged[name].overlay(p)
+	}
+	return merged
+}
+
+// Policy returns the policy of the named activity.
+func (ps ActivityPolicies) Policy(name string) ActivityPolicy {
+	return ps[DefaultPolicy].overlay(ps[name])
+}
+
+// Options returns the activity options of the named activity.
+func (ps ActivityPolicies) Options(name string) workflow.ActivityOptions {
+	p := ps.Policy(name)
+	ao := workflow.ActivityOptions{
+		StartToCloseTimeout:    p.StartToCloseTimeout,
+		ScheduleToCloseTimeout: p.ScheduleToCloseTimeout,
+		HeartbeatTimeout:       p.HeartbeatTimeout,
+	}
+
+	// leave the server's retry policy in place when none is configured
+	if p.InitialInterval != 0 || p.BackoffCoefficient != 0 || p.MaximumInterval != 0 ||
+		p.MaximumAttempts != 0 || p.NonRetryableErrorTypes != nil {
+		ao.RetryPolicy = &temporal.RetryPolicy{
+			InitialInterval:        p.InitialInterval,
+			BackoffCoefficient:     p.BackoffCoefficient,
+			MaximumInterval:        p.MaximumInterval,
+			MaximumAttempts:        max(0, p.MaximumAttempts),
+			NonRetryableErrorTypes: p.NonRetryableErrorTypes,
+		}
+	}
+	return ao
+}
+
+// loadActivityPolicies returns the activity policies of a workflow. The
+// policies given in the input are used when set, otherwise the worker's
+// configured policies are read once with a local activity so that replays
+// see the same policies even if the configuration has since changed.
+func loadActivityPolicies(ctx workflow.Context, policies ActivityPolicies) (ActivityPolicies, error) {
+	if policies == nil {
+		lao := workflow.LocalActivityOptions{
+			StartToCloseTimeout: activityPoliciesTimeout,
+		}
+		err := workflow.ExecuteLocalActivity(workflow.WithLocalActivityOptions(ctx, lao),
+			"ActivityPoliciesActivity").Get(ctx, &policies)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return DefaultActivityPolicies.Merge(policies), nil
+}
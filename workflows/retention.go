@@ -0,0 +1,120 @@
+package workflows
+
+import (
+	"time"
+
+	"github.com/joberly/demo-temporal/activities"
+	"github.com/joberly/demo-temporal/internal/retention"
+
+	"go.temporal.io/sdk/workflow"
+)
+
+// maxSweepBatches is how many batches a RetentionSweepWorkflow run deletes
+// before continuing as new to keep its history short.
+const maxSweepBatches = 50
+
+// defaultSweepBatchSize is the batch size used when the input sets none.
+const defaultSweepBatchSize = 100
+
+// RetentionSweepInput is the input to RetentionSweepWorkflow.
+type RetentionSweepInput struct {
+	Rules retention.Rules
+	// TombstoneTTL is how long the tombstones of expired images are kept,
+	// zero keeps them forever.
+	TombstoneTTL time.Duration
+	BatchSize    int
+	// StartAfter and Reclaimed carry progress across continue-as-new.
+	StartAfter string
+	Reclaimed  RetentionSweepResult
+}
+
+// RetentionSweepResult records how much a retention sweep reclaimed.
+type RetentionSweepResult struct {
+	Deleted    int
+	Bytes      int64
+	Tombstones int
+}
+
+// RetentionSweepWorkflow is a Temporal workflow that deletes processed
+// images that have outlived their retention. It is run periodically by a
+// schedule created by the worker.
+func RetentionSweepWorkflow(ctx workflow.Context, input RetentionSweepInput) (*RetentionSweepResult, error) {
+	logger := workflow.GetLogger(ctx)
+	logger.Info("starting RetentionSweepWorkflow", "startAfter", input.StartAfter)
+
+	// report what has been reclaimed so far via query
+	reclaimed := input.Reclaimed
+	err := workflow.SetQueryHandler(ctx, "status",
+		func() (RetentionSweepResult, error) {
+			return reclaimed, nil
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	policies, err := loadActivityPolicies(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	activityCtx := func(name string) workflow.Context {
+		return workflow.WithActivityOptions(ctx, policies.Options(name))
+	}
+
+	batchSize := input.BatchSize
+	if batchSize <= 0 {
+		batchSize = defaultSweepBatchSize
+	}
+	now := workflow.Now(ctx)
+
+	startAfter := input.StartAfter
+	for batch := 0; batch < maxSweepBatches; batch++ {
+		// find the next batch of expired images
+		var list activities.ListExpiredResult
+		err = workflow.ExecuteActivity(activityCtx("ListExpiredActivity"), "ListExpiredActivity",
+			activities.ListExpiredInput{
+				Rules:        input.Rules,
+				TombstoneTTL: input.TombstoneTTL,
+				Now:          now,
+				StartAfter:   startAfter,
+				Limit:        batchSize,
+			}).Get(ctx, &list)
+		if err != nil {
+			return nil, err
+		}
+
+		// delete them
+		if len(list.Keys) > 0 {
+			var deleted activities.DeleteExpiredResult
+			err = workflow.ExecuteActivity(activityCtx("DeleteExpiredActivity"), "DeleteExpiredActivity",
+				activities.DeleteExpiredInput{
+					Keys: list.Keys,
+					Now:  now,
+				}).Get(ctx, &deleted)
+			if err != nil {
+				return nil, err
+			}
+			reclaimed.Deleted += deleted.Deleted
+			reclaimed.Bytes += deleted.Bytes
+			reclaimed.Tombstones += deleted.Tombstones
+			startAfter = list.Keys[len(list.Keys)-1]
+		}
+		// batches carry on from the last key listed, expired or not
+		if list.Next != "" {
+			startAfter = list.Next
+		}
+
+		if list.Done {
+			logger.Info("retention sweep complete",
+				"deleted", reclaimed.Deleted, "bytes", reclaimed.Bytes)
+			return &reclaimed, nil
+		}
+	}
+
+	// carry on in a fresh run for large backlogs
+	logger.Info("continuing retention sweep",
+		"deleted", reclaimed.Deleted, "bytes", reclaimed.Bytes)
+	input.StartAfter = startAfter
+	input.Reclaimed = reclaimed
+	return nil, workflow.NewContinueAsNewError(ctx, RetentionSweepWorkflow, input)
+}
@@ -0,0 +1,202 @@
+package workflows
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/joberly/demo-temporal/activities"
+
+	"go.temporal.io/sdk/temporal"
+	"go.temporal.io/sdk/workflow"
+)
+
+// StatusVersion is the version of the status model reporting a State and
+// Stages. Workflows started before it only report the Status string.
+const StatusVersion = 2
+
+// Workflow states reported in ImageProcessingWorkflowStatus.State.
+const (
+	StateQueued     = "queued"
+	StateValidating = "validating"
+	StateProcessing = "processing"
+	StateCompleted  = "completed"
+	StateFailed     = "failed"
+	StateCancelled  = "cancelled"
+)
+
+// Stage states reported in Stage.State.
+const (
+	StagePending   = "pending"
+	StageRunning   = "running"
+	StageCompleted = "completed"
+	StageFailed    = "failed"
+	StageCancelled = "cancelled"
+)
+
+// Error codes for failures that are not one of the application error types
+// returned by activities.
+const (
+	ErrorCodeCancelled = "Cancelled"
+	ErrorCodeTimeout   = "Timeout"
+	ErrorCodeInternal  = "Internal"
+)
+
+// errorCodes are the application error types reported as error codes as
+// they are. Any other failure is reported as an internal error.
+var errorCodes = map[string]bool{
+	activities.ErrTypeInvalidPipeline:     true,
+	activities.ErrTypeUnsupportedFormat:   true,
+	activities.ErrTypeContentTypeMismatch: true,
+	activities.ErrTypeInvalidImage:        true,
+	activities.ErrTypeImageTooLarge:       true,
+}
+
+// Stage is one step of the work done by a workflow.
+type Stage struct {
+	Name string
+	// Activity is the activity that runs the stage.
+	Activity  string
+	State     string
+	StartedAt *time.Time `json:",omitempty"`
+	EndedAt   *time.Time `json:",omitempty"`
+	// Attempts is the current attempt of a running stage. It is filled in
+	// by the api from the workflow description.
+	Attempts int32 `json:",omitempty"`
+}
+
+// structured reports whether the status reports states and stages.
+func (s *ImageProcessingWorkflowStatus) structured() bool {
+	return s.Version >= StatusVersion
+}
+
+// addStage adds a pending stage to the status.
+func (s *ImageProcessingWorkflowStatus) addStage(name, activity string) {
+	if s.structured() {
+		s.Stages = append(s.Stages, Stage{Name: name, Activity: activity, State: StagePending})
+	}
+}
+
+// beginStage marks the next pending stage as running.
+func (s *ImageProcessingWorkflowStatus) beginStage(ctx workflow.Context) {
+	if !s.structured() {
+		return
+	}
+	for i := range s.Stages {
+		stage := &s.Stages[i]
+		if stage.State != StagePending {
+			continue
+		}
+		now := workflow.Now(ctx)
+		stage.State = StageRunning
+		stage.StartedAt = &now
+		s.State = StateProcessing
+		if stage.Activity == "ValidateImageActivity" {
+			s.State = StateValidating
+		}
+		return
+	}
+}
+
+// endStage marks the running stage as ended by err and updates the
+// progress.
+func (s *ImageProcessingWorkflowStatus) endStage(ctx workflow.Context, err error) {
+	if !s.structured() {
+		return
+	}
+	completed := 0
+	for i := range s.Stages {
+		stage := &s.Stages[i]
+		if stage.State == StageRunning {
+			now := workflow.Now(ctx)
+			stage.EndedAt = &now
+			stage.State = stageState(err)
+		}
+		if stage.State == StageCompleted {
+			completed++
+		}
+	}
+	if len(s.Stages) > 0 {
+		s.Progress = completed * 100 / len(s.Stages)
+	}
+}
+
+// stageState returns the state of a stage that ended with err.
+func stageState(err error) string {
+	switch {
+	case err == nil:
+		return StageCompleted
+	case temporal.IsCanceledError(err):
+		return StageCancelled
+	default:
+		return StageFailed
+	}
+}
+
+// finish records the final state of a workflow that ended with err. It may
+// be called more than once, the first call sets the end time.
+func (s *ImageProcessingWorkflowStatus) finish(ctx workflow.Context, err error) {
+	if temporal.IsCanceledError(err) {
+		s.Status = "cancelled"
+	}
+	if !s.structured() {
+		return
+	}
+
+	switch {
+	case err == nil:
+		s.State = StateCompleted
+		s.Progress = 100
+	case temporal.IsCanceledError(err):
+		s.State = StateCancelled
+	default:
+		s.State = StateFailed
+	}
+	if s.EndedAt == nil {
+		now := workflow.Now(ctx)
+		s.EndedAt = &now
+	}
+}
+
+// setError records a failure in the status.
+func (s *ImageProcessingWorkflowStatus) setError(err error) {
+	s.Error = err.Error()
+
+	var appErr *temporal.ApplicationError
+	var timeoutErr *temporal.TimeoutError
+	switch {
+	case errors.As(err, &appErr):
+		s.ErrorType = appErr.Type()
+		s.ErrorCode = ErrorCodeInternal
+		if errorCodes[appErr.Type()] {
+			s.ErrorCode = appErr.Type()
+		}
+	case temporal.IsCanceledError(err):
+		s.ErrorCode = ErrorCodeCancelled
+	case errors.As(err, &timeoutErr):
+		s.ErrorCode = ErrorCodeTimeout
+	default:
+		s.ErrorCode = ErrorCodeInternal
+	}
+}
+
+// CurrentState returns the state of the workflow. For workflows started
+// before states were reported it is worked out from the Status string.
+func (s *ImageProcessingWorkflowStatus) CurrentState() string {
+	switch {
+	case s.structured():
+		return s.State
+	case s.Status == "starting":
+		return StateQueued
+	case s.Status == "processing complete":
+		return StateCompleted
+	case s.Status == "cancelled":
+		return StateCancelled
+	case s.Status == "invalid pipeline", s.Status == "invalid image", strings.HasPrefix(s.Status, "error"):
+		return StateFailed
+	case s.Status == "validating image":
+		return StateValidating
+	default:
+		return StateProcessing
+	}
+}